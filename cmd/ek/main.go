@@ -24,6 +24,10 @@ import (
 	"log"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/gilliek/go-opml/opml"
@@ -146,20 +150,53 @@ Commands:
 	channels NAME                create channel with NAME
 	channels UID NAME            update channel UID with NAME
 	channels -delete UID         delete channel with UID
+	channels -type UID TYPE      set timeline type of channel UID (sorted-set, stream or capped)
+	channels -type UID capped N  keep the latest N items in channel UID
+	channels -order UID...       sort the channels, the channels that are missing go last
+
+	sources                      list micropub sources
+	sources -create UID LABEL    create a source with LABEL that posts to channel UID
+	sources -channel ID UID      post the items of source ID to channel UID
+	sources -label ID LABEL      set the label of source ID to LABEL
+	sources -rate-limit ID N     allow N items per hour from source ID, 0 is unlimited
+	sources -delete ID           delete source ID
 
 	timeline UID                 show posts for channel UID
 	timeline UID -after AFTER    show posts for channel UID starting from AFTER
 	timeline UID -before BEFORE  show posts for channel UID ending at BEFORE
+	timeline UID -limit N        show N posts for channel UID
+	timeline UID -unread         show unread posts for channel UID
+	timeline UID -source URL     show posts for channel UID from the feed URL
+	timeline UID -since DATE     show posts for channel UID published from DATE
+	timeline UID -until DATE     show posts for channel UID published before DATE
+	timeline UID -type TYPE      show posts of TYPE (like, reply, repost, bookmark, checkin, photo, article or note)
+	timeline UID -mark-read ENTRY...    mark entries in channel UID as read
+	timeline UID -mark-unread ENTRY...  mark entries in channel UID as unread
+	timeline UID -mark-read-up-to ENTRY mark ENTRY and all entries before it as read
+	timeline UID -mark-all-read         mark all entries in channel UID as read
+	timeline UID -remove ENTRY...       remove entries from channel UID
 
 	search QUERY                 search for feeds from QUERY
+	search -channel UID QUERY    search for items in channel UID
 
 	preview URL                  show items from the feed at URL
 
 	follow UID                   show follow list for channel UID
+	follow UID -status           show the fetch status of the feeds of channel UID, failing feeds first
 	follow UID URL               follow URL on channel UID
 
 	unfollow UID URL             unfollow URL on channel UID
 
+	mute UID                     show muted users on channel UID
+	mute UID URL                 mute user with URL on channel UID
+	unmute UID URL               unmute user with URL on channel UID
+
+	block UID                    show blocked users on channel UID
+	block UID URL                block user with URL on channel UID
+	unblock UID URL              unblock user with URL on channel UID
+
+	events                       show the events of the server as they happen
+
 	export opml                  export feeds as OPML
 	import opml FILENAME         import OPML feeds
 
@@ -244,8 +281,16 @@ func performCommands(sub microsub.Microsub, commands []string) {
 		}
 
 		for _, ch := range channels {
-			fmt.Printf("%-20s %s\n", ch.UID, ch.Name)
+			fmt.Printf("%-20s %-12s %s\n", ch.UID, ch.TimelineType, ch.Name)
+		}
+	}
+
+	if len(commands) >= 3 && commands[0] == "channels" && commands[1] == "-order" {
+		err := sub.ChannelsOrder(commands[2:])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
 		}
+		return
 	}
 
 	if len(commands) == 2 && commands[0] == "channels" {
@@ -276,20 +321,120 @@ func performCommands(sub microsub.Microsub, commands []string) {
 		}
 	}
 
+	if (len(commands) == 4 || len(commands) == 5) && commands[0] == "channels" && commands[1] == "-type" {
+		uid := commands[2]
+		timelineType := commands[3]
+		size := 0
+		if len(commands) == 5 {
+			var err error
+			size, err = strconv.Atoi(commands[4])
+			if err != nil {
+				log.Fatalf("An error occurred: %s\n", err)
+			}
+		}
+		channel, err := sub.ChannelsSetType(uid, timelineType, size)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		fmt.Printf("Channel %s uses timeline %s\n", channel.UID, channel.TimelineType)
+	}
+
+	if len(commands) == 1 && commands[0] == "sources" {
+		sources, err := sub.SourcesGetList()
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		showSources(sources)
+	}
+
+	if len(commands) == 3 && commands[0] == "sources" && commands[1] == "-delete" {
+		err := sub.SourcesDelete(commands[2])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		fmt.Printf("Source %s deleted\n", commands[2])
+	}
+
+	if len(commands) == 4 && commands[0] == "sources" && commands[1] == "-create" {
+		source, err := sub.SourcesCreate(microsub.MicropubSource{Channel: commands[2], Label: commands[3]})
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		fmt.Printf("%s\n", source.ID)
+	}
+
+	if len(commands) == 4 && commands[0] == "sources" && commands[1] != "-create" {
+		source := findSource(sub, commands[2])
+		switch commands[1] {
+		case "-channel":
+			source.Channel = commands[3]
+		case "-label":
+			source.Label = commands[3]
+		case "-rate-limit":
+			rateLimit, err := strconv.Atoi(commands[3])
+			if err != nil {
+				log.Fatalf("An error occurred: %s\n", err)
+			}
+			source.RateLimit = rateLimit
+		default:
+			log.Fatalf("unknown sources option %q", commands[1])
+		}
+		source, err := sub.SourcesUpdate(source)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		fmt.Printf("Source updated %s %s\n", source.ID, source.Label)
+	}
+
+	if len(commands) >= 4 && commands[0] == "timeline" && commands[2] == "-mark-read" {
+		err := sub.MarkRead(commands[1], commands[3:])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		return
+	}
+
+	if len(commands) >= 4 && commands[0] == "timeline" && commands[2] == "-mark-unread" {
+		err := sub.MarkUnread(commands[1], commands[3:])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		return
+	}
+
+	if len(commands) >= 4 && commands[0] == "timeline" && commands[2] == "-remove" {
+		err := sub.RemoveItems(commands[1], commands[3:])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		return
+	}
+
+	if len(commands) == 4 && commands[0] == "timeline" && commands[2] == "-mark-read-up-to" {
+		err := sub.MarkReadUpTo(commands[1], commands[3])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		return
+	}
+
+	if len(commands) == 3 && commands[0] == "timeline" && commands[2] == "-mark-all-read" {
+		err := sub.MarkAllRead(commands[1])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		return
+	}
+
 	if len(commands) >= 2 && commands[0] == "timeline" {
 		channel := commands[1]
 
-		var timeline microsub.Timeline
-		var err error
-
-		if len(commands) == 4 && commands[2] == "-after" {
-			timeline, err = sub.TimelineGet("", commands[3], channel)
-		} else if len(commands) == 4 && commands[2] == "-before" {
-			timeline, err = sub.TimelineGet(commands[3], "", channel)
-		} else {
-			timeline, err = sub.TimelineGet("", "", channel)
+		query, err := parseTimelineQuery(commands[2:])
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
 		}
 
+		timeline, err := sub.TimelineGetQuery(channel, query)
 		if err != nil {
 			log.Fatalf("An error occurred: %s\n", err)
 		}
@@ -301,6 +446,26 @@ func performCommands(sub microsub.Microsub, commands []string) {
 		fmt.Printf("Before: %s, After: %s\n", timeline.Paging.Before, timeline.Paging.After)
 	}
 
+	if len(commands) >= 4 && commands[0] == "search" && commands[1] == "-channel" {
+		items, err := sub.ItemSearch(commands[2], strings.Join(commands[3:], " "))
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+
+		for _, item := range items {
+			showItem(&item)
+		}
+		return
+	}
+
+	if len(commands) == 1 && commands[0] == "events" {
+		err := sub.AddEventListener(&eventPrinter{})
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		select {}
+	}
+
 	if len(commands) == 2 && commands[0] == "search" {
 		query := commands[1]
 		feeds, err := sub.Search(query)
@@ -336,7 +501,14 @@ func performCommands(sub microsub.Microsub, commands []string) {
 		}
 	}
 
-	if len(commands) == 3 && commands[0] == "follow" {
+	if len(commands) == 3 && commands[0] == "follow" && commands[2] == "-status" {
+		uid := commands[1]
+		feeds, err := sub.FollowGetList(uid)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		showFeedStatus(feeds)
+	} else if len(commands) == 3 && commands[0] == "follow" {
 		uid := commands[1]
 		u := commands[2]
 		_, err := sub.FollowURL(uid, u)
@@ -355,6 +527,64 @@ func performCommands(sub microsub.Microsub, commands []string) {
 		}
 	}
 
+	if len(commands) == 2 && commands[0] == "mute" {
+		uid := commands[1]
+		cards, err := sub.MuteGetList(uid)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		for _, card := range cards {
+			fmt.Println(card.URL)
+		}
+	}
+
+	if len(commands) == 3 && commands[0] == "mute" {
+		uid := commands[1]
+		u := commands[2]
+		err := sub.Mute(uid, u)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
+	if len(commands) == 3 && commands[0] == "unmute" {
+		uid := commands[1]
+		u := commands[2]
+		err := sub.Unmute(uid, u)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
+	if len(commands) == 2 && commands[0] == "block" {
+		uid := commands[1]
+		cards, err := sub.BlockGetList(uid)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+		for _, card := range cards {
+			fmt.Println(card.URL)
+		}
+	}
+
+	if len(commands) == 3 && commands[0] == "block" {
+		uid := commands[1]
+		u := commands[2]
+		err := sub.Block(uid, u)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
+	if len(commands) == 3 && commands[0] == "unblock" {
+		uid := commands[1]
+		u := commands[2]
+		err := sub.Unblock(uid, u)
+		if err != nil {
+			log.Fatalf("An error occurred: %s\n", err)
+		}
+	}
+
 	if len(commands) == 2 && commands[0] == "export" {
 		filetype := commands[1]
 
@@ -424,6 +654,84 @@ func exportOpmlFromMicrosub(sub microsub.Microsub) {
 	os.Stdout.WriteString(xml)
 }
 
+// showFeedStatus prints the fetch status of the feeds, the feeds with the most
+// errors in a row first and then the feeds without new items for the longest time
+func showFeedStatus(feeds []microsub.Feed) {
+	sort.SliceStable(feeds, func(i, j int) bool {
+		a, b := feeds[i].Status, feeds[j].Status
+		if a == nil || b == nil {
+			return a != nil
+		}
+		if a.Errors != b.Errors {
+			return a.Errors > b.Errors
+		}
+		return a.LastItem < b.LastItem
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ERRORS\tSTATUS\tLAST SUCCESS\tLAST ITEM\tITEMS\tWEBSUB\tURL")
+	for _, feed := range feeds {
+		status := feed.Status
+		if status == nil {
+			fmt.Fprintf(w, "-\t-\t-\t-\t-\t-\t%s\n", feed.URL)
+			continue
+		}
+		statusCode := "-"
+		if status.StatusCode != 0 {
+			statusCode = strconv.Itoa(status.StatusCode)
+		}
+		websub := "no"
+		if status.WebSub {
+			websub = "yes"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			status.Errors, statusCode, orNever(status.LastSuccess), orNever(status.LastItem),
+			status.Items, websub, feed.URL)
+		if status.LastError != "" {
+			fmt.Fprintf(w, "\t\t\t\t\t\t  %s\n", status.LastError)
+		}
+	}
+	w.Flush()
+}
+
+// findSource returns the micropub source with id
+func findSource(sub microsub.Microsub, id string) microsub.MicropubSource {
+	sources, err := sub.SourcesGetList()
+	if err != nil {
+		log.Fatalf("An error occurred: %s\n", err)
+	}
+	for _, source := range sources {
+		if source.ID == id {
+			return source
+		}
+	}
+	log.Fatalf("unknown source %q", id)
+	return microsub.MicropubSource{}
+}
+
+// showSources prints the micropub sources with their channel and use
+func showSources(sources []microsub.MicropubSource) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCHANNEL\tITEMS\tRATE LIMIT\tLAST USED\tLABEL")
+	for _, source := range sources {
+		rateLimit := "-"
+		if source.RateLimit > 0 {
+			rateLimit = fmt.Sprintf("%d/h", source.RateLimit)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			source.ID, source.Channel, source.Items, rateLimit, orNever(source.LastUsed), source.Label)
+	}
+	w.Flush()
+}
+
+// orNever returns "never" for an empty time
+func orNever(t string) string {
+	if t == "" {
+		return "never"
+	}
+	return t
+}
+
 func exportJsonFromMicrosub(sub microsub.Microsub) {
 	contents := Export{Version: "1.0", Generator: "ek version " + Version}
 	channels, err := sub.ChannelsGetList()
@@ -575,11 +883,83 @@ func importOpmlIntoMicrosub(sub microsub.Microsub, filename string) {
 	}
 }
 
+// parseTimelineQuery reads the paging and filter flags of the timeline command
+func parseTimelineQuery(args []string) (microsub.TimelineQuery, error) {
+	var query microsub.TimelineQuery
+	var since, until string
+
+	flags := flag.NewFlagSet("timeline", flag.ContinueOnError)
+	flags.StringVar(&query.After, "after", "", "show posts starting from AFTER")
+	flags.StringVar(&query.Before, "before", "", "show posts ending at BEFORE")
+	flags.IntVar(&query.Limit, "limit", 0, "show N posts")
+	flags.BoolVar(&query.Unread, "unread", false, "only show unread posts")
+	flags.StringVar(&query.Source, "source", "", "only show posts from the feed URL")
+	flags.StringVar(&since, "since", "", "only show posts published from DATE")
+	flags.StringVar(&until, "until", "", "only show posts published before DATE")
+	flags.StringVar(&query.Type, "type", "", "only show posts of TYPE")
+	err := flags.Parse(args)
+	if err != nil {
+		return query, err
+	}
+
+	if since != "" {
+		query.Since, err = parseDate(since)
+		if err != nil {
+			return query, err
+		}
+	}
+	if until != "" {
+		query.Until, err = parseDate(until)
+		if err != nil {
+			return query, err
+		}
+	}
+
+	return query, nil
+}
+
+// parseDate parses a date (2006-01-02) or a RFC3339 time
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// eventPrinter prints every event on a line
+type eventPrinter struct{}
+
+func (p *eventPrinter) WriteMessage(evt microsub.Event) {
+	fmt.Printf("%d %s", evt.ID, evt.Type)
+	if evt.Channel != nil {
+		fmt.Printf(" channel=%s", evt.Channel.UID)
+		switch evt.Type {
+		case microsub.EventChannelCreated, microsub.EventChannelUpdated:
+			fmt.Printf(" name=%q", evt.Channel.Name)
+		case microsub.EventUnreadCountChanged:
+			fmt.Printf(" unread=%d", evt.Channel.Unread)
+		}
+	}
+	if evt.Item != "" {
+		fmt.Printf(" item=%s", evt.Item)
+	}
+	if evt.Feed != nil {
+		fmt.Printf(" url=%s", evt.Feed.URL)
+	}
+	if evt.Error != "" {
+		fmt.Printf(" error=%q", evt.Error)
+	}
+	fmt.Println()
+}
+
 func showItem(item *microsub.Item) {
 	if item.Name != "" {
 		fmt.Printf("%s - ", item.Name)
 	}
 	fmt.Printf("%s\n", item.Published)
+	if item.Summary != "" {
+		fmt.Println(item.Summary)
+	}
 	if item.Content != nil {
 		if item.Content.Text != "" {
 			fmt.Println(item.Content.Text)
@@ -587,6 +967,18 @@ func showItem(item *microsub.Item) {
 			fmt.Println(item.Content.HTML)
 		}
 	}
+	if item.Featured != "" {
+		fmt.Printf("featured: %s\n", item.Featured)
+	}
+	for _, u := range item.Audio {
+		fmt.Printf("audio: %s\n", u)
+	}
+	for _, u := range item.Video {
+		fmt.Printf("video: %s\n", u)
+	}
+	for _, u := range item.Syndication {
+		fmt.Printf("syndication: %s\n", u)
+	}
 	fmt.Println(item.URL)
 	fmt.Println()
 }
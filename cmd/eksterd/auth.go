@@ -25,13 +25,20 @@ import (
 	"regexp"
 	"time"
 
-	"github.com/gomodule/redigo/redis"
 	"p83.nl/go/ekster/pkg/auth"
 )
 
 var authHeaderRegex = regexp.MustCompile("^Bearer (.+)$")
 
-func (b *memoryBackend) cachedCheckAuthToken(conn redis.Conn, header string, r *auth.TokenResponse) bool {
+// AuthTokenAccepted checks a token of the owner, see authTokenAccepted
+func (u *userBackends) AuthTokenAccepted(header string, r *auth.TokenResponse) bool {
+	return u.authTokenAccepted(header, "", r)
+}
+
+// authTokenAccepted checks a token of the user me, or of the owner when me is
+// empty. Tokens from /auth/token and tokens that were checked before are found
+// in the storage, the other tokens are only sent to the token endpoint of me.
+func (u *userBackends) authTokenAccepted(header, me string, r *auth.TokenResponse) bool {
 	tokens := authHeaderRegex.FindStringSubmatch(header)
 
 	if len(tokens) != 2 {
@@ -39,9 +46,18 @@ func (b *memoryBackend) cachedCheckAuthToken(conn redis.Conn, header string, r *
 		return false
 	}
 
-	key := fmt.Sprintf("token:%s", tokens[1])
+	now := time.Now()
+	if req, ok := loadToken(u.store, tokens[1], now); ok {
+		if _, ok := u.backend(req.Me); ok {
+			touchToken(u.store, tokens[1], &req, now)
+			*r = auth.TokenResponse{Me: req.Me, ClientID: req.ClientID, Scope: req.Scope, IssuedAt: req.IssuedAt}
+			return true
+		}
+	}
+
+	key := tokenCacheKey(tokens[1])
 
-	authorized, err := getCachedValue(conn, key, r)
+	authorized, err := u.store.TokenCacheGet(key, r)
 	if err != nil {
 		log.Println(err)
 	}
@@ -50,9 +66,9 @@ func (b *memoryBackend) cachedCheckAuthToken(conn redis.Conn, header string, r *
 		return true
 	}
 
-	authorized = b.checkAuthToken(header, r)
+	authorized = u.checkAuthToken(header, me, r)
 	if authorized {
-		err = setCachedTokenResponseValue(conn, key, r)
+		err = u.store.TokenCacheSet(key, r, 10*time.Minute)
 		if err != nil {
 			log.Println(err)
 		}
@@ -62,10 +78,46 @@ func (b *memoryBackend) cachedCheckAuthToken(conn redis.Conn, header string, r *
 	return authorized
 }
 
-func (b *memoryBackend) checkAuthToken(header string, token *auth.TokenResponse) bool {
-	log.Println("Checking auth token")
+// tokenCacheKey is the key of the cached token response, it's different from
+// the "token:" keys of the tokens that /auth/token issues
+func tokenCacheKey(token string) string {
+	return fmt.Sprintf("token_cache:%s", token)
+}
+
+// checkAuthToken asks the token endpoint of the user me about the token, the
+// token is never sent to the token endpoints of the other users. The endpoint
+// is only trusted for the users that use it, so it can't give out tokens for
+// the other users.
+func (u *userBackends) checkAuthToken(header, me string, r *auth.TokenResponse) bool {
+	if me == "" {
+		me = u.owner.Me
+	}
+	if _, ok := u.backend(me); !ok {
+		log.Printf("Unknown user %q\n", me)
+		return false
+	}
+
+	tokenEndpoint := u.userTokenEndpoint(me)
+	if tokenEndpoint == "" {
+		return false
+	}
+
+	var token auth.TokenResponse
+	if !checkAuthToken(tokenEndpoint, header, &token) {
+		return false
+	}
+	if token.Me != me {
+		if _, ok := u.backend(token.Me); !ok || u.userTokenEndpoint(token.Me) != tokenEndpoint {
+			log.Printf("Token endpoint %s can't give tokens for %q\n", tokenEndpoint, token.Me)
+			return false
+		}
+	}
+	*r = token
+	return true
+}
 
-	tokenEndpoint := b.TokenEndpoint
+func checkAuthToken(tokenEndpoint, header string, token *auth.TokenResponse) bool {
+	log.Println("Checking auth token")
 
 	req, err := buildValidateAuthTokenRequest(tokenEndpoint, header)
 	if err != nil {
@@ -102,24 +154,3 @@ func buildValidateAuthTokenRequest(tokenEndpoint string, header string) (*http.R
 	req.Header.Add("Accept", "application/json")
 	return req, err
 }
-
-// setCachedTokenResponseValue remembers the value of the auth token response in redis
-func setCachedTokenResponseValue(conn redis.Conn, key string, r *auth.TokenResponse) error {
-	_, err := conn.Do("HMSET", redis.Args{}.Add(key).AddFlat(r)...)
-	if err != nil {
-		return fmt.Errorf("error while setting token: %v", err)
-	}
-	conn.Do("EXPIRE", key, uint64(10*time.Minute/time.Second))
-	return nil
-}
-
-// getCachedValue gets the cached value from Redis
-func getCachedValue(conn redis.Conn, key string, r *auth.TokenResponse) (bool, error) {
-	values, err := redis.Values(conn.Do("HGETALL", key))
-	if err == nil && len(values) > 0 {
-		if err = redis.ScanStruct(values, r); err == nil {
-			return true, nil
-		}
-	}
-	return false, fmt.Errorf("error while getting value from backend: %v", err)
-}
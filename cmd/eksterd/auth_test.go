@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"p83.nl/go/ekster/pkg/auth"
+	"p83.nl/go/ekster/pkg/server"
+)
+
+func TestWithAuth_Scopes(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	// the token is the scope of the token
+	tokenEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		json.NewEncoder(w).Encode(auth.TokenResponse{Me: "https://example.com/", Scope: strings.Replace(scope, "+", " ", -1)})
+	}))
+	defer tokenEndpoint.Close()
+
+	b := &memoryBackend{store: store, Me: "https://example.com/", TokenEndpoint: tokenEndpoint.URL}
+	handler := WithAuth(server.NewMicrosubHandler(&server.NullBackend{}), newUserBackends(b))
+
+	tests := []struct {
+		method, target, body, token string
+		status                      int
+	}{
+		{"GET", "/microsub?action=channels", "", "read", 200},
+		{"GET", "/microsub?action=channels", "", "follow+mute", 403},
+		{"POST", "/microsub?action=channels&method=delete&channel=0001", "", "read+follow+mute+block", 403},
+		{"POST", "/microsub?action=channels&method=delete&channel=0001", "", "read+channels", 200},
+		{"POST", "/microsub?action=follow&channel=0001&url=" + url.QueryEscape("https://example.com/"), "", "read", 403},
+		{"POST", "/microsub?action=unmute&channel=0001&uid=" + url.QueryEscape("https://example.com/"), "", "mute", 200},
+		{"POST", "/microsub?action=block&channel=0001&uid=" + url.QueryEscape("https://example.com/"), "", "create", 403},
+		{"POST", "/microsub", "action=timeline&method=remove&channel=0001&entry=1", "create", 403},
+		{"POST", "/microsub", "action=timeline&method=remove&channel=0001&entry=1", "read", 200},
+		// the action in the query is used, the action in the body is ignored
+		{"POST", "/microsub?action=x", "action=timeline&method=remove&channel=0001&entry=1", "create", 400},
+		{"POST", "/microsub", "", "read", 400},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.body != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, tt.status, w.Code, "%s %s %s with %s", tt.method, tt.target, tt.body, tt.token)
+		if tt.status == 403 {
+			assert.Contains(t, w.Body.String(), `"insufficient_scope"`)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+// timelineCursor is a position in a timeline. The items of a timeline are
+// ordered by score and then by ID, so a cursor stays valid when items are added
+// or removed.
+type timelineCursor struct {
+	Score int64
+	ID    string
+}
+
+// String encodes the cursor as the opaque string that is used for paging
+func (c timelineCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.Score, 10) + ":" + c.ID))
+}
+
+// compare returns -1, 0 or 1 when c comes before, at or after other
+func (c timelineCursor) compare(other timelineCursor) int {
+	switch {
+	case c.Score < other.Score:
+		return -1
+	case c.Score > other.Score:
+		return 1
+	}
+	return strings.Compare(c.ID, other.ID)
+}
+
+func parseTimelineCursor(s string) (timelineCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return timelineCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return timelineCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	score, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return timelineCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	return timelineCursor{Score: score, ID: parts[1]}, nil
+}
+
+// timelinePage collects the items of a page. The page is read by walking the
+// timeline from the cursor: in the order of the timeline for after and the
+// first page, in the other direction for before.
+type timelinePage struct {
+	query    microsub.TimelineQuery
+	limit    int
+	backward bool
+
+	// desc is true when the walk goes from high to low cursors
+	desc  bool
+	start *timelineCursor
+
+	items   []microsub.Item
+	cursors []timelineCursor
+	more    bool
+}
+
+// newTimelinePage starts a page for the query, newestFirst is the order of
+// the timeline
+func newTimelinePage(query microsub.TimelineQuery, newestFirst bool) (*timelinePage, error) {
+	page := &timelinePage{query: query, limit: timelineLimit(query)}
+
+	cursor := query.After
+	if cursor == "" && query.Before != "" {
+		cursor = query.Before
+		page.backward = true
+	}
+	page.desc = newestFirst != page.backward
+
+	if cursor != "" {
+		start, err := parseTimelineCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		page.start = &start
+	}
+	return page, nil
+}
+
+// skip reports whether the entry at c is at or before the start of the walk
+func (page *timelinePage) skip(c timelineCursor) bool {
+	if page.start == nil {
+		return false
+	}
+	if page.desc {
+		return c.compare(*page.start) >= 0
+	}
+	return c.compare(*page.start) <= 0
+}
+
+// add adds the item at c to the page when it matches the query. When the page
+// is full the walk can stop, done reports this.
+func (page *timelinePage) add(c timelineCursor, item microsub.Item) {
+	if !page.query.Match(item) {
+		return
+	}
+	if len(page.items) == page.limit {
+		page.more = true
+		return
+	}
+	page.items = append(page.items, item)
+	page.cursors = append(page.cursors, c)
+}
+
+// done reports whether the page is full and there are more items after it
+func (page *timelinePage) done() bool {
+	return page.more
+}
+
+// timeline returns the items in the order of the timeline. The cursor in the
+// direction of the walk is only set when there are more items, the cursor in
+// the other direction is always set, so a client can check for new items.
+func (page *timelinePage) timeline() microsub.Timeline {
+	items, cursors := page.items, page.cursors
+	if page.backward {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+			cursors[i], cursors[j] = cursors[j], cursors[i]
+		}
+	}
+	if items == nil {
+		items = []microsub.Item{}
+	}
+
+	paging := microsub.Pagination{}
+	if n := len(cursors); n > 0 {
+		first, last := cursors[0].String(), cursors[n-1].String()
+		if page.backward {
+			paging.After = last
+			if page.more {
+				paging.Before = first
+			}
+		} else {
+			paging.Before = first
+			if page.more {
+				paging.After = last
+			}
+		}
+	}
+
+	return microsub.Timeline{
+		Paging: paging,
+		Items:  items,
+	}
+}
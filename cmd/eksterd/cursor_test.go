@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func TestTimelineCursor(t *testing.T) {
+	c := timelineCursor{Score: 1533124800, ID: "item:a:b"}
+	parsed, err := parseTimelineCursor(c.String())
+	assert.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	for _, s := range []string{"1533124800", "!!", "MTIz"} {
+		_, err = parseTimelineCursor(s)
+		assert.Error(t, err, s)
+	}
+
+	assert.Equal(t, -1, timelineCursor{Score: 1, ID: "b"}.compare(timelineCursor{Score: 2, ID: "a"}))
+	assert.Equal(t, -1, timelineCursor{Score: 1, ID: "a"}.compare(timelineCursor{Score: 1, ID: "b"}))
+	assert.Equal(t, 0, timelineCursor{Score: 1, ID: "a"}.compare(timelineCursor{Score: 1, ID: "a"}))
+
+	sc, err := streamCursor("1533124800000-12")
+	assert.NoError(t, err)
+	assert.Equal(t, "1533124800000-12", streamCursorID(sc))
+	sc2, _ := streamCursor("1533124800000-9")
+	assert.Equal(t, 1, sc.compare(sc2))
+}
+
+func pageNames(page microsub.Timeline) []string {
+	var names []string
+	for _, item := range page.Items {
+		names = append(names, item.Name)
+	}
+	return names
+}
+
+// walkTimeline reads all pages of the timeline with after, and then walks back
+// from the last page with before
+func walkTimeline(t *testing.T, timeline TimelineBackend, limit int) (forward, backward []string) {
+	page, err := timeline.Items(microsub.TimelineQuery{Limit: limit})
+	require.NoError(t, err)
+	forward = pageNames(page)
+	for page.Paging.After != "" {
+		page, err = timeline.Items(microsub.TimelineQuery{After: page.Paging.After, Limit: limit})
+		require.NoError(t, err)
+		require.NotEmpty(t, page.Items)
+		assert.True(t, len(page.Items) <= limit)
+		forward = append(forward, pageNames(page)...)
+	}
+
+	backward = pageNames(page)
+	for page.Paging.Before != "" {
+		page, err = timeline.Items(microsub.TimelineQuery{Before: page.Paging.Before, Limit: limit})
+		require.NoError(t, err)
+		if len(page.Items) == 0 {
+			break
+		}
+		assert.NotEmpty(t, page.Paging.After)
+		backward = append(pageNames(page), backward...)
+	}
+	return forward, backward
+}
+
+func TestBoltStorage_Paging(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+	testTimelinePaging(t, store)
+}
+
+// testTimelinePaging walks the timelines of store in both directions, also
+// when items have the same published time
+func testTimelinePaging(t *testing.T, store Storage) {
+	start := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		timelineType string
+		newestFirst  bool
+	}{
+		{timelineTypeSortedSet, false},
+		{timelineTypeStream, true},
+		{timelineTypeCapped, true},
+	} {
+		timeline := store.Timeline("paging-"+tt.timelineType, tt.timelineType, 0)
+		require.NoError(t, timeline.Init())
+
+		// items are added in groups of three with the same published time
+		const n = 23
+		var expected []string
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("%02d", i)
+			// Redis streams would take a number for the id of an entry
+			_, err := timeline.AddItem(microsub.Item{
+				ID:        "item-" + name,
+				Type:      "entry",
+				Name:      name,
+				Published: start.Add(time.Duration(i/3) * time.Minute).Format(time.RFC3339),
+			})
+			require.NoError(t, err)
+			if tt.newestFirst {
+				expected = append([]string{name}, expected...)
+			} else {
+				expected = append(expected, name)
+			}
+		}
+
+		for _, limit := range []int{1, 3, 5, n, 50} {
+			forward, backward := walkTimeline(t, timeline, limit)
+			assert.Equal(t, expected, forward, "%s limit %d", tt.timelineType, limit)
+			assert.Equal(t, expected, backward, "%s limit %d", tt.timelineType, limit)
+		}
+
+		// the cursors stay valid when items are added and removed
+		first, err := timeline.Items(microsub.TimelineQuery{Limit: 5})
+		require.NoError(t, err)
+		assert.Equal(t, expected[:5], pageNames(first), tt.timelineType)
+
+		removed := first.Items[4].ID
+		require.NoError(t, timeline.Remove([]string{removed, "not-found"}))
+
+		published := start.Add(time.Hour)
+		if !tt.newestFirst {
+			published = start.Add(-time.Hour)
+		}
+		_, err = timeline.AddItem(microsub.Item{ID: "new", Type: "entry", Name: "new", Published: published.Format(time.RFC3339)})
+		require.NoError(t, err)
+
+		page, err := timeline.Items(microsub.TimelineQuery{After: first.Paging.After, Limit: 5})
+		assert.NoError(t, err)
+		assert.Equal(t, expected[5:10], pageNames(page), tt.timelineType)
+
+		page, err = timeline.Items(microsub.TimelineQuery{Before: page.Paging.Before, Limit: 4})
+		assert.NoError(t, err)
+		assert.Equal(t, expected[:4], pageNames(page), tt.timelineType)
+
+		page, err = timeline.Items(microsub.TimelineQuery{Before: first.Paging.Before, Limit: 5})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"new"}, pageNames(page), tt.timelineType)
+		assert.Empty(t, page.Paging.Before, tt.timelineType)
+
+		// the last page has no cursor to the next page
+		page, err = timeline.Items(microsub.TimelineQuery{Limit: n + 1})
+		assert.NoError(t, err)
+		assert.Len(t, page.Items, n)
+		assert.Empty(t, page.Paging.After, tt.timelineType)
+		assert.NotEmpty(t, page.Paging.Before, tt.timelineType)
+
+		_, err = timeline.Items(microsub.TimelineQuery{After: "1533124800"})
+		assert.Error(t, err, tt.timelineType)
+	}
+}
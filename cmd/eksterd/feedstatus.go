@@ -0,0 +1,148 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+// feedStatus is the fetch state of a followed feed, it's used to find the
+// feeds that are broken or no longer updated
+type feedStatus struct {
+	LastFetch   time.Time
+	LastSuccess time.Time
+	StatusCode  int
+	// Errors is the number of fetches that failed in a row
+	Errors    int
+	LastError string
+	// LastItem is the time the last new item of the feed was added
+	LastItem time.Time
+	// Items is the number of items in the feed at the last fetch
+	Items int
+}
+
+// fetched records the result of a fetch, statusCode is 0 when there was no
+// response
+func (s *feedStatus) fetched(statusCode int, err error, now time.Time) {
+	s.LastFetch = now
+	s.StatusCode = statusCode
+	if err != nil {
+		s.Errors++
+		s.LastError = err.Error()
+		return
+	}
+	s.Errors = 0
+	s.LastError = ""
+	s.LastSuccess = now
+}
+
+// processed records the number of items in the feed and the number of items
+// that were new
+func (s *feedStatus) processed(items, added int, now time.Time) {
+	s.Items = items
+	if added > 0 {
+		s.LastItem = now
+	}
+}
+
+// microsubStatus returns the status as it's shown in the follow list
+func (s feedStatus) microsubStatus(websub bool) *microsub.FeedStatus {
+	return &microsub.FeedStatus{
+		LastFetch:   formatStatusTime(s.LastFetch),
+		LastSuccess: formatStatusTime(s.LastSuccess),
+		StatusCode:  s.StatusCode,
+		Errors:      s.Errors,
+		LastError:   s.LastError,
+		LastItem:    formatStatusTime(s.LastItem),
+		Items:       s.Items,
+		WebSub:      websub,
+	}
+}
+
+// feedStatusKey is the key of the status of the feed in the channel
+func feedStatusKey(channel, feedURL string) string {
+	return channel + " " + feedURL
+}
+
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// updateFeedStatus changes the saved status of the feed with update and
+// returns the new status
+func (b *memoryBackend) updateFeedStatus(channel, feedURL string, update func(status *feedStatus)) feedStatus {
+	b.statusLock.Lock()
+	defer b.statusLock.Unlock()
+
+	var status feedStatus
+	if err := b.store.FeedStatusLoad(channel, feedURL, &status); err != nil {
+		log.Printf("Error while loading status of %s: %v\n", feedURL, err)
+	}
+	update(&status)
+	if err := b.store.FeedStatusSave(channel, feedURL, &status); err != nil {
+		log.Printf("Error while saving status of %s: %v\n", feedURL, err)
+	}
+	return status
+}
+
+// activeWebSubFeeds returns the urls of the feeds with an active WebSub
+// subscription, the subscription is shared by all channels that follow the feed
+func (b *memoryBackend) activeWebSubFeeds() map[string]bool {
+	active := make(map[string]bool)
+	feeds, err := b.store.HubFeeds()
+	if err != nil {
+		log.Printf("Error while loading WebSub feeds: %v\n", err)
+		return active
+	}
+	for _, feed := range feeds {
+		// the lease is set when the hub has verified the subscription
+		if feed.Hub != "" && feed.LeaseSeconds > 0 {
+			active[feed.URL] = true
+		}
+	}
+	return active
+}
+
+// followedFeed is a feed with the channel that follows it
+type followedFeed struct {
+	Channel microsub.Channel
+	microsub.Feed
+}
+
+// sortFeedsByHealth puts the feeds with the most errors in a row first, and
+// then the feeds without new items for the longest time
+func sortFeedsByHealth(feeds []followedFeed) {
+	sort.SliceStable(feeds, func(i, j int) bool {
+		a, b := feeds[i].Status, feeds[j].Status
+		if a == nil || b == nil {
+			return a != nil
+		}
+		if a.Errors != b.Errors {
+			return a.Errors > b.Errors
+		}
+		return a.LastItem < b.LastItem
+	})
+}
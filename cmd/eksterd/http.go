@@ -25,20 +25,23 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"p83.nl/go/ekster/pkg/auth"
 	"p83.nl/go/ekster/pkg/indieauth"
 	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/server"
 	"p83.nl/go/ekster/pkg/util"
 
 	"github.com/alecthomas/template"
-	"github.com/gomodule/redigo/redis"
 	"willnorris.com/go/microformats"
 )
 
 type mainHandler struct {
-	Backend     *memoryBackend
+	Users       *userBackends
 	BaseURL     string
 	TemplateDir string
 }
@@ -50,6 +53,7 @@ type session struct {
 	State                 string `redis:"state"`
 	LoggedIn              bool   `redis:"logged_in"`
 	NextURI               string `redis:"next_uri"`
+	CodeVerifier          string `redis:"code_verifier"`
 }
 
 type authResponse struct {
@@ -61,6 +65,7 @@ type authTokenResponse struct {
 	AccessToken string `json:"access_token"`
 	TokenType   string `json:"token_type"`
 	Scope       string `json:"scope"`
+	ExpiresIn   int64  `json:"expires_in,omitempty"`
 }
 
 type indexPage struct {
@@ -76,21 +81,68 @@ type settingsPage struct {
 	Channels []microsub.Channel
 	Feeds    []microsub.Feed
 }
+type sourcesPage struct {
+	Session session
+	BaseURL string
+
+	Sources  []microsub.MicropubSource
+	Channels []microsub.Channel
+}
+type tokensPage struct {
+	Session session
+
+	Apps []authorizedApp
+}
 type logsPage struct {
 	Session session
 }
+type feedsPage struct {
+	Session session
+
+	Feeds []followedFeed
+}
 
 type authPage struct {
 	Session     session
 	Me          string
 	ClientID    string
 	Scope       string
+	Scopes      []scopeInfo
 	RedirectURI string
 	State       string
 	Channels    []microsub.Channel
 	App         app
 }
 
+// scopeInfo is a scope with the explanation that is shown on the consent page
+type scopeInfo struct {
+	Name        string
+	Description string
+}
+
+// scopeDescriptions explains what a token with the scope can do
+var scopeDescriptions = map[string]string{
+	server.ScopeRead:     "Read the channels and timelines, and mark items as read",
+	server.ScopeFollow:   "Search and preview feeds, follow and unfollow feeds",
+	server.ScopeMute:     "Mute and unmute people",
+	server.ScopeBlock:    "Block and unblock people",
+	server.ScopeChannels: "Create, rename, sort and delete channels",
+	"create":             "Post to the selected channel with Micropub",
+}
+
+// scopeList returns the space separated scopes with their descriptions
+func scopeList(scope string) []scopeInfo {
+	var scopes []scopeInfo
+	for _, name := range strings.Fields(scope) {
+		description, ok := scopeDescriptions[name]
+		if !ok {
+			description = "Unknown scope, it doesn't give access to anything in Ekster"
+		}
+		scopes = append(scopes, scopeInfo{Name: name, Description: description})
+	}
+	return scopes
+}
+
 type authRequest struct {
 	Me          string `redis:"me"`
 	ClientID    string `redis:"client_id"`
@@ -100,10 +152,20 @@ type authRequest struct {
 	Code        string `redis:"code"`
 	Channel     string `redis:"channel"`
 	AccessToken string `redis:"access_token"`
+
+	// CodeChallenge is the PKCE challenge, the client sends the verifier with
+	// the code to /auth/token
+	CodeChallenge       string `redis:"code_challenge"`
+	CodeChallengeMethod string `redis:"code_challenge_method"`
+
+	// IssuedAt, ExpiresAt and LastUsed are the unix times of a token
+	IssuedAt  int64 `redis:"issued_at"`
+	ExpiresAt int64 `redis:"expires_at"`
+	LastUsed  int64 `redis:"last_used"`
 }
 
-func newMainHandler(backend *memoryBackend, baseURL, templateDir string) (*mainHandler, error) {
-	h := &mainHandler{Backend: backend}
+func newMainHandler(users *userBackends, baseURL, templateDir string) (*mainHandler, error) {
+	h := &mainHandler{Users: users}
 
 	h.BaseURL = baseURL
 
@@ -113,6 +175,34 @@ func newMainHandler(backend *memoryBackend, baseURL, templateDir string) (*mainH
 	return h, nil
 }
 
+// metadataURL is the url of the IndieAuth server metadata
+func (h *mainHandler) metadataURL() string {
+	return strings.TrimRight(h.BaseURL, "/") + "/.well-known/oauth-authorization-server"
+}
+
+// metadata describes the IndieAuth endpoints of eksterd
+func (h *mainHandler) metadata() indieauth.Metadata {
+	baseURL := strings.TrimRight(h.BaseURL, "/")
+
+	var scopes []string
+	for scope := range scopeDescriptions {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+
+	return indieauth.Metadata{
+		Issuer:                        baseURL + "/",
+		AuthorizationEndpoint:         baseURL + "/auth",
+		TokenEndpoint:                 baseURL + "/auth/token",
+		IntrospectionEndpoint:         baseURL + "/auth/introspect",
+		RevocationEndpoint:            baseURL + "/auth/revoke",
+		ScopesSupported:               scopes,
+		ResponseTypesSupported:        []string{"code"},
+		GrantTypesSupported:           []string{"authorization_code"},
+		CodeChallengeMethodsSupported: []string{indieauth.CodeChallengeMethod},
+	}
+}
+
 func (h *mainHandler) templateFile(filename string) string {
 	return fmt.Sprintf("%s/%s", h.TemplateDir, filename)
 }
@@ -148,30 +238,27 @@ func getSessionCookie(w http.ResponseWriter, r *http.Request) string {
 	return sessionVar
 }
 
-func loadSession(sessionVar string, conn redis.Conn) (session, error) {
+func loadSession(sessionVar string, store Storage) (session, error) {
 	var sess session
-	sessionKey := "session:" + sessionVar
-	data, err := redis.Values(conn.Do("HGETALL", sessionKey))
-	if err != nil {
-		return sess, err
-	}
-	err = redis.ScanStruct(data, &sess)
+	err := store.SessionLoad(sessionVar, &sess)
 	if err != nil {
 		return sess, err
 	}
 	return sess, nil
 }
 
-func saveSession(sessionVar string, sess *session, conn redis.Conn) error {
-	_, err := conn.Do("HMSET", redis.Args{}.Add("session:"+sessionVar).AddFlat(sess)...)
-	return err
+func saveSession(sessionVar string, sess *session, store Storage) error {
+	return store.SessionSave(sessionVar, sess)
 }
 
-func verifyAuthCode(code, redirectURI, authEndpoint string) (bool, *authResponse, error) {
+func verifyAuthCode(code, redirectURI, authEndpoint, codeVerifier string) (bool, *authResponse, error) {
 	reqData := url.Values{}
 	reqData.Set("code", code)
 	reqData.Set("client_id", ClientID)
 	reqData.Set("redirect_uri", redirectURI)
+	if codeVerifier != "" {
+		reqData.Set("code_verifier", codeVerifier)
+	}
 
 	req, err := http.NewRequest(http.MethodPost, authEndpoint, strings.NewReader(reqData.Encode()))
 	if err != nil {
@@ -204,22 +291,6 @@ func verifyAuthCode(code, redirectURI, authEndpoint string) (bool, *authResponse
 	return false, nil, fmt.Errorf("HTTP response code from authorization_endpoint (%s) %d", authEndpoint, resp.StatusCode)
 }
 
-func isLoggedIn(backend *memoryBackend, sess *session) bool {
-	if !sess.LoggedIn {
-		return false
-	}
-
-	if !backend.AuthEnabled {
-		return true
-	}
-
-	if sess.Me != backend.Me {
-		return false
-	}
-
-	return true
-}
-
 func performIndieauthCallback(r *http.Request, sess *session) (bool, *authResponse, error) {
 	state := r.Form.Get("state")
 	if state != sess.State {
@@ -227,7 +298,7 @@ func performIndieauthCallback(r *http.Request, sess *session) (bool, *authRespon
 	}
 
 	code := r.Form.Get("code")
-	return verifyAuthCode(code, sess.RedirectURI, sess.AuthorizationEndpoint)
+	return verifyAuthCode(code, sess.RedirectURI, sess.AuthorizationEndpoint, sess.CodeVerifier)
 }
 
 type app struct {
@@ -274,8 +345,7 @@ func getAppInfo(clientID string) (app, error) {
 }
 
 func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	conn := pool.Get()
-	defer conn.Close()
+	store := h.Users.store
 
 	err := r.ParseForm()
 	if err != nil {
@@ -287,7 +357,7 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		if r.URL.Path == "/" {
 			sessionVar := getSessionCookie(w, r)
-			sess, err := loadSession(sessionVar, conn)
+			sess, err := loadSession(sessionVar, store)
 			if err != nil {
 				fmt.Fprintf(w, "ERROR: %q\n", err)
 				return
@@ -297,6 +367,8 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			page.Session = sess
 			page.Baseurl = strings.TrimRight(h.BaseURL, "/")
 
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"indieauth-metadata\"", h.metadataURL()))
+
 			err = h.renderTemplate(w, "index.html", page)
 			if err != nil {
 				fmt.Fprintf(w, "ERROR: %s\n", err)
@@ -310,7 +382,7 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 
 			sessionVar := c.Value
-			sess, err := loadSession(sessionVar, conn)
+			sess, err := loadSession(sessionVar, store)
 
 			verified, authResponse, err := performIndieauthCallback(r, &sess)
 			if err != nil {
@@ -320,7 +392,7 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if verified {
 				sess.Me = authResponse.Me
 				sess.LoggedIn = true
-				saveSession(sessionVar, &sess, conn)
+				saveSession(sessionVar, &sess, store)
 				log.Printf("SESSION: %#v\n", sess)
 				if sess.NextURI != "" {
 					http.Redirect(w, r, sess.NextURI, 302)
@@ -337,9 +409,10 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			sessionVar := c.Value
-			sess, err := loadSession(sessionVar, conn)
+			sess, err := loadSession(sessionVar, store)
 
-			if !isLoggedIn(h.Backend, &sess) {
+			backend, ok := h.Users.sessionBackend(&sess)
+			if !ok {
 				w.WriteHeader(401)
 				fmt.Fprintf(w, "Unauthorized")
 				return
@@ -348,17 +421,13 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			var page settingsPage
 			page.Session = sess
 			currentChannel := r.URL.Query().Get("uid")
-			page.Channels, err = h.Backend.ChannelsGetList()
-			page.Feeds, err = h.Backend.FollowGetList(currentChannel)
+			page.Channels, err = backend.ChannelsGetList()
+			page.Feeds, err = backend.FollowGetList(currentChannel)
 
 			for _, v := range page.Channels {
 				if v.UID == currentChannel {
 					page.CurrentChannel = v
-					if setting, e := h.Backend.Settings[v.UID]; e {
-						page.CurrentSetting = setting
-					} else {
-						page.CurrentSetting = channelSetting{}
-					}
+					page.CurrentSetting = backend.getSetting(v.UID)
 					break
 				}
 			}
@@ -375,9 +444,9 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			sessionVar := c.Value
-			sess, err := loadSession(sessionVar, conn)
+			sess, err := loadSession(sessionVar, store)
 
-			if !isLoggedIn(h.Backend, &sess) {
+			if _, ok := h.Users.sessionBackend(&sess); !ok {
 				w.WriteHeader(401)
 				fmt.Fprintf(w, "Unauthorized")
 				return
@@ -391,6 +460,36 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				fmt.Fprintf(w, "ERROR: %s\n", err)
 			}
 			return
+		} else if r.URL.Path == "/feeds" {
+			c, err := r.Cookie("session")
+			if err == http.ErrNoCookie {
+				http.Redirect(w, r, "/", 302)
+				return
+			}
+			sessionVar := c.Value
+			sess, err := loadSession(sessionVar, store)
+
+			backend, ok := h.Users.sessionBackend(&sess)
+			if !ok {
+				w.WriteHeader(401)
+				fmt.Fprintf(w, "Unauthorized")
+				return
+			}
+
+			var page feedsPage
+			page.Session = sess
+			page.Feeds, err = backend.followedFeeds()
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %s\n", err)
+				return
+			}
+			sortFeedsByHealth(page.Feeds)
+
+			err = h.renderTemplate(w, "feeds.html", page)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %s\n", err)
+			}
+			return
 		} else if r.URL.Path == "/settings" {
 			c, err := r.Cookie("session")
 			if err == http.ErrNoCookie {
@@ -398,9 +497,10 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			sessionVar := c.Value
-			sess, err := loadSession(sessionVar, conn)
+			sess, err := loadSession(sessionVar, store)
 
-			if !isLoggedIn(h.Backend, &sess) {
+			backend, ok := h.Users.sessionBackend(&sess)
+			if !ok {
 				w.WriteHeader(401)
 				fmt.Fprintf(w, "Unauthorized")
 				return
@@ -408,36 +508,132 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			var page settingsPage
 			page.Session = sess
-			page.Channels, err = h.Backend.ChannelsGetList()
-			// page.Feeds = h.Backend.Feeds
+			page.Channels, err = backend.ChannelsGetList()
+			// page.Feeds = backend.Feeds
 
 			err = h.renderTemplate(w, "settings.html", page)
 			if err != nil {
 				fmt.Fprintf(w, "ERROR: %s\n", err)
 			}
 			return
+		} else if r.URL.Path == "/settings/sources" {
+			c, err := r.Cookie("session")
+			if err == http.ErrNoCookie {
+				http.Redirect(w, r, "/", 302)
+				return
+			}
+			sess, err := loadSession(c.Value, store)
+
+			backend, ok := h.Users.sessionBackend(&sess)
+			if !ok {
+				w.WriteHeader(401)
+				fmt.Fprintf(w, "Unauthorized")
+				return
+			}
+
+			var page sourcesPage
+			page.Session = sess
+			page.BaseURL = strings.TrimRight(h.BaseURL, "/")
+			page.Sources, err = backend.SourcesGetList()
+			if err != nil {
+				log.Println(err)
+			}
+			page.Channels, err = backend.ChannelsGetList()
+			if err != nil {
+				log.Println(err)
+			}
+
+			err = h.renderTemplate(w, "sources.html", page)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %s\n", err)
+			}
+			return
+		} else if r.URL.Path == "/settings/tokens" {
+			c, err := r.Cookie("session")
+			if err == http.ErrNoCookie {
+				http.Redirect(w, r, "/", 302)
+				return
+			}
+			sess, err := loadSession(c.Value, store)
+
+			backend, ok := h.Users.sessionBackend(&sess)
+			if !ok {
+				w.WriteHeader(401)
+				fmt.Fprintf(w, "Unauthorized")
+				return
+			}
+
+			var page tokensPage
+			page.Session = sess
+			page.Apps, err = authorizedApps(backend, store, time.Now())
+			if err != nil {
+				log.Println(err)
+			}
+
+			err = h.renderTemplate(w, "tokens.html", page)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %s\n", err)
+			}
+			return
+		} else if r.URL.Path == "/.well-known/oauth-authorization-server" {
+			w.Header().Add("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			err := enc.Encode(h.metadata())
+			if err != nil {
+				log.Println(err)
+			}
+			return
+		} else if r.URL.Path == "/auth/token" {
+			// verify the token for the servers that use this token endpoint
+			var token string
+			if tokens := authHeaderRegex.FindStringSubmatch(r.Header.Get("Authorization")); len(tokens) == 2 {
+				token = tokens[1]
+			}
+
+			now := time.Now()
+			req, ok := loadToken(store, token, now)
+			if !ok {
+				http.Error(w, "Unauthorized", 401)
+				return
+			}
+			touchToken(store, token, &req, now)
+
+			res := auth.TokenResponse{
+				Me:       req.Me,
+				ClientID: req.ClientID,
+				Scope:    req.Scope,
+				IssuedAt: req.IssuedAt,
+			}
+
+			w.Header().Add("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			err := enc.Encode(&res)
+			if err != nil {
+				log.Println(err)
+			}
+			return
 		} else if r.URL.Path == "/auth" {
 			// check if we are logged in
 			// TODO: if not logged in, make sure we get back here
 
 			sessionVar := getSessionCookie(w, r)
 
-			sess, err := loadSession(sessionVar, conn)
+			sess, err := loadSession(sessionVar, store)
 
-			if !isLoggedIn(h.Backend, &sess) {
+			backend, ok := h.Users.sessionBackend(&sess)
+			if !ok {
 				sess.NextURI = r.URL.String()
-				saveSession(sessionVar, &sess, conn)
+				saveSession(sessionVar, &sess, store)
 				http.Redirect(w, r, "/", 302)
 				return
 			}
 
 			sess.NextURI = r.URL.String()
-			saveSession(sessionVar, &sess, conn)
+			saveSession(sessionVar, &sess, store)
 
 			query := r.URL.Query()
 
 			// responseType := query.Get("response_type") // TODO: check response_type
-			me := query.Get("me")
 			clientID := query.Get("client_id")
 			redirectURI := query.Get("redirect_uri")
 			state := query.Get("state")
@@ -446,15 +642,25 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				scope = "create"
 			}
 
+			codeChallenge := query.Get("code_challenge")
+			codeChallengeMethod := query.Get("code_challenge_method")
+			if codeChallenge != "" && codeChallengeMethod != indieauth.CodeChallengeMethod {
+				http.Error(w, fmt.Sprintf("ERROR: code_challenge_method should be %q", indieauth.CodeChallengeMethod), 400)
+				return
+			}
+
+			// the token is for the user that is logged in
 			authReq := authRequest{
-				Me:          me,
-				ClientID:    clientID,
-				RedirectURI: redirectURI,
-				Scope:       scope,
-				State:       state,
+				Me:                  backend.Me,
+				ClientID:            clientID,
+				RedirectURI:         redirectURI,
+				Scope:               scope,
+				State:               state,
+				CodeChallenge:       codeChallenge,
+				CodeChallengeMethod: codeChallengeMethod,
 			}
 
-			_, err = conn.Do("HMSET", redis.Args{}.Add("state:"+state).AddFlat(&authReq)...)
+			err = store.AuthRequestSave("state:"+state, &authReq, authStateLifetime)
 			if err != nil {
 				log.Println(err)
 				fmt.Fprintf(w, "ERROR: %q\n", err)
@@ -463,12 +669,13 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			var page authPage
 			page.Session = sess
-			page.Me = me
+			page.Me = backend.Me
 			page.ClientID = clientID
 			page.RedirectURI = redirectURI
 			page.Scope = scope
+			page.Scopes = scopeList(scope)
 			page.State = state
-			page.Channels, err = h.Backend.ChannelsGetList()
+			page.Channels, err = backend.ChannelsGetList()
 
 			app, err := getAppInfo(clientID)
 			if err != nil {
@@ -516,17 +723,23 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			state := util.RandStringBytes(16)
 			redirectURI := fmt.Sprintf("%s/session/callback", h.BaseURL)
+			codeVerifier, err := indieauth.NewCodeVerifier()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("ERROR: %s", err), 500)
+				return
+			}
 
-			sess, err := loadSession(sessionVar, conn)
+			sess, err := loadSession(sessionVar, store)
 
 			sess.AuthorizationEndpoint = endpoints.AuthorizationEndpoint
 			sess.Me = meURL.String()
 			sess.State = state
 			sess.RedirectURI = redirectURI
 			sess.LoggedIn = false
-			saveSession(sessionVar, &sess, conn)
+			sess.CodeVerifier = codeVerifier
+			saveSession(sessionVar, &sess, store)
 
-			authenticationURL := indieauth.CreateAuthenticationURL(*authURL, meURL.String(), ClientID, redirectURI, state)
+			authenticationURL := indieauth.CreateAuthenticationURL(*authURL, meURL.String(), ClientID, redirectURI, state, indieauth.CodeChallenge(codeVerifier))
 
 			http.Redirect(w, r, authenticationURL, 302)
 			return
@@ -539,7 +752,7 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 
 			sessionVar := c.Value
-			conn.Do("DEL", "session:"+sessionVar)
+			store.SessionDelete(sessionVar)
 			http.Redirect(w, r, "/", 302)
 			return
 		} else if r.URL.Path == "/auth/approve" {
@@ -548,28 +761,44 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			state := r.FormValue("state")
 			channel := r.FormValue("channel")
 
-			values, err := redis.Values(conn.Do("HGETALL", "state:"+state))
+			var auth authRequest
+			err := store.AuthRequestLoad("state:"+state, &auth)
 			if err != nil {
 				log.Println(err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
-			var auth authRequest
-			err = redis.ScanStruct(values, &auth)
+			if auth.Me == "" {
+				http.Error(w, "ERROR: unknown or expired state", 400)
+				return
+			}
+
+			// only the user that the request is for can approve it
+			c, err := r.Cookie("session")
+			if err == http.ErrNoCookie {
+				http.Error(w, "Forbidden", 403)
+				return
+			}
+			sess, err := loadSession(c.Value, store)
 			if err != nil {
 				log.Println(err)
-				fmt.Fprintf(w, "ERROR: %q", err)
+			}
+			backend, ok := h.Users.sessionBackend(&sess)
+			if !ok || backend.Me != auth.Me {
+				http.Error(w, "Forbidden", 403)
 				return
 			}
-			auth.Code = code
-			auth.Channel = channel
-			_, err = conn.Do("HMSET", redis.Args{}.Add("code:"+code).AddFlat(&auth)...)
+
+			// a request is approved once
+			err = store.AuthRequestDelete("state:" + state)
 			if err != nil {
 				log.Println(err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
-			_, err = conn.Do("EXPIRE", "code:"+code, 5*60)
+			auth.Code = code
+			auth.Channel = channel
+			err = store.AuthRequestSave("code:"+code, &auth, 5*time.Minute)
 			if err != nil {
 				log.Println(err)
 				fmt.Fprintf(w, "ERROR: %q", err)
@@ -592,6 +821,15 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, redirectURI.String(), 302)
 			return
 		} else if r.URL.Path == "/auth/token" {
+			if r.FormValue("action") == "revoke" {
+				// the response is the same for tokens that don't exist
+				err := revokeToken(store, r.FormValue("token"))
+				if err != nil {
+					log.Println(err)
+				}
+				return
+			}
+
 			grantType := r.FormValue("grant_type")
 			if grantType != "authorization_code" {
 				w.WriteHeader(400)
@@ -603,21 +841,36 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// redirectURI := r.FormValue("redirect_uri")
 			// me := r.FormValue("me")
 
-			values, err := redis.Values(conn.Do("HGETALL", "code:"+code))
+			var auth authRequest
+			err := store.AuthRequestLoad("code:"+code, &auth)
 			if err != nil {
 				log.Println(err)
 				fmt.Fprintf(w, "ERROR: %q", err)
 				return
 			}
-			var auth authRequest
-			err = redis.ScanStruct(values, &auth)
+			if auth.Me == "" {
+				http.Error(w, "ERROR: unknown or expired code", 400)
+				return
+			}
+
+			codeVerifier := r.FormValue("code_verifier")
+			if auth.CodeChallenge != "" {
+				if !indieauth.VerifyCodeChallenge(auth.CodeChallenge, auth.CodeChallengeMethod, codeVerifier) {
+					http.Error(w, "ERROR: code_verifier doesn't match the code_challenge", 400)
+					return
+				}
+			} else if codeVerifier != "" {
+				http.Error(w, "ERROR: code_verifier without a code_challenge", 400)
+				return
+			}
+
+			// a code can only be used once
+			err = store.AuthRequestDelete("code:" + code)
 			if err != nil {
 				log.Println(err)
-				fmt.Fprintf(w, "ERROR: %q", err)
-				return
 			}
-			token := util.RandStringBytes(32)
-			_, err = conn.Do("HMSET", redis.Args{}.Add("token:"+token).AddFlat(&auth)...)
+
+			token, auth, err := issueToken(store, auth, time.Now())
 			if err != nil {
 				log.Println(err)
 				fmt.Fprintf(w, "ERROR: %q", err)
@@ -629,6 +882,7 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				AccessToken: token,
 				TokenType:   "Bearer",
 				Scope:       auth.Scope,
+				ExpiresIn:   int64(tokenLifetime / time.Second),
 			}
 
 			w.Header().Add("Content-Type", "application/json")
@@ -640,35 +894,158 @@ func (h *mainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			return
-		} else if r.URL.Path == "/settings/channel" {
-			defer h.Backend.save()
-			uid := r.FormValue("uid")
-			// name := r.FormValue("name")
-			excludeRegex := r.FormValue("exclude_regex")
+		} else if r.URL.Path == "/auth/revoke" {
+			// the revocation endpoint of the metadata, the response is the same for
+			// tokens that don't exist
+			err := revokeToken(store, r.FormValue("token"))
+			if err != nil {
+				log.Println(err)
+			}
+			return
+		} else if r.URL.Path == "/auth/introspect" {
+			// the token of the caller has to be from the same user
+			var caller string
+			if tokens := authHeaderRegex.FindStringSubmatch(r.Header.Get("Authorization")); len(tokens) == 2 {
+				caller = tokens[1]
+			}
+
+			now := time.Now()
+			callerReq, ok := loadToken(store, caller, now)
+			if !ok {
+				http.Error(w, "Unauthorized", 401)
+				return
+			}
+
+			var res introspectionResponse
+			if req, ok := loadToken(store, r.FormValue("token"), now); ok && req.Me == callerReq.Me {
+				res = introspectionResponse{
+					Active:   true,
+					Me:       req.Me,
+					ClientID: req.ClientID,
+					Scope:    req.Scope,
+					Exp:      req.ExpiresAt,
+					Iat:      req.IssuedAt,
+				}
+			}
+
+			w.Header().Add("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			err := enc.Encode(&res)
+			if err != nil {
+				log.Println(err)
+			}
+			return
+		} else if r.URL.Path == "/settings/sources" || r.URL.Path == "/settings/sources/delete" {
+			c, err := r.Cookie("session")
+			if err == http.ErrNoCookie {
+				http.Redirect(w, r, "/", 302)
+				return
+			}
+			sess, err := loadSession(c.Value, store)
+
+			backend, ok := h.Users.sessionBackend(&sess)
+			if !ok {
+				w.WriteHeader(401)
+				fmt.Fprintf(w, "Unauthorized")
+				return
+			}
 
-			if setting, e := h.Backend.Settings[uid]; e {
-				setting.ExcludeRegex = excludeRegex
-				h.Backend.Settings[uid] = setting
+			id := r.FormValue("id")
+			if r.URL.Path == "/settings/sources/delete" {
+				err = backend.SourcesDelete(id)
 			} else {
-				setting = channelSetting{
-					ExcludeRegex: excludeRegex,
+				source := microsub.MicropubSource{
+					ID:      id,
+					Label:   r.FormValue("label"),
+					Channel: r.FormValue("channel"),
+				}
+				if rateLimit := r.FormValue("rate_limit"); rateLimit != "" {
+					source.RateLimit, err = strconv.Atoi(rateLimit)
+					if err != nil {
+						http.Error(w, fmt.Sprintf("Bad Request: rate limit should be a number: %q", rateLimit), 400)
+						return
+					}
+				}
+				if id == "" {
+					_, err = backend.SourcesCreate(source)
+				} else {
+					_, err = backend.SourcesUpdate(source)
 				}
-				h.Backend.Settings[uid] = setting
 			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad Request: %s", err), 400)
+				return
+			}
+
+			http.Redirect(w, r, "/settings/sources", 302)
+			return
+		} else if r.URL.Path == "/settings/tokens/revoke" {
+			c, err := r.Cookie("session")
+			if err == http.ErrNoCookie {
+				http.Redirect(w, r, "/", 302)
+				return
+			}
+			sess, err := loadSession(c.Value, store)
 
+			backend, ok := h.Users.sessionBackend(&sess)
+			if !ok {
+				w.WriteHeader(401)
+				fmt.Fprintf(w, "Unauthorized")
+				return
+			}
+
+			found, err := revokeUserToken(store, backend.Me, r.FormValue("id"))
+			if err != nil {
+				log.Println(err)
+				fmt.Fprintf(w, "ERROR: %q", err)
+				return
+			}
+			if !found {
+				http.Error(w, "Unknown token", 404)
+				return
+			}
+
+			http.Redirect(w, r, "/settings/tokens", 302)
+			return
+		} else if r.URL.Path == "/settings/channel" {
+			c, err := r.Cookie("session")
+			if err == http.ErrNoCookie {
+				http.Redirect(w, r, "/", 302)
+				return
+			}
+			sess, err := loadSession(c.Value, store)
+
+			backend, ok := h.Users.sessionBackend(&sess)
+			if !ok {
+				w.WriteHeader(401)
+				fmt.Fprintf(w, "Unauthorized")
+				return
+			}
+
+			uid := r.FormValue("uid")
+			// name := r.FormValue("name")
+			excludeRegex := r.FormValue("exclude_regex")
 			includeRegex := r.FormValue("include_regex")
 
-			if setting, e := h.Backend.Settings[uid]; e {
-				setting.IncludeRegex = includeRegex
-				h.Backend.Settings[uid] = setting
-			} else {
-				setting = channelSetting{
-					IncludeRegex: includeRegex,
+			maxItems, _ := strconv.Atoi(r.FormValue("retention_max_items"))
+			maxAgeDays, _ := strconv.Atoi(r.FormValue("retention_max_age"))
+			backend.setFilters(uid, excludeRegex, includeRegex, retentionPolicy{
+				MaxItems:   maxItems,
+				MaxAge:     time.Duration(maxAgeDays) * 24 * time.Hour,
+				KeepUnread: r.FormValue("retention_keep_unread") != "",
+			})
+
+			if timelineType := r.FormValue("timeline_type"); timelineType != "" {
+				size, _ := strconv.Atoi(r.FormValue("timeline_size"))
+				_, err := backend.ChannelsSetType(uid, timelineType, size)
+				if err != nil {
+					log.Println(err)
+					fmt.Fprintf(w, "ERROR: %q\n", err)
+					return
 				}
-				h.Backend.Settings[uid] = setting
 			}
 
-			h.Backend.Debug()
+			backend.Debug()
 
 			http.Redirect(w, r, "/settings", 302)
 			return
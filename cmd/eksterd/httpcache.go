@@ -0,0 +1,82 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// httpCacheKeep is how long a response is kept for revalidation after it was fetched
+const httpCacheKeep = 30 * 24 * time.Hour
+
+// cachedResponse is a response in the HTTP cache. It's kept after it is no
+// longer fresh, so it can be revalidated with the ETag and Last-Modified headers.
+type cachedResponse struct {
+	Fresh    time.Time
+	Response []byte
+}
+
+func (c cachedResponse) response(req *http.Request) (*http.Response, error) {
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(c.Response)), req)
+}
+
+// addValidators adds the conditional headers for the cached response to req
+func (c cachedResponse) addValidators(req *http.Request) {
+	resp, err := c.response(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+func (b *memoryBackend) loadCachedResponse(cacheKey string) (cachedResponse, bool) {
+	var cached cachedResponse
+	data, err := b.store.CacheGet(cacheKey)
+	if err != nil {
+		return cached, false
+	}
+	// Responses cached by older versions are not wrapped and are fetched again
+	if err := json.Unmarshal(data, &cached); err != nil || len(cached.Response) == 0 {
+		return cached, false
+	}
+	return cached, true
+}
+
+func (b *memoryBackend) saveCachedResponse(cacheKey string, cached cachedResponse) {
+	data, err := json.Marshal(cached)
+	if err != nil {
+		log.Printf("Error while caching %s: %v\n", cacheKey, err)
+		return
+	}
+	err = b.store.CacheSet(cacheKey, data, httpCacheKeep)
+	if err != nil {
+		log.Printf("Error while caching %s: %v\n", cacheKey, err)
+	}
+}
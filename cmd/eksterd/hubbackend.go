@@ -18,18 +18,16 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
 	"p83.nl/go/ekster/pkg/util"
 	"p83.nl/go/ekster/pkg/websub"
-
-	"github.com/gomodule/redigo/redis"
 )
 
 // LeaseSeconds is the default number of seconds we want the subscription to last
@@ -48,6 +46,9 @@ type HubBackend interface {
 type hubIncomingBackend struct {
 	backend *memoryBackend
 	baseURL string
+
+	// users receive the updates of the feeds they follow
+	users *userBackends
 }
 
 type Feed struct {
@@ -62,29 +63,38 @@ type Feed struct {
 }
 
 func (h *hubIncomingBackend) GetSecret(id int64) string {
-	conn := pool.Get()
-	defer conn.Close()
-	secret, err := redis.String(conn.Do("HGET", fmt.Sprintf("feed:%d", id), "secret"))
+	feed, err := h.backend.store.HubFeedGet(id)
 	if err != nil {
 		return ""
 	}
-	return secret
+	return feed.Secret
 }
 
+// CreateFeed subscribes to the hub of the topic. The subscription is shared by
+// all channels and users that follow the topic, when it exists its id is
+// returned.
 func (h *hubIncomingBackend) CreateFeed(topic string, channel string) (int64, error) {
-	conn := pool.Get()
-	defer conn.Close()
+	store := h.backend.store
 
-	// TODO(peter): check if topic already is registered
-	id, err := redis.Int64(conn.Do("INCR", "feed:next_id"))
+	feeds, err := store.HubFeeds()
 	if err != nil {
 		return 0, err
 	}
+	for _, feed := range feeds {
+		if feed.URL == topic {
+			return feed.ID, nil
+		}
+	}
 
-	conn.Do("HSET", fmt.Sprintf("feed:%d", id), "url", topic)
-	conn.Do("HSET", fmt.Sprintf("feed:%d", id), "channel", channel)
-	secret := util.RandStringBytes(16)
-	conn.Do("HSET", fmt.Sprintf("feed:%d", id), "secret", secret)
+	feed := Feed{
+		URL:     topic,
+		Channel: channel,
+		Secret:  util.RandStringBytes(16),
+	}
+	id, err := store.HubFeedCreate(&feed)
+	if err != nil {
+		return 0, err
+	}
 
 	client := &http.Client{}
 
@@ -99,46 +109,55 @@ func (h *hubIncomingBackend) CreateFeed(topic string, channel string) (int64, er
 	callbackURL := fmt.Sprintf("%s/incoming/%d", h.baseURL, id)
 
 	if err == nil && hubURL != "" {
-		args := redis.Args{}.Add(fmt.Sprintf("feed:%d", id), "hub", hubURL, "callback", callbackURL)
-		conn.Do("HMSET", args...)
+		feed.Hub = hubURL
+		feed.Callback = callbackURL
+		store.HubFeedSave(feed)
 	} else {
 		return id, nil
 	}
 
-	websub.Subscribe(client, hubURL, topic, callbackURL, secret, 24*3600)
+	websub.Subscribe(client, hubURL, topic, callbackURL, feed.Secret, 24*3600)
 
 	return id, nil
 }
 
+// UpdateFeed adds the items to the channels of all users that follow the feed
 func (h *hubIncomingBackend) UpdateFeed(feedID int64, contentType string, body io.Reader) error {
-	conn := pool.Get()
-	defer conn.Close()
 	log.Printf("updating feed %d", feedID)
-	u, err := redis.String(conn.Do("HGET", fmt.Sprintf("feed:%d", feedID), "url"))
+	feed, err := h.backend.store.HubFeedGet(feedID)
 	if err != nil {
 		return err
 	}
-	channel, err := redis.String(conn.Do("HGET", fmt.Sprintf("feed:%d", feedID), "channel"))
+
+	data, err := ioutil.ReadAll(body)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Updating feed %d - %s %s\n", feedID, u, channel)
-	err = h.backend.ProcessContent(channel, u, contentType, body)
-	if err != nil {
-		log.Printf("Error while updating content for channel %s: %s", channel, err)
+	log.Printf("Updating feed %d - %s\n", feedID, feed.URL)
+	for _, follower := range h.users.followers()[feed.URL] {
+		e := follower.backend.ProcessContent(follower.channel, feed.URL, contentType, bytes.NewReader(data))
+		if e != nil {
+			log.Printf("Error while updating content for channel %s of %s: %s", follower.channel, follower.backend.Me, e)
+			err = e
+		}
 	}
 
 	return err
 }
 
 func (h *hubIncomingBackend) FeedSetLeaseSeconds(feedID int64, leaseSeconds int64) error {
-	conn := pool.Get()
-	defer conn.Close()
 	log.Printf("updating feed %d lease_seconds", feedID)
 
-	args := redis.Args{}.Add(fmt.Sprintf("feed:%d", feedID), "lease_seconds", leaseSeconds, "resubscribe_at", time.Now().Add(time.Duration(60*(leaseSeconds-15))*time.Second).Unix())
-	_, err := conn.Do("HMSET", args...)
+	feed, err := h.backend.store.HubFeedGet(feedID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	feed.LeaseSeconds = leaseSeconds
+	feed.ResubscribeAt = time.Now().Add(time.Duration(60*(leaseSeconds-15)) * time.Second).Unix()
+
+	err = h.backend.store.HubFeedSave(feed)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -148,39 +167,15 @@ func (h *hubIncomingBackend) FeedSetLeaseSeconds(feedID int64, leaseSeconds int6
 }
 
 func (h *hubIncomingBackend) GetFeeds() []Feed {
-	conn := pool.Get()
-	defer conn.Close()
 	feeds := []Feed{}
 
-	// FIXME(peter): replace with set of currently checked feeds
-	feedKeys, err := redis.Strings(conn.Do("KEYS", "feed:*"))
+	allFeeds, err := h.backend.store.HubFeeds()
 	if err != nil {
 		log.Println(err)
 		return feeds
 	}
 
-	for _, feedKey := range feedKeys {
-		var feed Feed
-		values, err := redis.Values(conn.Do("HGETALL", feedKey))
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		err = redis.ScanStruct(values, &feed)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		if feed.ID == 0 {
-			parts := strings.Split(feedKey, ":")
-			if len(parts) == 2 {
-				feed.ID, _ = strconv.ParseInt(parts[1], 10, 64)
-				conn.Do("HPUT", feedKey, "id", feed.ID)
-			}
-		}
-
+	for _, feed := range allFeeds {
 		// Skip feeds without a Hub
 		if feed.Hub == "" {
 			continue
@@ -23,9 +23,7 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"time"
 
-	"github.com/gomodule/redigo/redis"
 	"p83.nl/go/ekster/pkg/auth"
 
 	"p83.nl/go/ekster/pkg/server"
@@ -42,25 +40,20 @@ type AppOptions struct {
 	RedisServer string
 	BaseURL     string
 	TemplateDir string
+	Storage     string
+	Database    string
+	MediaDir    string
 }
 
-var (
-	pool *redis.Pool
-)
-
 func init() {
 	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime)
 }
 
-func newPool(addr string) *redis.Pool {
-	return &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
-	}
-}
-
-func WithAuth(handler http.Handler, b *memoryBackend) http.Handler {
+// WithAuth only lets requests through with a token of one of the users that has
+// the scope for the action, the user is added to the request for handler. The
+// "me" parameter of the endpoint tells which user the token is for, the owner
+// when it's missing.
+func WithAuth(handler http.Handler, users *userBackends) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodOptions {
 			handler.ServeHTTP(w, r)
@@ -71,54 +64,80 @@ func WithAuth(handler http.Handler, b *memoryBackend) http.Handler {
 
 		var token auth.TokenResponse
 
-		if !b.AuthTokenAccepted(authorization, &token) {
+		if !users.authTokenAccepted(authorization, r.URL.Query().Get("me"), &token) {
 			log.Printf("Token could not be validated")
 			http.Error(w, "Can't validate token", 403)
 			return
 		}
 
-		if token.Me != b.Me {
-			log.Printf("Missing \"me\" in token response: %#v\n", token)
+		b, ok := users.backend(token.Me)
+		if !ok {
+			log.Printf("Unknown \"me\" in token response: %#v\n", token)
 			http.Error(w, "Wrong me", 403)
 			return
 		}
 
-		handler.ServeHTTP(w, r)
+		scope, ok := server.RequiredScope(r)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown action %s\n", server.RequestAction(r)), 400)
+			return
+		}
+		if scope != "" && !token.HasScope(scope) {
+			log.Printf("Token without scope %q: %q\n", scope, token.Scope)
+			server.RespondInsufficientScope(w, scope)
+			return
+		}
+
+		handler.ServeHTTP(w, withUser(r, b))
 	})
 }
 
 type App struct {
 	options    AppOptions
-	backend    *memoryBackend
+	users      *userBackends
 	hubBackend *hubIncomingBackend
+	webmention *webmentionHandler
 }
 
 func (app *App) Run() {
-	app.backend.run()
+	app.users.run()
 	app.hubBackend.run()
+	app.webmention.run()
 
 	log.Printf("Listening on port %d\n", app.options.Port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", app.options.Port), nil))
 
 }
 
-func NewApp(options AppOptions) *App {
+func NewApp(options AppOptions, store Storage) *App {
 	app := &App{
 		options: options,
 	}
 
-	app.backend = loadMemoryBackend()
-	app.backend.AuthEnabled = options.AuthEnabled
+	users, err := loadUserBackends(store, options.BaseURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	users.AuthEnabled = options.AuthEnabled
+	app.users = users
 
-	app.hubBackend = &hubIncomingBackend{app.backend, options.BaseURL}
+	app.hubBackend = &hubIncomingBackend{backend: users.owner, baseURL: options.BaseURL, users: users}
 
-	http.Handle("/micropub", &micropubHandler{
-		Backend: app.backend,
-	})
+	micropub := &micropubHandler{
+		Users:    users,
+		BaseURL:  options.BaseURL,
+		MediaDir: options.MediaDir,
+	}
+	http.Handle("/micropub", micropub)
+	http.Handle(sourceItemsPath, micropub)
+	http.Handle("/media/", &mediaHandler{Dir: options.MediaDir})
+
+	app.webmention = newWebmentionHandler(users)
+	http.Handle("/webmention", app.webmention)
 
-	handler := server.NewMicrosubHandler(app.backend)
+	var handler http.Handler = users
 	if options.AuthEnabled {
-		handler = WithAuth(handler, app.backend)
+		handler = WithAuth(handler, users)
 	}
 
 	http.Handle("/microsub", handler)
@@ -128,7 +147,7 @@ func NewApp(options AppOptions) *App {
 	})
 
 	if !options.Headless {
-		handler, err := newMainHandler(app.backend, options.BaseURL, options.TemplateDir)
+		handler, err := newMainHandler(users, options.BaseURL, options.TemplateDir)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -149,6 +168,9 @@ func main() {
 	flag.StringVar(&options.RedisServer, "redis", "redis:6379", "redis server")
 	flag.StringVar(&options.BaseURL, "baseurl", "", "http server baseurl")
 	flag.StringVar(&options.TemplateDir, "templates", "./templates", "template directory")
+	flag.StringVar(&options.Storage, "storage", "redis", "storage backend (redis or bolt)")
+	flag.StringVar(&options.Database, "db", "ekster.db", "database file for the bolt storage")
+	flag.StringVar(&options.MediaDir, "media", "media", "directory for the files uploaded to the micropub endpoint")
 
 	flag.Parse()
 
@@ -194,7 +216,11 @@ func main() {
 		return
 	}
 
-	pool = newPool(options.RedisServer)
+	store, err := newStorage(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
 
-	NewApp(options).Run()
+	NewApp(options, store).Run()
 }
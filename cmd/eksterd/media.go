@@ -0,0 +1,147 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxMediaMemory is the part of a multipart request that is kept in memory,
+// the rest of the files is saved to temporary files
+const maxMediaMemory = 32 << 20
+
+// maxMicropubRequest is the largest micropub request with all its uploaded
+// files, larger requests are refused
+var maxMicropubRequest int64 = 64 << 20
+
+// mediaTypes are the content types of the extensions that are kept for
+// uploaded files, only images, audio and video are served inline
+var mediaTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/opus",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+}
+
+// upload is an uploaded file that is saved as name
+type upload struct {
+	name string
+	fh   *multipart.FileHeader
+}
+
+// mediaName returns the name of the uploaded file, the name is based on the
+// contents, so the same file is saved once
+func mediaName(fh *multipart.FileHeader) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%x", h.Sum(nil))
+	if ext := strings.ToLower(filepath.Ext(fh.Filename)); mediaTypes[ext] != "" {
+		name += ext
+	}
+	return name, nil
+}
+
+// saveMedia saves the uploaded file in dir, the file is written to a
+// temporary file first, so a file with the name is always complete
+func saveMedia(dir string, u upload) error {
+	f, err := u.fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, f)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, u.name))
+}
+
+// mediaHandler serves the files that were uploaded to the micropub endpoint.
+// The content type follows from the extension and is never sniffed, other
+// files are only served as downloads.
+type mediaHandler struct {
+	Dir string
+}
+
+func (h *mediaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/media/")
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if contentType, ok := mediaTypes[filepath.Ext(name)]; ok {
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	http.ServeFile(w, r, filepath.Join(h.Dir, name))
+}
@@ -18,7 +18,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -26,18 +25,15 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
-	"p83.nl/go/ekster/pkg/auth"
 	"p83.nl/go/ekster/pkg/fetch"
 	"p83.nl/go/ekster/pkg/microsub"
 	"p83.nl/go/ekster/pkg/util"
 
-	"github.com/gomodule/redigo/redis"
 	"willnorris.com/go/microformats"
 )
 
@@ -50,21 +46,47 @@ type memoryBackend struct {
 	Channels map[string]microsub.Channel
 	Feeds    map[string][]microsub.Feed
 	Settings map[string]channelSetting
+	Muted    map[string][]string
+	Blocked  map[string][]string
 	NextUid  int
 
+	// ChannelsOrdered is set when the channels were ordered by the user,
+	// ChannelsGetList then doesn't move channels with unread items up
+	ChannelsOrdered bool
+
 	Me            string
 	TokenEndpoint string
-	AuthEnabled   bool
+
+	// WebmentionChannel is the channel for the webmentions of the user, the
+	// webmentions go to notifications when it's empty
+	WebmentionChannel string `json:",omitempty"`
+
+	// Users are the other users of the server, they are only read from the
+	// backend.json of the owner
+	Users []userConfig `json:",omitempty"`
 
 	ticker *time.Ticker
 	quit   chan struct{}
 
-	listeners []microsub.EventListener
+	listenersLock sync.RWMutex
+	listeners     []microsub.EventListener
+
+	// statusLock serializes the updates of the feed status
+	statusLock sync.Mutex
+
+	// sourcesLock protects sourceRates, the rate limit counts of the sources
+	sourcesLock sync.Mutex
+	sourceRates map[string]*sourceRate
+
+	store Storage
 }
 
 type channelSetting struct {
 	ExcludeRegex string
 	IncludeRegex string
+	ChannelType  string
+	CappedSize   int
+	Retention    retentionPolicy
 }
 
 type Debug interface {
@@ -75,6 +97,7 @@ type redisItem struct {
 	ID        string
 	Published string
 	Read      bool
+	Hash      string
 	Data      []byte
 }
 
@@ -84,16 +107,12 @@ func (ri *redisItem) Item() microsub.Item {
 	return item
 }
 
-type fetch2 struct{}
-
-func (f *fetch2) Fetch(url string) (*http.Response, error) {
-	return Fetch2(url)
+type fetch2 struct {
+	backend *memoryBackend
 }
 
-func (b *memoryBackend) AuthTokenAccepted(header string, r *auth.TokenResponse) bool {
-	conn := pool.Get()
-	defer conn.Close()
-	return b.cachedCheckAuthToken(conn, header, r)
+func (f *fetch2) Fetch(url string) (*http.Response, error) {
+	return f.backend.Fetch2(url)
 }
 
 func (b *memoryBackend) Debug() {
@@ -105,94 +124,62 @@ func (b *memoryBackend) Debug() {
 }
 
 func (b *memoryBackend) load() error {
-	filename := "backend.json"
-	f, err := os.Open(filename)
-	if err != nil {
-		panic("cant open backend.json")
-	}
-	defer f.Close()
-	jw := json.NewDecoder(f)
-	err = jw.Decode(b)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return b.store.LoadBackend(b)
 }
 
 func (b *memoryBackend) refreshChannels() {
-	conn := pool.Get()
-	defer conn.Close()
-
-	conn.Do("DEL", "channels")
+	err := b.store.ChannelsReset()
+	if err != nil {
+		log.Printf("Error while resetting channels: %v\n", err)
+	}
 
-	updateChannelInRedis(conn, "notifications", 1)
+	b.updateChannelInStore("notifications", 1)
 
 	b.lock.RLock()
 	for uid, channel := range b.Channels {
 		log.Printf("loading channel %s - %s\n", uid, channel.Name)
-		updateChannelInRedis(conn, channel.UID, DefaultPrio)
+		b.updateChannelInStore(channel.UID, DefaultPrio)
 	}
 
 	b.lock.RUnlock()
 }
 
 func (b *memoryBackend) save() {
-	filename := "backend.json"
-	f, _ := os.Create(filename)
-	defer f.Close()
-	jw := json.NewEncoder(f)
-	jw.SetIndent("", "    ")
-	b.lock.RLock()
-	defer b.lock.RUnlock()
-	jw.Encode(b)
+	err := b.store.SaveBackend(b)
+	if err != nil {
+		log.Printf("Error while saving backend: %v\n", err)
+	}
 }
 
-func loadMemoryBackend() *memoryBackend {
-	backend := &memoryBackend{}
+func loadMemoryBackend(store Storage) (*memoryBackend, error) {
+	backend := &memoryBackend{store: store}
 	err := backend.load()
 	if err != nil {
-		log.Printf("Error while loadingbackend: %v\n", err)
-		return nil
+		return nil, fmt.Errorf("while loading backend: %v", err)
 	}
 	backend.refreshChannels()
 
-	return backend
+	return backend, nil
 }
 
 func createMemoryBackend() {
 	backend := memoryBackend{}
-	backend.lock.Lock()
-
-	backend.Feeds = make(map[string][]microsub.Feed)
-	channels := []microsub.Channel{
-		{UID: "notifications", Name: "Notifications"},
-		{UID: "home", Name: "Home"},
-	}
-
-	backend.Channels = make(map[string]microsub.Channel)
-	for _, c := range channels {
-		backend.Channels[c.UID] = c
-	}
-
-	backend.NextUid = 1000000
+	backend.setState(defaultState())
 	backend.Me = "https://example.com/"
 
-	backend.lock.Unlock()
-
-	backend.save()
+	err := saveBackendFile(&backend)
+	if err != nil {
+		log.Printf("Error while saving backend: %v\n", err)
+	}
 }
 
 // ChannelsGetList gets channels
 func (b *memoryBackend) ChannelsGetList() ([]microsub.Channel, error) {
-	conn := pool.Get()
-	defer conn.Close()
-
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 
 	var channels []microsub.Channel
-	uids, err := redis.Strings(conn.Do("SORT", "channels", "BY", "channel_sortorder_*", "ASC"))
+	uids, err := b.store.ChannelsSorted()
 	if err != nil {
 		log.Printf("Sorting channels failed: %v\n", err)
 		for _, v := range b.Channels {
@@ -205,13 +192,60 @@ func (b *memoryBackend) ChannelsGetList() ([]microsub.Channel, error) {
 			}
 		}
 	}
-	util.StablePartition(channels, 0, len(channels), func(i int) bool {
-		return channels[i].Unread > 0
-	})
+	for i, c := range channels {
+		channels[i] = b.withTimelineType(c)
+	}
+	if !b.ChannelsOrdered {
+		util.StablePartition(channels, 0, len(channels), func(i int) bool {
+			return channels[i].Unread > 0
+		})
+	}
 
 	return channels, nil
 }
 
+// ChannelsOrder sorts the channels in the order of uids. The notifications
+// channel stays first, channels missing from uids are placed after the others.
+func (b *memoryBackend) ChannelsOrder(uids []string) error {
+	b.lock.RLock()
+	for _, uid := range uids {
+		if _, e := b.Channels[uid]; !e {
+			b.lock.RUnlock()
+			return fmt.Errorf("channel %s does not exist", uid)
+		}
+	}
+	b.lock.RUnlock()
+
+	current, err := b.store.ChannelsSorted()
+	if err != nil {
+		return fmt.Errorf("while sorting channels: %v", err)
+	}
+
+	order := []string{"notifications"}
+	seen := map[string]bool{"notifications": true}
+	for _, list := range [][]string{uids, current} {
+		for _, uid := range list {
+			if !seen[uid] {
+				seen[uid] = true
+				order = append(order, uid)
+			}
+		}
+	}
+
+	err = b.store.ChannelsOrder(order)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	b.ChannelsOrdered = true
+	b.lock.Unlock()
+
+	b.save()
+
+	return nil
+}
+
 // ChannelsCreate creates a channels
 func (b *memoryBackend) ChannelsCreate(name string) (microsub.Channel, error) {
 	defer b.save()
@@ -219,10 +253,9 @@ func (b *memoryBackend) ChannelsCreate(name string) (microsub.Channel, error) {
 	channel := b.createChannel(name)
 	b.setChannel(channel)
 
-	conn := pool.Get()
-	defer conn.Close()
+	b.updateChannelInStore(channel.UID, DefaultPrio)
 
-	updateChannelInRedis(conn, channel.UID, DefaultPrio)
+	b.sendEvent(microsub.Event{Type: microsub.EventChannelCreated, Channel: &channel})
 
 	return channel, nil
 }
@@ -231,9 +264,6 @@ func (b *memoryBackend) ChannelsCreate(name string) (microsub.Channel, error) {
 func (b *memoryBackend) ChannelsUpdate(uid, name string) (microsub.Channel, error) {
 	defer b.save()
 
-	b.lock.RLock()
-	defer b.lock.RUnlock()
-
 	b.lock.RLock()
 	c, e := b.Channels[uid]
 	b.lock.RUnlock()
@@ -245,26 +275,126 @@ func (b *memoryBackend) ChannelsUpdate(uid, name string) (microsub.Channel, erro
 		b.Channels[uid] = c
 		b.lock.Unlock()
 
+		b.sendEvent(microsub.Event{Type: microsub.EventChannelUpdated, Channel: &c})
+
 		return c, nil
 	}
 
 	return microsub.Channel{}, fmt.Errorf("channel %s does not exist", uid)
 }
 
+// ChannelsSetType changes the timeline type of a channel, the items of the
+// channel are moved to the new timeline
+func (b *memoryBackend) ChannelsSetType(uid, timelineType string, size int) (microsub.Channel, error) {
+	if !isValidTimelineType(timelineType) {
+		return microsub.Channel{}, fmt.Errorf("unknown timeline type %q, use sorted-set, stream or capped", timelineType)
+	}
+
+	b.lock.RLock()
+	_, e := b.Channels[uid]
+	b.lock.RUnlock()
+
+	if !e {
+		return microsub.Channel{}, fmt.Errorf("channel %s does not exist", uid)
+	}
+
+	err := b.setTimelineType(uid, timelineType, size)
+	if err != nil {
+		return microsub.Channel{}, err
+	}
+
+	b.lock.RLock()
+	channel := b.withTimelineType(b.Channels[uid])
+	b.lock.RUnlock()
+
+	b.sendEvent(microsub.Event{Type: microsub.EventChannelUpdated, Channel: &channel})
+
+	return channel, nil
+}
+
+func (b *memoryBackend) setTimelineType(uid, timelineType string, size int) error {
+	oldType, _ := b.channelTimelineType(uid)
+	from := b.getTimeline(uid)
+
+	b.lock.Lock()
+	if b.Settings == nil {
+		b.Settings = make(map[string]channelSetting)
+	}
+	setting := b.Settings[uid]
+	setting.ChannelType = timelineType
+	if size > 0 {
+		setting.CappedSize = size
+	}
+	b.Settings[uid] = setting
+	b.lock.Unlock()
+
+	b.save()
+
+	if oldType == timelineType {
+		return nil
+	}
+
+	to := b.getTimeline(uid)
+	if from == nil || to == nil {
+		return fmt.Errorf("can't migrate channel %s from %s to %s", uid, oldType, timelineType)
+	}
+
+	log.Printf("Migrating channel %s from %s to %s\n", uid, oldType, timelineType)
+	err := migrateTimeline(from, to)
+	if err != nil {
+		return fmt.Errorf("while migrating channel %s: %v", uid, err)
+	}
+
+	return b.updateChannelUnreadCount(uid)
+}
+
+// getSetting returns the setting of the channel
+func (b *memoryBackend) getSetting(uid string) channelSetting {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.Settings[uid]
+}
+
+// setFilters sets the regexes and the retention policy of the channel
+func (b *memoryBackend) setFilters(uid, excludeRegex, includeRegex string, retention retentionPolicy) {
+	b.lock.Lock()
+	if b.Settings == nil {
+		b.Settings = make(map[string]channelSetting)
+	}
+	setting := b.Settings[uid]
+	setting.ExcludeRegex = excludeRegex
+	setting.IncludeRegex = includeRegex
+	setting.Retention = retention
+	b.Settings[uid] = setting
+	b.lock.Unlock()
+
+	b.save()
+}
+
+// withTimelineType adds the timeline type to the channel, b.lock should be held
+func (b *memoryBackend) withTimelineType(c microsub.Channel) microsub.Channel {
+	timelineType, size := timelineTypeFromSetting(c.UID, b.Settings[c.UID])
+	c.TimelineType = timelineType
+	if timelineType == timelineTypeCapped {
+		c.TimelineSize = size
+	}
+	return c
+}
+
 // ChannelsDelete deletes a channel
 func (b *memoryBackend) ChannelsDelete(uid string) error {
 	defer b.save()
 
-	conn := pool.Get()
-	defer conn.Close()
-
-	removeChannelFromRedis(conn, uid)
+	b.removeChannelFromStore(uid)
+	b.clearChannelItems(uid)
 
 	b.lock.Lock()
 	delete(b.Channels, uid)
 	delete(b.Feeds, uid)
 	b.lock.Unlock()
 
+	b.sendEvent(microsub.Event{Type: microsub.EventChannelDeleted, Channel: &microsub.Channel{UID: uid}})
+
 	return nil
 }
 
@@ -280,35 +410,17 @@ func (b *memoryBackend) getFeeds() map[string][]string {
 	return feeds
 }
 
+// run applies the retention policies of the channels every hour, the feeds
+// are fetched by the scheduler of userBackends
 func (b *memoryBackend) run() {
-	b.ticker = time.NewTicker(10 * time.Minute)
+	b.ticker = time.NewTicker(time.Hour)
 	b.quit = make(chan struct{})
 
 	go func() {
 		for {
 			select {
 			case <-b.ticker.C:
-				feeds := b.getFeeds()
-
-				for uid := range feeds {
-					for _, feedURL := range feeds[uid] {
-						resp, err := b.Fetch3(uid, feedURL)
-						if err != nil {
-							_ = b.channelAddItem("notifications", microsub.Item{
-								Type: "entry",
-								Name: fmt.Sprintf("Error while Fetch3 of %s: %v", feedURL, err),
-								Content: &microsub.Content{
-									Text: "error while fetching feed",
-								},
-								UID: time.Now().String(),
-							})
-							log.Printf("Error while Fetch3 of %s: %v\n", feedURL, err)
-							continue
-						}
-						_ = b.ProcessContent(uid, feedURL, resp.Header.Get("Content-Type"), resp.Body)
-						_ = resp.Body.Close()
-					}
-				}
+				b.applyRetention()
 
 			case <-b.quit:
 				b.ticker.Stop()
@@ -319,23 +431,60 @@ func (b *memoryBackend) run() {
 }
 
 func (b *memoryBackend) TimelineGet(before, after, channel string) (microsub.Timeline, error) {
-	log.Printf("TimelineGet %s\n", channel)
+	return b.TimelineGetQuery(channel, microsub.TimelineQuery{Before: before, After: after})
+}
 
-	// Check if feed exists
-	_, err := b.FollowGetList(channel)
-	if err != nil {
-		return microsub.Timeline{Items: []microsub.Item{}}, err
-	}
+// TimelineGetQuery returns a page of the items in channel that match the query
+func (b *memoryBackend) TimelineGetQuery(channel string, query microsub.TimelineQuery) (microsub.Timeline, error) {
+	log.Printf("TimelineGet %s\n", channel)
 
 	timelineBackend := b.getTimeline(channel)
 
-	return timelineBackend.Items(before, after)
+	// the items of muted and blocked authors are skipped while the page is
+	// read, so the page is filled with other items
+	query.Hide = b.hiddenAuthors(channel)
+
+	return timelineBackend.Items(query)
 }
 
+// FollowGetList returns the feeds of the channel with their fetch status
 func (b *memoryBackend) FollowGetList(uid string) ([]microsub.Feed, error) {
+	return b.followList(uid, b.activeWebSubFeeds()), nil
+}
+
+// followList returns copies of the feeds of the channel with the status set,
+// websub contains the feeds with an active WebSub subscription
+func (b *memoryBackend) followList(uid string, websub map[string]bool) []microsub.Feed {
 	b.lock.RLock()
-	defer b.lock.RUnlock()
-	return b.Feeds[uid], nil
+	feeds := append([]microsub.Feed{}, b.Feeds[uid]...)
+	b.lock.RUnlock()
+
+	for i, feed := range feeds {
+		var status feedStatus
+		if err := b.store.FeedStatusLoad(uid, feed.URL, &status); err != nil {
+			log.Printf("Error while loading status of %s: %v\n", feed.URL, err)
+		}
+		feeds[i].Status = status.microsubStatus(websub[feed.URL])
+	}
+	return feeds
+}
+
+// followedFeeds returns the feeds of all channels with their fetch status
+func (b *memoryBackend) followedFeeds() ([]followedFeed, error) {
+	channels, err := b.ChannelsGetList()
+	if err != nil {
+		return nil, err
+	}
+
+	websub := b.activeWebSubFeeds()
+
+	var feeds []followedFeed
+	for _, channel := range channels {
+		for _, feed := range b.followList(channel.UID, websub) {
+			feeds = append(feeds, followedFeed{Channel: channel, Feed: feed})
+		}
+	}
+	return feeds, nil
 }
 
 func (b *memoryBackend) FollowURL(uid string, url string) (microsub.Feed, error) {
@@ -344,14 +493,8 @@ func (b *memoryBackend) FollowURL(uid string, url string) (microsub.Feed, error)
 
 	resp, err := b.Fetch3(uid, feed.URL)
 	if err != nil {
-		_ = b.channelAddItem("notifications", microsub.Item{
-			Type: "entry",
-			Name: fmt.Sprintf("Error while Fetch3 of %s: %v", feed.URL, err),
-			Content: &microsub.Content{
-				Text: "error while fetching feed",
-			},
-			UID: time.Now().String(),
-		})
+		// the feed isn't followed, so it has no status
+		b.sendFetchError(uid, feed.URL, err)
 		return feed, err
 	}
 	defer resp.Body.Close()
@@ -360,6 +503,16 @@ func (b *memoryBackend) FollowURL(uid string, url string) (microsub.Feed, error)
 	b.Feeds[uid] = append(b.Feeds[uid], feed)
 	b.lock.Unlock()
 
+	var statusErr error
+	if resp.StatusCode >= 400 {
+		statusErr = fmt.Errorf("status %d", resp.StatusCode)
+	}
+	b.updateFeedStatus(uid, feed.URL, func(status *feedStatus) {
+		status.fetched(resp.StatusCode, statusErr, time.Now())
+	})
+
+	b.sendEvent(microsub.Event{Type: microsub.EventFollowAdded, Channel: &microsub.Channel{UID: uid}, Feed: &feed})
+
 	_ = b.ProcessContent(uid, feed.URL, resp.Header.Get("Content-Type"), resp.Body)
 
 	_, _ = b.CreateFeed(url, uid)
@@ -383,6 +536,13 @@ func (b *memoryBackend) UnfollowURL(uid string, url string) error {
 	}
 	b.lock.Unlock()
 
+	if index >= 0 {
+		if err := b.store.FeedStatusDelete(uid, url); err != nil {
+			log.Printf("Error while removing status of %s: %v\n", url, err)
+		}
+		b.sendEvent(microsub.Event{Type: microsub.EventFollowRemoved, Channel: &microsub.Channel{UID: uid}, Feed: &microsub.Feed{Type: "feed", URL: url}})
+	}
+
 	return nil
 }
 
@@ -430,7 +590,7 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 
 	for _, u := range urls {
 		log.Println(u)
-		resp, err := Fetch2(u)
+		resp, err := b.Fetch2(u)
 		if err != nil {
 			log.Printf("Error while fetching %s: %v\n", u, err)
 			continue
@@ -444,7 +604,7 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 			continue
 		}
 
-		feedResp, err := Fetch2(fetchUrl.String())
+		feedResp, err := b.Fetch2(fetchUrl.String())
 		if err != nil {
 			log.Printf("Error in fetch of %s - %v\n", fetchUrl, err)
 			continue
@@ -452,7 +612,7 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 		defer feedResp.Body.Close()
 
 		// TODO: Combine FeedHeader and FeedItems so we can use it here
-		parsedFeed, err := fetch.FeedHeader(&fetch2{}, fetchUrl.String(), feedResp.Header.Get("Content-Type"), feedResp.Body)
+		parsedFeed, err := fetch.FeedHeader(&fetch2{b}, fetchUrl.String(), feedResp.Header.Get("Content-Type"), feedResp.Body)
 		if err != nil {
 			log.Printf("Error in parse of %s - %v\n", fetchUrl, err)
 			continue
@@ -467,7 +627,7 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 				log.Printf("alternate found with type %s %#v\n", relURL.Type, relURL)
 
 				if strings.HasPrefix(relURL.Type, "text/html") || strings.HasPrefix(relURL.Type, "application/json") || strings.HasPrefix(relURL.Type, "application/xml") || strings.HasPrefix(relURL.Type, "text/xml") || strings.HasPrefix(relURL.Type, "application/rss+xml") || strings.HasPrefix(relURL.Type, "application/atom+xml") {
-					feedResp, err := Fetch2(alt)
+					feedResp, err := b.Fetch2(alt)
 					if err != nil {
 						log.Printf("Error in fetch of %s - %v\n", alt, err)
 						continue
@@ -475,7 +635,7 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 					// FIXME: don't defer in for loop (possible memory leak)
 					defer feedResp.Body.Close()
 
-					parsedFeed, err := fetch.FeedHeader(&fetch2{}, alt, feedResp.Header.Get("Content-Type"), feedResp.Body)
+					parsedFeed, err := fetch.FeedHeader(&fetch2{b}, alt, feedResp.Header.Get("Content-Type"), feedResp.Body)
 					if err != nil {
 						log.Printf("Error in parse of %s - %v\n", alt, err)
 						continue
@@ -491,12 +651,12 @@ func (b *memoryBackend) Search(query string) ([]microsub.Feed, error) {
 }
 
 func (b *memoryBackend) PreviewURL(previewURL string) (microsub.Timeline, error) {
-	resp, err := Fetch2(previewURL)
+	resp, err := b.Fetch2(previewURL)
 	if err != nil {
 		return microsub.Timeline{}, fmt.Errorf("error while fetching %s: %v", previewURL, err)
 	}
 	defer resp.Body.Close()
-	items, err := fetch.FeedItems(&fetch2{}, previewURL, resp.Header.Get("content-type"), resp.Body)
+	items, err := fetch.FeedItems(&fetch2{b}, previewURL, resp.Header.Get("content-type"), resp.Body)
 	if err != nil {
 		return microsub.Timeline{}, fmt.Errorf("error while fetching %s: %v", previewURL, err)
 	}
@@ -522,23 +682,113 @@ func (b *memoryBackend) MarkRead(channel string, uids []string) error {
 	return nil
 }
 
-func (b *memoryBackend) ProcessContent(channel, fetchURL, contentType string, body io.Reader) error {
-	conn := pool.Get()
-	defer conn.Close()
+func (b *memoryBackend) MarkUnread(channel string, uids []string) error {
+	timeline := b.getTimeline(channel)
+	err := timeline.MarkUnread(uids)
 
-	items, err := fetch.FeedItems(&fetch2{}, fetchURL, contentType, body)
 	if err != nil {
 		return err
 	}
 
+	return b.updateChannelUnreadCount(channel)
+}
+
+// MarkReadUpTo marks lastReadEntry and all entries before it as read
+func (b *memoryBackend) MarkReadUpTo(channel string, lastReadEntry string) error {
+	timeline := b.getTimeline(channel)
+	err := timeline.MarkReadUpTo(lastReadEntry)
+
+	if err != nil {
+		return err
+	}
+
+	return b.updateChannelUnreadCount(channel)
+}
+
+// MarkAllRead marks all entries in the channel as read
+func (b *memoryBackend) MarkAllRead(channel string) error {
+	timeline := b.getTimeline(channel)
+	err := timeline.MarkAllRead()
+
+	if err != nil {
+		return err
+	}
+
+	return b.updateChannelUnreadCount(channel)
+}
+
+// RemoveItems removes the entries from the channel
+func (b *memoryBackend) RemoveItems(channel string, uids []string) error {
+	timeline := b.getTimeline(channel)
+	err := timeline.Remove(uids)
+
+	if err != nil {
+		return err
+	}
+
+	return b.updateChannelUnreadCount(channel)
+}
+
+// applyRetention removes the items that fall outside the retention policy of
+// their channel
+func (b *memoryBackend) applyRetention() {
+	policies := make(map[string]retentionPolicy)
+	b.lock.RLock()
+	for uid := range b.Channels {
+		if policy := b.Settings[uid].Retention; policy.enabled() {
+			policies[uid] = policy
+		}
+	}
+	b.lock.RUnlock()
+
+	for uid, policy := range policies {
+		timeline := b.getTimeline(uid)
+		if timeline == nil {
+			continue
+		}
+
+		removed, err := pruneTimeline(timeline, policy, time.Now())
+		if err != nil {
+			log.Printf("Error while applying retention to channel %s: %v\n", uid, err)
+			continue
+		}
+		if removed == 0 {
+			continue
+		}
+
+		log.Printf("Removed %d items from channel %s\n", removed, uid)
+		err = b.updateChannelUnreadCount(uid)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (b *memoryBackend) ProcessContent(channel, fetchURL, contentType string, body io.Reader) error {
+	items, err := fetch.FeedItems(&fetch2{b}, fetchURL, contentType, body)
+	if err != nil {
+		return err
+	}
+
+	added := 0
 	for _, item := range items {
 		item.Read = false
-		err = b.channelAddItemWithMatcher(channel, item)
+		if item.Source == nil {
+			item.Source = &microsub.Source{URL: fetchURL}
+		}
+		isNew, err := b.channelAddItemWithMatcher(channel, item)
 		if err != nil {
 			log.Printf("ERROR: %s\n", err)
 		}
+		if isNew {
+			added++
+		}
 	}
 
+	b.updateFeedStatus(channel, fetchURL, func(status *feedStatus) {
+		status.processed(len(items), added, time.Now())
+	})
+
 	err = b.updateChannelUnreadCount(channel)
 	if err != nil {
 		return err
@@ -550,10 +800,13 @@ func (b *memoryBackend) ProcessContent(channel, fetchURL, contentType string, bo
 // Fetch3 fills stuff
 func (b *memoryBackend) Fetch3(channel, fetchURL string) (*http.Response, error) {
 	log.Printf("Fetching channel=%s fetchURL=%s\n", channel, fetchURL)
-	return Fetch2(fetchURL)
+	return b.Fetch2(fetchURL)
 }
 
-func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.Item) error {
+// channelAddItemWithMatcher adds the item to the channel and to the channels
+// with a matching include regex, it reports whether the item is new in the
+// channel
+func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.Item) (bool, error) {
 	// an item is posted
 	// check for all channels as channel
 	// if regex matches item
@@ -562,7 +815,10 @@ func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.
 	var updatedChannels []string
 
 	b.lock.RLock()
-	settings := b.Settings
+	settings := make(map[string]channelSetting, len(b.Settings))
+	for k, v := range b.Settings {
+		settings[k] = v
+	}
 	b.lock.RUnlock()
 
 	for channelKey, setting := range settings {
@@ -570,12 +826,15 @@ func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.
 			re, err := regexp.Compile(setting.IncludeRegex)
 			if err != nil {
 				log.Printf("error in regexp: %q, %s\n", setting.IncludeRegex, err)
-				return nil
+				return false, nil
 			}
 
 			if matchItem(item, re) {
+				if b.isHiddenAuthor(channelKey, item) {
+					continue
+				}
 				log.Printf("Included %#v\n", item)
-				err := b.channelAddItem(channelKey, item)
+				_, err := b.channelAddItem(channelKey, item)
 				if err != nil {
 					continue
 				}
@@ -593,6 +852,12 @@ func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.
 		}
 	}
 
+	// Skip items from muted and blocked authors
+	if b.isHiddenAuthor(channel, item) {
+		log.Printf("Skipped item from muted or blocked author %#v\n", item.Author)
+		return false, nil
+	}
+
 	// Check for the exclude regex
 	b.lock.RLock()
 	setting, exists := b.Settings[channel]
@@ -602,17 +867,54 @@ func (b *memoryBackend) channelAddItemWithMatcher(channel string, item microsub.
 		excludeRegex, err := regexp.Compile(setting.ExcludeRegex)
 		if err != nil {
 			log.Printf("error in regexp: %q\n", excludeRegex)
-			return nil
+			return false, nil
 		}
 		if matchItem(item, excludeRegex) {
 			log.Printf("Excluded %#v\n", item)
-			return nil
+			return false, nil
 		}
 	}
 
 	return b.channelAddItem(channel, item)
 }
 
+// isHiddenAuthor returns true when the author of item is muted or blocked in
+// channel or in all channels
+func (b *memoryBackend) isHiddenAuthor(channel string, item microsub.Item) bool {
+	return b.hiddenAuthors(channel)(item)
+}
+
+// hiddenAuthors returns a function that reports whether the author of an item
+// is muted or blocked in channel or in all channels. Mutes and blocks without
+// a channel are for all channels.
+func (b *memoryBackend) hiddenAuthors(channel string) func(item microsub.Item) bool {
+	b.lock.RLock()
+	var urls []string
+	urls = append(urls, b.Muted[channel]...)
+	urls = append(urls, b.Blocked[channel]...)
+	if channel != "" {
+		urls = append(urls, b.Muted[""]...)
+		urls = append(urls, b.Blocked[""]...)
+	}
+	b.lock.RUnlock()
+
+	return func(item microsub.Item) bool {
+		if item.Author == nil || item.Author.URL == "" {
+			return false
+		}
+		for _, u := range urls {
+			if sameURL(u, item.Author.URL) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func sameURL(a, b string) bool {
+	return strings.TrimRight(a, "/") == strings.TrimRight(b, "/")
+}
+
 func matchItem(item microsub.Item, re *regexp.Regexp) bool {
 	if matchItemText(item, re) {
 		return true
@@ -639,9 +941,17 @@ func matchItemText(item microsub.Item, re *regexp.Regexp) bool {
 	return re.MatchString(item.Name)
 }
 
-func (b *memoryBackend) channelAddItem(channel string, item microsub.Item) error {
+// channelAddItem adds the item to the channel, it reports whether the item is new
+func (b *memoryBackend) channelAddItem(channel string, item microsub.Item) (bool, error) {
 	timelineBackend := b.getTimeline(channel)
-	return timelineBackend.AddItem(item)
+	added, err := timelineBackend.AddItem(item)
+	if err != nil {
+		return false, err
+	}
+	if added {
+		b.sendEvent(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: channel}, Item: item.ID})
+	}
+	return added, nil
 }
 
 func (b *memoryBackend) updateChannelUnreadCount(channel string) error {
@@ -656,21 +966,35 @@ func (b *memoryBackend) updateChannelUnreadCount(channel string) error {
 			return err
 		}
 		defer b.save()
+		changed := c.Unread != unread
 		c.Unread = unread
 
 		b.lock.Lock()
 		b.Channels[channel] = c
 		b.lock.Unlock()
+
+		if changed {
+			b.sendEvent(microsub.Event{Type: microsub.EventUnreadCountChanged, Channel: &c})
+		}
 	}
 
 	return nil
 }
 
-// Fetch2 fetches stuff
-func Fetch2(fetchURL string) (*http.Response, error) {
-	conn := pool.Get()
-	defer conn.Close()
+// Fetch2 fetches stuff. Responses are cached for as long as the Cache-Control
+// or Expires headers allow. After that the cached response is revalidated with
+// If-None-Match and If-Modified-Since, on 304 the cached response is returned.
+func (b *memoryBackend) Fetch2(fetchURL string) (*http.Response, error) {
+	return b.fetchCached(fetchURL, false)
+}
+
+// fetchRevalidated works like Fetch2, but a cached response is always
+// revalidated, also when it is still fresh
+func (b *memoryBackend) fetchRevalidated(fetchURL string) (*http.Response, error) {
+	return b.fetchCached(fetchURL, true)
+}
 
+func (b *memoryBackend) fetchCached(fetchURL string, revalidate bool) (*http.Response, error) {
 	if !strings.HasPrefix(fetchURL, "http") {
 		return nil, fmt.Errorf("error parsing %s as url, has no http(s) prefix", fetchURL)
 	}
@@ -681,13 +1005,18 @@ func Fetch2(fetchURL string) (*http.Response, error) {
 	}
 
 	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating request for %s: %s", u, err)
+	}
 
 	cacheKey := fmt.Sprintf("http_cache:%s", u.String())
-	data, err := redis.Bytes(conn.Do("GET", cacheKey))
-	if err == nil {
-		log.Printf("HIT %s\n", u.String())
-		rd := bufio.NewReader(bytes.NewReader(data))
-		return http.ReadResponse(rd, req)
+	cached, hasCached := b.loadCachedResponse(cacheKey)
+	if hasCached {
+		if !revalidate && time.Now().Before(cached.Fresh) {
+			log.Printf("HIT %s\n", u.String())
+			return cached.response(req)
+		}
+		cached.addValidators(req)
 	}
 
 	log.Printf("MISS %s\n", u.String())
@@ -697,28 +1026,137 @@ func Fetch2(fetchURL string) (*http.Response, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error while fetching %s: %s", u, err)
 	}
+
+	if resp.StatusCode == http.StatusNotModified && hasCached {
+		resp.Body.Close()
+		log.Printf("NOT MODIFIED %s\n", u.String())
+		cached.Fresh = time.Now().Add(cacheLifetime(resp.Header, time.Now()))
+		b.saveCachedResponse(cacheKey, cached)
+		return cached.response(req)
+	}
+
+	// Error responses are not cached
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
 	defer resp.Body.Close()
 
-	var b bytes.Buffer
-	resp.Write(&b)
+	var buf bytes.Buffer
+	resp.Write(&buf)
 
-	cachedCopy := make([]byte, b.Len())
-	cur := b.Bytes()
-	copy(cachedCopy, cur)
+	cached = cachedResponse{
+		Fresh:    time.Now().Add(cacheLifetime(resp.Header, time.Now())),
+		Response: buf.Bytes(),
+	}
+	b.saveCachedResponse(cacheKey, cached)
+
+	return cached.response(req)
+}
 
-	conn.Do("SET", cacheKey, cachedCopy, "EX", 60*60)
+func (b *memoryBackend) MuteGetList(channel string) ([]microsub.Card, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return urlsToCards(b.Muted[channel]), nil
+}
 
-	cachedResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(cachedCopy)), req)
-	return cachedResp, err
+func (b *memoryBackend) Mute(channel string, uid string) error {
+	defer b.save()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.Muted == nil {
+		b.Muted = make(map[string][]string)
+	}
+	b.Muted[channel] = addURL(b.Muted[channel], uid)
+	return nil
 }
 
-func (b *memoryBackend) sendMessage(msg microsub.Message) {
+func (b *memoryBackend) Unmute(channel string, uid string) error {
+	defer b.save()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.Muted == nil {
+		return nil
+	}
+	b.Muted[channel] = removeURL(b.Muted[channel], uid)
+	return nil
+}
+
+func (b *memoryBackend) BlockGetList(channel string) ([]microsub.Card, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return urlsToCards(b.Blocked[channel]), nil
+}
+
+func (b *memoryBackend) Block(channel string, uid string) error {
+	defer b.save()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.Blocked == nil {
+		b.Blocked = make(map[string][]string)
+	}
+	b.Blocked[channel] = addURL(b.Blocked[channel], uid)
+	return nil
+}
+
+func (b *memoryBackend) Unblock(channel string, uid string) error {
+	defer b.save()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.Blocked == nil {
+		return nil
+	}
+	b.Blocked[channel] = removeURL(b.Blocked[channel], uid)
+	return nil
+}
+
+func urlsToCards(urls []string) []microsub.Card {
+	cards := []microsub.Card{}
+	for _, u := range urls {
+		cards = append(cards, microsub.Card{Type: "card", URL: u})
+	}
+	return cards
+}
+
+func addURL(urls []string, u string) []string {
+	for _, v := range urls {
+		if sameURL(v, u) {
+			return urls
+		}
+	}
+	return append(urls, u)
+}
+
+func removeURL(urls []string, u string) []string {
+	var result []string
+	for _, v := range urls {
+		if !sameURL(v, u) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// sendEvent sends the event to all listeners, b.lock should not be held
+func (b *memoryBackend) sendEvent(evt microsub.Event) {
+	b.listenersLock.RLock()
+	defer b.listenersLock.RUnlock()
 	for _, l := range b.listeners {
-		l.WriteMessage(microsub.Event{Msg: msg})
+		l.WriteMessage(evt)
 	}
 }
 
+func (b *memoryBackend) sendFetchError(channel, feedURL string, err error) {
+	b.sendEvent(microsub.Event{
+		Type:    microsub.EventFetchError,
+		Channel: &microsub.Channel{UID: channel},
+		Feed:    &microsub.Feed{Type: "feed", URL: feedURL},
+		Error:   err.Error(),
+	})
+}
+
 func (b *memoryBackend) AddEventListener(el microsub.EventListener) error {
+	b.listenersLock.Lock()
+	defer b.listenersLock.Unlock()
 	b.listeners = append(b.listeners, el)
 	return nil
 }
@@ -740,12 +1178,43 @@ func (b *memoryBackend) setChannel(channel microsub.Channel) {
 	b.NextUid++
 }
 
-func updateChannelInRedis(conn redis.Conn, uid string, prio int) {
-	conn.Do("SADD", "channels", uid)
-	conn.Do("SETNX", "channel_sortorder_"+uid, prio)
+func (b *memoryBackend) updateChannelInStore(uid string, prio int) {
+	err := b.store.ChannelAdd(uid, prio)
+	if err != nil {
+		log.Printf("Error while adding channel %s: %v\n", uid, err)
+	}
+}
+
+func (b *memoryBackend) removeChannelFromStore(uid string) {
+	err := b.store.ChannelRemove(uid)
+	if err != nil {
+		log.Printf("Error while removing channel %s: %v\n", uid, err)
+	}
 }
 
-func removeChannelFromRedis(conn redis.Conn, uid string) {
-	conn.Do("SREM", "channels", uid)
-	conn.Do("DEL", "channel_sortorder_"+uid)
+// clearChannelItems removes the items of a deleted channel from its timeline
+// and from the search index
+func (b *memoryBackend) clearChannelItems(uid string) {
+	timeline := b.getTimeline(uid)
+	if timeline == nil {
+		return
+	}
+	items, err := timeline.Export()
+	if err != nil {
+		log.Printf("Error while reading the items of channel %s: %v\n", uid, err)
+		return
+	}
+	for _, item := range items {
+		if item.ID == "" {
+			continue
+		}
+		err = b.store.UnindexItem(uid, item.ID)
+		if err != nil {
+			log.Printf("Error while removing item %s of channel %s from search: %v\n", item.ID, uid, err)
+		}
+	}
+	err = timeline.Clear()
+	if err != nil {
+		log.Printf("Error while clearing channel %s: %v\n", uid, err)
+	}
 }
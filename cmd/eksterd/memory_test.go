@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+type eventRecorder struct {
+	events []microsub.Event
+}
+
+func (r *eventRecorder) WriteMessage(evt microsub.Event) {
+	r.events = append(r.events, evt)
+}
+
+func (r *eventRecorder) types() []string {
+	var types []string
+	for _, evt := range r.events {
+		types = append(types, evt.Type)
+	}
+	return types
+}
+
+func TestMemoryBackend_Fetch2ConditionalGet(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	var requests, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/feed":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("feed"))
+		case "/cached":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Write([]byte("cached"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	b := &memoryBackend{store: store}
+
+	for i := 0; i < 2; i++ {
+		resp, err := b.Fetch2(server.URL + "/feed")
+		if assert.NoError(t, err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "feed", string(body))
+		}
+	}
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 1, notModified)
+
+	// fresh responses are not fetched again
+	requests = 0
+	for i := 0; i < 2; i++ {
+		resp, err := b.Fetch2(server.URL + "/cached")
+		if assert.NoError(t, err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, "cached", string(body))
+		}
+	}
+	assert.Equal(t, 1, requests)
+
+	// error responses are not cached
+	requests = 0
+	for i := 0; i < 2; i++ {
+		resp, err := b.Fetch2(server.URL + "/missing")
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+	assert.Equal(t, 2, requests)
+}
+
+func TestMemoryBackend_Events(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	b := &memoryBackend{
+		store:    store,
+		Channels: map[string]microsub.Channel{},
+		Feeds:    map[string][]microsub.Feed{},
+	}
+	recorder := &eventRecorder{}
+	require.NoError(t, b.AddEventListener(recorder))
+
+	channel, err := b.ChannelsCreate("Home")
+	require.NoError(t, err)
+
+	item := microsub.Item{ID: "a", Type: "entry", Name: "First", Published: time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)}
+	_, err = b.channelAddItem(channel.UID, item)
+	require.NoError(t, err)
+	require.NoError(t, b.updateChannelUnreadCount(channel.UID))
+
+	// items that are already in the channel and unchanged counts send no events
+	_, err = b.channelAddItem(channel.UID, item)
+	require.NoError(t, err)
+	require.NoError(t, b.updateChannelUnreadCount(channel.UID))
+
+	_, err = b.ChannelsUpdate(channel.UID, "Start")
+	require.NoError(t, err)
+	require.NoError(t, b.ChannelsDelete(channel.UID))
+
+	assert.Equal(t, []string{
+		microsub.EventChannelCreated,
+		microsub.EventNewItem,
+		microsub.EventUnreadCountChanged,
+		microsub.EventChannelUpdated,
+		microsub.EventChannelDeleted,
+	}, recorder.types())
+
+	if assert.Len(t, recorder.events, 5) {
+		assert.Equal(t, channel.UID, recorder.events[1].Channel.UID)
+		assert.Equal(t, "a", recorder.events[1].Item)
+		assert.Equal(t, 1, recorder.events[2].Channel.Unread)
+		assert.Equal(t, "Start", recorder.events[3].Channel.Name)
+	}
+}
+
+func TestMemoryBackend_HiddenAuthors(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	b := &memoryBackend{
+		store:    store,
+		Channels: map[string]microsub.Channel{},
+		Feeds:    map[string][]microsub.Feed{},
+	}
+	home, err := b.ChannelsCreate("Home")
+	require.NoError(t, err)
+	other, err := b.ChannelsCreate("Other")
+	require.NoError(t, err)
+
+	authors := []string{"https://muted.example/", "https://muted.example/", "https://ok.example/", "https://muted.example/", "https://ok.example/", "https://blocked.example/", "https://ok.example/"}
+	for i, author := range authors {
+		item := microsub.Item{
+			ID:        fmt.Sprintf("%d", i),
+			Type:      "entry",
+			Name:      fmt.Sprintf("Item %d", i),
+			Author:    &microsub.Card{URL: author},
+			Published: time.Date(2018, 8, 1, 12, i, 0, 0, time.UTC).Format(time.RFC3339),
+		}
+		_, err = b.channelAddItem(home.UID, item)
+		require.NoError(t, err)
+		_, err = b.channelAddItem(other.UID, item)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, b.Mute(home.UID, "https://muted.example"))
+	// a block without a channel is for all channels
+	require.NoError(t, b.Block("", "https://blocked.example/"))
+
+	// the pages are full and the cursors don't skip items
+	pageIDs := func(channel string) [][]string {
+		var pages [][]string
+		query := microsub.TimelineQuery{Limit: 2}
+		for {
+			timeline, err := b.TimelineGetQuery(channel, query)
+			require.NoError(t, err)
+			var ids []string
+			for _, item := range timeline.Items {
+				ids = append(ids, item.ID)
+			}
+			pages = append(pages, ids)
+			if timeline.Paging.After == "" {
+				return pages
+			}
+			query.After = timeline.Paging.After
+		}
+	}
+	assert.Equal(t, [][]string{{"2", "4"}, {"6"}}, pageIDs(home.UID))
+	assert.Equal(t, [][]string{{"0", "1"}, {"2", "3"}, {"4", "6"}}, pageIDs(other.UID))
+}
+
+func TestMemoryBackend_FeedStatus(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Write([]byte(`<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Feed</title>
+<item><guid>https://example.com/1</guid><title>First</title><link>https://example.com/1</link><pubDate>Wed, 01 Aug 2018 12:00:00 +0000</pubDate></item>
+<item><guid>https://example.com/2</guid><title>Second</title><link>https://example.com/2</link><pubDate>Thu, 02 Aug 2018 12:00:00 +0000</pubDate></item>
+</channel></rss>`))
+	}))
+	defer server.Close()
+
+	b := &memoryBackend{
+		store:    store,
+		Channels: map[string]microsub.Channel{},
+		Feeds:    map[string][]microsub.Feed{},
+	}
+	b.hubIncomingBackend = hubIncomingBackend{backend: b, baseURL: server.URL}
+	users := newUserBackends(b)
+	channel, err := b.ChannelsCreate("Home")
+	require.NoError(t, err)
+
+	feedURL := server.URL + "/feed"
+	_, err = b.FollowURL(channel.UID, feedURL)
+	require.NoError(t, err)
+
+	feeds, err := b.FollowGetList(channel.UID)
+	require.NoError(t, err)
+	require.Len(t, feeds, 1)
+	status := feeds[0].Status
+	if assert.NotNil(t, status) {
+		assert.Equal(t, 200, status.StatusCode)
+		assert.Equal(t, 0, status.Errors)
+		assert.Equal(t, 2, status.Items)
+		assert.NotEmpty(t, status.LastFetch)
+		assert.NotEmpty(t, status.LastSuccess)
+		assert.NotEmpty(t, status.LastItem)
+		assert.False(t, status.WebSub)
+	}
+
+	recorder := &eventRecorder{}
+	require.NoError(t, b.AddEventListener(recorder))
+
+	failing = true
+	users.fetchScheduledFeed(feedURL)
+	users.fetchScheduledFeed(feedURL)
+
+	var saved feedStatus
+	require.NoError(t, store.FeedStatusLoad(channel.UID, feedURL, &saved))
+	assert.Equal(t, 2, saved.Errors)
+	assert.Equal(t, 500, saved.StatusCode)
+	assert.Equal(t, "status 500", saved.LastError)
+	assert.True(t, saved.LastSuccess.Before(saved.LastFetch))
+
+	// errors are reported with events, not with items in notifications
+	assert.Equal(t, []string{microsub.EventFetchError, microsub.EventFetchError}, recorder.types())
+	assert.Equal(t, "status 500", recorder.events[0].Error)
+	notifications, err := b.getTimeline("notifications").Items(microsub.TimelineQuery{})
+	require.NoError(t, err)
+	assert.Empty(t, notifications.Items)
+
+	failing = false
+	users.fetchScheduledFeed(feedURL)
+
+	saved = feedStatus{}
+	require.NoError(t, store.FeedStatusLoad(channel.UID, feedURL, &saved))
+	assert.Equal(t, 0, saved.Errors)
+	assert.Empty(t, saved.LastError)
+	assert.Equal(t, saved.LastFetch, saved.LastSuccess)
+
+	require.NoError(t, b.UnfollowURL(channel.UID, feedURL))
+	saved = feedStatus{}
+	require.NoError(t, store.FeedStatusLoad(channel.UID, feedURL, &saved))
+	assert.Equal(t, feedStatus{}, saved)
+}
+
+func TestSortFeedsByHealth(t *testing.T) {
+	feeds := []followedFeed{
+		{Feed: microsub.Feed{URL: "new", Status: &microsub.FeedStatus{LastItem: "2018-08-03T12:00:00Z"}}},
+		{Feed: microsub.Feed{URL: "unknown"}},
+		{Feed: microsub.Feed{URL: "failing", Status: &microsub.FeedStatus{Errors: 3, LastItem: "2018-08-03T12:00:00Z"}}},
+		{Feed: microsub.Feed{URL: "old", Status: &microsub.FeedStatus{LastItem: "2018-08-01T12:00:00Z"}}},
+		{Feed: microsub.Feed{URL: "dead", Status: &microsub.FeedStatus{}}},
+	}
+	sortFeedsByHealth(feeds)
+
+	var urls []string
+	for _, feed := range feeds {
+		urls = append(urls, feed.URL)
+	}
+	assert.Equal(t, []string{"failing", "dead", "old", "new", "unknown"}, urls)
+}
+
+func TestMainHandler_ChannelSettings(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	owner := &memoryBackend{store: store, Me: "https://owner.example/"}
+	owner.setState(defaultState())
+	owner.refreshChannels()
+
+	// a user from before the settings, without a Settings map
+	aliceStore, err := store.User("https://alice.example/")
+	require.NoError(t, err)
+	alice := &memoryBackend{store: aliceStore, Me: "https://alice.example/"}
+	alice.setState(backendState{Channels: defaultState().Channels})
+	alice.refreshChannels()
+
+	users := newUserBackends(owner, alice)
+	users.AuthEnabled = true
+	h := &mainHandler{Users: users, TemplateDir: "../../templates"}
+	require.NoError(t, store.SessionSave("s1", &session{Me: alice.Me, LoggedIn: true}))
+
+	r := httptest.NewRequest("POST", "/settings/channel", strings.NewReader(url.Values{
+		"uid":                   {"home"},
+		"exclude_regex":         {"spam"},
+		"include_regex":         {"ekster"},
+		"retention_max_items":   {"10"},
+		"retention_keep_unread": {"on"},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 302, w.Code)
+
+	setting := alice.getSetting("home")
+	assert.Equal(t, "spam", setting.ExcludeRegex)
+	assert.Equal(t, "ekster", setting.IncludeRegex)
+	assert.Equal(t, retentionPolicy{MaxItems: 10, KeepUnread: true}, setting.Retention)
+
+	reloaded := &memoryBackend{store: aliceStore}
+	require.NoError(t, reloaded.load())
+	assert.Equal(t, setting, reloaded.Settings["home"])
+}
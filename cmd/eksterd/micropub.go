@@ -18,23 +18,28 @@
 package main
 
 import (
-	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	"p83.nl/go/ekster/pkg/jf2"
 	"p83.nl/go/ekster/pkg/microsub"
-
-	"github.com/gomodule/redigo/redis"
-	"willnorris.com/go/microformats"
 )
 
 type micropubHandler struct {
-	Backend *memoryBackend
+	Users *userBackends
+
+	// BaseURL is used for the locations of items without a url and of the
+	// uploaded files
+	BaseURL string
+	// MediaDir is the directory where uploaded files are saved
+	MediaDir string
 }
 
 /*
@@ -46,87 +51,278 @@ type micropubHandler struct {
  */
 func (h *micropubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, maxMicropubRequest)
 
-	conn := pool.Get()
-	defer conn.Close()
-
-	r.ParseForm()
+	var parseErr error
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "multipart/form-data" {
+		parseErr = r.ParseMultipartForm(maxMediaMemory)
+	} else {
+		parseErr = r.ParseForm()
+	}
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(parseErr, &maxBytesErr) {
+		micropubError(w, 413, "invalid_request", fmt.Sprintf("The request is larger than %d bytes", maxBytesErr.Limit))
+		return
+	}
 
 	if r.Method == http.MethodGet {
-		// show profile with endpoint urls
-
-	} else if r.Method == http.MethodPost {
-		sourceID := r.URL.Query().Get("source_id")
-
-		authHeader := r.Header.Get("Authorization")
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			sourceID = authHeader[7:]
+		backend, sourceID, _, err := h.source(r)
+		if err != nil {
+			micropubError(w, 401, "unauthorized", err.Error())
+			return
 		}
-
-		channel, err := redis.String(conn.Do("HGET", "sources", sourceID))
+		if strings.HasPrefix(r.URL.Path, sourceItemsPath) {
+			h.item(w, r, backend, sourceID)
+			return
+		}
+		h.query(w, r, backend, sourceID)
+		return
+	} else if r.Method == http.MethodPost && !strings.HasPrefix(r.URL.Path, sourceItemsPath) {
+		backend, sourceID, channel, err := h.source(r)
 		if err != nil {
+			micropubError(w, 401, "unauthorized", err.Error())
+			return
+		}
 
-			channel, err = redis.String(conn.Do("HGET", "token:"+sourceID, "channel"))
+		var req micropubRequest
+		var uploads []upload
+		switch contentType {
+		case "application/jf2+json":
+			var item microsub.Item
+			err = json.NewDecoder(r.Body).Decode(&item)
+			if err != nil {
+				micropubError(w, 400, "invalid_request", fmt.Sprintf("Error decoding: %v", err))
+				return
+			}
+			if item.Type == "" {
+				item.Type = "entry"
+			}
+			req.Type = []string{"h-" + item.Type}
+			req.Properties = itemProperties(item)
+		case "application/json":
+			err = json.NewDecoder(r.Body).Decode(&req)
 			if err != nil {
-				http.Error(w, "Unknown source", 400)
+				micropubError(w, 400, "invalid_request", fmt.Sprintf("Error decoding: %v", err))
 				return
 			}
+		case "application/x-www-form-urlencoded", "multipart/form-data":
+			req, uploads, err = h.formRequest(r)
+			if err != nil {
+				log.Printf("Error while reading uploaded files: %v\n", err)
+				micropubError(w, 500, "server_error", "The uploaded files could not be read")
+				return
+			}
+		default:
+			micropubError(w, 400, "invalid_request", "Unsupported Content-Type")
+			return
 		}
 
-		var item microsub.Item
-		ok := false
-		if r.Header.Get("Content-Type") == "application/jf2+json" {
-			dec := json.NewDecoder(r.Body)
-			err := dec.Decode(&item)
+		switch req.Action {
+		case "":
+			wait, err := backend.useSource(sourceID, time.Now())
+			if err == errRateLimited {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too Many Requests", 429)
+				return
+			}
+			if err != nil {
+				log.Printf("Error while saving the use of source %s: %v\n", sourceID, err)
+			}
+
+			// the uploaded files are only saved for items that are added
+			if _, err := simplifySourceItem(req.Type, req.Properties); err != nil {
+				micropubError(w, 400, "invalid_request", err.Error())
+				return
+			}
+			for _, u := range uploads {
+				err = saveMedia(h.MediaDir, u)
+				if err != nil {
+					log.Printf("Error while saving uploaded files: %v\n", err)
+					micropubError(w, 500, "server_error", "The uploaded files could not be saved")
+					return
+				}
+			}
+
+			location, err := backend.createSourceItem(sourceID, channel, h.BaseURL, req)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Error decoding: %v", err), 400)
+				micropubError(w, 400, "invalid_request", err.Error())
+				return
+			}
+			w.Header().Set("Location", location)
+			w.WriteHeader(201)
+		case "update", "delete":
+			if req.Action == "update" {
+				err = backend.updateSourceItem(sourceID, req)
+			} else {
+				err = backend.deleteSourceItem(sourceID, req.URL)
+			}
+			if err == errNotFound {
+				micropubError(w, 400, "invalid_request", fmt.Sprintf("The source didn't post an item at %q", req.URL))
 				return
 			}
-			ok = true
-		} else if r.Header.Get("Content-Type") == "application/json" {
-			var mfItem microformats.Microformat
-			dec := json.NewDecoder(r.Body)
-			err := dec.Decode(&mfItem)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Error decoding: %v", err), 400)
+				micropubError(w, 400, "invalid_request", err.Error())
 				return
 			}
+			w.WriteHeader(204)
+		default:
+			micropubError(w, 400, "invalid_request", fmt.Sprintf("Unsupported action %q", req.Action))
+		}
+		return
+	}
+
+	http.Error(w, "Method not allowed", 405)
+}
+
+// source returns the user, the source and the channel of the request. The
+// source is the source_id parameter or a token from /auth/token.
+func (h *micropubHandler) source(r *http.Request) (*memoryBackend, string, string, error) {
+	sourceID := r.URL.Query().Get("source_id")
+
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		sourceID = authHeader[7:]
+	} else if token := r.PostFormValue("access_token"); token != "" {
+		sourceID = token
+	}
+
+	backend, channel, err := h.Users.sourceBackend(sourceID)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return backend, sourceID, channel, nil
+}
+
+// formRequest converts the form of a create, update or delete to a request,
+// uploaded files are added to the properties as urls and returned to be saved
+func (h *micropubHandler) formRequest(r *http.Request) (micropubRequest, []upload, error) {
+	req := micropubRequest{
+		Action: r.PostFormValue("action"),
+		URL:    r.PostFormValue("url"),
+	}
+	if req.Action != "" {
+		return req, nil, nil
+	}
+
+	itemType := r.PostFormValue("h")
+	if itemType == "" {
+		itemType = "entry"
+	}
+	req.Type = []string{"h-" + itemType}
+	req.Properties = make(map[string][]interface{})
+
+	for k, values := range r.PostForm {
+		k = strings.TrimSuffix(k, "[]")
+		if k == "h" || k == "action" || k == "access_token" || strings.HasPrefix(k, "mp-") {
+			continue
+		}
+		for _, v := range values {
+			req.Properties[k] = append(req.Properties[k], v)
+		}
+	}
+
+	var uploads []upload
+	if r.MultipartForm != nil {
+		for k, files := range r.MultipartForm.File {
+			k = strings.TrimSuffix(k, "[]")
+			for _, fh := range files {
+				name, err := mediaName(fh)
+				if err != nil {
+					return req, nil, err
+				}
+				uploads = append(uploads, upload{name: name, fh: fh})
+				req.Properties[k] = append(req.Properties[k], strings.TrimRight(h.BaseURL, "/")+"/media/"+name)
+			}
+		}
+	}
 
-			author := microsub.Card{}
-			item, ok = jf2.SimplifyMicroformatItem(&mfItem, author)
-		} else if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
-			content := r.FormValue("content")
-			name := r.FormValue("name")
-			item.Type = "entry"
-			item.Name = name
-			item.Content = &microsub.Content{Text: content}
-			item.Published = time.Now().Format(time.RFC3339)
-			ok = true
-		} else {
-			http.Error(w, "Unsupported Content-Type", 400)
+	return req, uploads, nil
+}
+
+// query answers q=config, q=syndicate-to and q=source
+func (h *micropubHandler) query(w http.ResponseWriter, r *http.Request, backend *memoryBackend, sourceID string) {
+	var result interface{}
+
+	switch q := r.FormValue("q"); q {
+	case "config":
+		result = map[string]interface{}{
+			"syndicate-to": []interface{}{},
+			"q":            []string{"config", "source", "syndicate-to"},
+		}
+	case "syndicate-to":
+		result = map[string]interface{}{
+			"syndicate-to": []interface{}{},
+		}
+	case "source":
+		u := r.FormValue("url")
+		var src sourceItem
+		err := backend.store.SourceItemLoad(sourceID, u, &src)
+		if err == errNotFound {
+			micropubError(w, 400, "invalid_request", fmt.Sprintf("The source didn't post an item at %q", u))
+			return
+		}
+		if err != nil {
+			micropubError(w, 500, "server_error", err.Error())
 			return
 		}
 
-		if ok {
-			item.Read = false
-			id, _ := redis.Int(conn.Do("INCR", "source:"+sourceID+"next_id"))
-			item.ID = fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("source:%s:%d", sourceID, id))))
-			err = h.Backend.channelAddItemWithMatcher(channel, item)
-			err = h.Backend.updateChannelUnreadCount(channel)
-			if err != nil {
-				log.Printf("error: while updating channel unread count for %s: %s\n", channel, err)
+		names := append(r.Form["properties[]"], r.Form["properties"]...)
+		if len(names) == 0 {
+			result = map[string]interface{}{"type": src.Type, "properties": src.Properties}
+			break
+		}
+		properties := make(map[string][]interface{})
+		for _, name := range names {
+			if v, ok := src.Properties[name]; ok {
+				properties[name] = v
 			}
 		}
+		result = map[string]interface{}{"properties": properties}
+	default:
+		micropubError(w, 400, "invalid_request", fmt.Sprintf("Unsupported query %q", q))
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Println(err)
+	}
+}
 
-		enc := json.NewEncoder(w)
-		err = enc.Encode(map[string]string{
-			"ok": "1",
-		})
+// item answers requests for the location of an item without a url with the
+// item, only the source that posted the item can read it
+func (h *micropubHandler) item(w http.ResponseWriter, r *http.Request, backend *memoryBackend, sourceID string) {
+	id := strings.TrimPrefix(r.URL.Path, sourceItemsPath)
 
+	var src sourceItem
+	err := backend.store.SourceItemLoad(sourceID, sourceItemURL(h.BaseURL, id), &src)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		micropubError(w, 500, "server_error", err.Error())
 		return
 	}
 
-	http.Error(w, "Method not allowed", 405)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(map[string]interface{}{"type": src.Type, "properties": src.Properties})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// micropubError writes a Micropub error response
+func micropubError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
 }
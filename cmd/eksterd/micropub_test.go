@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func newMicropubTest(t *testing.T) (*memoryBackend, *micropubHandler, func()) {
+	store, cleanup := createBoltStorage(t)
+	dir, err := ioutil.TempDir("", "ekster-media")
+	require.NoError(t, err)
+
+	b := &memoryBackend{store: store, Me: "https://owner.example/"}
+	b.setState(defaultState())
+	b.refreshChannels()
+	h := &micropubHandler{Users: newUserBackends(b), BaseURL: "https://ekster.example/", MediaDir: dir}
+	return b, h, func() {
+		cleanup()
+		os.RemoveAll(dir)
+	}
+}
+
+func micropubRequestTo(h http.Handler, r *http.Request, sourceID string) *httptest.ResponseRecorder {
+	r.Header.Set("Authorization", "Bearer "+sourceID)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func postMicropubJSON(h http.Handler, sourceID string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	r := httptest.NewRequest("POST", "/micropub", bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	return micropubRequestTo(h, r, sourceID)
+}
+
+func homeItems(t *testing.T, b *memoryBackend) []microsub.Item {
+	timeline, err := b.TimelineGet("", "", "home")
+	require.NoError(t, err)
+	return timeline.Items
+}
+
+func TestMicropubHandler_CreateUpdateDelete(t *testing.T) {
+	b, h, cleanup := newMicropubTest(t)
+	defer cleanup()
+
+	src, err := b.SourcesCreate(microsub.MicropubSource{Label: "Bridge", Channel: "home"})
+	require.NoError(t, err)
+	other, err := b.SourcesCreate(microsub.MicropubSource{Label: "Other", Channel: "home"})
+	require.NoError(t, err)
+
+	w := micropubRequestTo(h, httptest.NewRequest("POST", "/micropub", nil), "unknown")
+	assert.Equal(t, 401, w.Code)
+
+	form := url.Values{
+		"h":           {"entry"},
+		"content":     {"Hello world"},
+		"category[]":  {"indieweb", "micropub"},
+		"in-reply-to": {"https://example.com/post"},
+	}
+	r := httptest.NewRequest("POST", "/micropub", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	w = micropubRequestTo(h, r, src.ID)
+	require.Equal(t, 201, w.Code)
+	location := w.Header().Get("Location")
+	require.True(t, strings.HasPrefix(location, "https://ekster.example/micropub/items/"), location)
+
+	// the location serves the item to the source that posted it
+	itemPath := strings.TrimPrefix(location, "https://ekster.example")
+	w = micropubRequestTo(h, httptest.NewRequest("GET", itemPath, nil), src.ID)
+	require.Equal(t, 200, w.Code)
+	var posted map[string]interface{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&posted))
+	assert.Equal(t, []interface{}{"h-entry"}, posted["type"])
+	assert.Equal(t, []interface{}{"Hello world"}, posted["properties"].(map[string]interface{})["content"])
+	assert.Equal(t, 404, micropubRequestTo(h, httptest.NewRequest("GET", itemPath, nil), other.ID).Code)
+	assert.Equal(t, 401, micropubRequestTo(h, httptest.NewRequest("GET", itemPath, nil), "unknown").Code)
+	assert.Equal(t, 405, micropubRequestTo(h, httptest.NewRequest("POST", itemPath, nil), src.ID).Code)
+
+	items := homeItems(t, b)
+	require.Len(t, items, 1)
+	assert.Equal(t, "Hello world", items[0].Content.Text)
+	assert.Equal(t, []string{"indieweb", "micropub"}, items[0].Category)
+	assert.Equal(t, []string{"https://example.com/post"}, items[0].InReplyTo)
+	assert.NotEmpty(t, items[0].Published)
+
+	// q=source returns the properties of the item
+	r = httptest.NewRequest("GET", "/micropub?q=source&properties[]=category&url="+url.QueryEscape(location), nil)
+	w = micropubRequestTo(h, r, src.ID)
+	require.Equal(t, 200, w.Code)
+	var source map[string]map[string][]interface{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&source))
+	assert.Equal(t, map[string][]interface{}{"category": {"indieweb", "micropub"}}, source["properties"])
+
+	// only the source that posted the item can see and change it
+	r = httptest.NewRequest("GET", "/micropub?q=source&url="+url.QueryEscape(location), nil)
+	assert.Equal(t, 400, micropubRequestTo(h, r, other.ID).Code)
+	w = postMicropubJSON(h, other.ID, map[string]interface{}{"action": "delete", "url": location})
+	assert.Equal(t, 400, w.Code)
+
+	w = postMicropubJSON(h, src.ID, map[string]interface{}{
+		"action":  "update",
+		"url":     location,
+		"replace": map[string][]interface{}{"content": {"Hello again"}},
+		"add":     map[string][]interface{}{"category": {"go"}},
+		"delete":  map[string][]interface{}{"category": {"indieweb"}},
+	})
+	require.Equal(t, 204, w.Code)
+	items = homeItems(t, b)
+	require.Len(t, items, 1)
+	assert.Equal(t, "Hello again", items[0].Content.Text)
+	assert.Equal(t, []string{"micropub", "go"}, items[0].Category)
+
+	w = postMicropubJSON(h, src.ID, map[string]interface{}{"action": "update", "url": location, "delete": []string{"in-reply-to"}})
+	require.Equal(t, 204, w.Code)
+	assert.Empty(t, homeItems(t, b)[0].InReplyTo)
+
+	form = url.Values{"action": {"delete"}, "url": {location}}
+	r = httptest.NewRequest("POST", "/micropub", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = micropubRequestTo(h, r, src.ID)
+	require.Equal(t, 204, w.Code)
+	assert.Empty(t, homeItems(t, b))
+	assert.Equal(t, 404, micropubRequestTo(h, httptest.NewRequest("GET", itemPath, nil), src.ID).Code)
+
+	w = postMicropubJSON(h, src.ID, map[string]interface{}{"action": "delete", "url": location})
+	assert.Equal(t, 400, w.Code)
+
+	// an item with a url is found at that url
+	w = postMicropubJSON(h, src.ID, map[string]interface{}{
+		"type":       []string{"h-entry"},
+		"properties": map[string][]interface{}{"like-of": {"https://example.com/liked"}, "url": {"https://bridge.example/1"}},
+	})
+	require.Equal(t, 201, w.Code)
+	assert.Equal(t, "https://bridge.example/1", w.Header().Get("Location"))
+	assert.Equal(t, []string{"https://example.com/liked"}, homeItems(t, b)[0].LikeOf)
+
+	// media properties, a photo can have alt text
+	w = postMicropubJSON(h, src.ID, map[string]interface{}{
+		"type": []string{"h-entry"},
+		"properties": map[string][]interface{}{
+			"url":         {"https://bridge.example/2"},
+			"summary":     {"An episode"},
+			"audio":       {"https://bridge.example/2.mp3"},
+			"video":       {"https://bridge.example/2.mp4"},
+			"featured":    {map[string]string{"value": "https://bridge.example/2.jpg", "alt": "Cover"}},
+			"syndication": {"https://social.example/2"},
+		},
+	})
+	require.Equal(t, 201, w.Code)
+	var item microsub.Item
+	for _, it := range homeItems(t, b) {
+		if it.URL == "https://bridge.example/2" {
+			item = it
+		}
+	}
+	assert.Equal(t, "An episode", item.Summary)
+	assert.Equal(t, []string{"https://bridge.example/2.mp3"}, item.Audio)
+	assert.Equal(t, []string{"https://bridge.example/2.mp4"}, item.Video)
+	assert.Equal(t, "https://bridge.example/2.jpg", item.Featured)
+	assert.Equal(t, []string{"https://social.example/2"}, item.Syndication)
+}
+
+func TestMicropubHandler_Upload(t *testing.T) {
+	b, h, cleanup := newMicropubTest(t)
+	defer cleanup()
+
+	src, err := b.SourcesCreate(microsub.MicropubSource{Label: "Camera", Channel: "home"})
+	require.NoError(t, err)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	require.NoError(t, mw.WriteField("h", "entry"))
+	require.NoError(t, mw.WriteField("content", "A photo"))
+	fw, err := mw.CreateFormFile("photo", "Photo.JPG")
+	require.NoError(t, err)
+	fw.Write([]byte("not really a jpeg"))
+	fw, err = mw.CreateFormFile("photo", "page.html")
+	require.NoError(t, err)
+	fw.Write([]byte("<html><script>alert(1)</script></html>"))
+	require.NoError(t, mw.Close())
+
+	r := httptest.NewRequest("POST", "/micropub?source_id="+src.ID, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, 201, w.Code)
+
+	items := homeItems(t, b)
+	require.Len(t, items, 1)
+	require.Len(t, items[0].Photo, 2)
+	photo := items[0].Photo[0]
+	assert.True(t, strings.HasPrefix(photo, "https://ekster.example/media/"), photo)
+	assert.True(t, strings.HasSuffix(photo, ".jpg"), photo)
+
+	media := &mediaHandler{Dir: h.MediaDir}
+	r = httptest.NewRequest("GET", strings.TrimPrefix(photo, "https://ekster.example"), nil)
+	w = httptest.NewRecorder()
+	media.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "not really a jpeg", w.Body.String())
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Empty(t, w.Header().Get("Content-Disposition"))
+
+	// files that are not images, audio or video lose their extension and
+	// are only served as downloads
+	page := items[0].Photo[1]
+	assert.Equal(t, -1, strings.LastIndex(strings.TrimPrefix(page, "https://ekster.example/media/"), "."), page)
+	r = httptest.NewRequest("GET", strings.TrimPrefix(page, "https://ekster.example"), nil)
+	w = httptest.NewRecorder()
+	media.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	assert.Equal(t, "attachment", w.Header().Get("Content-Disposition"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+
+	r = httptest.NewRequest("GET", "/media/", nil)
+	w = httptest.NewRecorder()
+	media.ServeHTTP(w, r)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestMicropubHandler_UploadRefused(t *testing.T) {
+	b, h, cleanup := newMicropubTest(t)
+	defer cleanup()
+
+	src, err := b.SourcesCreate(microsub.MicropubSource{Label: "Camera", Channel: "home"})
+	require.NoError(t, err)
+	limited, err := b.SourcesCreate(microsub.MicropubSource{Label: "Limited", Channel: "home", RateLimit: 1})
+	require.NoError(t, err)
+
+	postPhoto := func(sourceID, itemType, photo string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		require.NoError(t, mw.WriteField("h", itemType))
+		fw, err := mw.CreateFormFile("photo", "photo.jpg")
+		require.NoError(t, err)
+		fw.Write([]byte(photo))
+		require.NoError(t, mw.Close())
+
+		r := httptest.NewRequest("POST", "/micropub?source_id="+sourceID, &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	savedFiles := func() int {
+		files, err := ioutil.ReadDir(h.MediaDir)
+		require.NoError(t, err)
+		return len(files)
+	}
+
+	// files of items that are not valid are not saved
+	w := postPhoto(src.ID, "card", "photo of a card")
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, 0, savedFiles())
+
+	w = postPhoto(limited.ID, "entry", "first photo")
+	assert.Equal(t, 201, w.Code)
+	assert.Equal(t, 1, savedFiles())
+
+	// nor are the files of sources over their rate limit
+	w = postPhoto(limited.ID, "entry", "second photo")
+	assert.Equal(t, 429, w.Code)
+	assert.Equal(t, 1, savedFiles())
+
+	// large requests are refused
+	defer func(max int64) { maxMicropubRequest = max }(maxMicropubRequest)
+	maxMicropubRequest = 1024
+	w = postPhoto(src.ID, "entry", strings.Repeat("x", 2048))
+	assert.Equal(t, 413, w.Code)
+	assert.Equal(t, 1, savedFiles())
+}
+
+func TestMicropubHandler_Config(t *testing.T) {
+	b, h, cleanup := newMicropubTest(t)
+	defer cleanup()
+
+	src, err := b.SourcesCreate(microsub.MicropubSource{Label: "Bridge", Channel: "home"})
+	require.NoError(t, err)
+
+	w := micropubRequestTo(h, httptest.NewRequest("GET", "/micropub?q=config", nil), src.ID)
+	require.Equal(t, 200, w.Code)
+	var config map[string]interface{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&config))
+	assert.Equal(t, []interface{}{}, config["syndicate-to"])
+
+	w = micropubRequestTo(h, httptest.NewRequest("GET", "/micropub?q=unknown", nil), src.ID)
+	assert.Equal(t, 400, w.Code)
+
+	// jf2 items can be read as properties
+	r := httptest.NewRequest("POST", "/micropub", strings.NewReader(`{"type":"entry","name":"Title","content":{"text":"Body"}}`))
+	r.Header.Set("Content-Type", "application/jf2+json")
+	w = micropubRequestTo(h, r, src.ID)
+	require.Equal(t, 201, w.Code)
+	assert.Equal(t, "Title", homeItems(t, b)[0].Name)
+
+	r = httptest.NewRequest("GET", "/micropub?q=source&url="+url.QueryEscape(w.Header().Get("Location")), nil)
+	w = micropubRequestTo(h, r, src.ID)
+	require.Equal(t, 200, w.Code)
+	var source struct {
+		Type       []string
+		Properties map[string][]interface{}
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&source))
+	assert.Equal(t, []string{"h-entry"}, source.Type)
+	assert.Equal(t, []interface{}{"Title"}, source.Properties["name"])
+}
@@ -0,0 +1,373 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// minFetchInterval is the shortest time between two fetches of a feed
+	minFetchInterval = 10 * time.Minute
+	// maxFetchInterval is the longest time between two fetches of a feed
+	maxFetchInterval = 24 * time.Hour
+
+	// fetchWorkers is the number of feeds that are fetched at the same time
+	fetchWorkers = 8
+)
+
+// feedSchedule keeps track of when a feed should be fetched again
+type feedSchedule struct {
+	URL       string
+	NextFetch time.Time
+	Interval  time.Duration
+	Errors    int
+
+	// hash of the last response body, used to see if the feed has changed
+	hash     []byte
+	fetching bool
+}
+
+// feedScheduler fetches every feed on its own schedule. Feeds that don't
+// change or return errors are fetched less often. A feed is fetched once for
+// all channels and users that follow it.
+type feedScheduler struct {
+	lock  sync.Mutex
+	feeds map[string]*feedSchedule
+}
+
+func newFeedScheduler() *feedScheduler {
+	return &feedScheduler{feeds: make(map[string]*feedSchedule)}
+}
+
+// update adds the new feeds and forgets the feeds that are no longer followed,
+// new feeds are spread over the first interval
+func (s *feedScheduler) update(urls []string, now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	followed := make(map[string]bool)
+	for _, feedURL := range urls {
+		followed[feedURL] = true
+		if _, e := s.feeds[feedURL]; e {
+			continue
+		}
+		s.feeds[feedURL] = &feedSchedule{
+			URL:       feedURL,
+			NextFetch: now.Add(time.Duration(rand.Int63n(int64(minFetchInterval)))),
+			Interval:  minFetchInterval,
+		}
+	}
+
+	for feedURL := range s.feeds {
+		if !followed[feedURL] {
+			delete(s.feeds, feedURL)
+		}
+	}
+}
+
+// due returns the feeds that should be fetched now. The feeds are skipped by
+// due until done is called for them.
+func (s *feedScheduler) due(now time.Time) []feedSchedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var due []feedSchedule
+	for _, feed := range s.feeds {
+		if feed.fetching || feed.NextFetch.After(now) {
+			continue
+		}
+		feed.fetching = true
+		due = append(due, *feed)
+	}
+	return due
+}
+
+// done schedules the next fetch of the feed. When the fetch failed err is set,
+// otherwise body is the response body and hint the refresh interval that was
+// asked for by the response headers or the feed.
+func (s *feedScheduler) done(feedURL string, body []byte, hint time.Duration, err error, now time.Time) (changed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	feed, e := s.feeds[feedURL]
+	if !e {
+		return err == nil
+	}
+	feed.fetching = false
+
+	if err != nil {
+		feed.Errors++
+		feed.Interval = backoff(minFetchInterval, feed.Errors)
+		feed.NextFetch = now.Add(feed.Interval)
+		return false
+	}
+	feed.Errors = 0
+
+	hash := sha1.Sum(body)
+	changed = !bytes.Equal(feed.hash, hash[:])
+	feed.hash = hash[:]
+
+	if changed {
+		feed.Interval = minFetchInterval
+	} else {
+		feed.Interval = backoff(feed.Interval, 1)
+	}
+	if hint > feed.Interval {
+		feed.Interval = hint
+	}
+	if feed.Interval > maxFetchInterval {
+		feed.Interval = maxFetchInterval
+	}
+	feed.NextFetch = now.Add(feed.Interval)
+
+	return changed
+}
+
+// backoff doubles interval n times, up to maxFetchInterval
+func backoff(interval time.Duration, n int) time.Duration {
+	for i := 0; i < n && interval < maxFetchInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxFetchInterval {
+		interval = maxFetchInterval
+	}
+	return interval
+}
+
+// cacheLifetime returns how long the response can be cached according to the
+// Cache-Control and Expires headers, or 0 when there is no such header
+func cacheLifetime(header http.Header, now time.Time) time.Duration {
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "no-cache" || directive == "no-store" {
+				return 0
+			}
+			if strings.HasPrefix(directive, "max-age=") {
+				seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+				if err == nil && seconds > 0 {
+					return time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			now = date
+		}
+		if t.After(now) {
+			return t.Sub(now)
+		}
+	}
+
+	return 0
+}
+
+// feedUpdateInterval returns the refresh interval from the RSS <ttl> or the
+// <sy:updatePeriod> and <sy:updateFrequency> elements, or 0 when the feed
+// has none of them
+func feedUpdateInterval(body []byte) time.Duration {
+	var ttl, frequency int
+	var period string
+
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	dec.Strict = false
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			break
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		// items don't contain feed level elements
+		if start.Name.Local == "item" || start.Name.Local == "entry" {
+			break
+		}
+
+		var value string
+		switch start.Name.Local {
+		case "ttl", "updatePeriod", "updateFrequency":
+			if err := dec.DecodeElement(&value, &start); err != nil {
+				continue
+			}
+		default:
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch start.Name.Local {
+		case "ttl":
+			ttl, _ = strconv.Atoi(value)
+		case "updatePeriod":
+			period = value
+		case "updateFrequency":
+			frequency, _ = strconv.Atoi(value)
+		}
+	}
+
+	if ttl > 0 {
+		return time.Duration(ttl) * time.Minute
+	}
+
+	var duration time.Duration
+	switch period {
+	case "hourly":
+		duration = time.Hour
+	case "daily":
+		duration = 24 * time.Hour
+	case "weekly":
+		duration = 7 * 24 * time.Hour
+	case "monthly":
+		duration = 30 * 24 * time.Hour
+	case "yearly":
+		duration = 365 * 24 * time.Hour
+	default:
+		return 0
+	}
+	if frequency > 1 {
+		duration /= time.Duration(frequency)
+	}
+	return duration
+}
+
+// runScheduler fetches the feeds of all users that are due with fetchWorkers
+// workers, until quit is closed
+func (u *userBackends) runScheduler(quit chan struct{}) {
+	jobs := make(chan feedSchedule)
+
+	for i := 0; i < fetchWorkers; i++ {
+		go func() {
+			for feed := range jobs {
+				u.fetchScheduledFeed(feed.URL)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	defer close(jobs)
+
+	for {
+		var urls []string
+		for feedURL := range u.followers() {
+			urls = append(urls, feedURL)
+		}
+		u.schedule.update(urls, time.Now())
+		for _, feed := range u.schedule.due(time.Now()) {
+			select {
+			case jobs <- feed:
+			case <-quit:
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// fetchResult is the outcome of a scheduled fetch of a feed
+type fetchResult struct {
+	statusCode  int
+	contentType string
+	body        []byte
+	// changed is set when the body is different from the last fetch
+	changed bool
+	err     error
+}
+
+// fetchScheduledFeed fetches the feed once and passes the result to every
+// channel that follows it. Fetch2 returns the cached body on 304 Not Modified,
+// so the hash stays the same and the items are not processed again.
+func (u *userBackends) fetchScheduledFeed(feedURL string) {
+	var result fetchResult
+	var hint time.Duration
+
+	resp, err := u.owner.Fetch2(feedURL)
+	if err != nil {
+		log.Printf("Error while Fetch2 of %s: %v\n", feedURL, err)
+	} else {
+		result.statusCode = resp.StatusCode
+		result.contentType = resp.Header.Get("Content-Type")
+		result.body, err = ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err == nil && resp.StatusCode >= 400 {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		if err != nil {
+			log.Printf("Error while fetching %s: %v\n", feedURL, err)
+		}
+		hint = cacheLifetime(resp.Header, time.Now())
+		if feedHint := feedUpdateInterval(result.body); feedHint > hint {
+			hint = feedHint
+		}
+	}
+	result.err = err
+
+	result.changed = u.schedule.done(feedURL, result.body, hint, err, time.Now())
+	for _, follower := range u.followers()[feedURL] {
+		follower.backend.feedFetched(follower.channel, feedURL, result)
+	}
+}
+
+// feedFetched records the fetch in the status of the feed and processes the
+// items when the feed has changed
+func (b *memoryBackend) feedFetched(channel, feedURL string, result fetchResult) {
+	b.updateFeedStatus(channel, feedURL, func(status *feedStatus) {
+		status.fetched(result.statusCode, result.err, time.Now())
+	})
+	if result.err != nil {
+		b.sendFetchError(channel, feedURL, result.err)
+		return
+	}
+	if !result.changed {
+		return
+	}
+
+	err := b.ProcessContent(channel, feedURL, result.contentType, bytes.NewReader(result.body))
+	if err != nil {
+		log.Printf("Error while processing %s: %v\n", feedURL, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeedScheduler(t *testing.T) {
+	s := newFeedScheduler()
+	now := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	s.update([]string{"https://example.com/feed"}, now)
+	assert.Empty(t, s.due(now.Add(-time.Minute)))
+
+	due := s.due(now.Add(minFetchInterval))
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, "https://example.com/feed", due[0].URL)
+	}
+	// a feed that is being fetched is not due again
+	assert.Empty(t, s.due(now.Add(minFetchInterval)))
+
+	feed := s.feeds["https://example.com/feed"]
+
+	assert.True(t, s.done("https://example.com/feed", []byte("a"), 0, nil, now))
+	assert.Equal(t, minFetchInterval, feed.Interval)
+
+	// unchanged feeds back off
+	assert.False(t, s.done("https://example.com/feed", []byte("a"), 0, nil, now))
+	assert.Equal(t, 2*minFetchInterval, feed.Interval)
+	assert.False(t, s.done("https://example.com/feed", []byte("a"), 0, nil, now))
+	assert.Equal(t, 4*minFetchInterval, feed.Interval)
+
+	// the hint is the shortest interval
+	assert.True(t, s.done("https://example.com/feed", []byte("b"), time.Hour, nil, now))
+	assert.Equal(t, time.Hour, feed.Interval)
+	assert.Equal(t, now.Add(time.Hour), feed.NextFetch)
+
+	// errors back off
+	err := errors.New("error")
+	assert.False(t, s.done("https://example.com/feed", nil, 0, err, now))
+	assert.Equal(t, 2*minFetchInterval, feed.Interval)
+	for i := 0; i < 10; i++ {
+		s.done("https://example.com/feed", nil, 0, err, now)
+	}
+	assert.Equal(t, maxFetchInterval, feed.Interval)
+
+	s.update(nil, now)
+	assert.Empty(t, s.feeds)
+}
+
+func TestCacheLifetime(t *testing.T) {
+	now := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	header := http.Header{}
+	assert.Equal(t, time.Duration(0), cacheLifetime(header, now))
+
+	header.Set("Cache-Control", "public, max-age=3600")
+	assert.Equal(t, time.Hour, cacheLifetime(header, now))
+
+	header.Set("Cache-Control", "no-cache")
+	assert.Equal(t, time.Duration(0), cacheLifetime(header, now))
+
+	header = http.Header{}
+	header.Set("Date", now.Format(http.TimeFormat))
+	header.Set("Expires", now.Add(2*time.Hour).Format(http.TimeFormat))
+	assert.Equal(t, 2*time.Hour, cacheLifetime(header, now.Add(time.Hour)))
+}
+
+func TestFeedUpdateInterval(t *testing.T) {
+	rss := `<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Test</title><ttl>90</ttl>
+<item><title>Item</title><ttl>1</ttl></item></channel></rss>`
+	assert.Equal(t, 90*time.Minute, feedUpdateInterval([]byte(rss)))
+
+	sy := `<?xml version="1.0"?>
+<rss version="2.0" xmlns:sy="http://purl.org/rss/1.0/modules/syndication/"><channel><title>Test</title>
+<sy:updatePeriod>daily</sy:updatePeriod><sy:updateFrequency>2</sy:updateFrequency></channel></rss>`
+	assert.Equal(t, 12*time.Hour, feedUpdateInterval([]byte(sy)))
+
+	assert.Equal(t, time.Duration(0), feedUpdateInterval([]byte(`<html><body>no feed</body></html>`)))
+	assert.Equal(t, time.Duration(0), feedUpdateInterval([]byte(`{"version": "https://jsonfeed.org/version/1"}`)))
+}
@@ -0,0 +1,114 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+// maxSearchResults is the maximum number of items returned by ItemSearch
+const maxSearchResults = 50
+
+// searchTerms splits text into lowercase words, words of one character are skipped
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	seen := make(map[string]bool)
+	var terms []string
+	for _, word := range words {
+		if len([]rune(word)) < 2 || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// itemSearchTerms returns the terms of the name, content, author and categories of the item
+func itemSearchTerms(item microsub.Item) []string {
+	parts := []string{item.Name, item.Summary}
+	if item.Content != nil {
+		if item.Content.Text != "" {
+			parts = append(parts, item.Content.Text)
+		} else {
+			parts = append(parts, htmlText(item.Content.HTML))
+		}
+	}
+	if item.Author != nil {
+		parts = append(parts, item.Author.Name, item.Author.URL)
+	}
+	parts = append(parts, item.Category...)
+	return searchTerms(strings.Join(parts, " "))
+}
+
+// htmlText returns the text of the html fragment
+func htmlText(fragment string) string {
+	var text []string
+	tokenizer := html.NewTokenizer(strings.NewReader(fragment))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return strings.Join(text, " ")
+		case html.TextToken:
+			text = append(text, string(tokenizer.Text()))
+		}
+	}
+}
+
+// sortSearchResults sorts the items newest first and keeps maxSearchResults items
+func sortSearchResults(items []microsub.Item) []microsub.Item {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Published > items[j].Published
+	})
+	if len(items) > maxSearchResults {
+		items = items[:maxSearchResults]
+	}
+	return items
+}
+
+// ItemSearch returns the items in the channel that contain all words of the query
+func (b *memoryBackend) ItemSearch(channel, query string) ([]microsub.Item, error) {
+	items := []microsub.Item{}
+
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return items, nil
+	}
+
+	results, err := b.store.SearchItems(channel, terms)
+	if err != nil {
+		return items, err
+	}
+
+	for _, item := range results {
+		if b.isHiddenAuthor(channel, item) {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	return sortSearchResults(items), nil
+}
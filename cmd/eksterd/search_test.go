@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func TestSearchTerms(t *testing.T) {
+	assert.Equal(t, []string{"hello", "world", "café"}, searchTerms("Hello, world! Café a hello"))
+	assert.Empty(t, searchTerms("a - b"))
+}
+
+func TestItemSearchTerms(t *testing.T) {
+	item := microsub.Item{
+		Name:     "Title",
+		Content:  &microsub.Content{HTML: "<p>Some <b>bold</b> text</p>"},
+		Author:   &microsub.Card{Name: "Peter"},
+		Category: []string{"golang"},
+	}
+	assert.Equal(t, []string{"title", "some", "bold", "text", "peter", "golang"}, itemSearchTerms(item))
+}
+
+func TestMemoryBackend_ItemSearch(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	b := &memoryBackend{store: store}
+
+	for _, timelineType := range []string{timelineTypeSortedSet, timelineTypeStream} {
+		channel := "home-" + timelineType
+		b.Settings = map[string]channelSetting{channel: {ChannelType: timelineType}}
+
+		items := []microsub.Item{
+			{ID: "1-" + timelineType, Type: "entry", Name: "Searching posts", Published: time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)},
+			{ID: "2-" + timelineType, Type: "entry", Content: &microsub.Content{Text: "Posts about search engines"}, Published: time.Date(2018, 8, 2, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)},
+			{ID: "3-" + timelineType, Type: "entry", Name: "Other posts", Category: []string{"search"}, Published: time.Date(2018, 8, 3, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)},
+		}
+		for _, item := range items {
+			_, err := b.channelAddItem(channel, item)
+			require.NoError(t, err)
+		}
+
+		results, err := b.ItemSearch(channel, "Search posts")
+		assert.NoError(t, err)
+		if assert.Len(t, results, 2, timelineType) {
+			assert.Equal(t, "3-"+timelineType, results[0].ID)
+			assert.Equal(t, "2-"+timelineType, results[1].ID)
+		}
+
+		results, err = b.ItemSearch(channel, "posts")
+		assert.NoError(t, err)
+		assert.Len(t, results, 3, timelineType)
+
+		results, err = b.ItemSearch("other", "posts")
+		assert.NoError(t, err)
+		assert.Empty(t, results)
+	}
+}
+
+func TestMemoryBackend_ItemSearchIndex(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	testItemSearchIndex(t, store)
+}
+
+// testItemSearchIndex checks that removed items are removed from the search
+// index and that updated items are indexed under their new terms
+func testItemSearchIndex(t *testing.T, store Storage) {
+	b := &memoryBackend{store: store}
+
+	ids := func(items []microsub.Item) []string {
+		var ids []string
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+	search := func(channel, query string) []string {
+		results, err := b.ItemSearch(channel, query)
+		require.NoError(t, err)
+		return ids(results)
+	}
+
+	for _, timelineType := range []string{timelineTypeSortedSet, timelineTypeStream, timelineTypeCapped} {
+		channel := "index-" + timelineType
+		b.Settings = map[string]channelSetting{channel: {ChannelType: timelineType, CappedSize: 2}}
+
+		item := func(id, name string, day int) microsub.Item {
+			return microsub.Item{ID: id, Type: "entry", Name: name, Published: time.Date(2018, 8, day, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)}
+		}
+		for _, it := range []microsub.Item{item("one", "First post", 1), item("two", "Second post", 2)} {
+			_, err := b.channelAddItem(channel, it)
+			require.NoError(t, err)
+		}
+		assert.ElementsMatch(t, []string{"one", "two"}, search(channel, "post"), timelineType)
+
+		// an update replaces the terms of the item
+		_, err := b.channelAddItem(channel, item("two", "Second article", 2))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"one"}, search(channel, "post"), timelineType)
+		assert.Equal(t, []string{"two"}, search(channel, "second article"), timelineType)
+
+		// removed items are not found, also not when they are added again
+		require.NoError(t, b.RemoveItems(channel, []string{"one"}))
+		assert.Empty(t, search(channel, "post"), timelineType)
+		_, err = b.channelAddItem(channel, item("one", "First post", 1))
+		require.NoError(t, err)
+		assert.Empty(t, search(channel, "post"), timelineType)
+
+		// the items that capped timelines drop are removed
+		if timelineType == timelineTypeCapped {
+			for _, it := range []microsub.Item{item("three", "Third article", 3), item("four", "Fourth article", 4)} {
+				_, err := b.channelAddItem(channel, it)
+				require.NoError(t, err)
+			}
+			assert.ElementsMatch(t, []string{"three", "four"}, search(channel, "article"), timelineType)
+		}
+
+		// retention removes items
+		_, err = pruneTimeline(b.getTimeline(channel), retentionPolicy{MaxItems: 1}, time.Now())
+		require.NoError(t, err)
+		assert.Len(t, search(channel, "article"), 1, timelineType)
+
+		// nothing is left of a deleted channel
+		b.Channels = map[string]microsub.Channel{channel: {UID: channel}}
+		require.NoError(t, b.ChannelsDelete(channel))
+		assert.Empty(t, search(channel, "article"), timelineType)
+	}
+}
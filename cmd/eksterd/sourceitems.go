@@ -0,0 +1,356 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"p83.nl/go/ekster/pkg/jf2"
+	"p83.nl/go/ekster/pkg/microsub"
+
+	"willnorris.com/go/microformats"
+)
+
+// sourceItemsPath is the path of the items without a url
+const sourceItemsPath = "/micropub/items/"
+
+// micropubRequest is a Micropub create, update or delete. Forms are converted
+// to the same request as the JSON syntax.
+type micropubRequest struct {
+	Type       []string                 `json:"type"`
+	Properties map[string][]interface{} `json:"properties"`
+
+	Action  string                   `json:"action"`
+	URL     string                   `json:"url"`
+	Replace map[string][]interface{} `json:"replace"`
+	Add     map[string][]interface{} `json:"add"`
+	// Delete is a list of properties, or the values to remove per property
+	Delete interface{} `json:"delete"`
+}
+
+// sourceItem is an item that a micropub source posted, the properties are
+// kept so the source can read, update and delete the item later
+type sourceItem struct {
+	// URL is the location of the item, its own url or a url on the server
+	URL        string
+	ID         string
+	Channel    string
+	Type       []string
+	Properties map[string][]interface{}
+}
+
+// createSourceItem adds the item from the source to the channel and returns
+// its location
+func (b *memoryBackend) createSourceItem(sourceID, channel, baseURL string, req micropubRequest) (string, error) {
+	if req.Properties == nil {
+		req.Properties = make(map[string][]interface{})
+	}
+	if len(req.Properties["published"]) == 0 {
+		req.Properties["published"] = []interface{}{time.Now().Format(time.RFC3339)}
+	}
+
+	item, err := simplifySourceItem(req.Type, req.Properties)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := b.store.SourceNextID(sourceID)
+	if err != nil {
+		return "", err
+	}
+	item.ID = fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("source:%s:%d", sourceID, id))))
+
+	src := sourceItem{
+		URL:        item.URL,
+		ID:         item.ID,
+		Channel:    channel,
+		Type:       req.Type,
+		Properties: req.Properties,
+	}
+	if src.URL == "" {
+		src.URL = sourceItemURL(baseURL, item.ID)
+	}
+	err = b.store.SourceItemSave(sourceID, &src)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = b.channelAddItemWithMatcher(channel, item)
+	if err != nil {
+		return "", err
+	}
+	return src.URL, b.updateChannelUnreadCount(channel)
+}
+
+// sourceItemURL returns the location on the server of the item with id, for
+// items without a url
+func sourceItemURL(baseURL, id string) string {
+	return strings.TrimRight(baseURL, "/") + sourceItemsPath + id
+}
+
+// updateSourceItem replaces, adds and deletes the properties of the item that
+// the source posted at req.URL
+func (b *memoryBackend) updateSourceItem(sourceID string, req micropubRequest) error {
+	var src sourceItem
+	err := b.store.SourceItemLoad(sourceID, req.URL, &src)
+	if err != nil {
+		return err
+	}
+
+	err = updateProperties(src.Properties, req)
+	if err != nil {
+		return err
+	}
+
+	item, err := simplifySourceItem(src.Type, src.Properties)
+	if err != nil {
+		return err
+	}
+	item.ID = src.ID
+
+	err = b.store.SourceItemSave(sourceID, &src)
+	if err != nil {
+		return err
+	}
+	_, err = b.channelAddItem(src.Channel, item)
+	return err
+}
+
+// deleteSourceItem removes the item that the source posted at url from its
+// channel
+func (b *memoryBackend) deleteSourceItem(sourceID, url string) error {
+	var src sourceItem
+	err := b.store.SourceItemLoad(sourceID, url, &src)
+	if err != nil {
+		return err
+	}
+
+	err = b.RemoveItems(src.Channel, []string{src.ID})
+	if err != nil {
+		return err
+	}
+	return b.store.SourceItemDelete(sourceID, url)
+}
+
+// updateProperties applies the replace, add and delete of the update to the
+// properties
+func updateProperties(properties map[string][]interface{}, req micropubRequest) error {
+	for k, v := range req.Replace {
+		properties[k] = v
+	}
+	for k, v := range req.Add {
+		properties[k] = append(properties[k], v...)
+	}
+
+	switch del := req.Delete.(type) {
+	case nil:
+	case []interface{}:
+		for _, k := range del {
+			name, ok := k.(string)
+			if !ok {
+				return fmt.Errorf("delete should be a list of property names")
+			}
+			delete(properties, name)
+		}
+	case map[string]interface{}:
+		for k, v := range del {
+			values, ok := v.([]interface{})
+			if !ok {
+				return fmt.Errorf("the values to delete of %q should be a list", k)
+			}
+			properties[k] = removeValues(properties[k], values)
+			if len(properties[k]) == 0 {
+				delete(properties, k)
+			}
+		}
+	default:
+		return fmt.Errorf("delete should be a list or an object")
+	}
+	return nil
+}
+
+// removeValues returns the values that are not in remove
+func removeValues(values, remove []interface{}) []interface{} {
+	var kept []interface{}
+	for _, v := range values {
+		found := false
+		for _, r := range remove {
+			if reflect.DeepEqual(v, r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// simplifySourceItem converts the properties to an item, the properties can
+// use the shorthands of Micropub, like a string for the content
+func simplifySourceItem(itemType []string, properties map[string][]interface{}) (microsub.Item, error) {
+	if len(itemType) == 0 {
+		itemType = []string{"h-entry"}
+	}
+	if !strings.HasPrefix(itemType[0], "h-") {
+		return microsub.Item{}, fmt.Errorf("unsupported type %q", itemType[0])
+	}
+
+	mf := microformats.Microformat{Type: itemType, Properties: make(map[string][]interface{})}
+	for k, values := range properties {
+		if len(values) == 0 {
+			continue
+		}
+		for _, v := range values {
+			mf.Properties[k] = append(mf.Properties[k], simplifyValue(k, v))
+		}
+	}
+
+	item, ok := jf2.SimplifyMicroformatItem(&mf, microsub.Card{})
+	if !ok {
+		return microsub.Item{}, fmt.Errorf("unsupported type %q", itemType[0])
+	}
+	return item, nil
+}
+
+// simplifyValue converts a property value to the value that jf2 expects
+func simplifyValue(k string, v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		if k == "content" {
+			return map[string]interface{}{"value": t}
+		}
+		return t
+	case map[string]interface{}:
+		if props, ok := t["properties"].(map[string]interface{}); ok {
+			return nestedMicroformat(t, props)
+		}
+		if k == "content" {
+			return t
+		}
+		// a photo with alt text
+		if value, ok := t["value"].(string); ok {
+			return value
+		}
+		return t
+	case *microformats.Microformat:
+		return t
+	}
+	return fmt.Sprint(v)
+}
+
+// nestedMicroformat converts a JSON object with a type and properties to a
+// microformat
+func nestedMicroformat(obj, props map[string]interface{}) *microformats.Microformat {
+	mf := &microformats.Microformat{Properties: make(map[string][]interface{})}
+	if types, ok := obj["type"].([]interface{}); ok {
+		for _, t := range types {
+			mf.Type = append(mf.Type, fmt.Sprint(t))
+		}
+	}
+	if value, ok := obj["value"].(string); ok {
+		mf.Value = value
+	}
+	for k, v := range props {
+		values, ok := v.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, value := range values {
+			mf.Properties[k] = append(mf.Properties[k], simplifyValue(k, value))
+		}
+	}
+	return mf
+}
+
+// itemProperties returns the properties of a jf2 item
+func itemProperties(item microsub.Item) map[string][]interface{} {
+	properties := make(map[string][]interface{})
+	for k, v := range map[string]string{
+		"name":      item.Name,
+		"summary":   item.Summary,
+		"featured":  item.Featured,
+		"published": item.Published,
+		"updated":   item.Updated,
+		"url":       item.URL,
+		"uid":       item.UID,
+		"latitude":  item.Latitude,
+		"longitude": item.Longitude,
+	} {
+		if v != "" {
+			properties[k] = []interface{}{v}
+		}
+	}
+	for k, values := range map[string][]string{
+		"category":    item.Category,
+		"photo":       item.Photo,
+		"audio":       item.Audio,
+		"video":       item.Video,
+		"syndication": item.Syndication,
+		"like-of":     item.LikeOf,
+		"bookmark-of": item.BookmarkOf,
+		"repost-of":   item.RepostOf,
+		"in-reply-to": item.InReplyTo,
+	} {
+		for _, v := range values {
+			properties[k] = append(properties[k], v)
+		}
+	}
+	if item.Content != nil {
+		content := make(map[string]interface{})
+		if item.Content.Text != "" {
+			content["value"] = item.Content.Text
+		}
+		if item.Content.HTML != "" {
+			content["html"] = item.Content.HTML
+		}
+		properties["content"] = []interface{}{content}
+	}
+	if item.Author != nil {
+		properties["author"] = []interface{}{cardProperties(*item.Author)}
+	}
+	if item.Checkin != nil {
+		properties["checkin"] = []interface{}{cardProperties(*item.Checkin)}
+	}
+	return properties
+}
+
+// cardProperties returns the card as a JSON h-card
+func cardProperties(card microsub.Card) map[string]interface{} {
+	props := make(map[string]interface{})
+	for k, v := range map[string]string{
+		"name":         card.Name,
+		"url":          card.URL,
+		"photo":        card.Photo,
+		"locality":     card.Locality,
+		"region":       card.Region,
+		"country-name": card.CountryName,
+		"latitude":     card.Latitude,
+		"longitude":    card.Longitude,
+	} {
+		if v != "" {
+			props[k] = []interface{}{v}
+		}
+	}
+	return map[string]interface{}{"type": []interface{}{"h-card"}, "properties": props}
+}
@@ -0,0 +1,185 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"p83.nl/go/ekster/pkg/microsub"
+	"p83.nl/go/ekster/pkg/util"
+)
+
+// sourceRateWindow is the period of the rate limit of the sources
+const sourceRateWindow = time.Hour
+
+// source is a micropub source, the items that are posted with the ID are
+// added to the channel
+type source struct {
+	ID        string `redis:"-" json:"-"`
+	Channel   string `redis:"-" json:"-"`
+	Items     int    `redis:"-" json:"-"`
+	Label     string `redis:"label"`
+	RateLimit int    `redis:"rate_limit"`
+	LastUsed  int64  `redis:"last_used"`
+}
+
+// sourceRate counts the items of a source in the current window
+type sourceRate struct {
+	start time.Time
+	count int
+}
+
+func (src source) microsub() microsub.MicropubSource {
+	s := microsub.MicropubSource{
+		ID:        src.ID,
+		Label:     src.Label,
+		Channel:   src.Channel,
+		Items:     src.Items,
+		RateLimit: src.RateLimit,
+	}
+	if src.LastUsed != 0 {
+		s.LastUsed = time.Unix(src.LastUsed, 0).Format(time.RFC3339)
+	}
+	return s
+}
+
+// SourcesGetList returns the micropub sources sorted by label
+func (b *memoryBackend) SourcesGetList() ([]microsub.MicropubSource, error) {
+	ids, err := b.store.Sources()
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []microsub.MicropubSource{}
+	for _, id := range ids {
+		var src source
+		err = b.store.SourceLoad(id, &src)
+		if err != nil {
+			log.Printf("Error while loading source %s: %v\n", id, err)
+			continue
+		}
+		sources = append(sources, src.microsub())
+	}
+
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Label != sources[j].Label {
+			return sources[i].Label < sources[j].Label
+		}
+		return sources[i].ID < sources[j].ID
+	})
+	return sources, nil
+}
+
+// SourcesCreate creates a source with a new ID that posts to the channel
+func (b *memoryBackend) SourcesCreate(s microsub.MicropubSource) (microsub.MicropubSource, error) {
+	src := source{ID: util.RandStringBytes(32)}
+	err := b.setSource(&src, s)
+	if err != nil {
+		return microsub.MicropubSource{}, err
+	}
+	return src.microsub(), nil
+}
+
+// SourcesUpdate changes the label, channel and rate limit of the source
+func (b *memoryBackend) SourcesUpdate(s microsub.MicropubSource) (microsub.MicropubSource, error) {
+	var src source
+	err := b.store.SourceLoad(s.ID, &src)
+	if err == errNotFound {
+		return microsub.MicropubSource{}, fmt.Errorf("unknown source %s", s.ID)
+	}
+	if err != nil {
+		return microsub.MicropubSource{}, err
+	}
+
+	err = b.setSource(&src, s)
+	if err != nil {
+		return microsub.MicropubSource{}, err
+	}
+	return src.microsub(), nil
+}
+
+// setSource copies the fields of s that can be changed to src and saves it
+func (b *memoryBackend) setSource(src *source, s microsub.MicropubSource) error {
+	b.lock.RLock()
+	_, ok := b.Channels[s.Channel]
+	b.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown channel %q", s.Channel)
+	}
+	if s.RateLimit < 0 {
+		return fmt.Errorf("rate limit can't be negative")
+	}
+
+	src.Label = s.Label
+	src.Channel = s.Channel
+	src.RateLimit = s.RateLimit
+	return b.store.SourceSave(src)
+}
+
+// SourcesDelete deletes the source, its items stay in the channel
+func (b *memoryBackend) SourcesDelete(id string) error {
+	b.sourcesLock.Lock()
+	delete(b.sourceRates, id)
+	b.sourcesLock.Unlock()
+
+	return b.store.SourceDelete(id)
+}
+
+// errRateLimited is returned when a source posts more items than its rate
+// limit allows
+var errRateLimited = errors.New("rate limit of the source is exceeded")
+
+// useSource records that the source posts an item at now. When the source is
+// over its rate limit, it returns errRateLimited and the time until the next
+// item is accepted. Tokens from /auth/token are no sources and have no limit.
+func (b *memoryBackend) useSource(sourceID string, now time.Time) (time.Duration, error) {
+	var src source
+	err := b.store.SourceLoad(sourceID, &src)
+	if err == errNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if src.RateLimit > 0 {
+		b.sourcesLock.Lock()
+		if b.sourceRates == nil {
+			b.sourceRates = make(map[string]*sourceRate)
+		}
+		rate, ok := b.sourceRates[sourceID]
+		if !ok || now.Sub(rate.start) >= sourceRateWindow {
+			rate = &sourceRate{start: now}
+			b.sourceRates[sourceID] = rate
+		}
+		if rate.count >= src.RateLimit {
+			b.sourcesLock.Unlock()
+			return rate.start.Add(sourceRateWindow).Sub(now), errRateLimited
+		}
+		rate.count++
+		b.sourcesLock.Unlock()
+	}
+
+	src.LastUsed = now.Unix()
+	return 0, b.store.SourceSave(&src)
+}
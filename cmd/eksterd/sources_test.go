@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func TestMemoryBackend_Sources(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	b := &memoryBackend{store: store, Me: "https://owner.example/"}
+	b.setState(defaultState())
+	b.refreshChannels()
+
+	_, err := b.SourcesCreate(microsub.MicropubSource{Label: "Bridge", Channel: "unknown"})
+	assert.Error(t, err)
+
+	created, err := b.SourcesCreate(microsub.MicropubSource{Label: "Bridge", Channel: "home"})
+	require.NoError(t, err)
+	assert.NotEmpty(t, created.ID)
+	_, err = b.SourcesCreate(microsub.MicropubSource{Label: "Alerts", Channel: "notifications", RateLimit: 10})
+	require.NoError(t, err)
+
+	sources, err := b.SourcesGetList()
+	require.NoError(t, err)
+	require.Len(t, sources, 2)
+	assert.Equal(t, "Alerts", sources[0].Label)
+	assert.Equal(t, 10, sources[0].RateLimit)
+	assert.Equal(t, created, sources[1])
+
+	_, err = b.SourcesUpdate(microsub.MicropubSource{ID: created.ID, Label: "Bridge", Channel: "home", RateLimit: -1})
+	assert.Error(t, err)
+	_, err = b.SourcesUpdate(microsub.MicropubSource{ID: "unknown", Channel: "home"})
+	assert.Error(t, err)
+
+	updated, err := b.SourcesUpdate(microsub.MicropubSource{ID: created.ID, Label: "Renamed", Channel: "notifications", RateLimit: 5})
+	require.NoError(t, err)
+	assert.Equal(t, "notifications", updated.Channel)
+
+	users := newUserBackends(b)
+	backend, channel, err := users.sourceBackend(created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, b, backend)
+	assert.Equal(t, "notifications", channel)
+
+	require.NoError(t, b.SourcesDelete(created.ID))
+	sources, err = b.SourcesGetList()
+	require.NoError(t, err)
+	assert.Len(t, sources, 1)
+	_, _, err = users.sourceBackend(created.ID)
+	assert.Error(t, err)
+}
+
+func TestMicropubHandler_SourceRateLimit(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	b := &memoryBackend{store: store, Me: "https://owner.example/"}
+	b.setState(defaultState())
+	b.refreshChannels()
+	h := &micropubHandler{Users: newUserBackends(b)}
+
+	src, err := b.SourcesCreate(microsub.MicropubSource{Label: "Bridge", Channel: "home", RateLimit: 2})
+	require.NoError(t, err)
+	assert.Empty(t, src.LastUsed)
+
+	post := func(content string) *httptest.ResponseRecorder {
+		form := url.Values{"content": {content}}
+		r := httptest.NewRequest("POST", "/micropub?source_id="+src.ID, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	assert.Equal(t, 201, post("first").Code)
+	assert.Equal(t, 201, post("second").Code)
+	w := post("third")
+	assert.Equal(t, 429, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	sources, err := b.SourcesGetList()
+	require.NoError(t, err)
+	require.Len(t, sources, 1)
+	assert.Equal(t, 2, sources[0].Items)
+	assert.NotEmpty(t, sources[0].LastUsed)
+
+	// the window starts over after an hour
+	_, err = b.useSource(src.ID, time.Now().Add(sourceRateWindow))
+	assert.NoError(t, err)
+
+	// without a rate limit every item is accepted
+	_, err = b.SourcesUpdate(microsub.MicropubSource{ID: src.ID, Label: "Bridge", Channel: "home"})
+	require.NoError(t, err)
+	assert.Equal(t, 201, post("fourth").Code)
+}
+
+func TestMainHandler_Sources(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	owner := &memoryBackend{store: store, Me: "https://owner.example/"}
+	owner.setState(defaultState())
+	owner.refreshChannels()
+	users := newUserBackends(owner)
+	users.AuthEnabled = true
+	h := &mainHandler{Users: users, TemplateDir: "../../templates", BaseURL: "https://ekster.example/"}
+	require.NoError(t, store.SessionSave("s1", &session{Me: owner.Me, LoggedIn: true}))
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post("/settings/sources", url.Values{"label": {"Bridge"}, "channel": {"home"}, "rate_limit": {"3"}})
+	require.Equal(t, 302, w.Code)
+	sources, err := owner.SourcesGetList()
+	require.NoError(t, err)
+	require.Len(t, sources, 1)
+	id := sources[0].ID
+	assert.Equal(t, 3, sources[0].RateLimit)
+
+	w = post("/settings/sources", url.Values{"id": {id}, "label": {"Renamed"}, "channel": {"notifications"}, "rate_limit": {"many"}})
+	assert.Equal(t, 400, w.Code)
+	w = post("/settings/sources", url.Values{"id": {id}, "label": {"Renamed"}, "channel": {"notifications"}, "rate_limit": {"0"}})
+	require.Equal(t, 302, w.Code)
+
+	r := httptest.NewRequest("GET", "/settings/sources", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "Renamed")
+	assert.Contains(t, w.Body.String(), "https://ekster.example/micropub?source_id="+id)
+
+	w = post("/settings/sources/delete", url.Values{"id": {id}})
+	require.Equal(t, 302, w.Code)
+	sources, err = owner.SourcesGetList()
+	require.NoError(t, err)
+	assert.Empty(t, sources)
+}
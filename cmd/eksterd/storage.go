@@ -0,0 +1,228 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"p83.nl/go/ekster/pkg/auth"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+const backendFilename = "backend.json"
+
+// Storage keeps the state of eksterd. The configuration of the server
+// (Me, TokenEndpoint, Users) is always read from backend.json.
+//
+// The storage returned by newStorage belongs to the owner of the server, Me in
+// backend.json. User returns the storage of the other users. Sessions, auth
+// requests, the token and HTTP caches and the WebSub feeds are shared by all
+// users.
+type Storage interface {
+	// User returns the storage of the channels, feeds, timelines and sources of me
+	User(me string) (Storage, error)
+
+	// LoadBackend loads the channels, feeds and settings into b
+	LoadBackend(b *memoryBackend) error
+	// SaveBackend saves the channels, feeds and settings of b
+	SaveBackend(b *memoryBackend) error
+
+	// ChannelsReset forgets which channels exist, but keeps their sort order
+	ChannelsReset() error
+	// ChannelAdd adds a channel, prio is only used when the channel has no sort order yet
+	ChannelAdd(uid string, prio int) error
+	ChannelRemove(uid string) error
+	// ChannelsSorted returns the uids of the channels in sort order
+	ChannelsSorted() ([]string, error)
+	// ChannelsOrder sets the sort order of the channels to the order of uids
+	ChannelsOrder(uids []string) error
+
+	// UnindexItem removes the item from the search index of the channel, the
+	// timelines add the items they keep to the index and remove them again
+	UnindexItem(channel, id string) error
+	// SearchItems returns the items of the channel that are indexed under all terms
+	SearchItems(channel string, terms []string) ([]microsub.Item, error)
+
+	// Timeline returns the timeline of the channel, or nil when timelineType is not supported.
+	// The size is only used by capped timelines.
+	Timeline(channel, timelineType string, size int) TimelineBackend
+
+	SessionLoad(id string, sess *session) error
+	SessionSave(id string, sess *session) error
+	SessionDelete(id string) error
+
+	// AuthRequestLoad loads the auth request saved under key ("state:", "code:" or "token:")
+	AuthRequestLoad(key string, req *authRequest) error
+	// AuthRequestSave saves req under key, an expire of 0 means it never expires
+	AuthRequestSave(key string, req *authRequest, expire time.Duration) error
+	AuthRequestDelete(key string) error
+
+	// AuthTokens returns the tokens that /auth/token issued to me, including
+	// tokens that have expired since
+	AuthTokens(me string) ([]string, error)
+	AuthTokenAdd(me, token string) error
+	AuthTokenRemove(me, token string) error
+
+	TokenCacheGet(key string, r *auth.TokenResponse) (bool, error)
+	TokenCacheSet(key string, r *auth.TokenResponse, expire time.Duration) error
+	TokenCacheDelete(key string) error
+
+	// CacheGet returns the cached HTTP response for key
+	CacheGet(key string) ([]byte, error)
+	CacheSet(key string, data []byte, expire time.Duration) error
+
+	// HubFeedCreate saves a new WebSub feed and sets its ID
+	HubFeedCreate(feed *Feed) (int64, error)
+	HubFeedGet(id int64) (Feed, error)
+	HubFeedSave(feed Feed) error
+	HubFeeds() ([]Feed, error)
+
+	// FeedStatusLoad loads the fetch status of the feed in the channel, a feed
+	// that wasn't fetched yet has the zero status
+	FeedStatusLoad(channel, feedURL string, status *feedStatus) error
+	FeedStatusSave(channel, feedURL string, status *feedStatus) error
+	FeedStatusDelete(channel, feedURL string) error
+
+	// SourceChannel returns the channel that the micropub source posts to
+	SourceChannel(sourceID string) (string, error)
+	SourceNextID(sourceID string) (int, error)
+	// Sources returns the ids of the micropub sources
+	Sources() ([]string, error)
+	// SourceLoad loads the source, Items is the last id of SourceNextID. It
+	// returns errNotFound for unknown sources.
+	SourceLoad(sourceID string, src *source) error
+	// SourceSave saves the source, except Items
+	SourceSave(src *source) error
+	// SourceDelete deletes the source and the items it posted
+	SourceDelete(sourceID string) error
+
+	// SourceItemLoad loads the item that the source posted at url, it returns
+	// errNotFound for unknown items
+	SourceItemLoad(sourceID, url string, item *sourceItem) error
+	// SourceItemSave saves the item under its URL
+	SourceItemSave(sourceID string, item *sourceItem) error
+	SourceItemDelete(sourceID, url string) error
+
+	Close() error
+}
+
+// backendState is the part of the memoryBackend that is saved by the storage
+type backendState struct {
+	Channels map[string]microsub.Channel
+	Feeds    map[string][]microsub.Feed
+	Settings map[string]channelSetting
+	Muted    map[string][]string
+	Blocked  map[string][]string
+	NextUid  int
+
+	ChannelsOrdered bool
+}
+
+// defaultState is the state of a new backend with the notifications and home
+// channels
+func defaultState() backendState {
+	state := backendState{
+		Channels: make(map[string]microsub.Channel),
+		Feeds:    make(map[string][]microsub.Feed),
+		Settings: make(map[string]channelSetting),
+		NextUid:  1000000,
+	}
+	for _, c := range []microsub.Channel{
+		{UID: "notifications", Name: "Notifications"},
+		{UID: "home", Name: "Home"},
+	} {
+		state.Channels[c.UID] = c
+	}
+	return state
+}
+
+// userPrefix is the prefix of the keys of the user in the storage
+func userPrefix(me string) string {
+	return fmt.Sprintf("user:%x:", sha1.Sum([]byte(me)))
+}
+
+func (b *memoryBackend) state() backendState {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return backendState{
+		Channels: b.Channels,
+		Feeds:    b.Feeds,
+		Settings: b.Settings,
+		Muted:    b.Muted,
+		Blocked:  b.Blocked,
+		NextUid:  b.NextUid,
+
+		ChannelsOrdered: b.ChannelsOrdered,
+	}
+}
+
+func (b *memoryBackend) setState(state backendState) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.Channels = state.Channels
+	b.Feeds = state.Feeds
+	b.Settings = state.Settings
+	b.Muted = state.Muted
+	b.Blocked = state.Blocked
+	b.NextUid = state.NextUid
+	b.ChannelsOrdered = state.ChannelsOrdered
+}
+
+func newStorage(options AppOptions) (Storage, error) {
+	switch options.Storage {
+	case "redis":
+		return newRedisStorage(options.RedisServer), nil
+	case "bolt":
+		return newBoltStorage(options.Database)
+	}
+	return nil, fmt.Errorf("unknown storage %q, use redis or bolt", options.Storage)
+}
+
+// loadBackendFile reads backend.json into b
+func loadBackendFile(b *memoryBackend) error {
+	f, err := os.Open(backendFilename)
+	if err != nil {
+		panic("cant open backend.json")
+	}
+	defer f.Close()
+	jw := json.NewDecoder(f)
+	err = jw.Decode(b)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// saveBackendFile writes b to backend.json
+func saveBackendFile(b *memoryBackend) error {
+	f, err := os.Create(backendFilename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	jw := json.NewEncoder(f)
+	jw.SetIndent("", "    ")
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return jw.Encode(b)
+}
@@ -0,0 +1,1852 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"p83.nl/go/ekster/pkg/auth"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+var (
+	bucketBackend      = []byte("backend")
+	bucketChannels     = []byte("channels")
+	bucketSortOrder    = []byte("channel_sortorder")
+	bucketSessions     = []byte("sessions")
+	bucketAuth         = []byte("auth")
+	bucketAuthTokens   = []byte("auth_tokens")
+	bucketTokenCache   = []byte("token_cache")
+	bucketHTTPCache    = []byte("http_cache")
+	bucketFeeds        = []byte("feeds")
+	bucketFeedStatus   = []byte("feed_status")
+	bucketSources      = []byte("sources")
+	bucketSourceInfo   = []byte("source_info")
+	bucketSourceNextID = []byte("source_next_id")
+	bucketSourceItems  = []byte("source_items")
+	bucketItems        = []byte("items")
+
+	bucketPosts  = []byte("posts")
+	bucketScores = []byte("scores")
+	bucketRead   = []byte("read")
+
+	bucketRemoved = []byte("removed")
+
+	keyState = []byte("state")
+)
+
+// userBuckets are the buckets that every user has, the other buckets are
+// shared by all users
+var userBuckets = [][]byte{
+	bucketBackend, bucketChannels, bucketSortOrder, bucketFeedStatus,
+	bucketSources, bucketSourceInfo, bucketSourceNextID, bucketSourceItems,
+}
+
+// errNotFound is returned when a key does not exist or has expired
+var errNotFound = errors.New("not found")
+
+// boltStorage keeps everything in a single bolt database, so eksterd can run
+// without Redis
+type boltStorage struct {
+	db *bolt.DB
+
+	// prefix is added to the buckets and channels of the user, it's empty for
+	// the owner
+	prefix string
+}
+
+// expiringValue wraps values that should disappear after a while, like Redis EXPIRE
+type expiringValue struct {
+	Expires int64  `json:"expires"`
+	Data    []byte `json:"data"`
+}
+
+func newBoltStorage(path string) (*boltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("while opening database %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range append([][]byte{
+			bucketSessions, bucketAuth, bucketAuthTokens, bucketTokenCache, bucketHTTPCache,
+			bucketFeeds, bucketItems,
+		}, userBuckets...) {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStorage{db: db}, nil
+}
+
+// User returns the storage of me, the buckets of the user are created when
+// they don't exist
+func (s *boltStorage) User(me string) (Storage, error) {
+	user := &boltStorage{db: s.db, prefix: userPrefix(me)}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range userBuckets {
+			if _, err := tx.CreateBucketIfNotExists(user.bucket(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// bucket returns the name of the bucket of the user
+func (s *boltStorage) bucket(name []byte) []byte {
+	return append([]byte(s.prefix), name...)
+}
+
+// LoadBackend reads the configuration of the owner from backend.json, the
+// channels, feeds and settings saved in the database replace the ones from the
+// file. The other users are only saved in the database.
+func (s *boltStorage) LoadBackend(b *memoryBackend) error {
+	if s.prefix == "" {
+		err := loadBackendFile(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data = copyBytes(tx.Bucket(s.bucket(bucketBackend)).Get(keyState))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Nothing saved yet, use the state from backend.json
+	if data == nil {
+		return nil
+	}
+
+	var state backendState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	b.setState(state)
+	return nil
+}
+
+func (s *boltStorage) SaveBackend(b *memoryBackend) error {
+	data, err := json.Marshal(b.state())
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket(bucketBackend)).Put(keyState, data)
+	})
+}
+
+func (s *boltStorage) ChannelsReset() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(s.bucket(bucketChannels)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(s.bucket(bucketChannels))
+		return err
+	})
+}
+
+func (s *boltStorage) ChannelAdd(uid string, prio int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(s.bucket(bucketChannels)).Put([]byte(uid), []byte{}); err != nil {
+			return err
+		}
+		order := tx.Bucket(s.bucket(bucketSortOrder))
+		if order.Get([]byte(uid)) != nil {
+			return nil
+		}
+		return order.Put([]byte(uid), []byte(strconv.Itoa(prio)))
+	})
+}
+
+func (s *boltStorage) ChannelRemove(uid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(s.bucket(bucketChannels)).Delete([]byte(uid)); err != nil {
+			return err
+		}
+		return tx.Bucket(s.bucket(bucketSortOrder)).Delete([]byte(uid))
+	})
+}
+
+func (s *boltStorage) ChannelsSorted() ([]string, error) {
+	type channelOrder struct {
+		uid  string
+		prio int
+	}
+	var channels []channelOrder
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		order := tx.Bucket(s.bucket(bucketSortOrder))
+		return tx.Bucket(s.bucket(bucketChannels)).ForEach(func(k, v []byte) error {
+			prio, _ := strconv.Atoi(string(order.Get(k)))
+			channels = append(channels, channelOrder{string(k), prio})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(channels, func(i, j int) bool {
+		if channels[i].prio == channels[j].prio {
+			return channels[i].uid < channels[j].uid
+		}
+		return channels[i].prio < channels[j].prio
+	})
+
+	var uids []string
+	for _, c := range channels {
+		uids = append(uids, c.uid)
+	}
+	return uids, nil
+}
+
+func (s *boltStorage) ChannelsOrder(uids []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		order := tx.Bucket(s.bucket(bucketSortOrder))
+		for i, uid := range uids {
+			if err := order.Put([]byte(uid), []byte(strconv.Itoa(i+1))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The search index of a channel is kept in three buckets, the keys of the
+// search bucket are the term and the item id separated by a zero byte. The
+// timelines keep it up to date with indexBoltItem and unindexBoltItems, the
+// channel of these functions includes the prefix of the user.
+
+func searchBucketName(channel string) []byte {
+	return []byte("search:" + channel)
+}
+
+// searchItemsBucketName is the bucket with the copies of the items that search
+// returns, stream timelines don't keep the items under their id
+func searchItemsBucketName(channel string) []byte {
+	return []byte("searchitems:" + channel)
+}
+
+// searchTermsBucketName is the bucket with the terms of every item, so they
+// can be removed from the index
+func searchTermsBucketName(channel string) []byte {
+	return []byte("searchterms:" + channel)
+}
+
+// indexBoltItem adds the item to the search index of the channel, the terms
+// of an updated item replace the old terms
+func indexBoltItem(tx *bolt.Tx, channel string, item microsub.Item) error {
+	if item.ID == "" {
+		return nil
+	}
+
+	items, err := tx.CreateBucketIfNotExists(searchItemsBucketName(channel))
+	if err != nil {
+		return err
+	}
+	id := []byte(item.ID)
+	var stored redisItem
+	if data := items.Get(id); data != nil && json.Unmarshal(data, &stored) == nil && !isItemUpdate(stored, item, itemHash(item)) {
+		return nil
+	}
+
+	if err := unindexBoltItems(tx, channel, []string{item.ID}); err != nil {
+		return err
+	}
+	if err := saveBoltItem(items, id, &item); err != nil {
+		return err
+	}
+
+	b, err := tx.CreateBucketIfNotExists(searchBucketName(channel))
+	if err != nil {
+		return err
+	}
+	terms := itemSearchTerms(item)
+	for _, term := range terms {
+		if err := b.Put(append([]byte(term+"\x00"), id...), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	termsBucket, err := tx.CreateBucketIfNotExists(searchTermsBucketName(channel))
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(terms)
+	if err != nil {
+		return err
+	}
+	return termsBucket.Put(id, data)
+}
+
+// unindexBoltItems removes the items from the search index of the channel
+func unindexBoltItems(tx *bolt.Tx, channel string, ids []string) error {
+	termsBucket := tx.Bucket(searchTermsBucketName(channel))
+	if termsBucket == nil {
+		return nil
+	}
+	b := tx.Bucket(searchBucketName(channel))
+	items := tx.Bucket(searchItemsBucketName(channel))
+
+	for _, id := range ids {
+		var terms []string
+		if data := termsBucket.Get([]byte(id)); data != nil {
+			if err := json.Unmarshal(data, &terms); err != nil {
+				return err
+			}
+		}
+		for _, term := range terms {
+			if err := b.Delete([]byte(term + "\x00" + id)); err != nil {
+				return err
+			}
+		}
+		if err := termsBucket.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := items.Delete([]byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStorage) UnindexItem(channel, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return unindexBoltItems(tx, s.prefix+channel, []string{id})
+	})
+}
+
+func (s *boltStorage) SearchItems(channel string, terms []string) ([]microsub.Item, error) {
+	var items []microsub.Item
+
+	channel = s.prefix + channel
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(searchBucketName(channel))
+		if b == nil {
+			return nil
+		}
+
+		var matches map[string]bool
+		for i, term := range terms {
+			prefix := []byte(term + "\x00")
+			found := make(map[string]bool)
+			c := b.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				id := string(k[len(prefix):])
+				if i == 0 || matches[id] {
+					found[id] = true
+				}
+			}
+			matches = found
+		}
+
+		itemsBucket := tx.Bucket(searchItemsBucketName(channel))
+		for id := range matches {
+			if item, ok := loadBoltItem(itemsBucket, []byte(id)); ok {
+				items = append(items, item)
+			}
+		}
+		return nil
+	})
+
+	return items, err
+}
+
+func (s *boltStorage) Timeline(channel, timelineType string, size int) TimelineBackend {
+	channel = s.prefix + channel
+	switch timelineType {
+	case timelineTypeSortedSet:
+		return &boltSortedSetTimeline{db: s.db, channel: channel}
+	case timelineTypeStream:
+		return &boltStreamTimeline{db: s.db, channel: channel}
+	case timelineTypeCapped:
+		return &boltCappedTimeline{db: s.db, channel: channel, size: size}
+	}
+	return nil
+}
+
+func (s *boltStorage) SessionLoad(id string, sess *session) error {
+	data, err := s.get(bucketSessions, id)
+	if err == errNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, sess)
+}
+
+func (s *boltStorage) SessionSave(id string, sess *session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return s.put(bucketSessions, id, data)
+}
+
+func (s *boltStorage) SessionDelete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketSessions).Delete([]byte(id))
+	})
+}
+
+func (s *boltStorage) AuthRequestLoad(key string, req *authRequest) error {
+	data, err := s.getExpiring(bucketAuth, key)
+	if err == errNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, req)
+}
+
+func (s *boltStorage) AuthRequestSave(key string, req *authRequest, expire time.Duration) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return s.putExpiring(bucketAuth, key, data, expire)
+}
+
+func (s *boltStorage) AuthRequestDelete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAuth).Delete([]byte(key))
+	})
+}
+
+// authTokenKey is the key of the token in the auth_tokens bucket, the tokens
+// of a user are next to each other
+func authTokenKey(me, token string) []byte {
+	return []byte(me + " " + token)
+}
+
+func (s *boltStorage) AuthTokens(me string) ([]string, error) {
+	var tokens []string
+	prefix := authTokenKey(me, "")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketAuthTokens).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			tokens = append(tokens, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	return tokens, err
+}
+
+func (s *boltStorage) AuthTokenAdd(me, token string) error {
+	return s.put(bucketAuthTokens, string(authTokenKey(me, token)), []byte{})
+}
+
+func (s *boltStorage) AuthTokenRemove(me, token string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAuthTokens).Delete(authTokenKey(me, token))
+	})
+}
+
+func (s *boltStorage) TokenCacheGet(key string, r *auth.TokenResponse) (bool, error) {
+	data, err := s.getExpiring(bucketTokenCache, key)
+	if err != nil {
+		return false, fmt.Errorf("error while getting value from backend: %v", err)
+	}
+	err = json.Unmarshal(data, r)
+	if err != nil {
+		return false, fmt.Errorf("error while getting value from backend: %v", err)
+	}
+	return true, nil
+}
+
+func (s *boltStorage) TokenCacheSet(key string, r *auth.TokenResponse, expire time.Duration) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("error while setting token: %v", err)
+	}
+	return s.putExpiring(bucketTokenCache, key, data, expire)
+}
+
+func (s *boltStorage) TokenCacheDelete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTokenCache).Delete([]byte(key))
+	})
+}
+
+func (s *boltStorage) CacheGet(key string) ([]byte, error) {
+	return s.getExpiring(bucketHTTPCache, key)
+}
+
+func (s *boltStorage) CacheSet(key string, data []byte, expire time.Duration) error {
+	return s.putExpiring(bucketHTTPCache, key, data, expire)
+}
+
+func (s *boltStorage) HubFeedCreate(feed *Feed) (int64, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		feeds := tx.Bucket(bucketFeeds)
+		id, err := feeds.NextSequence()
+		if err != nil {
+			return err
+		}
+		feed.ID = int64(id)
+		data, err := json.Marshal(feed)
+		if err != nil {
+			return err
+		}
+		return feeds.Put(itob(feed.ID), data)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return feed.ID, nil
+}
+
+func (s *boltStorage) HubFeedGet(id int64) (Feed, error) {
+	var feed Feed
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketFeeds).Get(itob(id))
+		if data == nil {
+			return fmt.Errorf("feed %d does not exist", id)
+		}
+		return json.Unmarshal(data, &feed)
+	})
+	return feed, err
+}
+
+func (s *boltStorage) HubFeedSave(feed Feed) error {
+	data, err := json.Marshal(feed)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketFeeds).Put(itob(feed.ID), data)
+	})
+}
+
+func (s *boltStorage) HubFeeds() ([]Feed, error) {
+	feeds := []Feed{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketFeeds).ForEach(func(k, v []byte) error {
+			var feed Feed
+			if err := json.Unmarshal(v, &feed); err != nil {
+				log.Println(err)
+				return nil
+			}
+			feeds = append(feeds, feed)
+			return nil
+		})
+	})
+	return feeds, err
+}
+
+func (s *boltStorage) FeedStatusLoad(channel, feedURL string, status *feedStatus) error {
+	data, err := s.get(s.bucket(bucketFeedStatus), feedStatusKey(channel, feedURL))
+	if err == errNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, status)
+}
+
+func (s *boltStorage) FeedStatusSave(channel, feedURL string, status *feedStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return s.put(s.bucket(bucketFeedStatus), feedStatusKey(channel, feedURL), data)
+}
+
+func (s *boltStorage) FeedStatusDelete(channel, feedURL string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket(bucketFeedStatus)).Delete([]byte(feedStatusKey(channel, feedURL)))
+	})
+}
+
+func (s *boltStorage) SourceChannel(sourceID string) (string, error) {
+	data, err := s.get(s.bucket(bucketSources), sourceID)
+	if err == nil {
+		return string(data), nil
+	}
+
+	var req authRequest
+	err = s.AuthRequestLoad("token:"+sourceID, &req)
+	if err != nil {
+		return "", err
+	}
+	if req.Channel == "" {
+		return "", fmt.Errorf("unknown source %s", sourceID)
+	}
+	return req.Channel, nil
+}
+
+func (s *boltStorage) SourceNextID(sourceID string) (int, error) {
+	var id int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket(bucketSourceNextID))
+		id, _ = strconv.Atoi(string(b.Get([]byte(sourceID))))
+		id++
+		return b.Put([]byte(sourceID), []byte(strconv.Itoa(id)))
+	})
+	return id, err
+}
+
+func (s *boltStorage) Sources() ([]string, error) {
+	var ids []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket(bucketSources)).ForEach(func(k, v []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+func (s *boltStorage) SourceLoad(sourceID string, src *source) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		channel := tx.Bucket(s.bucket(bucketSources)).Get([]byte(sourceID))
+		if channel == nil {
+			return errNotFound
+		}
+		if data := tx.Bucket(s.bucket(bucketSourceInfo)).Get([]byte(sourceID)); data != nil {
+			if err := json.Unmarshal(data, src); err != nil {
+				return err
+			}
+		}
+		src.ID = sourceID
+		src.Channel = string(channel)
+		src.Items, _ = strconv.Atoi(string(tx.Bucket(s.bucket(bucketSourceNextID)).Get([]byte(sourceID))))
+		return nil
+	})
+}
+
+func (s *boltStorage) SourceSave(src *source) error {
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(s.bucket(bucketSources)).Put([]byte(src.ID), []byte(src.Channel))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(s.bucket(bucketSourceInfo)).Put([]byte(src.ID), data)
+	})
+}
+
+func (s *boltStorage) SourceDelete(sourceID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketSources, bucketSourceInfo, bucketSourceNextID} {
+			if err := tx.Bucket(s.bucket(name)).Delete([]byte(sourceID)); err != nil {
+				return err
+			}
+		}
+
+		prefix := sourceItemKey(sourceID, "")
+		c := tx.Bucket(s.bucket(bucketSourceItems)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sourceItemKey is the key of the item at url of the source, the source ids
+// don't contain spaces
+func sourceItemKey(sourceID, url string) []byte {
+	return []byte(sourceID + " " + url)
+}
+
+func (s *boltStorage) SourceItemLoad(sourceID, url string, item *sourceItem) error {
+	data, err := s.get(s.bucket(bucketSourceItems), string(sourceItemKey(sourceID, url)))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, item)
+}
+
+func (s *boltStorage) SourceItemSave(sourceID string, item *sourceItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return s.put(s.bucket(bucketSourceItems), string(sourceItemKey(sourceID, item.URL)), data)
+}
+
+func (s *boltStorage) SourceItemDelete(sourceID, url string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket(bucketSourceItems)).Delete(sourceItemKey(sourceID, url))
+	})
+}
+
+// Close closes the database, the storage of a user shares it with the storage
+// of the owner and doesn't close it
+func (s *boltStorage) Close() error {
+	if s.prefix != "" {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *boltStorage) get(bucket []byte, key string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data = copyBytes(tx.Bucket(bucket).Get([]byte(key)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errNotFound
+	}
+	return data, nil
+}
+
+func (s *boltStorage) put(bucket []byte, key string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+func (s *boltStorage) getExpiring(bucket []byte, key string) ([]byte, error) {
+	data, err := s.get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var value expiringValue
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return nil, err
+	}
+
+	if value.Expires != 0 && time.Now().Unix() >= value.Expires {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucket).Delete([]byte(key))
+		})
+		if err != nil {
+			log.Println(err)
+		}
+		return nil, errNotFound
+	}
+
+	return value.Data, nil
+}
+
+func (s *boltStorage) putExpiring(bucket []byte, key string, data []byte, expire time.Duration) error {
+	value := expiringValue{Data: data}
+	if expire > 0 {
+		value.Expires = time.Now().Add(expire).Unix()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.put(bucket, key, encoded)
+}
+
+/*
+ * BOLT SORTED SET TIMELINE
+ */
+
+// boltSortedSetTimeline works like redisSortedSetTimeline, the posts bucket
+// contains the unread items ordered by the published time
+type boltSortedSetTimeline struct {
+	db      *bolt.DB
+	channel string
+}
+
+func (timeline *boltSortedSetTimeline) bucketName() []byte {
+	return []byte("timeline:" + timeline.channel)
+}
+
+func (timeline *boltSortedSetTimeline) Init() error {
+	return timeline.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(timeline.bucketName())
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{bucketPosts, bucketScores, bucketRead, bucketRemoved} {
+			if _, err := b.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Items returns the oldest unread items first, after points to newer items
+func (timeline *boltSortedSetTimeline) Items(query microsub.TimelineQuery) (microsub.Timeline, error) {
+	page, err := newTimelinePage(query, false)
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	err = timeline.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		readBoltPage(page, b.Bucket(bucketPosts), tx.Bucket(bucketItems), func(itemKey []byte) bool {
+			return false
+		})
+		return nil
+	})
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	return page.timeline(), nil
+}
+
+// AddItem adds the item to the channel. An item that is already in the channel
+// is updated in place and keeps its read state and position.
+func (timeline *boltSortedSetTimeline) AddItem(item microsub.Item) (bool, error) {
+	itemKey := []byte(fmt.Sprintf("item:%s", item.ID))
+
+	var added bool
+	err := timeline.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		if b.Bucket(bucketRemoved).Get(itemKey) != nil {
+			return nil
+		}
+
+		err := saveBoltItem(tx.Bucket(bucketItems), itemKey, &item)
+		if err != nil {
+			return err
+		}
+		err = indexBoltItem(tx, timeline.channel, item)
+		if err != nil {
+			return err
+		}
+
+		if item.Read {
+			if err := b.Bucket(bucketRead).Put(itemKey, []byte{}); err != nil {
+				return err
+			}
+			return removePost(b, itemKey)
+		}
+
+		if b.Bucket(bucketRead).Get(itemKey) != nil {
+			return nil
+		}
+
+		if b.Bucket(bucketScores).Get(itemKey) != nil {
+			return nil
+		}
+
+		score, err := time.Parse(time.RFC3339, item.Published)
+		if err != nil {
+			return fmt.Errorf("error can't parse %s as time", item.Published)
+		}
+
+		added = true
+		return putPost(b, itemKey, score.Unix())
+	})
+	return added, err
+}
+
+func (timeline *boltSortedSetTimeline) Count() (int, error) {
+	var unread int
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		unread = countKeys(tx.Bucket(timeline.bucketName()).Bucket(bucketPosts))
+		return nil
+	})
+	if err != nil {
+		return -1, fmt.Errorf("while updating channel unread count for %s: %s", timeline.channel, err)
+	}
+	return unread, nil
+}
+
+func (timeline *boltSortedSetTimeline) MarkRead(uids []string) error {
+	err := timeline.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		read := b.Bucket(bucketRead)
+
+		for _, uid := range uids {
+			itemKey := []byte("item:" + uid)
+			if err := read.Put(itemKey, []byte{}); err != nil {
+				return err
+			}
+			if err := removePost(b, itemKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("marking read for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+func (timeline *boltSortedSetTimeline) MarkUnread(uids []string) error {
+	err := timeline.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		itemsBucket := tx.Bucket(bucketItems)
+
+		for _, uid := range uids {
+			itemKey := []byte("item:" + uid)
+			item, ok := loadBoltItem(itemsBucket, itemKey)
+			if !ok {
+				continue
+			}
+			score, err := time.Parse(time.RFC3339, item.Published)
+			if err != nil {
+				return fmt.Errorf("error can't parse %s as time", item.Published)
+			}
+			if err := b.Bucket(bucketRead).Delete(itemKey); err != nil {
+				return err
+			}
+			if err := putPost(b, itemKey, score.Unix()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("marking unread for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+func (timeline *boltSortedSetTimeline) MarkReadUpTo(uid string) error {
+	var uids []string
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		item, ok := loadBoltItem(tx.Bucket(bucketItems), []byte("item:"+uid))
+		if !ok {
+			return fmt.Errorf("unknown entry %s", uid)
+		}
+		score, err := time.Parse(time.RFC3339, item.Published)
+		if err != nil {
+			return fmt.Errorf("error can't parse %s as time", item.Published)
+		}
+		uids = postIDs(tx.Bucket(timeline.bucketName()), score.Unix())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return timeline.MarkRead(uids)
+}
+
+func (timeline *boltSortedSetTimeline) MarkAllRead() error {
+	var uids []string
+	timeline.db.View(func(tx *bolt.Tx) error {
+		uids = postIDs(tx.Bucket(timeline.bucketName()), math.MaxInt64)
+		return nil
+	})
+	return timeline.MarkRead(uids)
+}
+
+func (timeline *boltSortedSetTimeline) Export() ([]microsub.Item, error) {
+	var items []microsub.Item
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		itemsBucket := tx.Bucket(bucketItems)
+
+		err := b.Bucket(bucketPosts).ForEach(func(k, v []byte) error {
+			if item, ok := loadBoltItem(itemsBucket, k[8:]); ok {
+				item.Read = false
+				items = append(items, item)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return b.Bucket(bucketRead).ForEach(func(k, v []byte) error {
+			if item, ok := loadBoltItem(itemsBucket, k); ok {
+				item.Read = true
+				items = append(items, item)
+			}
+			return nil
+		})
+	})
+	return items, err
+}
+
+func (timeline *boltSortedSetTimeline) Clear() error {
+	return timeline.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(timeline.bucketName())
+	})
+}
+
+func (timeline *boltSortedSetTimeline) Entries() ([]timelineEntry, error) {
+	var entries []timelineEntry
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		itemsBucket := tx.Bucket(bucketItems)
+
+		err := b.Bucket(bucketPosts).ForEach(func(k, v []byte) error {
+			entries = append(entries, timelineEntry{
+				ID:        strings.TrimPrefix(string(k[8:]), "item:"),
+				Published: time.Unix(keyScore(k), 0),
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return b.Bucket(bucketRead).ForEach(func(k, v []byte) error {
+			item, ok := loadBoltItem(itemsBucket, k)
+			if !ok {
+				return nil
+			}
+			published, err := time.Parse(time.RFC3339, item.Published)
+			if err != nil {
+				return nil
+			}
+			entries = append(entries, timelineEntry{
+				ID:        strings.TrimPrefix(string(k), "item:"),
+				Published: published,
+				Read:      true,
+			})
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Remove removes the items from the channel, the items are remembered in the
+// removed bucket so AddItem doesn't add them again
+func (timeline *boltSortedSetTimeline) Remove(uids []string) error {
+	err := timeline.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+
+		for _, uid := range uids {
+			itemKey := []byte("item:" + uid)
+			if err := b.Bucket(bucketRemoved).Put(itemKey, []byte{}); err != nil {
+				return err
+			}
+			if err := b.Bucket(bucketRead).Delete(itemKey); err != nil {
+				return err
+			}
+			if err := removePost(b, itemKey); err != nil {
+				return err
+			}
+		}
+		return unindexBoltItems(tx, timeline.channel, uids)
+	})
+	if err != nil {
+		return fmt.Errorf("removing items from channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+/*
+ * BOLT STREAM TIMELINE
+ */
+
+// boltStreamTimeline works like redisStreamTimeline, items are kept in the
+// order they were added and get the sequence number as ID
+type boltStreamTimeline struct {
+	db      *bolt.DB
+	channel string
+}
+
+func (timeline *boltStreamTimeline) bucketName() []byte {
+	return []byte("stream:" + timeline.channel)
+}
+
+// idsBucketName is the bucket that maps item ids to sequence numbers
+func (timeline *boltStreamTimeline) idsBucketName() []byte {
+	return []byte("streamids:" + timeline.channel)
+}
+
+func (timeline *boltStreamTimeline) Init() error {
+	return timeline.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(timeline.bucketName()); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(timeline.idsBucketName())
+		return err
+	})
+}
+
+// Items returns the newest items first, after points to older items
+func (timeline *boltStreamTimeline) Items(query microsub.TimelineQuery) (microsub.Timeline, error) {
+	page, err := newTimelinePage(query, true)
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	err = timeline.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(timeline.bucketName()).Cursor()
+		next := c.Next
+		if page.desc {
+			next = c.Prev
+		}
+
+		// the entries are ordered by the sequence number, which is the score of
+		// the cursor
+		var k, v []byte
+		switch {
+		case page.start != nil:
+			k, v = c.Seek(itob(page.start.Score))
+			if k == nil && page.desc {
+				k, v = c.Last()
+			}
+		case page.desc:
+			k, v = c.Last()
+		default:
+			k, v = c.First()
+		}
+
+		for ; k != nil && !page.done(); k, v = next() {
+			id := int64(binary.BigEndian.Uint64(k))
+			cursor := timelineCursor{Score: id}
+			if page.skip(cursor) {
+				continue
+			}
+
+			var forBolt redisItem
+			if err := json.Unmarshal(v, &forBolt); err != nil {
+				continue
+			}
+			item := forBolt.Item()
+			item.ID = strconv.FormatInt(id, 10)
+			item.Read = forBolt.Read
+			page.add(cursor, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	return page.timeline(), nil
+}
+
+// AddItem adds the item to the stream. Items with an ID are added once, when
+// the item is updated the old entry is replaced and the read state is kept.
+func (timeline *boltStreamTimeline) AddItem(item microsub.Item) (bool, error) {
+	hash := itemHash(item)
+
+	added := true
+	err := timeline.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		ids := tx.Bucket(timeline.idsBucketName())
+
+		if item.ID != "" {
+			if oldID := ids.Get([]byte(item.ID)); oldID != nil {
+				added = false
+				data := b.Get(oldID)
+				if data == nil {
+					// the item was removed
+					return nil
+				}
+				var stored redisItem
+				if err := json.Unmarshal(data, &stored); err != nil {
+					return err
+				}
+				if item.Published == "" {
+					item.Published = stored.Published
+				}
+				if !isItemUpdate(stored, item, hash) {
+					return nil
+				}
+				item.Read = item.Read || stored.Read
+				if err := b.Delete(copyBytes(oldID)); err != nil {
+					return err
+				}
+			}
+		}
+
+		if item.Published == "" {
+			item.Published = time.Now().Format(time.RFC3339)
+		}
+
+		forBolt, err := encodeBoltItem(item, hash)
+		if err != nil {
+			return err
+		}
+
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if item.ID != "" {
+			if err := ids.Put([]byte(item.ID), itob(int64(id))); err != nil {
+				return err
+			}
+		}
+		if err := b.Put(itob(int64(id)), forBolt); err != nil {
+			return err
+		}
+		return indexBoltItem(tx, timeline.channel, item)
+	})
+	return added, err
+}
+
+// Count returns the number of unread items
+func (timeline *boltStreamTimeline) Count() (int, error) {
+	var count int
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(timeline.bucketName()).ForEach(func(k, v []byte) error {
+			var forBolt redisItem
+			if err := json.Unmarshal(v, &forBolt); err == nil && !forBolt.Read {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+// MarkRead marks the entries with the sequence numbers in uids as read
+func (timeline *boltStreamTimeline) MarkRead(uids []string) error {
+	err := timeline.setRead(uids, true)
+	if err != nil {
+		return fmt.Errorf("marking read for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+// MarkUnread marks the entries with the sequence numbers in uids as unread
+func (timeline *boltStreamTimeline) MarkUnread(uids []string) error {
+	err := timeline.setRead(uids, false)
+	if err != nil {
+		return fmt.Errorf("marking unread for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+// MarkReadUpTo marks the entry uid and all entries added before it as read
+func (timeline *boltStreamTimeline) MarkReadUpTo(uid string) error {
+	last, err := strconv.ParseUint(uid, 10, 64)
+	if err != nil {
+		return fmt.Errorf("unknown entry %s: %v", uid, err)
+	}
+	return timeline.MarkRead(timeline.entryIDs(last))
+}
+
+func (timeline *boltStreamTimeline) MarkAllRead() error {
+	return timeline.MarkRead(timeline.entryIDs(^uint64(0)))
+}
+
+// entryIDs returns the ids of the entries up to and including last
+func (timeline *boltStreamTimeline) entryIDs(last uint64) []string {
+	var ids []string
+	timeline.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(timeline.bucketName()).Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= last; k, _ = c.Next() {
+			ids = append(ids, strconv.FormatUint(binary.BigEndian.Uint64(k), 10))
+		}
+		return nil
+	})
+	return ids
+}
+
+func (timeline *boltStreamTimeline) setRead(uids []string, isRead bool) error {
+	return timeline.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		for _, uid := range uids {
+			id, err := strconv.ParseInt(uid, 10, 64)
+			if err != nil {
+				continue
+			}
+			data := b.Get(itob(id))
+			if data == nil {
+				continue
+			}
+			var forBolt redisItem
+			if err := json.Unmarshal(data, &forBolt); err != nil {
+				return err
+			}
+			forBolt.Read = isRead
+			data, err = json.Marshal(forBolt)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(itob(id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (timeline *boltStreamTimeline) Export() ([]microsub.Item, error) {
+	var items []microsub.Item
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(timeline.bucketName()).ForEach(func(k, v []byte) error {
+			var forBolt redisItem
+			if err := json.Unmarshal(v, &forBolt); err != nil {
+				return nil
+			}
+			item := forBolt.Item()
+			item.Read = forBolt.Read
+			items = append(items, item)
+			return nil
+		})
+	})
+	return items, err
+}
+
+func (timeline *boltStreamTimeline) Clear() error {
+	return timeline.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(timeline.bucketName()); err != nil {
+			return err
+		}
+		err := tx.DeleteBucket(timeline.idsBucketName())
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (timeline *boltStreamTimeline) Entries() ([]timelineEntry, error) {
+	var entries []timelineEntry
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(timeline.bucketName()).ForEach(func(k, v []byte) error {
+			var forBolt redisItem
+			if err := json.Unmarshal(v, &forBolt); err != nil {
+				return nil
+			}
+			published, err := time.Parse(time.RFC3339, forBolt.Published)
+			if err != nil {
+				return nil
+			}
+			entries = append(entries, timelineEntry{
+				ID:        strconv.FormatUint(binary.BigEndian.Uint64(k), 10),
+				Published: published,
+				Read:      forBolt.Read,
+			})
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Remove removes the entries with the sequence numbers in uids, or the entries
+// of the items with those ids
+func (timeline *boltStreamTimeline) Remove(uids []string) error {
+	err := timeline.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		ids := tx.Bucket(timeline.idsBucketName())
+		var itemIDs []string
+		for _, uid := range uids {
+			var key []byte
+			if id, err := strconv.ParseInt(uid, 10, 64); err == nil && b.Get(itob(id)) != nil {
+				key = itob(id)
+			} else if key = copyBytes(ids.Get([]byte(uid))); key == nil {
+				continue
+			}
+			var forBolt redisItem
+			if err := json.Unmarshal(b.Get(key), &forBolt); err == nil && forBolt.ID != "" {
+				itemIDs = append(itemIDs, forBolt.ID)
+			}
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+		return unindexBoltItems(tx, timeline.channel, itemIDs)
+	})
+	if err != nil {
+		return fmt.Errorf("removing items from channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+/*
+ * BOLT CAPPED TIMELINE
+ */
+
+// boltCappedTimeline works like redisCappedTimeline, it keeps the latest
+// size items. Read items stay in the posts bucket.
+type boltCappedTimeline struct {
+	db      *bolt.DB
+	channel string
+	size    int
+}
+
+func (timeline *boltCappedTimeline) bucketName() []byte {
+	return []byte("capped:" + timeline.channel)
+}
+
+func (timeline *boltCappedTimeline) Init() error {
+	if timeline.size <= 0 {
+		timeline.size = defaultCappedSize
+	}
+	return timeline.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(timeline.bucketName())
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{bucketPosts, bucketScores, bucketRead, bucketRemoved} {
+			if _, err := b.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Items returns the newest items first, after points to older items
+func (timeline *boltCappedTimeline) Items(query microsub.TimelineQuery) (microsub.Timeline, error) {
+	page, err := newTimelinePage(query, true)
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	err = timeline.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		read := b.Bucket(bucketRead)
+		readBoltPage(page, b.Bucket(bucketPosts), tx.Bucket(bucketItems), func(itemKey []byte) bool {
+			return read.Get(itemKey) != nil
+		})
+		return nil
+	})
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	return page.timeline(), nil
+}
+
+// AddItem adds the item to the timeline. An item that is already in the
+// timeline is updated in place and keeps its read state.
+func (timeline *boltCappedTimeline) AddItem(item microsub.Item) (bool, error) {
+	itemKey := []byte(fmt.Sprintf("item:%s", item.ID))
+
+	var added bool
+	err := timeline.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		if b.Bucket(bucketRemoved).Get(itemKey) != nil {
+			return nil
+		}
+
+		err := saveBoltItem(tx.Bucket(bucketItems), itemKey, &item)
+		if err != nil {
+			return err
+		}
+		err = indexBoltItem(tx, timeline.channel, item)
+		if err != nil {
+			return err
+		}
+
+		read := b.Bucket(bucketRead)
+
+		if b.Bucket(bucketScores).Get(itemKey) != nil {
+			if item.Read {
+				return read.Put(itemKey, []byte{})
+			}
+			return nil
+		}
+
+		score, err := time.Parse(time.RFC3339, item.Published)
+		if err != nil {
+			return fmt.Errorf("error can't parse %s as time", item.Published)
+		}
+
+		if err := putPost(b, itemKey, score.Unix()); err != nil {
+			return err
+		}
+		added = true
+
+		if item.Read {
+			if err := read.Put(itemKey, []byte{}); err != nil {
+				return err
+			}
+		}
+
+		// Remove the oldest items when there are more than size items
+		posts := b.Bucket(bucketPosts)
+		for n := countKeys(posts); n > timeline.size; n-- {
+			k, _ := posts.Cursor().First()
+			if k == nil {
+				break
+			}
+			oldKey := copyBytes(k[8:])
+			if bytes.Equal(oldKey, itemKey) {
+				// the item itself is older than the items that are kept
+				added = false
+			}
+			if err := removePost(b, oldKey); err != nil {
+				return err
+			}
+			if err := read.Delete(oldKey); err != nil {
+				return err
+			}
+			if err := unindexBoltItems(tx, timeline.channel, itemIDs([]string{string(oldKey)})); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	return added, err
+}
+
+// Count returns the number of unread items
+func (timeline *boltCappedTimeline) Count() (int, error) {
+	var unread int
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		unread = countKeys(b.Bucket(bucketPosts)) - countKeys(b.Bucket(bucketRead))
+		return nil
+	})
+	if err != nil {
+		return -1, fmt.Errorf("while updating channel unread count for %s: %s", timeline.channel, err)
+	}
+	return unread, nil
+}
+
+func (timeline *boltCappedTimeline) MarkRead(uids []string) error {
+	err := timeline.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		scores, read := b.Bucket(bucketScores), b.Bucket(bucketRead)
+
+		for _, uid := range uids {
+			itemKey := []byte("item:" + uid)
+			// Only remember items that are still in the timeline
+			if scores.Get(itemKey) == nil {
+				continue
+			}
+			if err := read.Put(itemKey, []byte{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("marking read for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+func (timeline *boltCappedTimeline) MarkUnread(uids []string) error {
+	err := timeline.db.Update(func(tx *bolt.Tx) error {
+		read := tx.Bucket(timeline.bucketName()).Bucket(bucketRead)
+		for _, uid := range uids {
+			if err := read.Delete([]byte("item:" + uid)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("marking unread for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+func (timeline *boltCappedTimeline) MarkReadUpTo(uid string) error {
+	var uids []string
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		key := b.Bucket(bucketScores).Get([]byte("item:" + uid))
+		if key == nil {
+			return fmt.Errorf("unknown entry %s", uid)
+		}
+		uids = postIDs(b, keyScore(key))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return timeline.MarkRead(uids)
+}
+
+func (timeline *boltCappedTimeline) MarkAllRead() error {
+	var uids []string
+	timeline.db.View(func(tx *bolt.Tx) error {
+		uids = postIDs(tx.Bucket(timeline.bucketName()), math.MaxInt64)
+		return nil
+	})
+	return timeline.MarkRead(uids)
+}
+
+func (timeline *boltCappedTimeline) Export() ([]microsub.Item, error) {
+	var items []microsub.Item
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		read := b.Bucket(bucketRead)
+		itemsBucket := tx.Bucket(bucketItems)
+
+		return b.Bucket(bucketPosts).ForEach(func(k, v []byte) error {
+			if item, ok := loadBoltItem(itemsBucket, k[8:]); ok {
+				item.Read = read.Get(k[8:]) != nil
+				items = append(items, item)
+			}
+			return nil
+		})
+	})
+	return items, err
+}
+
+func (timeline *boltCappedTimeline) Clear() error {
+	return timeline.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(timeline.bucketName())
+	})
+}
+
+func (timeline *boltCappedTimeline) Entries() ([]timelineEntry, error) {
+	var entries []timelineEntry
+	err := timeline.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		read := b.Bucket(bucketRead)
+
+		return b.Bucket(bucketPosts).ForEach(func(k, v []byte) error {
+			entries = append(entries, timelineEntry{
+				ID:        strings.TrimPrefix(string(k[8:]), "item:"),
+				Published: time.Unix(keyScore(k), 0),
+				Read:      read.Get(k[8:]) != nil,
+			})
+			return nil
+		})
+	})
+	return entries, err
+}
+
+// Remove removes the items from the timeline, the items are remembered in the
+// removed bucket so AddItem doesn't add them again
+func (timeline *boltCappedTimeline) Remove(uids []string) error {
+	err := timeline.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(timeline.bucketName())
+		for _, uid := range uids {
+			itemKey := []byte("item:" + uid)
+			if err := b.Bucket(bucketRemoved).Put(itemKey, []byte{}); err != nil {
+				return err
+			}
+			if err := b.Bucket(bucketRead).Delete(itemKey); err != nil {
+				return err
+			}
+			if err := removePost(b, itemKey); err != nil {
+				return err
+			}
+		}
+		return unindexBoltItems(tx, timeline.channel, uids)
+	})
+	if err != nil {
+		return fmt.Errorf("removing items from channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+// encodeBoltItem encodes the item in the same way as the Redis timelines
+func encodeBoltItem(item microsub.Item, hash string) ([]byte, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		log.Printf("error while creating item for bolt: %v\n", err)
+		return nil, err
+	}
+
+	return json.Marshal(redisItem{
+		ID:        item.ID,
+		Published: item.Published,
+		Read:      item.Read,
+		Hash:      hash,
+		Data:      data,
+	})
+}
+
+// saveBoltItem works like saveRedisItem, it writes the item to itemKey when it
+// is new or updated
+func saveBoltItem(itemsBucket *bolt.Bucket, itemKey []byte, item *microsub.Item) error {
+	hash := itemHash(*item)
+
+	var stored redisItem
+	data := itemsBucket.Get(itemKey)
+	exists := data != nil && json.Unmarshal(data, &stored) == nil
+
+	if exists && item.Published == "" {
+		item.Published = stored.Published
+	}
+	if item.Published == "" {
+		item.Published = time.Now().Format(time.RFC3339)
+	}
+
+	if exists && !isItemUpdate(stored, *item, hash) {
+		return nil
+	}
+
+	forBolt, err := encodeBoltItem(*item, hash)
+	if err != nil {
+		return err
+	}
+
+	err = itemsBucket.Put(itemKey, forBolt)
+	if err != nil {
+		return fmt.Errorf("error while writing item for bolt: %v", err)
+	}
+	return nil
+}
+
+// loadBoltItem loads the item with itemKey from the items bucket
+func loadBoltItem(itemsBucket *bolt.Bucket, itemKey []byte) (microsub.Item, bool) {
+	item := microsub.Item{}
+
+	data := itemsBucket.Get(itemKey)
+	if data == nil {
+		return item, false
+	}
+
+	var forBolt redisItem
+	if err := json.Unmarshal(data, &forBolt); err != nil {
+		log.Println(err)
+		return item, false
+	}
+
+	if err := json.Unmarshal(forBolt.Data, &item); err != nil {
+		// FIXME: what should we do if one of the items doen't unmarshal?
+		log.Println(err)
+		return item, false
+	}
+
+	return item, true
+}
+
+// readBoltPage fills page with the items of the posts bucket, isRead returns
+// the read state of an item. The keys of the posts are the score followed by
+// the item key, so they have the same order as the cursors.
+func readBoltPage(page *timelinePage, posts, itemsBucket *bolt.Bucket, isRead func(itemKey []byte) bool) {
+	c := posts.Cursor()
+	next := c.Next
+	if page.desc {
+		next = c.Prev
+	}
+
+	var k []byte
+	switch {
+	case page.start != nil:
+		k, _ = c.Seek(append(scoreKey(page.start.Score), page.start.ID...))
+		if k == nil && page.desc {
+			k, _ = c.Last()
+		}
+	case page.desc:
+		k, _ = c.Last()
+	default:
+		k, _ = c.First()
+	}
+
+	for ; k != nil && !page.done(); k, _ = next() {
+		cursor := timelineCursor{Score: keyScore(k), ID: string(k[8:])}
+		if page.skip(cursor) {
+			continue
+		}
+
+		item, ok := loadBoltItem(itemsBucket, k[8:])
+		if !ok {
+			continue
+		}
+		item.Read = isRead(k[8:])
+		page.add(cursor, item)
+	}
+}
+
+// putPost adds itemKey with score to the posts of timeline bucket b
+func putPost(b *bolt.Bucket, itemKey []byte, score int64) error {
+	if err := removePost(b, itemKey); err != nil {
+		return err
+	}
+	key := scoreKey(score)
+	if err := b.Bucket(bucketScores).Put(itemKey, key); err != nil {
+		return err
+	}
+	return b.Bucket(bucketPosts).Put(append(key, itemKey...), []byte{})
+}
+
+// postIDs returns the uids of the posts of timeline bucket b with a score up to maxScore
+func postIDs(b *bolt.Bucket, maxScore int64) []string {
+	var uids []string
+	c := b.Bucket(bucketPosts).Cursor()
+	for k, _ := c.First(); k != nil && keyScore(k) <= maxScore; k, _ = c.Next() {
+		uids = append(uids, strings.TrimPrefix(string(k[8:]), "item:"))
+	}
+	return uids
+}
+
+// removePost removes itemKey from the posts of timeline bucket b
+func removePost(b *bolt.Bucket, itemKey []byte) error {
+	scores := b.Bucket(bucketScores)
+	key := scores.Get(itemKey)
+	if key == nil {
+		return nil
+	}
+	if err := b.Bucket(bucketPosts).Delete(append(copyBytes(key), itemKey...)); err != nil {
+		return err
+	}
+	return scores.Delete(itemKey)
+}
+
+// scoreKey encodes score so that the keys sort in the same order as the scores
+func scoreKey(score int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(score)^(1<<63))
+	return key
+}
+
+func keyScore(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[:8]) ^ (1 << 63))
+}
+
+// countKeys returns the number of keys in b, Stats doesn't count the changes
+// of the current transaction
+func countKeys(b *bolt.Bucket) int {
+	n := 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+func itob(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func createBoltStorage(t *testing.T) (*boltStorage, func()) {
+	dir, err := ioutil.TempDir("", "ekster")
+	require.NoError(t, err)
+
+	store, err := newBoltStorage(filepath.Join(dir, "ekster.db"))
+	require.NoError(t, err)
+
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStorage_Channels(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	assert.NoError(t, store.ChannelAdd("home", DefaultPrio))
+	assert.NoError(t, store.ChannelAdd("notifications", 1))
+	assert.NoError(t, store.ChannelAdd("abc", 10))
+
+	uids, err := store.ChannelsSorted()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"notifications", "abc", "home"}, uids)
+
+	// the sort order is kept when the channel is added again
+	assert.NoError(t, store.ChannelsReset())
+	assert.NoError(t, store.ChannelAdd("abc", DefaultPrio))
+	assert.NoError(t, store.ChannelAdd("home", DefaultPrio))
+	uids, err = store.ChannelsSorted()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"abc", "home"}, uids)
+
+	assert.NoError(t, store.ChannelRemove("abc"))
+	uids, err = store.ChannelsSorted()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"home"}, uids)
+}
+
+func TestMemoryBackend_ChannelsOrder(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	b := &memoryBackend{
+		store: store,
+		Channels: map[string]microsub.Channel{
+			"notifications": {UID: "notifications", Name: "Notifications"},
+			"home":          {UID: "home", Name: "Home"},
+			"a":             {UID: "a", Name: "A", Unread: 3},
+			"b":             {UID: "b", Name: "B"},
+		},
+	}
+	b.refreshChannels()
+
+	assert.NoError(t, b.ChannelsOrder([]string{"b", "notifications", "home"}))
+	assert.Error(t, b.ChannelsOrder([]string{"missing"}))
+
+	channels, err := b.ChannelsGetList()
+	assert.NoError(t, err)
+	var uids []string
+	for _, c := range channels {
+		uids = append(uids, c.UID)
+	}
+	assert.Equal(t, []string{"notifications", "b", "home", "a"}, uids)
+}
+
+func TestBoltStorage_Cache(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	assert.NoError(t, store.CacheSet("http_cache:a", []byte("a"), time.Hour))
+	store.putExpiring(bucketHTTPCache, "http_cache:c", []byte("c"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	data, err := store.CacheGet("http_cache:a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), data)
+
+	_, err = store.CacheGet("http_cache:c")
+	assert.Equal(t, errNotFound, err)
+
+	_, err = store.CacheGet("http_cache:missing")
+	assert.Equal(t, errNotFound, err)
+}
+
+func TestBoltStorage_Session(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	assert.NoError(t, store.SessionSave("1234", &session{Me: "https://example.com/", LoggedIn: true}))
+
+	var sess session
+	assert.NoError(t, store.SessionLoad("1234", &sess))
+	assert.Equal(t, "https://example.com/", sess.Me)
+	assert.True(t, sess.LoggedIn)
+
+	assert.NoError(t, store.SessionDelete("1234"))
+	sess = session{}
+	assert.NoError(t, store.SessionLoad("1234", &sess))
+	assert.False(t, sess.LoggedIn)
+}
+
+func TestBoltStorage_SortedSetTimeline(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	timeline := store.Timeline("home", timelineTypeSortedSet, 0)
+	require.NoError(t, timeline.Init())
+
+	start := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 25; i++ {
+		_, err := timeline.AddItem(microsub.Item{
+			ID:        string(rune('a' + i)),
+			Type:      "entry",
+			Published: start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+		assert.NoError(t, err)
+	}
+
+	count, err := timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 25, count)
+
+	page, err := timeline.Items(microsub.TimelineQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 20)
+	assert.Equal(t, "a", page.Items[0].ID)
+	assert.Equal(t, "t", page.Items[19].ID)
+
+	page, err = timeline.Items(microsub.TimelineQuery{After: page.Paging.After})
+	assert.NoError(t, err)
+	assert.Len(t, page.Items, 5)
+	assert.Equal(t, "u", page.Items[0].ID)
+
+	assert.NoError(t, timeline.MarkRead([]string{"a", "b"}))
+	count, err = timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 23, count)
+
+	// read items are not added again
+	added, err := timeline.AddItem(microsub.Item{ID: "a", Type: "entry", Published: start.Format(time.RFC3339)})
+	assert.NoError(t, err)
+	assert.False(t, added)
+	page, err = timeline.Items(microsub.TimelineQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, "c", page.Items[0].ID)
+}
+
+func TestBoltStorage_SortedSetReadState(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	timeline := store.Timeline("home", timelineTypeSortedSet, 0)
+	require.NoError(t, timeline.Init())
+
+	start := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		_, err := timeline.AddItem(microsub.Item{
+			ID:        string(rune('a' + i)),
+			Type:      "entry",
+			Published: start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, timeline.MarkReadUpTo("c"))
+	count, err := timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assert.NoError(t, timeline.MarkUnread([]string{"b"}))
+	page, err := timeline.Items(microsub.TimelineQuery{})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Items, 3) {
+		assert.Equal(t, "b", page.Items[0].ID)
+		assert.Equal(t, "d", page.Items[1].ID)
+	}
+
+	assert.NoError(t, timeline.MarkAllRead())
+	count, err = timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestBoltStorage_StreamTimeline(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	timeline := store.Timeline("notifications", timelineTypeStream, 0)
+	require.NoError(t, timeline.Init())
+
+	for _, name := range []string{"first", "second", "third"} {
+		added, err := timeline.AddItem(microsub.Item{Type: "entry", Name: name})
+		assert.NoError(t, err)
+		assert.True(t, added)
+	}
+
+	count, err := timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	page, err := timeline.Items(microsub.TimelineQuery{})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Items, 3) {
+		assert.Equal(t, "third", page.Items[0].Name)
+		assert.Equal(t, "3", page.Items[0].ID)
+		assert.Equal(t, "first", page.Items[2].Name)
+	}
+
+	assert.NoError(t, timeline.MarkReadUpTo("2"))
+	count, err = timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.NoError(t, timeline.MarkUnread([]string{"1"}))
+	count, err = timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assert.NoError(t, timeline.MarkAllRead())
+	count, err = timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestBoltStorage_CappedTimeline(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	timeline := store.Timeline("latest", timelineTypeCapped, 3)
+	require.NoError(t, timeline.Init())
+
+	start := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		_, err := timeline.AddItem(microsub.Item{
+			ID:        string(rune('a' + i)),
+			Type:      "entry",
+			Published: start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, timeline.MarkRead([]string{"d"}))
+
+	count, err := timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	page, err := timeline.Items(microsub.TimelineQuery{})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Items, 3) {
+		assert.Equal(t, "e", page.Items[0].ID)
+		assert.Equal(t, "d", page.Items[1].ID)
+		assert.True(t, page.Items[1].Read)
+		assert.Equal(t, "c", page.Items[2].ID)
+	}
+
+	assert.NoError(t, timeline.MarkUnread([]string{"d"}))
+	assert.NoError(t, timeline.MarkReadUpTo("d"))
+	count, err = timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.NoError(t, timeline.MarkAllRead())
+	count, err = timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestMigrateTimeline(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	from := store.Timeline("home", timelineTypeSortedSet, 0)
+	require.NoError(t, from.Init())
+
+	start := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		_, err := from.AddItem(microsub.Item{
+			ID:        string(rune('a' + i)),
+			Type:      "entry",
+			Published: start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, from.MarkRead([]string{"a", "c"}))
+
+	to := store.Timeline("home", timelineTypeCapped, 10)
+	require.NoError(t, to.Init())
+	require.NoError(t, migrateTimeline(from, to))
+
+	count, err := to.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	items, err := to.Export()
+	assert.NoError(t, err)
+	read := map[string]bool{}
+	for _, item := range items {
+		read[item.ID] = item.Read
+	}
+	assert.Equal(t, map[string]bool{"a": true, "b": false, "c": true, "d": false}, read)
+
+	// and back again
+	back := store.Timeline("home", timelineTypeSortedSet, 0)
+	require.NoError(t, back.Init())
+	require.NoError(t, migrateTimeline(to, back))
+
+	page, err := back.Items(microsub.TimelineQuery{})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Items, 2) {
+		assert.Equal(t, "b", page.Items[0].ID)
+		assert.Equal(t, "d", page.Items[1].ID)
+	}
+}
+
+func TestBoltStorage_Remove(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+	testTimelineRemove(t, store)
+}
+
+// testTimelineRemove removes items from a sorted set timeline of store
+func testTimelineRemove(t *testing.T, store Storage) {
+	timeline := store.Timeline("home", timelineTypeSortedSet, 0)
+	require.NoError(t, timeline.Init())
+
+	start := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		_, err := timeline.AddItem(microsub.Item{
+			ID:        string(rune('a' + i)),
+			Type:      "entry",
+			Published: start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, timeline.MarkRead([]string{"c"}))
+
+	assert.NoError(t, timeline.Remove([]string{"a", "c"}))
+
+	entries, err := timeline.Entries()
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "b", entries[0].ID)
+	}
+
+	// removed items are not added again
+	added, err := timeline.AddItem(microsub.Item{ID: "a", Type: "entry", Published: start.Format(time.RFC3339)})
+	assert.NoError(t, err)
+	assert.False(t, added)
+	count, err := timeline.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestPruneTimeline(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	now := time.Date(2018, 8, 10, 12, 0, 0, 0, time.UTC)
+
+	for _, timelineType := range []string{timelineTypeSortedSet, timelineTypeStream, timelineTypeCapped} {
+		timeline := store.Timeline("home-"+timelineType, timelineType, 10)
+		require.NoError(t, timeline.Init())
+
+		// one item per day, a is the oldest
+		for i := 0; i < 6; i++ {
+			_, err := timeline.AddItem(microsub.Item{
+				ID:        string(rune('a' + i)),
+				Type:      "entry",
+				Published: now.Add(-time.Duration(6-i) * 24 * time.Hour).Format(time.RFC3339),
+				Read:      i%2 == 0,
+			})
+			assert.NoError(t, err)
+		}
+
+		// a, c and e are read, unread b is older than four days but is kept
+		policy := retentionPolicy{MaxItems: 3, MaxAge: 4*24*time.Hour + time.Minute, KeepUnread: true}
+		removed, err := pruneTimeline(timeline, policy, now)
+		assert.NoError(t, err, timelineType)
+		assert.Equal(t, 2, removed, timelineType)
+
+		items, err := timeline.Export()
+		assert.NoError(t, err)
+		var names []string
+		for _, item := range items {
+			names = append(names, item.ID)
+		}
+		assert.ElementsMatch(t, []string{"b", "d", "e", "f"}, names, timelineType)
+
+		count, err := timeline.Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, count, timelineType)
+	}
+}
+
+func TestBoltStorage_ItemUpdates(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+	testTimelineItemUpdates(t, store)
+}
+
+// testTimelineItemUpdates adds new versions of an item to the timelines of
+// store
+func testTimelineItemUpdates(t *testing.T, store Storage) {
+	published := time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)
+
+	for _, timelineType := range []string{timelineTypeSortedSet, timelineTypeStream, timelineTypeCapped} {
+		timeline := store.Timeline("updates-"+timelineType, timelineType, 10)
+		require.NoError(t, timeline.Init())
+
+		item := microsub.Item{ID: "post-" + timelineType, Type: "entry", Name: "First", Published: published}
+		added, err := timeline.AddItem(item)
+		assert.NoError(t, err)
+		assert.True(t, added, timelineType)
+		added, err = timeline.AddItem(item)
+		assert.NoError(t, err)
+		assert.False(t, added, timelineType)
+
+		items, err := timeline.Export()
+		assert.NoError(t, err)
+		require.Len(t, items, 1, timelineType)
+
+		entries, err := timeline.Entries()
+		assert.NoError(t, err)
+		require.Len(t, entries, 1, timelineType)
+		assert.NoError(t, timeline.MarkRead([]string{entries[0].ID}))
+
+		// the update keeps the read state
+		item.Name = "Second"
+		added, err = timeline.AddItem(item)
+		assert.NoError(t, err)
+		assert.False(t, added, timelineType)
+		items, err = timeline.Export()
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1, timelineType) {
+			assert.Equal(t, "Second", items[0].Name, timelineType)
+			assert.True(t, items[0].Read, timelineType)
+		}
+
+		// an older version is ignored
+		item.Updated = "2018-08-02T12:00:00Z"
+		item.Name = "Third"
+		_, err = timeline.AddItem(item)
+		assert.NoError(t, err)
+		item.Updated = "2018-08-01T12:00:00Z"
+		item.Name = "Older"
+		_, err = timeline.AddItem(item)
+		assert.NoError(t, err)
+		items, err = timeline.Export()
+		assert.NoError(t, err)
+		if assert.Len(t, items, 1, timelineType) {
+			assert.Equal(t, "Third", items[0].Name, timelineType)
+		}
+	}
+}
+
+func TestBoltStorage_SharedItems(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	item := microsub.Item{ID: "shared", Type: "entry", Published: time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC).Format(time.RFC3339)}
+
+	for _, channel := range []string{"home", "tracking"} {
+		timeline := store.Timeline(channel, timelineTypeSortedSet, 0)
+		require.NoError(t, timeline.Init())
+		added, err := timeline.AddItem(item)
+		assert.NoError(t, err)
+		assert.True(t, added, channel)
+
+		count, err := timeline.Count()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count, channel)
+	}
+}
+
+func TestBoltStorage_ItemsQuery(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	day := func(d int) time.Time {
+		return time.Date(2018, 8, d, 12, 0, 0, 0, time.UTC)
+	}
+	feed1 := &microsub.Source{URL: "https://example.com/feed1"}
+	feed2 := &microsub.Source{URL: "https://example.com/feed2"}
+
+	urls := func(items []microsub.Item) []string {
+		var urls []string
+		for _, item := range items {
+			urls = append(urls, item.URL)
+		}
+		return urls
+	}
+
+	for _, timelineType := range []string{timelineTypeSortedSet, timelineTypeStream, timelineTypeCapped} {
+		timeline := store.Timeline("query-"+timelineType, timelineType, 10)
+		require.NoError(t, timeline.Init())
+
+		items := []microsub.Item{
+			{URL: "a", LikeOf: []string{"https://example.org/"}, Source: feed1, Published: day(1).Format(time.RFC3339)},
+			{URL: "b", InReplyTo: []string{"https://example.org/"}, Source: feed2, Published: day(2).Format(time.RFC3339)},
+			{URL: "c", Name: "Title", Content: &microsub.Content{Text: "Body"}, Source: feed1, Published: day(3).Format(time.RFC3339)},
+			{URL: "d", Name: "Body", Content: &microsub.Content{Text: "Body"}, Source: feed2, Published: day(4).Format(time.RFC3339)},
+			{URL: "e", RepostOf: []string{"https://example.org/"}, Source: feed1, Published: day(5).Format(time.RFC3339)},
+		}
+		for _, item := range items {
+			item.ID = timelineType + "-" + item.URL
+			item.Type = "entry"
+			_, err := timeline.AddItem(item)
+			require.NoError(t, err)
+		}
+
+		page, err := timeline.Items(microsub.TimelineQuery{Limit: 2})
+		assert.NoError(t, err)
+		assert.Len(t, page.Items, 2, timelineType)
+
+		page, err = timeline.Items(microsub.TimelineQuery{Source: feed1.URL})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a", "c", "e"}, urls(page.Items), timelineType)
+
+		// items that are skipped don't count for the limit
+		page, err = timeline.Items(microsub.TimelineQuery{Source: feed2.URL, Limit: 1})
+		assert.NoError(t, err)
+		if assert.Len(t, page.Items, 1, timelineType) {
+			assert.Equal(t, feed2.URL, page.Items[0].Source.URL, timelineType)
+		}
+
+		page, err = timeline.Items(microsub.TimelineQuery{Since: day(2), Until: day(4)})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"b", "c"}, urls(page.Items), timelineType)
+
+		for postType, expected := range map[string][]string{
+			microsub.PostTypeLike:    {"a"},
+			microsub.PostTypeReply:   {"b"},
+			microsub.PostTypeArticle: {"c"},
+			microsub.PostTypeNote:    {"d"},
+			microsub.PostTypeRepost:  {"e"},
+		} {
+			page, err = timeline.Items(microsub.TimelineQuery{Type: postType})
+			assert.NoError(t, err)
+			assert.Equal(t, expected, urls(page.Items), timelineType)
+		}
+
+		page, err = timeline.Items(microsub.TimelineQuery{})
+		assert.NoError(t, err)
+		for _, item := range page.Items {
+			if item.URL == "b" {
+				assert.NoError(t, timeline.MarkRead([]string{item.ID}))
+			}
+		}
+
+		page, err = timeline.Items(microsub.TimelineQuery{Unread: true})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a", "c", "d", "e"}, urls(page.Items), timelineType)
+	}
+}
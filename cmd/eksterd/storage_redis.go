@@ -0,0 +1,629 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"p83.nl/go/ekster/pkg/auth"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+// redisStorage keeps channels, feeds and settings of the owner in backend.json
+// and everything else in Redis
+type redisStorage struct {
+	pool *redis.Pool
+
+	// prefix is added to the keys and channels of the user, it's empty for
+	// the owner
+	prefix string
+}
+
+func newPool(addr string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+	}
+}
+
+func newRedisStorage(addr string) *redisStorage {
+	return &redisStorage{pool: newPool(addr)}
+}
+
+// User returns the storage of me, it uses the connections of s
+func (s *redisStorage) User(me string) (Storage, error) {
+	return &redisStorage{pool: s.pool, prefix: userPrefix(me)}, nil
+}
+
+// LoadBackend reads backend.json for the owner, the state of the other users
+// is kept in Redis
+func (s *redisStorage) LoadBackend(b *memoryBackend) error {
+	if s.prefix == "" {
+		return loadBackendFile(b)
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", s.prefix+"backend"))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state backendState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+	b.setState(state)
+	return nil
+}
+
+func (s *redisStorage) SaveBackend(b *memoryBackend) error {
+	if s.prefix == "" {
+		return saveBackendFile(b)
+	}
+
+	data, err := json.Marshal(b.state())
+	if err != nil {
+		return err
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("SET", s.prefix+"backend", data)
+	return err
+}
+
+func (s *redisStorage) ChannelsReset() error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", s.prefix+"channels")
+	return err
+}
+
+func (s *redisStorage) ChannelAdd(uid string, prio int) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SADD", s.prefix+"channels", uid); err != nil {
+		return err
+	}
+	_, err := conn.Do("SETNX", s.prefix+"channel_sortorder_"+uid, prio)
+	return err
+}
+
+func (s *redisStorage) ChannelRemove(uid string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SREM", s.prefix+"channels", uid); err != nil {
+		return err
+	}
+	_, err := conn.Do("DEL", s.prefix+"channel_sortorder_"+uid)
+	return err
+}
+
+func (s *redisStorage) ChannelsSorted() ([]string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SORT", s.prefix+"channels", "BY", s.prefix+"channel_sortorder_*", "ASC"))
+}
+
+func (s *redisStorage) ChannelsOrder(uids []string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	for i, uid := range uids {
+		if _, err := conn.Do("SET", s.prefix+"channel_sortorder_"+uid, i+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The search index of a channel has a set of item ids for every term. The
+// timelines keep it up to date with indexRedisItem and unindexRedisItems, the
+// channel of these functions includes the prefix of the user.
+
+// searchTermKey is the key of the ids of the items with the term
+func searchTermKey(channel, term string) string {
+	return fmt.Sprintf("search:%s:%s", channel, term)
+}
+
+// searchItemKey is the key of the copy of the item that search returns, stream
+// timelines don't keep the item under its key
+func searchItemKey(channel, id string) string {
+	return fmt.Sprintf("search_item:%s:%s", channel, id)
+}
+
+// searchItemTermsKey is the key of the terms of the item, so they can be
+// removed from the index
+func searchItemTermsKey(channel, id string) string {
+	return fmt.Sprintf("search_terms:%s:%s", channel, id)
+}
+
+// indexRedisItem adds the item to the search index of the channel, the terms
+// of an updated item replace the old terms
+func indexRedisItem(conn redis.Conn, channel string, item microsub.Item) error {
+	if item.ID == "" {
+		return nil
+	}
+
+	itemKey := searchItemKey(channel, item.ID)
+	values, err := redis.Values(conn.Do("HGETALL", itemKey))
+	if err != nil {
+		return err
+	}
+	var stored redisItem
+	if len(values) > 0 && redis.ScanStruct(values, &stored) == nil && !isItemUpdate(stored, item, itemHash(item)) {
+		return nil
+	}
+
+	if err := unindexRedisItems(conn, channel, []string{item.ID}); err != nil {
+		return err
+	}
+	if err := saveRedisItem(conn, itemKey, &item); err != nil {
+		return err
+	}
+
+	terms := itemSearchTerms(item)
+	for _, term := range terms {
+		if _, err := conn.Do("SADD", searchTermKey(channel, term), item.ID); err != nil {
+			return err
+		}
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	_, err = conn.Do("SADD", redis.Args{}.Add(searchItemTermsKey(channel, item.ID)).AddFlat(terms)...)
+	return err
+}
+
+// unindexRedisItems removes the items from the search index of the channel
+func unindexRedisItems(conn redis.Conn, channel string, ids []string) error {
+	for _, id := range ids {
+		termsKey := searchItemTermsKey(channel, id)
+		terms, err := redis.Strings(conn.Do("SMEMBERS", termsKey))
+		if err != nil {
+			return err
+		}
+		for _, term := range terms {
+			if _, err := conn.Do("SREM", searchTermKey(channel, term), id); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.Do("DEL", searchItemKey(channel, id), termsKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStorage) UnindexItem(channel, id string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return unindexRedisItems(conn, s.prefix+channel, []string{id})
+}
+
+func (s *redisStorage) SearchItems(channel string, terms []string) ([]microsub.Item, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	channel = s.prefix + channel
+
+	var keys []string
+	for _, term := range terms {
+		keys = append(keys, searchTermKey(channel, term))
+	}
+
+	ids, err := redis.Strings(conn.Do("SINTER", redis.Args{}.AddFlat(keys)...))
+	if err != nil {
+		return nil, err
+	}
+
+	var items []microsub.Item
+	for _, id := range ids {
+		itemJSON, err := redis.Bytes(conn.Do("HGET", searchItemKey(channel, id), "Data"))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		item := microsub.Item{}
+		err = json.Unmarshal(itemJSON, &item)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (s *redisStorage) Timeline(channel, timelineType string, size int) TimelineBackend {
+	channel = s.prefix + channel
+	switch timelineType {
+	case timelineTypeSortedSet:
+		return &redisSortedSetTimeline{pool: s.pool, channel: channel}
+	case timelineTypeStream:
+		return &redisStreamTimeline{pool: s.pool, channel: channel}
+	case timelineTypeCapped:
+		return &redisCappedTimeline{pool: s.pool, channel: channel, size: size}
+	}
+	return nil
+}
+
+func (s *redisStorage) SessionLoad(id string, sess *session) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	data, err := redis.Values(conn.Do("HGETALL", "session:"+id))
+	if err != nil {
+		return err
+	}
+	return redis.ScanStruct(data, sess)
+}
+
+func (s *redisStorage) SessionSave(id string, sess *session) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HMSET", redis.Args{}.Add("session:"+id).AddFlat(sess)...)
+	return err
+}
+
+func (s *redisStorage) SessionDelete(id string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", "session:"+id)
+	return err
+}
+
+func (s *redisStorage) AuthRequestLoad(key string, req *authRequest) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	values, err := redis.Values(conn.Do("HGETALL", key))
+	if err != nil {
+		return err
+	}
+	return redis.ScanStruct(values, req)
+}
+
+func (s *redisStorage) AuthRequestSave(key string, req *authRequest, expire time.Duration) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HMSET", redis.Args{}.Add(key).AddFlat(req)...)
+	if err != nil {
+		return err
+	}
+	if expire > 0 {
+		_, err = conn.Do("EXPIRE", key, int64(expire/time.Second))
+	}
+	return err
+}
+
+func (s *redisStorage) AuthRequestDelete(key string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+func (s *redisStorage) AuthTokens(me string) ([]string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", "auth_tokens:"+me))
+}
+
+func (s *redisStorage) AuthTokenAdd(me, token string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SADD", "auth_tokens:"+me, token)
+	return err
+}
+
+func (s *redisStorage) AuthTokenRemove(me, token string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SREM", "auth_tokens:"+me, token)
+	return err
+}
+
+// TokenCacheGet gets the cached value from Redis
+func (s *redisStorage) TokenCacheGet(key string, r *auth.TokenResponse) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	values, err := redis.Values(conn.Do("HGETALL", key))
+	if err == nil && len(values) > 0 {
+		if err = redis.ScanStruct(values, r); err == nil {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("error while getting value from backend: %v", err)
+}
+
+// TokenCacheSet remembers the value of the auth token response in redis
+func (s *redisStorage) TokenCacheSet(key string, r *auth.TokenResponse, expire time.Duration) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HMSET", redis.Args{}.Add(key).AddFlat(r)...)
+	if err != nil {
+		return fmt.Errorf("error while setting token: %v", err)
+	}
+	conn.Do("EXPIRE", key, uint64(expire/time.Second))
+	return nil
+}
+
+// TokenCacheDelete removes the cached value from Redis
+func (s *redisStorage) TokenCacheDelete(key string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", key)
+	return err
+}
+
+func (s *redisStorage) CacheGet(key string) ([]byte, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return redis.Bytes(conn.Do("GET", key))
+}
+
+func (s *redisStorage) CacheSet(key string, data []byte, expire time.Duration) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SET", key, data, "EX", int64(expire/time.Second))
+	return err
+}
+
+func (s *redisStorage) HubFeedCreate(feed *Feed) (int64, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	id, err := redis.Int64(conn.Do("INCR", "feed:next_id"))
+	if err != nil {
+		return 0, err
+	}
+	feed.ID = id
+
+	_, err = conn.Do("HMSET", redis.Args{}.Add(fmt.Sprintf("feed:%d", id)).AddFlat(feed)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (s *redisStorage) HubFeedGet(id int64) (Feed, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var feed Feed
+	values, err := redis.Values(conn.Do("HGETALL", fmt.Sprintf("feed:%d", id)))
+	if err != nil {
+		return feed, err
+	}
+	if len(values) == 0 {
+		return feed, fmt.Errorf("feed %d does not exist", id)
+	}
+	err = redis.ScanStruct(values, &feed)
+	if err != nil {
+		return feed, err
+	}
+	feed.ID = id
+	return feed, nil
+}
+
+func (s *redisStorage) HubFeedSave(feed Feed) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HMSET", redis.Args{}.Add(fmt.Sprintf("feed:%d", feed.ID)).AddFlat(&feed)...)
+	return err
+}
+
+func (s *redisStorage) HubFeeds() ([]Feed, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	feeds := []Feed{}
+
+	// FIXME(peter): replace with set of currently checked feeds
+	feedKeys, err := redis.Strings(conn.Do("KEYS", "feed:*"))
+	if err != nil {
+		return feeds, err
+	}
+
+	for _, feedKey := range feedKeys {
+		var feed Feed
+		values, err := redis.Values(conn.Do("HGETALL", feedKey))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		err = redis.ScanStruct(values, &feed)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if feed.ID == 0 {
+			parts := strings.Split(feedKey, ":")
+			if len(parts) == 2 {
+				feed.ID, _ = strconv.ParseInt(parts[1], 10, 64)
+				conn.Do("HSET", feedKey, "id", feed.ID)
+			}
+		}
+
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, nil
+}
+
+func (s *redisStorage) FeedStatusLoad(channel, feedURL string, status *feedStatus) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", s.prefix+"feed_status:"+feedStatusKey(channel, feedURL)))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, status)
+}
+
+func (s *redisStorage) FeedStatusSave(channel, feedURL string, status *feedStatus) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("SET", s.prefix+"feed_status:"+feedStatusKey(channel, feedURL), data)
+	return err
+}
+
+func (s *redisStorage) FeedStatusDelete(channel, feedURL string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", s.prefix+"feed_status:"+feedStatusKey(channel, feedURL))
+	return err
+}
+
+func (s *redisStorage) SourceChannel(sourceID string) (string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	channel, err := redis.String(conn.Do("HGET", s.prefix+"sources", sourceID))
+	if err != nil {
+		channel, err = redis.String(conn.Do("HGET", "token:"+sourceID, "channel"))
+	}
+	return channel, err
+}
+
+func (s *redisStorage) SourceNextID(sourceID string) (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return redis.Int(conn.Do("INCR", s.prefix+"source:"+sourceID+"next_id"))
+}
+
+func (s *redisStorage) Sources() ([]string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("HKEYS", s.prefix+"sources"))
+}
+
+func (s *redisStorage) SourceLoad(sourceID string, src *source) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	channel, err := redis.String(conn.Do("HGET", s.prefix+"sources", sourceID))
+	if err == redis.ErrNil {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	values, err := redis.Values(conn.Do("HGETALL", s.prefix+"source_info:"+sourceID))
+	if err != nil {
+		return err
+	}
+	err = redis.ScanStruct(values, src)
+	if err != nil {
+		return err
+	}
+
+	src.ID = sourceID
+	src.Channel = channel
+	src.Items, err = redis.Int(conn.Do("GET", s.prefix+"source:"+sourceID+"next_id"))
+	if err == redis.ErrNil {
+		err = nil
+	}
+	return err
+}
+
+func (s *redisStorage) SourceSave(src *source) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", s.prefix+"sources", src.ID, src.Channel)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HMSET", redis.Args{}.Add(s.prefix+"source_info:"+src.ID).AddFlat(src)...)
+	return err
+}
+
+func (s *redisStorage) SourceDelete(sourceID string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", s.prefix+"sources", sourceID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("DEL", s.prefix+"source_info:"+sourceID, s.prefix+"source:"+sourceID+"next_id", s.prefix+"source_items:"+sourceID)
+	return err
+}
+
+func (s *redisStorage) SourceItemLoad(sourceID, url string, item *sourceItem) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("HGET", s.prefix+"source_items:"+sourceID, url))
+	if err == redis.ErrNil {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, item)
+}
+
+func (s *redisStorage) SourceItemSave(sourceID string, item *sourceItem) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", s.prefix+"source_items:"+sourceID, item.URL, data)
+	return err
+}
+
+func (s *redisStorage) SourceItemDelete(sourceID, url string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HDEL", s.prefix+"source_items:"+sourceID, url)
+	return err
+}
+
+// Close closes the connections, the storage of a user shares them with the
+// storage of the owner and doesn't close them
+func (s *redisStorage) Close() error {
+	if s.prefix != "" {
+		return nil
+	}
+	return s.pool.Close()
+}
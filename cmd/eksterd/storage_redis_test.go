@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createRedisStorage returns the storage of a new user in the Redis server at
+// EKSTER_TEST_REDIS or localhost:6379, the test is skipped when there is no
+// server. The keys of the user are deleted afterwards.
+func createRedisStorage(t *testing.T) (*redisStorage, func()) {
+	addr := os.Getenv("EKSTER_TEST_REDIS")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	conn, err := redis.Dial("tcp", addr, redis.DialConnectTimeout(time.Second))
+	if err != nil {
+		t.Skipf("no Redis server at %s: %v", addr, err)
+	}
+	conn.Close()
+
+	store := &redisStorage{
+		pool:   newPool(addr),
+		prefix: userPrefix(fmt.Sprintf("https://test.example/%d", time.Now().UnixNano())),
+	}
+	return store, func() {
+		conn := store.pool.Get()
+		defer conn.Close()
+
+		// all keys of the user contain the prefix
+		cursor := 0
+		for {
+			values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "*"+store.prefix+"*", "COUNT", 1000))
+			require.NoError(t, err)
+			cursor, _ = redis.Int(values[0], nil)
+			keys, _ := redis.Strings(values[1], nil)
+			if len(keys) > 0 {
+				_, err = conn.Do("DEL", redis.Args{}.AddFlat(keys)...)
+				assert.NoError(t, err)
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+		store.pool.Close()
+	}
+}
+
+func TestRedisStorage_Paging(t *testing.T) {
+	store, cleanup := createRedisStorage(t)
+	defer cleanup()
+	testTimelinePaging(t, store)
+}
+
+func TestRedisStorage_Remove(t *testing.T) {
+	store, cleanup := createRedisStorage(t)
+	defer cleanup()
+	testTimelineRemove(t, store)
+}
+
+func TestRedisStorage_ItemUpdates(t *testing.T) {
+	store, cleanup := createRedisStorage(t)
+	defer cleanup()
+	testTimelineItemUpdates(t, store)
+}
+
+func TestRedisStorage_ItemSearchIndex(t *testing.T) {
+	store, cleanup := createRedisStorage(t)
+	defer cleanup()
+	testItemSearchIndex(t, store)
+}
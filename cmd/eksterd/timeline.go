@@ -1,207 +1,331 @@
 package main
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"p83.nl/go/ekster/pkg/microsub"
 )
 
+const (
+	timelineTypeSortedSet = "sorted-set"
+	timelineTypeStream    = "stream"
+	timelineTypeCapped    = "capped"
+
+	// defaultCappedSize is the number of items kept by a capped timeline
+	defaultCappedSize = 100
+
+	// defaultTimelineLimit is the number of items on a page
+	defaultTimelineLimit = 20
+
+	// maxTimelineLimit is the largest number of items on a page
+	maxTimelineLimit = 100
+
+	// removedItemsTTL is how long the Redis timelines remember removed items,
+	// so they are not added again while a feed still contains them
+	removedItemsTTL = 90 * 24 * time.Hour
+)
+
 type TimelineBackend interface {
 	Init() error
 
-	Items(before, after string) (microsub.Timeline, error)
-	AddItem(item microsub.Item) error
+	// Items returns a page of the items that match the query
+	Items(query microsub.TimelineQuery) (microsub.Timeline, error)
+	// AddItem adds or updates the item, it reports whether the item is new
+	AddItem(item microsub.Item) (bool, error)
 	Count() (int, error)
 
 	MarkRead(uids []string) error
 
-	// Not used at the moment
-	// MarkUnread(uids []string) error
+	MarkUnread(uids []string) error
+	// MarkReadUpTo marks the item with uid and all items before it as read
+	MarkReadUpTo(uid string) error
+	MarkAllRead() error
+
+	// Export returns all items of the timeline, read items have Read set
+	Export() ([]microsub.Item, error)
+	// Clear removes all items from the timeline
+	Clear() error
+
+	// Entries returns the id, published time and read state of all items
+	Entries() ([]timelineEntry, error)
+	// Remove removes the items from the timeline, they are not added again
+	// when a feed still contains them. Stream timelines accept the ids of the
+	// entries and the ids of the items.
+	Remove(uids []string) error
 }
 
-type redisSortedSetTimeline struct {
-	channel string
+// timelineEntry is the part of an item that the retention policy looks at
+type timelineEntry struct {
+	ID        string
+	Published time.Time
+	Read      bool
 }
 
-type redisStreamTimeline struct {
-	channel, channelKey string
+// retentionPolicy limits the items that are kept in a channel, zero values
+// mean there is no limit
+type retentionPolicy struct {
+	MaxItems   int
+	MaxAge     time.Duration
+	KeepUnread bool
 }
 
-func (b *memoryBackend) getTimeline(channel string) TimelineBackend {
-	// TODO: fetch timeline type from channel
-	timelineType := "sorted-set"
-	if channel == "notifications" {
-		timelineType = "stream"
-	}
-	if timelineType == "sorted-set" {
-		timeline := &redisSortedSetTimeline{channel}
-		err := timeline.Init()
-		if err != nil {
-			return nil
+func (p retentionPolicy) enabled() bool {
+	return p.MaxItems > 0 || p.MaxAge > 0
+}
+
+// MaxAgeDays returns MaxAge in days, for the settings page
+func (p retentionPolicy) MaxAgeDays() int {
+	return int(p.MaxAge / (24 * time.Hour))
+}
+
+// expired returns the ids of the entries that fall outside the policy at now,
+// unread entries count towards MaxItems even when they are kept
+func (p retentionPolicy) expired(entries []timelineEntry, now time.Time) []string {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Published.After(entries[j].Published)
+	})
+
+	var uids []string
+	kept := 0
+	for _, entry := range entries {
+		tooOld := p.MaxAge > 0 && now.Sub(entry.Published) > p.MaxAge
+		tooMany := p.MaxItems > 0 && kept >= p.MaxItems
+		if (tooOld || tooMany) && !(p.KeepUnread && !entry.Read) {
+			uids = append(uids, entry.ID)
+			continue
 		}
-		return timeline
+		kept++
 	}
-	if timelineType == "stream" {
-		timeline := &redisStreamTimeline{channel: channel}
-		err := timeline.Init()
-		if err != nil {
-			return nil
-		}
-		return timeline
+	return uids
+}
+
+// pruneTimeline removes the items that fall outside the policy and returns
+// the number of removed items
+func pruneTimeline(timeline TimelineBackend, policy retentionPolicy, now time.Time) (int, error) {
+	if !policy.enabled() {
+		return 0, nil
 	}
-	return nil
+
+	entries, err := timeline.Entries()
+	if err != nil {
+		return 0, fmt.Errorf("while reading entries: %v", err)
+	}
+
+	uids := policy.expired(entries, now)
+	if len(uids) == 0 {
+		return 0, nil
+	}
+
+	return len(uids), timeline.Remove(uids)
 }
 
-/*
- * REDIS SORTED SETS TIMELINE
- */
-func (timeline *redisSortedSetTimeline) Init() error {
-	return nil
+type redisSortedSetTimeline struct {
+	pool    *redis.Pool
+	channel string
 }
 
-func (timeline *redisSortedSetTimeline) Items(before, after string) (microsub.Timeline, error) {
-	conn := pool.Get()
-	defer conn.Close()
+type redisStreamTimeline struct {
+	pool                *redis.Pool
+	channel, channelKey string
+}
+
+// redisCappedTimeline keeps the latest items of a channel, read or unread
+type redisCappedTimeline struct {
+	pool    *redis.Pool
+	channel string
+	size    int
+}
 
-	items := []microsub.Item{}
+func isValidTimelineType(timelineType string) bool {
+	switch timelineType {
+	case timelineTypeSortedSet, timelineTypeStream, timelineTypeCapped:
+		return true
+	}
+	return false
+}
 
-	channel := timeline.channel
+// channelTimelineType returns the timeline type and size for the channel
+func (b *memoryBackend) channelTimelineType(channel string) (string, int) {
+	b.lock.RLock()
+	setting := b.Settings[channel]
+	b.lock.RUnlock()
 
-	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	return timelineTypeFromSetting(channel, setting)
+}
 
-	afterScore := "-inf"
-	if len(after) != 0 {
-		afterScore = "(" + after
-	}
-	beforeScore := "+inf"
-	if len(before) != 0 {
-		beforeScore = "(" + before
+func timelineTypeFromSetting(channel string, setting channelSetting) (string, int) {
+	timelineType := setting.ChannelType
+	if timelineType == "" {
+		timelineType = timelineTypeSortedSet
+		if channel == "notifications" {
+			timelineType = timelineTypeStream
+		}
 	}
 
-	var itemJSONs [][]byte
+	size := setting.CappedSize
+	if size <= 0 {
+		size = defaultCappedSize
+	}
 
-	itemScores, err := redis.Strings(
-		conn.Do(
-			"ZRANGEBYSCORE",
-			zchannelKey,
-			afterScore,
-			beforeScore,
-			"LIMIT",
-			0,
-			20,
-			"WITHSCORES",
-		),
-	)
+	return timelineType, size
+}
 
+func (b *memoryBackend) getTimeline(channel string) TimelineBackend {
+	timelineType, size := b.channelTimelineType(channel)
+	timeline := b.store.Timeline(channel, timelineType, size)
+	if timeline == nil {
+		return nil
+	}
+	err := timeline.Init()
 	if err != nil {
-		return microsub.Timeline{
-			Paging: microsub.Pagination{},
-			Items:  items,
-		}, err
+		return nil
 	}
+	return timeline
+}
 
-	if len(itemScores) >= 2 {
-		before = itemScores[1]
-		after = itemScores[len(itemScores)-1]
-	} else {
-		before = ""
-		after = ""
+// timelineLimit returns the number of items on a page for the query
+func timelineLimit(query microsub.TimelineQuery) int {
+	if query.Limit <= 0 {
+		return defaultTimelineLimit
 	}
+	if query.Limit > maxTimelineLimit {
+		return maxTimelineLimit
+	}
+	return query.Limit
+}
 
-	for i := 0; i < len(itemScores); i += 2 {
-		itemID := itemScores[i]
-		itemJSON, err := redis.Bytes(conn.Do("HGET", itemID, "Data"))
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		itemJSONs = append(itemJSONs, itemJSON)
+// migrateTimeline moves all items from one timeline to the other, AddItem
+// keeps the read state of the items
+func migrateTimeline(from, to TimelineBackend) error {
+	items, err := from.Export()
+	if err != nil {
+		return fmt.Errorf("while exporting items: %v", err)
 	}
 
-	for _, obj := range itemJSONs {
-		item := microsub.Item{}
-		err := json.Unmarshal(obj, &item)
+	for _, item := range items {
+		_, err = to.AddItem(item)
 		if err != nil {
-			// FIXME: what should we do if one of the items doen't unmarshal?
-			log.Println(err)
-			continue
+			return fmt.Errorf("while adding item %s: %v", item.ID, err)
 		}
-		item.Read = false
-		items = append(items, item)
-	}
-	paging := microsub.Pagination{
-		After:  after,
-		Before: before,
 	}
 
-	return microsub.Timeline{
-		Paging: paging,
-		Items:  items,
-	}, nil
+	return from.Clear()
 }
 
-func (timeline *redisSortedSetTimeline) AddItem(item microsub.Item) error {
-	conn := pool.Get()
+/*
+ * REDIS SORTED SETS TIMELINE
+ */
+// Init moves the removed items that older versions kept in a set to the
+// sorted set of removed items
+func (timeline *redisSortedSetTimeline) Init() error {
+	conn := timeline.pool.Get()
 	defer conn.Close()
 
-	channel := timeline.channel
-	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	return migrateRemovedSet(conn, fmt.Sprintf("channel:%s:removed", timeline.channel), timeline.removedKey())
+}
 
-	if item.Published == "" {
-		item.Published = time.Now().Format(time.RFC3339)
-	}
+// removedKey returns the key of the sorted set of removed items, the score is
+// the time the item was removed
+func (timeline *redisSortedSetTimeline) removedKey() string {
+	return fmt.Sprintf("zchannel:%s:removed", timeline.channel)
+}
 
-	data, err := json.Marshal(item)
+// hashKey returns the key of the hash of the item in this channel, every
+// channel keeps its own copy so the copy can be deleted with the item
+func (timeline *redisSortedSetTimeline) hashKey(itemKey string) string {
+	return fmt.Sprintf("channel:%s:%s", timeline.channel, itemKey)
+}
+
+// Items returns the oldest unread items first, after points to newer items
+func (timeline *redisSortedSetTimeline) Items(query microsub.TimelineQuery) (microsub.Timeline, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	page, err := newTimelinePage(query, false)
 	if err != nil {
-		log.Printf("error while creating item for redis: %v\n", err)
-		return err
+		return microsub.Timeline{Items: []microsub.Item{}}, err
 	}
 
-	forRedis := redisItem{
-		ID:        item.ID,
-		Published: item.Published,
-		Read:      item.Read,
-		Data:      data,
+	zchannelKey := fmt.Sprintf("zchannel:%s:posts", timeline.channel)
+
+	err = readRedisPage(conn, page, zchannelKey, timeline.hashKey, func(itemKey string) (bool, error) {
+		// the sorted set only contains unread items
+		return false, nil
+	})
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
 	}
 
+	return page.timeline(), nil
+}
+
+// AddItem adds the item to the channel. An item that is already in the channel
+// is updated in place and keeps its read state and position.
+func (timeline *redisSortedSetTimeline) AddItem(item microsub.Item) (bool, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	channel := timeline.channel
+	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
 	itemKey := fmt.Sprintf("item:%s", item.ID)
-	_, err = redis.String(conn.Do("HMSET", redis.Args{}.Add(itemKey).AddFlat(&forRedis)...))
+
+	isRemoved, err := isRemovedItem(conn, timeline.removedKey(), itemKey)
+	if err != nil || isRemoved {
+		return false, err
+	}
+
+	err = saveRedisItem(conn, timeline.hashKey(itemKey), &item)
 	if err != nil {
-		return fmt.Errorf("error while writing item for redis: %v", err)
+		return false, err
+	}
+	err = indexRedisItem(conn, channel, item)
+	if err != nil {
+		return false, err
 	}
 
 	readChannelKey := fmt.Sprintf("channel:%s:read", channel)
+
+	if item.Read {
+		if _, err := conn.Do("SADD", readChannelKey, itemKey); err != nil {
+			return false, err
+		}
+		_, err = conn.Do("ZREM", zchannelKey, itemKey)
+		return false, err
+	}
+
 	isRead, err := redis.Bool(conn.Do("SISMEMBER", readChannelKey, itemKey))
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if isRead {
-		return nil
+		return false, nil
 	}
 
 	score, err := time.Parse(time.RFC3339, item.Published)
 	if err != nil {
-		return fmt.Errorf("error can't parse %s as time", item.Published)
+		return false, fmt.Errorf("error can't parse %s as time", item.Published)
 	}
 
-	_, err = redis.Int64(conn.Do("ZADD", zchannelKey, score.Unix()*1.0, itemKey))
+	added, err := redis.Int64(conn.Do("ZADD", zchannelKey, "NX", score.Unix()*1.0, itemKey))
 	if err != nil {
-		return fmt.Errorf("error while zadding item %s to channel %s for redis: %v", itemKey, zchannelKey, err)
+		return false, fmt.Errorf("error while zadding item %s to channel %s for redis: %v", itemKey, zchannelKey, err)
 	}
 
-	// FIXME: send message to events...
-	// b.sendMessage(microsub.Message("item added " + item.ID))
-
-	return nil
+	return added == 1, nil
 }
 
 func (timeline *redisSortedSetTimeline) Count() (int, error) {
-	conn := pool.Get()
+	conn := timeline.pool.Get()
 	defer conn.Close()
 
 	channel := timeline.channel
@@ -214,9 +338,13 @@ func (timeline *redisSortedSetTimeline) Count() (int, error) {
 }
 
 func (timeline *redisSortedSetTimeline) MarkRead(uids []string) error {
-	conn := pool.Get()
+	conn := timeline.pool.Get()
 	defer conn.Close()
 
+	if len(uids) == 0 {
+		return nil
+	}
+
 	channel := timeline.channel
 
 	itemUIDs := []string{}
@@ -242,93 +370,1224 @@ func (timeline *redisSortedSetTimeline) MarkRead(uids []string) error {
 }
 
 func (timeline *redisSortedSetTimeline) MarkUnread(uids []string) error {
-	panic("implement me")
-}
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	channel := timeline.channel
+	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	readChannelKey := fmt.Sprintf("channel:%s:read", channel)
+
+	for _, uid := range uids {
+		itemKey := "item:" + uid
+
+		// removed items are not read anymore and are not added again
+		isRead, err := redis.Bool(conn.Do("SISMEMBER", readChannelKey, itemKey))
+		if err != nil {
+			return fmt.Errorf("marking unread for channel %s has failed: %s", channel, err)
+		}
+		if !isRead {
+			continue
+		}
+
+		published, err := redis.String(redisItemField(conn, timeline.hashKey(itemKey), itemKey, "Published"))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("marking unread for channel %s has failed: %s", channel, err)
+		}
+
+		score, err := time.Parse(time.RFC3339, published)
+		if err != nil {
+			return fmt.Errorf("error can't parse %s as time", published)
+		}
+
+		if _, err := conn.Do("SREM", readChannelKey, itemKey); err != nil {
+			return fmt.Errorf("marking unread for channel %s has failed: %s", channel, err)
+		}
+		if _, err := conn.Do("ZADD", zchannelKey, score.Unix(), itemKey); err != nil {
+			return fmt.Errorf("marking unread for channel %s has failed: %s", channel, err)
+		}
+	}
 
-/*
- * REDIS STREAMS TIMELINE
- */
-func (timeline *redisStreamTimeline) Init() error {
-	timeline.channelKey = fmt.Sprintf("stream:%s", timeline.channel)
 	return nil
 }
 
-func (timeline *redisStreamTimeline) Items(before, after string) (microsub.Timeline, error) {
-	conn := pool.Get()
+func (timeline *redisSortedSetTimeline) MarkReadUpTo(uid string) error {
+	conn := timeline.pool.Get()
 	defer conn.Close()
 
-	if before == "" {
-		before = "-"
+	zchannelKey := fmt.Sprintf("zchannel:%s:posts", timeline.channel)
+	itemKey := "item:" + uid
+
+	published, err := redis.String(redisItemField(conn, timeline.hashKey(itemKey), itemKey, "Published"))
+	if err != nil {
+		return fmt.Errorf("unknown entry %s: %v", uid, err)
+	}
+	score, err := time.Parse(time.RFC3339, published)
+	if err != nil {
+		return fmt.Errorf("error can't parse %s as time", published)
 	}
 
-	if after == "" {
-		after = "+"
+	itemKeys, err := redis.Strings(conn.Do("ZRANGEBYSCORE", zchannelKey, "-inf", score.Unix()))
+	if err != nil {
+		return err
 	}
 
-	results, err := redis.Values(conn.Do("XREVRANGE", redis.Args{}.Add(timeline.channelKey, after, before, "COUNT", "20")...))
+	return timeline.MarkRead(itemIDs(itemKeys))
+}
+
+func (timeline *redisSortedSetTimeline) MarkAllRead() error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	zchannelKey := fmt.Sprintf("zchannel:%s:posts", timeline.channel)
+	itemKeys, err := redis.Strings(conn.Do("ZRANGE", zchannelKey, 0, -1))
 	if err != nil {
-		return microsub.Timeline{}, err
+		return err
 	}
 
-	var forRedis redisItem
+	return timeline.MarkRead(itemIDs(itemKeys))
+}
+
+func (timeline *redisSortedSetTimeline) Export() ([]microsub.Item, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	channel := timeline.channel
+	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	readChannelKey := fmt.Sprintf("channel:%s:read", channel)
+
+	unread, err := redis.Strings(conn.Do("ZRANGE", zchannelKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	read, err := redis.Strings(conn.Do("SMEMBERS", readChannelKey))
+	if err != nil {
+		return nil, err
+	}
 
 	var items []microsub.Item
-	for _, result := range results {
-		if value, ok := result.([]interface{}); ok {
-			id, ok2 := value[0].([]uint8)
-
-			if item, ok3 := value[1].([]interface{}); ok3 {
-				err = redis.ScanStruct(item, &forRedis)
-				if err != nil {
-					continue
-				}
-				item := forRedis.Item()
-				if ok2 {
-					item.ID = string(id)
-				}
-				items = append(items, item)
-			}
+	for i, itemKey := range append(unread, read...) {
+		itemJSON, err := redis.Bytes(redisItemField(conn, timeline.hashKey(itemKey), itemKey, "Data"))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		item := microsub.Item{}
+		err = json.Unmarshal(itemJSON, &item)
+		if err != nil {
+			log.Println(err)
+			continue
 		}
+		item.Read = i >= len(unread)
+		items = append(items, item)
 	}
 
-	return microsub.Timeline{
-		Items:  items,
-		Paging: microsub.Pagination{},
-	}, nil
+	return items, nil
 }
 
-func (timeline *redisStreamTimeline) AddItem(item microsub.Item) error {
-	conn := pool.Get()
+// Clear removes all items and their hashes, the removed items are still
+// remembered
+func (timeline *redisSortedSetTimeline) Clear() error {
+	conn := timeline.pool.Get()
 	defer conn.Close()
 
-	if item.Published == "" {
-		item.Published = time.Now().Format(time.RFC3339)
-	}
+	channel := timeline.channel
+	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	readChannelKey := fmt.Sprintf("channel:%s:read", channel)
 
-	data, err := json.Marshal(item)
+	unread, err := redis.Strings(conn.Do("ZRANGE", zchannelKey, 0, -1))
+	if err != nil {
+		return err
+	}
+	read, err := redis.Strings(conn.Do("SMEMBERS", readChannelKey))
 	if err != nil {
-		log.Printf("error while creating item for redis: %v\n", err)
 		return err
 	}
 
-	args := redis.Args{}.Add(timeline.channelKey).Add("*").Add("ID").Add(item.ID).Add("Published").Add(item.Published).Add("Read").Add(item.Read).Add("Data").Add(data)
+	keys := []string{zchannelKey, readChannelKey}
+	for _, itemKey := range append(unread, read...) {
+		keys = append(keys, timeline.hashKey(itemKey))
+	}
+	_, err = conn.Do("DEL", redis.Args{}.AddFlat(keys)...)
+	return err
+}
 
-	_, err = redis.String(conn.Do("XADD", args...))
+func (timeline *redisSortedSetTimeline) Entries() ([]timelineEntry, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
 
-	return err
+	channel := timeline.channel
+	zchannelKey := fmt.Sprintf("zchannel:%s:posts", channel)
+	readChannelKey := fmt.Sprintf("channel:%s:read", channel)
+
+	itemScores, err := redis.Strings(conn.Do("ZRANGE", zchannelKey, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	read, err := redis.Strings(conn.Do("SMEMBERS", readChannelKey))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := scoredEntries(itemScores, nil)
+	for _, itemKey := range read {
+		published, err := redis.String(redisItemField(conn, timeline.hashKey(itemKey), itemKey, "Published"))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, published)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, timelineEntry{
+			ID:        strings.TrimPrefix(itemKey, "item:"),
+			Published: t,
+			Read:      true,
+		})
+	}
+
+	return entries, nil
 }
 
-func (timeline *redisStreamTimeline) Count() (int, error) {
-	conn := pool.Get()
+// Remove removes the items and their hashes from the channel, the items are
+// remembered in zchannel:%s:removed so AddItem doesn't add them again
+func (timeline *redisSortedSetTimeline) Remove(uids []string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	conn := timeline.pool.Get()
 	defer conn.Close()
 
-	return redis.Int(conn.Do("XLEN", timeline.channelKey))
+	channel := timeline.channel
+	keys := itemKeys(uids)
+
+	var hashKeys []string
+	for _, itemKey := range keys {
+		hashKeys = append(hashKeys, timeline.hashKey(itemKey))
+	}
+
+	err := rememberRemovedItems(conn, timeline.removedKey(), keys, time.Now())
+	if err == nil {
+		_, err = conn.Do("ZREM", redis.Args{}.Add(fmt.Sprintf("zchannel:%s:posts", channel)).AddFlat(keys)...)
+	}
+	if err == nil {
+		_, err = conn.Do("SREM", redis.Args{}.Add(fmt.Sprintf("channel:%s:read", channel)).AddFlat(keys)...)
+	}
+	if err == nil {
+		_, err = conn.Do("DEL", redis.Args{}.AddFlat(hashKeys)...)
+	}
+	if err == nil {
+		err = unindexRedisItems(conn, channel, uids)
+	}
+	if err != nil {
+		return fmt.Errorf("removing items from channel %s has failed: %s", channel, err)
+	}
+	return nil
 }
 
-func (timeline *redisStreamTimeline) MarkRead(uids []string) error {
-	panic("implement me")
+/*
+ * REDIS STREAMS TIMELINE
+ */
+func (timeline *redisStreamTimeline) Init() error {
+	timeline.channelKey = fmt.Sprintf("stream:%s", timeline.channel)
+	return nil
 }
 
-func (timeline *redisStreamTimeline) MarkUnread(uids []string) error {
-	panic("implement me")
+// Items returns the newest items first, after points to older items
+func (timeline *redisStreamTimeline) Items(query microsub.TimelineQuery) (microsub.Timeline, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	page, err := newTimelinePage(query, true)
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	read, err := timeline.readIDs(conn)
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	command, from, to := "XRANGE", "-", "+"
+	if page.desc {
+		command, from, to = "XREVRANGE", "+", "-"
+	}
+	if page.start != nil {
+		from = streamCursorID(*page.start)
+	}
+
+	// the entries are read in batches, the next batch starts at the last entry
+	// of the previous batch
+	batch := page.limit + 1
+	var last string
+	for !page.done() {
+		results, err := redis.Values(conn.Do(command, timeline.channelKey, from, to, "COUNT", batch))
+		if err != nil {
+			return microsub.Timeline{Items: []microsub.Item{}}, err
+		}
+
+		for _, result := range results {
+			if page.done() {
+				break
+			}
+			value, ok := result.([]interface{})
+			if !ok || len(value) != 2 {
+				continue
+			}
+			id, ok := value[0].([]uint8)
+			if !ok || string(id) == last {
+				continue
+			}
+			from = string(id)
+
+			c, err := streamCursor(string(id))
+			if err != nil || page.skip(c) {
+				continue
+			}
+
+			fields, ok := value[1].([]interface{})
+			if !ok {
+				continue
+			}
+			var forRedis redisItem
+			if err := redis.ScanStruct(fields, &forRedis); err != nil {
+				continue
+			}
+			item := forRedis.Item()
+			item.ID = string(id)
+			item.Read = read[item.ID]
+			page.add(c, item)
+		}
+
+		if len(results) < batch {
+			break
+		}
+		last = from
+	}
+
+	return page.timeline(), nil
+}
+
+// AddItem adds the item to the stream. Items with an ID are added once, when
+// the item is updated the old entry is replaced and the read state is kept.
+func (timeline *redisStreamTimeline) AddItem(item microsub.Item) (bool, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	hash := itemHash(item)
+	itemsKey := timeline.channelKey + ":items"
+	isNew := true
+
+	if item.ID != "" {
+		isRemoved, err := isRemovedItem(conn, timeline.channelKey+":removed", item.ID)
+		if err != nil || isRemoved {
+			return false, err
+		}
+
+		oldID, err := redis.String(conn.Do("HGET", itemsKey, item.ID))
+		if err != nil && err != redis.ErrNil {
+			return false, err
+		}
+		if oldID != "" {
+			stored, ok := timeline.entry(conn, oldID)
+			if !ok {
+				// the item was removed by an older version
+				return false, nil
+			}
+			if item.Published == "" {
+				item.Published = stored.Published
+			}
+			if !isItemUpdate(stored, item, hash) {
+				return false, nil
+			}
+			isRead, err := redis.Bool(conn.Do("SISMEMBER", timeline.channelKey+":read", oldID))
+			if err != nil {
+				return false, err
+			}
+			isNew = false
+			item.Read = item.Read || isRead
+			if _, err := conn.Do("XDEL", timeline.channelKey, oldID); err != nil {
+				return false, err
+			}
+			if _, err := conn.Do("SREM", timeline.channelKey+":read", oldID); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if item.Published == "" {
+		item.Published = time.Now().Format(time.RFC3339)
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		log.Printf("error while creating item for redis: %v\n", err)
+		return false, err
+	}
+
+	args := redis.Args{}.Add(timeline.channelKey).Add("*").Add("ID").Add(item.ID).Add("Published").Add(item.Published).Add("Read").Add(item.Read).Add("Hash").Add(hash).Add("Data").Add(data)
+
+	id, err := redis.String(conn.Do("XADD", args...))
+	if err != nil {
+		return false, err
+	}
+
+	if item.ID != "" {
+		if _, err := conn.Do("HSET", itemsKey, item.ID, id); err != nil {
+			return false, err
+		}
+	}
+
+	if item.Read {
+		if _, err := conn.Do("SADD", timeline.channelKey+":read", id); err != nil {
+			return false, err
+		}
+	}
+
+	return isNew, indexRedisItem(conn, timeline.channel, item)
+}
+
+// entry returns the stream entry with id
+func (timeline *redisStreamTimeline) entry(conn redis.Conn, id string) (redisItem, bool) {
+	var forRedis redisItem
+
+	results, err := redis.Values(conn.Do("XRANGE", timeline.channelKey, id, id))
+	if err != nil || len(results) == 0 {
+		return forRedis, false
+	}
+	value, ok := results[0].([]interface{})
+	if !ok || len(value) != 2 {
+		return forRedis, false
+	}
+	fields, ok := value[1].([]interface{})
+	if !ok {
+		return forRedis, false
+	}
+	if err := redis.ScanStruct(fields, &forRedis); err != nil {
+		return forRedis, false
+	}
+	return forRedis, true
+}
+
+func (timeline *redisStreamTimeline) Count() (int, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	count, err := redis.Int(conn.Do("XLEN", timeline.channelKey))
+	if err != nil {
+		return -1, err
+	}
+	read, err := redis.Int(conn.Do("SCARD", timeline.channelKey+":read"))
+	if err != nil {
+		return -1, err
+	}
+	return count - read, nil
+}
+
+// MarkRead marks the stream entries with the ids as read
+func (timeline *redisStreamTimeline) MarkRead(uids []string) error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	if len(uids) == 0 {
+		return nil
+	}
+
+	_, err := conn.Do("SADD", redis.Args{}.Add(timeline.channelKey+":read").AddFlat(uids)...)
+	if err != nil {
+		return fmt.Errorf("marking read for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+// MarkUnread marks the stream entries with the ids as unread
+func (timeline *redisStreamTimeline) MarkUnread(uids []string) error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	if len(uids) == 0 {
+		return nil
+	}
+
+	_, err := conn.Do("SREM", redis.Args{}.Add(timeline.channelKey+":read").AddFlat(uids)...)
+	if err != nil {
+		return fmt.Errorf("marking unread for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+// MarkReadUpTo marks the stream entry with id uid and all entries added before it as read
+func (timeline *redisStreamTimeline) MarkReadUpTo(uid string) error {
+	ids, err := timeline.entryIDs("-", uid)
+	if err != nil {
+		return err
+	}
+	return timeline.MarkRead(ids)
+}
+
+func (timeline *redisStreamTimeline) MarkAllRead() error {
+	ids, err := timeline.entryIDs("-", "+")
+	if err != nil {
+		return err
+	}
+	return timeline.MarkRead(ids)
+}
+
+func (timeline *redisStreamTimeline) entryIDs(start, end string) ([]string, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	results, err := redis.Values(conn.Do("XRANGE", timeline.channelKey, start, end))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, result := range results {
+		if value, ok := result.([]interface{}); ok && len(value) > 0 {
+			if id, ok := value[0].([]uint8); ok {
+				ids = append(ids, string(id))
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (timeline *redisStreamTimeline) readIDs(conn redis.Conn) (map[string]bool, error) {
+	ids, err := redis.Strings(conn.Do("SMEMBERS", timeline.channelKey+":read"))
+	if err != nil {
+		return nil, err
+	}
+	read := make(map[string]bool)
+	for _, id := range ids {
+		read[id] = true
+	}
+	return read, nil
+}
+
+func (timeline *redisStreamTimeline) Export() ([]microsub.Item, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	results, err := redis.Values(conn.Do("XRANGE", timeline.channelKey, "-", "+"))
+	if err != nil {
+		return nil, err
+	}
+
+	read, err := timeline.readIDs(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []microsub.Item
+	for _, result := range results {
+		value, ok := result.([]interface{})
+		if !ok || len(value) != 2 {
+			continue
+		}
+		id, _ := value[0].([]uint8)
+		fields, ok := value[1].([]interface{})
+		if !ok {
+			continue
+		}
+		var forRedis redisItem
+		err = redis.ScanStruct(fields, &forRedis)
+		if err != nil {
+			continue
+		}
+		item := forRedis.Item()
+		item.Read = read[string(id)]
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (timeline *redisStreamTimeline) Clear() error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", timeline.channelKey, timeline.channelKey+":read", timeline.channelKey+":items")
+	return err
+}
+
+func (timeline *redisStreamTimeline) Entries() ([]timelineEntry, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	results, err := redis.Values(conn.Do("XRANGE", timeline.channelKey, "-", "+"))
+	if err != nil {
+		return nil, err
+	}
+
+	read, err := timeline.readIDs(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []timelineEntry
+	for _, result := range results {
+		value, ok := result.([]interface{})
+		if !ok || len(value) != 2 {
+			continue
+		}
+		id, _ := value[0].([]uint8)
+		fields, ok := value[1].([]interface{})
+		if !ok {
+			continue
+		}
+		var forRedis redisItem
+		err = redis.ScanStruct(fields, &forRedis)
+		if err != nil {
+			continue
+		}
+		published, err := time.Parse(time.RFC3339, forRedis.Published)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, timelineEntry{
+			ID:        string(id),
+			Published: published,
+			Read:      read[string(id)],
+		})
+	}
+
+	return entries, nil
+}
+
+// streamIDRegex matches the ids of the entries of a redis stream
+var streamIDRegex = regexp.MustCompile(`^\d+(-\d+)?$`)
+
+// Remove removes the entries with the stream ids in uids, or the entries of
+// the items with those ids. The ids of the items are remembered in
+// stream:%s:removed so AddItem doesn't add them again.
+func (timeline *redisStreamTimeline) Remove(uids []string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	itemsKey := timeline.channelKey + ":items"
+
+	// the ids of items are replaced by the ids of their entries
+	var entryIDs, itemIDs []string
+	for _, uid := range uids {
+		entryID := uid
+		if !streamIDRegex.MatchString(uid) {
+			id, err := redis.String(conn.Do("HGET", itemsKey, uid))
+			if err != nil {
+				continue
+			}
+			entryID = id
+		}
+		entryIDs = append(entryIDs, entryID)
+		if stored, ok := timeline.entry(conn, entryID); ok && stored.ID != "" {
+			itemIDs = append(itemIDs, stored.ID)
+		}
+	}
+	if len(entryIDs) == 0 {
+		return nil
+	}
+
+	_, err := conn.Do("XDEL", redis.Args{}.Add(timeline.channelKey).AddFlat(entryIDs)...)
+	if err == nil {
+		_, err = conn.Do("SREM", redis.Args{}.Add(timeline.channelKey+":read").AddFlat(entryIDs)...)
+	}
+	if err == nil && len(itemIDs) > 0 {
+		err = rememberRemovedItems(conn, timeline.channelKey+":removed", itemIDs, time.Now())
+		if err == nil {
+			_, err = conn.Do("HDEL", redis.Args{}.Add(itemsKey).AddFlat(itemIDs)...)
+		}
+		if err == nil {
+			err = unindexRedisItems(conn, timeline.channel, itemIDs)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("removing items from channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+/*
+ * REDIS CAPPED TIMELINE
+ */
+func (timeline *redisCappedTimeline) Init() error {
+	if timeline.size <= 0 {
+		timeline.size = defaultCappedSize
+	}
+	return nil
+}
+
+func (timeline *redisCappedTimeline) keys() (string, string) {
+	return fmt.Sprintf("capped:%s:posts", timeline.channel), fmt.Sprintf("capped:%s:read", timeline.channel)
+}
+
+// removedKey returns the key of the sorted set of removed items, the score is
+// the time the item was removed
+func (timeline *redisCappedTimeline) removedKey() string {
+	return fmt.Sprintf("capped:%s:removed", timeline.channel)
+}
+
+// hashKey returns the key of the hash of the item in this timeline, every
+// timeline keeps its own copy so the copy can be deleted with the item
+func (timeline *redisCappedTimeline) hashKey(itemKey string) string {
+	return fmt.Sprintf("capped:%s:%s", timeline.channel, itemKey)
+}
+
+// Items returns the newest items first, after points to older items
+func (timeline *redisCappedTimeline) Items(query microsub.TimelineQuery) (microsub.Timeline, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	page, err := newTimelinePage(query, true)
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	postsKey, readKey := timeline.keys()
+
+	err = readRedisPage(conn, page, postsKey, timeline.hashKey, func(itemKey string) (bool, error) {
+		return redis.Bool(conn.Do("SISMEMBER", readKey, itemKey))
+	})
+	if err != nil {
+		return microsub.Timeline{Items: []microsub.Item{}}, err
+	}
+
+	return page.timeline(), nil
+}
+
+// AddItem adds the item to the timeline. An item that is already in the
+// timeline is updated in place and keeps its read state.
+func (timeline *redisCappedTimeline) AddItem(item microsub.Item) (bool, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	postsKey, readKey := timeline.keys()
+	itemKey := fmt.Sprintf("item:%s", item.ID)
+
+	isRemoved, err := isRemovedItem(conn, timeline.removedKey(), itemKey)
+	if err != nil || isRemoved {
+		return false, err
+	}
+
+	err = saveRedisItem(conn, timeline.hashKey(itemKey), &item)
+	if err != nil {
+		return false, err
+	}
+	err = indexRedisItem(conn, timeline.channel, item)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = redis.Int64(conn.Do("ZSCORE", postsKey, itemKey))
+	if err == nil {
+		if item.Read {
+			_, err = conn.Do("SADD", readKey, itemKey)
+		}
+		return false, err
+	} else if err != redis.ErrNil {
+		return false, err
+	}
+
+	score, err := time.Parse(time.RFC3339, item.Published)
+	if err != nil {
+		return false, fmt.Errorf("error can't parse %s as time", item.Published)
+	}
+
+	_, err = conn.Do("ZADD", postsKey, score.Unix(), itemKey)
+	if err != nil {
+		return false, fmt.Errorf("error while zadding item %s to channel %s for redis: %v", itemKey, postsKey, err)
+	}
+
+	if item.Read {
+		if _, err := conn.Do("SADD", readKey, itemKey); err != nil {
+			return false, err
+		}
+	}
+
+	// Remove the oldest items when there are more than size items
+	removed, err := redis.Strings(conn.Do("ZRANGE", postsKey, 0, -(timeline.size + 1)))
+	if err != nil {
+		return false, err
+	}
+	if len(removed) == 0 {
+		return true, nil
+	}
+	if _, err := conn.Do("ZREM", redis.Args{}.Add(postsKey).AddFlat(removed)...); err != nil {
+		return false, err
+	}
+	if _, err := conn.Do("SREM", redis.Args{}.Add(readKey).AddFlat(removed)...); err != nil {
+		return false, err
+	}
+	var hashKeys []string
+	for _, key := range removed {
+		hashKeys = append(hashKeys, timeline.hashKey(key))
+	}
+	if _, err := conn.Do("DEL", redis.Args{}.AddFlat(hashKeys)...); err != nil {
+		return false, err
+	}
+	if err := unindexRedisItems(conn, timeline.channel, itemIDs(removed)); err != nil {
+		return false, err
+	}
+
+	// the item itself can be older than the items that are kept
+	for _, key := range removed {
+		if key == itemKey {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Count returns the number of unread items
+func (timeline *redisCappedTimeline) Count() (int, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	postsKey, readKey := timeline.keys()
+
+	count, err := redis.Int(conn.Do("ZCARD", postsKey))
+	if err != nil {
+		return -1, fmt.Errorf("while updating channel unread count for %s: %s", timeline.channel, err)
+	}
+	read, err := redis.Int(conn.Do("SCARD", readKey))
+	if err != nil {
+		return -1, fmt.Errorf("while updating channel unread count for %s: %s", timeline.channel, err)
+	}
+	return count - read, nil
+}
+
+func (timeline *redisCappedTimeline) MarkRead(uids []string) error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	postsKey, readKey := timeline.keys()
+
+	for _, uid := range uids {
+		itemKey := "item:" + uid
+		// Only remember items that are still in the timeline
+		_, err := redis.Float64(conn.Do("ZSCORE", postsKey, itemKey))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = conn.Do("SADD", readKey, itemKey); err != nil {
+			return fmt.Errorf("marking read for channel %s has failed: %s", timeline.channel, err)
+		}
+	}
+
+	return nil
+}
+
+func (timeline *redisCappedTimeline) MarkUnread(uids []string) error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	if len(uids) == 0 {
+		return nil
+	}
+
+	_, readKey := timeline.keys()
+	_, err := conn.Do("SREM", redis.Args{}.Add(readKey).AddFlat(itemKeys(uids))...)
+	if err != nil {
+		return fmt.Errorf("marking unread for channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+func (timeline *redisCappedTimeline) MarkReadUpTo(uid string) error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	postsKey, _ := timeline.keys()
+
+	score, err := redis.Int64(conn.Do("ZSCORE", postsKey, "item:"+uid))
+	if err != nil {
+		return fmt.Errorf("unknown entry %s: %v", uid, err)
+	}
+
+	keys, err := redis.Strings(conn.Do("ZRANGEBYSCORE", postsKey, "-inf", score))
+	if err != nil {
+		return err
+	}
+
+	return timeline.MarkRead(itemIDs(keys))
+}
+
+func (timeline *redisCappedTimeline) MarkAllRead() error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	postsKey, _ := timeline.keys()
+	keys, err := redis.Strings(conn.Do("ZRANGE", postsKey, 0, -1))
+	if err != nil {
+		return err
+	}
+
+	return timeline.MarkRead(itemIDs(keys))
+}
+
+func (timeline *redisCappedTimeline) Export() ([]microsub.Item, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	postsKey, readKey := timeline.keys()
+
+	itemKeys, err := redis.Strings(conn.Do("ZRANGE", postsKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	var items []microsub.Item
+	for _, itemKey := range itemKeys {
+		itemJSON, err := redis.Bytes(redisItemField(conn, timeline.hashKey(itemKey), itemKey, "Data"))
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		item := microsub.Item{}
+		err = json.Unmarshal(itemJSON, &item)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		item.Read, err = redis.Bool(conn.Do("SISMEMBER", readKey, itemKey))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// Clear removes all items and their hashes, the removed items are still
+// remembered
+func (timeline *redisCappedTimeline) Clear() error {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	postsKey, readKey := timeline.keys()
+
+	itemKeys, err := redis.Strings(conn.Do("ZRANGE", postsKey, 0, -1))
+	if err != nil {
+		return err
+	}
+
+	keys := []string{postsKey, readKey}
+	for _, itemKey := range itemKeys {
+		keys = append(keys, timeline.hashKey(itemKey))
+	}
+	_, err = conn.Do("DEL", redis.Args{}.AddFlat(keys)...)
+	return err
+}
+
+func (timeline *redisCappedTimeline) Entries() ([]timelineEntry, error) {
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	postsKey, readKey := timeline.keys()
+
+	itemScores, err := redis.Strings(conn.Do("ZRANGE", postsKey, 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, err
+	}
+	read, err := redis.Strings(conn.Do("SMEMBERS", readKey))
+	if err != nil {
+		return nil, err
+	}
+	isRead := make(map[string]bool)
+	for _, itemKey := range read {
+		isRead[itemKey] = true
+	}
+
+	return scoredEntries(itemScores, isRead), nil
+}
+
+// Remove removes the items and their hashes from the timeline, the items are
+// remembered in capped:%s:removed so AddItem doesn't add them again
+func (timeline *redisCappedTimeline) Remove(uids []string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	conn := timeline.pool.Get()
+	defer conn.Close()
+
+	postsKey, readKey := timeline.keys()
+	keys := itemKeys(uids)
+
+	var hashKeys []string
+	for _, itemKey := range keys {
+		hashKeys = append(hashKeys, timeline.hashKey(itemKey))
+	}
+
+	err := rememberRemovedItems(conn, timeline.removedKey(), keys, time.Now())
+	if err == nil {
+		_, err = conn.Do("ZREM", redis.Args{}.Add(postsKey).AddFlat(keys)...)
+	}
+	if err == nil {
+		_, err = conn.Do("SREM", redis.Args{}.Add(readKey).AddFlat(keys)...)
+	}
+	if err == nil {
+		_, err = conn.Do("DEL", redis.Args{}.AddFlat(hashKeys)...)
+	}
+	if err == nil {
+		err = unindexRedisItems(conn, timeline.channel, uids)
+	}
+	if err != nil {
+		return fmt.Errorf("removing items from channel %s has failed: %s", timeline.channel, err)
+	}
+	return nil
+}
+
+// readRedisPage fills page with the items of the sorted set postsKey, hashKey
+// returns the key of the hash of an item and isRead returns the read state of
+// an item. Items with the same score are ordered by key, like Redis does.
+func readRedisPage(conn redis.Conn, page *timelinePage, postsKey string, hashKey func(itemKey string) string, isRead func(itemKey string) (bool, error)) error {
+	command, from, to := "ZRANGEBYSCORE", "-inf", "+inf"
+	if page.desc {
+		command, from, to = "ZREVRANGEBYSCORE", "+inf", "-inf"
+	}
+	if page.start != nil {
+		// the bound is inclusive, because items with the same score can
+		// come after the cursor
+		from = strconv.FormatInt(page.start.Score, 10)
+	}
+
+	// items that don't match the query are skipped, so more than one batch
+	// can be needed to fill the page
+	batch := page.limit + 1
+	for offset := 0; !page.done(); offset += batch {
+		itemScores, err := redis.Strings(conn.Do(command, postsKey, from, to, "LIMIT", offset, batch, "WITHSCORES"))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i+1 < len(itemScores) && !page.done(); i += 2 {
+			itemKey := itemScores[i]
+			score, err := strconv.ParseFloat(itemScores[i+1], 64)
+			if err != nil {
+				continue
+			}
+			c := timelineCursor{Score: int64(score), ID: itemKey}
+			if page.skip(c) {
+				continue
+			}
+
+			itemJSON, err := redis.Bytes(redisItemField(conn, hashKey(itemKey), itemKey, "Data"))
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			item := microsub.Item{}
+			err = json.Unmarshal(itemJSON, &item)
+			if err != nil {
+				// FIXME: what should we do if one of the items doen't unmarshal?
+				log.Println(err)
+				continue
+			}
+			item.Read, err = isRead(itemKey)
+			if err != nil {
+				return err
+			}
+			page.add(c, item)
+		}
+
+		if len(itemScores) < 2*batch {
+			break
+		}
+	}
+
+	return nil
+}
+
+// streamCursor returns the cursor of the stream entry with id. Entry ids are
+// ordered by the time and then by the sequence number, the sequence number is
+// padded so the cursors have the same order.
+func streamCursor(id string) (timelineCursor, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return timelineCursor{}, fmt.Errorf("invalid stream id %q", id)
+	}
+	ms, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return timelineCursor{}, fmt.Errorf("invalid stream id %q", id)
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return timelineCursor{}, fmt.Errorf("invalid stream id %q", id)
+	}
+	return timelineCursor{Score: ms, ID: fmt.Sprintf("%020d", seq)}, nil
+}
+
+// streamCursorID returns the stream entry id of cursor c
+func streamCursorID(c timelineCursor) string {
+	seq, _ := strconv.ParseUint(c.ID, 10, 64)
+	return fmt.Sprintf("%d-%d", c.Score, seq)
+}
+
+// redisItemField returns a field of the hash of an item. Items added by older
+// versions are shared by all channels and only have a hash at itemKey.
+func redisItemField(conn redis.Conn, hashKey, itemKey, field string) (interface{}, error) {
+	value, err := conn.Do("HGET", hashKey, field)
+	if err == nil && value == nil {
+		return conn.Do("HGET", itemKey, field)
+	}
+	return value, err
+}
+
+// isRemovedItem returns true when key is in the sorted set of removed items
+func isRemovedItem(conn redis.Conn, removedKey, key string) (bool, error) {
+	_, err := redis.Float64(conn.Do("ZSCORE", removedKey, key))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// rememberRemovedItems adds the keys to the sorted set of removed items with
+// the time of removal, items that were removed longer than removedItemsTTL ago
+// are forgotten
+func rememberRemovedItems(conn redis.Conn, removedKey string, keys []string, now time.Time) error {
+	args := redis.Args{}.Add(removedKey)
+	for _, key := range keys {
+		args = args.Add(now.Unix()).Add(key)
+	}
+	if _, err := conn.Do("ZADD", args...); err != nil {
+		return err
+	}
+	_, err := conn.Do("ZREMRANGEBYSCORE", removedKey, "-inf", now.Add(-removedItemsTTL).Unix())
+	return err
+}
+
+// migrateRemovedSet moves the removed items that older versions kept in the
+// set legacyKey, without the time they were removed, to the sorted set
+// removedKey
+func migrateRemovedSet(conn redis.Conn, legacyKey, removedKey string) error {
+	keys, err := redis.Strings(conn.Do("SMEMBERS", legacyKey))
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	if err := rememberRemovedItems(conn, removedKey, keys, time.Now()); err != nil {
+		return err
+	}
+	_, err = conn.Do("DEL", legacyKey)
+	return err
+}
+
+// saveRedisItem writes the item to itemKey when it is new or updated. The
+// published date of the stored item is used when item has none.
+func saveRedisItem(conn redis.Conn, itemKey string, item *microsub.Item) error {
+	hash := itemHash(*item)
+
+	var stored redisItem
+	values, err := redis.Values(conn.Do("HGETALL", itemKey))
+	if err != nil {
+		return err
+	}
+	exists := len(values) > 0 && redis.ScanStruct(values, &stored) == nil
+
+	if exists && item.Published == "" {
+		item.Published = stored.Published
+	}
+	if item.Published == "" {
+		item.Published = time.Now().Format(time.RFC3339)
+	}
+
+	if exists && !isItemUpdate(stored, *item, hash) {
+		return nil
+	}
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		log.Printf("error while creating item for redis: %v\n", err)
+		return err
+	}
+
+	forRedis := redisItem{
+		ID:        item.ID,
+		Published: item.Published,
+		Read:      item.Read,
+		Hash:      hash,
+		Data:      data,
+	}
+
+	_, err = conn.Do("HMSET", redis.Args{}.Add(itemKey).AddFlat(&forRedis)...)
+	if err != nil {
+		return fmt.Errorf("error while writing item for redis: %v", err)
+	}
+	return nil
+}
+
+// itemHash returns a hash of the content of the item, the read state is not
+// part of the hash
+func itemHash(item microsub.Item) string {
+	item.Read = false
+	data, _ := json.Marshal(item)
+	return fmt.Sprintf("%x", sha1.Sum(data))
+}
+
+// isItemUpdate returns true when item is a new version of the stored item. When
+// both have an updated date, only a later date is an update.
+func isItemUpdate(stored redisItem, item microsub.Item, hash string) bool {
+	if stored.Hash == hash {
+		return false
+	}
+
+	old := stored.Item()
+	if old.Updated != "" && item.Updated != "" {
+		oldUpdated, err1 := time.Parse(time.RFC3339, old.Updated)
+		newUpdated, err2 := time.Parse(time.RFC3339, item.Updated)
+		if err1 == nil && err2 == nil {
+			return newUpdated.After(oldUpdated)
+		}
+	}
+
+	return true
+}
+
+// scoredEntries creates entries from the result of ZRANGE WITHSCORES, the
+// score is the published time
+func scoredEntries(itemScores []string, isRead map[string]bool) []timelineEntry {
+	var entries []timelineEntry
+	for i := 0; i+1 < len(itemScores); i += 2 {
+		itemKey := itemScores[i]
+		score, err := strconv.ParseInt(itemScores[i+1], 10, 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, timelineEntry{
+			ID:        strings.TrimPrefix(itemKey, "item:"),
+			Published: time.Unix(score, 0),
+			Read:      isRead[itemKey],
+		})
+	}
+	return entries
+}
+
+// itemIDs removes the "item:" prefix from the item keys
+func itemIDs(keys []string) []string {
+	var uids []string
+	for _, key := range keys {
+		uids = append(uids, strings.TrimPrefix(key, "item:"))
+	}
+	return uids
+}
+
+// itemKeys adds the "item:" prefix to the uids
+func itemKeys(uids []string) []string {
+	var keys []string
+	for _, uid := range uids {
+		keys = append(keys, "item:"+uid)
+	}
+	return keys
 }
@@ -0,0 +1,246 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"p83.nl/go/ekster/pkg/util"
+)
+
+const (
+	// tokenLifetime is how long a token from /auth/token can be used
+	tokenLifetime = 90 * 24 * time.Hour
+
+	// lastUsedInterval is the time between two saves of the last use of a
+	// token, so not every request writes to the storage
+	lastUsedInterval = time.Minute
+
+	// authStateLifetime is how long the user has to approve an auth request
+	authStateLifetime = 10 * time.Minute
+)
+
+// introspectionResponse is the response of /auth/introspect, a token that
+// can't be used only has Active set to false
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Me       string `json:"me,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	Exp      int64  `json:"exp,omitempty"`
+	Iat      int64  `json:"iat,omitempty"`
+}
+
+// authorizedApp is a token that is shown on the settings page
+type authorizedApp struct {
+	ID       string
+	ClientID string
+	Scopes   []scopeInfo
+	Channel  string
+
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	LastUsed  time.Time
+}
+
+func tokenKey(token string) string {
+	return "token:" + token
+}
+
+// tokenID identifies the token on the settings page without showing it
+func tokenID(token string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(token)))
+}
+
+// unixTime returns the time of a unix timestamp, 0 is the zero time
+func unixTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(t, 0)
+}
+
+// issueToken saves a new token for the approved auth request
+func issueToken(store Storage, req authRequest, now time.Time) (string, authRequest, error) {
+	token := util.RandStringBytes(32)
+	req.Code = ""
+	req.AccessToken = token
+	req.IssuedAt = now.Unix()
+	req.ExpiresAt = now.Add(tokenLifetime).Unix()
+
+	err := store.AuthRequestSave(tokenKey(token), &req, tokenLifetime)
+	if err != nil {
+		return "", req, err
+	}
+	err = store.AuthTokenAdd(req.Me, token)
+	if err != nil {
+		return "", req, err
+	}
+	return token, req, nil
+}
+
+// loadToken loads the auth request of the token, it reports whether the token
+// can be used. Tokens from before tokens expired have no ExpiresAt.
+func loadToken(store Storage, token string, now time.Time) (authRequest, bool) {
+	var req authRequest
+	if token == "" {
+		return req, false
+	}
+	err := store.AuthRequestLoad(tokenKey(token), &req)
+	if err != nil {
+		log.Printf("Error while loading token: %v\n", err)
+		return req, false
+	}
+	if req.Me == "" {
+		return req, false
+	}
+	if req.ExpiresAt != 0 && now.Unix() >= req.ExpiresAt {
+		return req, false
+	}
+	return req, true
+}
+
+// touchToken saves the last use of the token. Tokens from before the list of
+// tokens are added to it, so they can be revoked.
+func touchToken(store Storage, token string, req *authRequest, now time.Time) {
+	if now.Sub(unixTime(req.LastUsed)) < lastUsedInterval {
+		return
+	}
+	req.LastUsed = now.Unix()
+
+	var expire time.Duration
+	if req.ExpiresAt != 0 {
+		expire = unixTime(req.ExpiresAt).Sub(now)
+	}
+	err := store.AuthRequestSave(tokenKey(token), req, expire)
+	if err != nil {
+		log.Printf("Error while saving last use of token: %v\n", err)
+	}
+	err = store.AuthTokenAdd(req.Me, token)
+	if err != nil {
+		log.Printf("Error while adding token: %v\n", err)
+	}
+}
+
+// revokeToken removes the token, it can't be used after this. Revoking an
+// unknown token is not an error.
+func revokeToken(store Storage, token string) error {
+	var req authRequest
+	err := store.AuthRequestLoad(tokenKey(token), &req)
+	if err != nil {
+		return err
+	}
+	err = store.AuthRequestDelete(tokenKey(token))
+	if err != nil {
+		return err
+	}
+	err = store.TokenCacheDelete(tokenCacheKey(token))
+	if err != nil {
+		return err
+	}
+	if req.Me == "" {
+		return nil
+	}
+	return store.AuthTokenRemove(req.Me, token)
+}
+
+// userTokens returns the tokens of me that can be used, newest first. The
+// tokens that expired are removed from the list.
+func userTokens(store Storage, me string, now time.Time) (map[string]authRequest, []string, error) {
+	tokens, err := store.AuthTokens(me)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reqs := make(map[string]authRequest)
+	var active []string
+	for _, token := range tokens {
+		req, ok := loadToken(store, token, now)
+		if !ok || req.Me != me {
+			err = store.AuthTokenRemove(me, token)
+			if err != nil {
+				log.Printf("Error while removing token: %v\n", err)
+			}
+			continue
+		}
+		reqs[token] = req
+		active = append(active, token)
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return reqs[active[i]].IssuedAt > reqs[active[j]].IssuedAt
+	})
+	return reqs, active, nil
+}
+
+// authorizedApps returns the tokens of the user for the settings page
+func authorizedApps(b *memoryBackend, store Storage, now time.Time) ([]authorizedApp, error) {
+	reqs, tokens, err := userTokens(store, b.Me, now)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := make(map[string]string)
+	list, err := b.ChannelsGetList()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range list {
+		channels[c.UID] = c.Name
+	}
+
+	var apps []authorizedApp
+	for _, token := range tokens {
+		req := reqs[token]
+		app := authorizedApp{
+			ID:        tokenID(token),
+			ClientID:  req.ClientID,
+			Scopes:    scopeList(req.Scope),
+			IssuedAt:  unixTime(req.IssuedAt),
+			ExpiresAt: unixTime(req.ExpiresAt),
+			LastUsed:  unixTime(req.LastUsed),
+		}
+		if req.Channel != "" {
+			app.Channel = channels[req.Channel]
+			if app.Channel == "" {
+				app.Channel = req.Channel
+			}
+		}
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+// revokeUserToken revokes the token of me with the id from the settings page
+func revokeUserToken(store Storage, me, id string) (bool, error) {
+	tokens, err := store.AuthTokens(me)
+	if err != nil {
+		return false, err
+	}
+	for _, token := range tokens {
+		if tokenID(token) == id {
+			return true, revokeToken(store, token)
+		}
+	}
+	return false, nil
+}
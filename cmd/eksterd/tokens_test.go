@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"p83.nl/go/ekster/pkg/auth"
+	"p83.nl/go/ekster/pkg/indieauth"
+)
+
+func postForm(h http.Handler, path string, form url.Values, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestMainHandler_Tokens(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	owner := &memoryBackend{store: store, Me: "https://owner.example/"}
+	owner.setState(defaultState())
+	owner.refreshChannels()
+	users := newUserBackends(owner)
+	users.AuthEnabled = true
+	h := &mainHandler{Users: users, TemplateDir: "../../templates"}
+
+	require.NoError(t, store.AuthRequestSave("code:abc", &authRequest{
+		Me:       owner.Me,
+		ClientID: "https://app.example/",
+		Scope:    "create read",
+		Channel:  "home",
+	}, 5*time.Minute))
+
+	w := postForm(h, "/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {"abc"}}, nil)
+	require.Equal(t, 200, w.Code)
+	var res authTokenResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+	assert.Equal(t, owner.Me, res.Me)
+	assert.Equal(t, int64(tokenLifetime/time.Second), res.ExpiresIn)
+	token := res.AccessToken
+
+	// a code can only be used once
+	w = postForm(h, "/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {"abc"}}, nil)
+	assert.Equal(t, 400, w.Code)
+
+	// verification
+	r := httptest.NewRequest("GET", "/auth/token", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Code)
+	var tokenResponse auth.TokenResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tokenResponse))
+	assert.Equal(t, owner.Me, tokenResponse.Me)
+	assert.Equal(t, "https://app.example/", tokenResponse.ClientID)
+	assert.Equal(t, "create read", tokenResponse.Scope)
+
+	// introspection
+	w = postForm(h, "/auth/introspect", url.Values{"token": {token}}, map[string]string{"Authorization": "Bearer " + token})
+	require.Equal(t, 200, w.Code)
+	var introspection introspectionResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&introspection))
+	assert.True(t, introspection.Active)
+	assert.Equal(t, "create read", introspection.Scope)
+	assert.NotZero(t, introspection.Exp)
+
+	w = postForm(h, "/auth/introspect", url.Values{"token": {"unknown"}}, map[string]string{"Authorization": "Bearer " + token})
+	introspection = introspectionResponse{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&introspection))
+	assert.False(t, introspection.Active)
+
+	w = postForm(h, "/auth/introspect", url.Values{"token": {token}}, nil)
+	assert.Equal(t, 401, w.Code)
+
+	// the settings page shows the token with its last use
+	require.NoError(t, store.SessionSave("s1", &session{Me: owner.Me, LoggedIn: true}))
+	r = httptest.NewRequest("GET", "/settings/tokens", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "https://app.example/")
+	assert.Contains(t, w.Body.String(), "Home")
+	assert.Contains(t, w.Body.String(), tokenID(token))
+	assert.NotContains(t, w.Body.String(), token)
+
+	apps, err := authorizedApps(owner, store, time.Now())
+	require.NoError(t, err)
+	require.Len(t, apps, 1)
+	assert.False(t, apps[0].LastUsed.IsZero())
+
+	// revoke from the settings page
+	r = httptest.NewRequest("POST", "/settings/tokens/revoke", strings.NewReader(url.Values{"id": {tokenID(token)}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 302, w.Code)
+
+	r = httptest.NewRequest("GET", "/auth/token", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, 401, w.Code)
+
+	_, _, err = users.sourceBackend(token)
+	assert.Error(t, err)
+}
+
+func TestTokens_RevokeAndExpire(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	h := &mainHandler{Users: newUserBackends(&memoryBackend{store: store, Me: "https://owner.example/"})}
+	req := authRequest{Me: "https://owner.example/", ClientID: "https://app.example/", Scope: "read"}
+
+	// action=revoke of the token endpoint
+	token, _, err := issueToken(store, req, time.Now())
+	require.NoError(t, err)
+	_, ok := loadToken(store, token, time.Now())
+	assert.True(t, ok)
+
+	w := postForm(h, "/auth/token", url.Values{"action": {"revoke"}, "token": {token}}, nil)
+	assert.Equal(t, 200, w.Code)
+	_, ok = loadToken(store, token, time.Now())
+	assert.False(t, ok)
+
+	w = postForm(h, "/auth/token", url.Values{"action": {"revoke"}, "token": {"unknown"}}, nil)
+	assert.Equal(t, 200, w.Code)
+
+	// expired tokens can't be used and are removed from the list
+	token, _, err = issueToken(store, req, time.Now())
+	require.NoError(t, err)
+	_, ok = loadToken(store, token, time.Now().Add(tokenLifetime))
+	assert.False(t, ok)
+
+	_, tokens, err := userTokens(store, req.Me, time.Now().Add(tokenLifetime))
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+	tokens, err = store.AuthTokens(req.Me)
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+
+	// tokens from before the expiry don't expire and are added to the list
+	// when they are used
+	require.NoError(t, store.AuthRequestSave(tokenKey("old"), &authRequest{Me: req.Me, Channel: "home"}, 0))
+	req, ok = loadToken(store, "old", time.Now().Add(10*tokenLifetime))
+	require.True(t, ok)
+	touchToken(store, "old", &req, time.Now())
+	tokens, err = store.AuthTokens(req.Me)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old"}, tokens)
+}
+
+func TestMainHandler_PKCE(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	h := &mainHandler{Users: newUserBackends(&memoryBackend{store: store, Me: "https://owner.example/"}), BaseURL: "https://ekster.example/"}
+
+	verifier, err := indieauth.NewCodeVerifier()
+	require.NoError(t, err)
+	require.NoError(t, store.AuthRequestSave("code:abc", &authRequest{
+		Me:                  "https://owner.example/",
+		ClientID:            "https://app.example/",
+		Scope:               "create",
+		CodeChallenge:       indieauth.CodeChallenge(verifier),
+		CodeChallengeMethod: indieauth.CodeChallengeMethod,
+	}, 5*time.Minute))
+
+	w := postForm(h, "/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {"abc"}}, nil)
+	assert.Equal(t, 400, w.Code)
+
+	require.NoError(t, store.AuthRequestSave("code:def", &authRequest{
+		Me:                  "https://owner.example/",
+		CodeChallenge:       indieauth.CodeChallenge(verifier),
+		CodeChallengeMethod: indieauth.CodeChallengeMethod,
+	}, 5*time.Minute))
+	w = postForm(h, "/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {"def"}, "code_verifier": {verifier}}, nil)
+	assert.Equal(t, 200, w.Code)
+
+	// a verifier for a code without a challenge
+	require.NoError(t, store.AuthRequestSave("code:ghi", &authRequest{Me: "https://owner.example/"}, 5*time.Minute))
+	w = postForm(h, "/auth/token", url.Values{"grant_type": {"authorization_code"}, "code": {"ghi"}, "code_verifier": {verifier}}, nil)
+	assert.Equal(t, 400, w.Code)
+
+	// the metadata
+	r := httptest.NewRequest("GET", "/.well-known/oauth-authorization-server", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Code)
+	var metadata indieauth.Metadata
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&metadata))
+	assert.Equal(t, "https://ekster.example/", metadata.Issuer)
+	assert.Equal(t, "https://ekster.example/auth/token", metadata.TokenEndpoint)
+	assert.Equal(t, []string{"S256"}, metadata.CodeChallengeMethodsSupported)
+}
+
+func TestMainHandler_AuthApprove(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	owner := &memoryBackend{store: store, Me: "https://owner.example/"}
+	owner.setState(defaultState())
+	owner.refreshChannels()
+	users := newUserBackends(owner)
+	users.AuthEnabled = true
+	h := &mainHandler{Users: users, TemplateDir: "../../templates"}
+
+	require.NoError(t, store.SessionSave("s1", &session{Me: owner.Me, LoggedIn: true}))
+	require.NoError(t, store.SessionSave("s2", &session{Me: "https://other.example/", LoggedIn: true}))
+	require.NoError(t, store.AuthRequestSave("state:abc", &authRequest{
+		Me:          owner.Me,
+		ClientID:    "https://app.example/",
+		RedirectURI: "https://app.example/callback",
+		Scope:       "create",
+		State:       "abc",
+	}, authStateLifetime))
+	require.NoError(t, store.AuthRequestSave("state:def", &authRequest{
+		Me:          "https://other.example/",
+		ClientID:    "https://app.example/",
+		RedirectURI: "https://app.example/callback",
+		State:       "def",
+	}, authStateLifetime))
+
+	// a request can only be approved by its user
+	w := postForm(h, "/auth/approve", url.Values{"state": {"abc"}, "channel": {"home"}}, nil)
+	assert.Equal(t, 403, w.Code)
+	w = postForm(h, "/auth/approve", url.Values{"state": {"abc"}, "channel": {"home"}}, map[string]string{"Cookie": "session=s2"})
+	assert.Equal(t, 403, w.Code)
+	w = postForm(h, "/auth/approve", url.Values{"state": {"def"}, "channel": {"home"}}, map[string]string{"Cookie": "session=s1"})
+	assert.Equal(t, 403, w.Code)
+
+	w = postForm(h, "/auth/approve", url.Values{"state": {"abc"}, "channel": {"home"}}, map[string]string{"Cookie": "session=s1"})
+	require.Equal(t, 302, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "abc", location.Query().Get("state"))
+	var auth authRequest
+	require.NoError(t, store.AuthRequestLoad("code:"+location.Query().Get("code"), &auth))
+	assert.Equal(t, owner.Me, auth.Me)
+	assert.Equal(t, "home", auth.Channel)
+
+	// and only once
+	w = postForm(h, "/auth/approve", url.Values{"state": {"abc"}, "channel": {"home"}}, map[string]string{"Cookie": "session=s1"})
+	assert.Equal(t, 400, w.Code)
+}
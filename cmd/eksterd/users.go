@@ -0,0 +1,288 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"p83.nl/go/ekster/pkg/indieauth"
+	"p83.nl/go/ekster/pkg/server"
+)
+
+// userConfig is one of the Users in backend.json
+type userConfig struct {
+	Me string
+	// TokenEndpoint is discovered from Me when it's empty
+	TokenEndpoint string `json:",omitempty"`
+	// WebmentionChannel is the channel for webmentions, notifications when
+	// it's empty
+	WebmentionChannel string `json:",omitempty"`
+}
+
+// feedFollower is a channel of a user that follows a feed
+type feedFollower struct {
+	backend *memoryBackend
+	channel string
+}
+
+// userBackends keeps a memoryBackend for every user of the server. The
+// channels, feeds, timelines and sources of a user are only visible to that
+// user, the feeds are fetched once for all users that follow them.
+type userBackends struct {
+	// store is the storage of the owner, it also keeps what the users share
+	store Storage
+	owner *memoryBackend
+
+	AuthEnabled bool
+
+	lock           sync.RWMutex
+	backends       map[string]*memoryBackend
+	handlers       map[*memoryBackend]http.Handler
+	tokenEndpoints map[string]string
+
+	schedule *feedScheduler
+	quit     chan struct{}
+}
+
+// userContextKey is the key of the user in the context of a Microsub request
+type userContextKey struct{}
+
+func newUserBackends(owner *memoryBackend, users ...*memoryBackend) *userBackends {
+	u := &userBackends{
+		store:          owner.store,
+		owner:          owner,
+		backends:       make(map[string]*memoryBackend),
+		handlers:       make(map[*memoryBackend]http.Handler),
+		tokenEndpoints: make(map[string]string),
+		schedule:       newFeedScheduler(),
+	}
+	for _, b := range append([]*memoryBackend{owner}, users...) {
+		u.backends[b.Me] = b
+		u.tokenEndpoints[b.Me] = b.TokenEndpoint
+	}
+	return u
+}
+
+// loadUserBackends loads the owner from backend.json and the users that are
+// listed in its Users
+func loadUserBackends(store Storage, baseURL string) (*userBackends, error) {
+	owner, err := loadMemoryBackend(store)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*memoryBackend
+	for _, config := range owner.Users {
+		if config.Me == owner.Me {
+			log.Printf("Skipping user %s, it's the owner\n", config.Me)
+			continue
+		}
+		b, err := loadUserBackend(store, config)
+		if err != nil {
+			return nil, fmt.Errorf("while loading user %s: %v", config.Me, err)
+		}
+		users = append(users, b)
+	}
+
+	u := newUserBackends(owner, users...)
+	for _, b := range u.all() {
+		b.hubIncomingBackend = hubIncomingBackend{backend: b, baseURL: baseURL, users: u}
+	}
+	return u, nil
+}
+
+// loadUserBackend loads the backend of a user from its own storage, a new
+// user starts with the notifications and home channels
+func loadUserBackend(store Storage, config userConfig) (*memoryBackend, error) {
+	userStore, err := store.User(config.Me)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &memoryBackend{store: userStore, Me: config.Me, TokenEndpoint: config.TokenEndpoint, WebmentionChannel: config.WebmentionChannel}
+	err = b.load()
+	if err != nil {
+		return nil, err
+	}
+	if b.Channels == nil {
+		log.Printf("Creating channels for new user %s\n", config.Me)
+		b.setState(defaultState())
+		b.save()
+	}
+	b.refreshChannels()
+
+	return b, nil
+}
+
+// run starts the scheduler that fetches the feeds of all users, and the
+// retention of every user
+func (u *userBackends) run() {
+	u.quit = make(chan struct{})
+	go u.runScheduler(u.quit)
+
+	for _, b := range u.all() {
+		b.run()
+	}
+}
+
+// backend returns the backend of the user me
+func (u *userBackends) backend(me string) (*memoryBackend, bool) {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+	b, ok := u.backends[me]
+	return b, ok
+}
+
+// all returns the backends of all users, the owner first
+func (u *userBackends) all() []*memoryBackend {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	var users []*memoryBackend
+	for _, b := range u.backends {
+		if b != u.owner {
+			users = append(users, b)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Me < users[j].Me
+	})
+	return append([]*memoryBackend{u.owner}, users...)
+}
+
+// followers returns the channels of all users that follow a feed, by the url
+// of the feed
+func (u *userBackends) followers() map[string][]feedFollower {
+	followers := make(map[string][]feedFollower)
+	for _, b := range u.all() {
+		for channel, urls := range b.getFeeds() {
+			for _, feedURL := range urls {
+				followers[feedURL] = append(followers[feedURL], feedFollower{backend: b, channel: channel})
+			}
+		}
+	}
+	return followers
+}
+
+// userTokenEndpoint returns the token endpoint of the user me, the endpoints
+// that are not in backend.json are discovered from me
+func (u *userBackends) userTokenEndpoint(me string) string {
+	u.lock.RLock()
+	endpoint, ok := u.tokenEndpoints[me]
+	u.lock.RUnlock()
+	if !ok || endpoint != "" {
+		return endpoint
+	}
+
+	endpoint, err := discoverTokenEndpoint(me)
+	if err != nil {
+		log.Printf("Token endpoint of %s not found: %v\n", me, err)
+		return ""
+	}
+	u.lock.Lock()
+	u.tokenEndpoints[me] = endpoint
+	u.lock.Unlock()
+	return endpoint
+}
+
+func discoverTokenEndpoint(me string) (string, error) {
+	meURL, err := url.Parse(me)
+	if err != nil {
+		return "", err
+	}
+	endpoints, err := indieauth.GetEndpoints(meURL)
+	if err != nil {
+		return "", err
+	}
+	if endpoints.TokenEndpoint == "" {
+		return "", fmt.Errorf("no token_endpoint on %s", me)
+	}
+	return endpoints.TokenEndpoint, nil
+}
+
+// withUser returns the request for the user b
+func withUser(r *http.Request, b *memoryBackend) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, b))
+}
+
+// ServeHTTP passes the Microsub request to the handler of the user that was
+// found by WithAuth, without auth all requests are for the owner
+func (u *userBackends) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, ok := r.Context().Value(userContextKey{}).(*memoryBackend)
+	if !ok {
+		b = u.owner
+	}
+	u.microsubHandler(b).ServeHTTP(w, r)
+}
+
+// microsubHandler returns the Microsub handler of the user, so every user
+// only receives their own events
+func (u *userBackends) microsubHandler(b *memoryBackend) http.Handler {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	handler, ok := u.handlers[b]
+	if !ok {
+		handler = server.NewMicrosubHandler(b)
+		u.handlers[b] = handler
+	}
+	return handler
+}
+
+// sessionBackend returns the user that is logged in with the session, without
+// auth every session is for the owner
+func (u *userBackends) sessionBackend(sess *session) (*memoryBackend, bool) {
+	if !sess.LoggedIn {
+		return nil, false
+	}
+	if !u.AuthEnabled {
+		return u.owner, true
+	}
+	return u.backend(sess.Me)
+}
+
+// sourceBackend returns the user and channel that the micropub source posts
+// to. Tokens from /auth/token belong to the user that approved them, the
+// other sources are found in the sources of the users.
+func (u *userBackends) sourceBackend(sourceID string) (*memoryBackend, string, error) {
+	now := time.Now()
+	req, ok := loadToken(u.store, sourceID, now)
+	if ok && req.Channel != "" {
+		touchToken(u.store, sourceID, &req, now)
+		b, ok := u.backend(req.Me)
+		if !ok {
+			// tokens from before the server had users belong to the owner
+			b = u.owner
+		}
+		return b, req.Channel, nil
+	}
+
+	for _, b := range u.all() {
+		channel, err := b.store.SourceChannel(sourceID)
+		if err == nil {
+			return b, channel, nil
+		}
+	}
+	return nil, "", fmt.Errorf("unknown source %s", sourceID)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"p83.nl/go/ekster/pkg/auth"
+)
+
+func channelNames(t *testing.T, b *memoryBackend) []string {
+	channels, err := b.ChannelsGetList()
+	require.NoError(t, err)
+	var names []string
+	for _, c := range channels {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func TestUserBackends_Isolation(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/rss+xml")
+		w.Write([]byte(`<?xml version="1.0"?>
+<rss version="2.0"><channel><title>Feed</title>
+<item><guid>https://example.com/1</guid><title>First</title><link>https://example.com/1</link><pubDate>Wed, 01 Aug 2018 12:00:00 +0000</pubDate></item>
+</channel></rss>`))
+	}))
+	defer server.Close()
+
+	owner := &memoryBackend{store: store, Me: "https://owner.example/"}
+	owner.setState(defaultState())
+	owner.refreshChannels()
+	alice, err := loadUserBackend(store, userConfig{Me: "https://alice.example/"})
+	require.NoError(t, err)
+
+	users := newUserBackends(owner, alice)
+	for _, b := range users.all() {
+		b.hubIncomingBackend = hubIncomingBackend{backend: b, baseURL: server.URL, users: users}
+	}
+
+	_, err = owner.ChannelsCreate("Owner")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"Notifications", "Home", "Owner"}, channelNames(t, owner))
+	assert.ElementsMatch(t, []string{"Notifications", "Home"}, channelNames(t, alice))
+
+	// both follow the same feed in a channel with the same uid
+	feedURL := server.URL + "/feed"
+	for _, b := range users.all() {
+		_, err = b.FollowURL("home", feedURL)
+		require.NoError(t, err)
+	}
+	require.NoError(t, owner.MarkAllRead("home"))
+
+	ownerHome, err := owner.TimelineGet("", "", "home")
+	require.NoError(t, err)
+	aliceHome, err := alice.TimelineGet("", "", "home")
+	require.NoError(t, err)
+	assert.Len(t, ownerHome.Items, 0)
+	assert.Len(t, aliceHome.Items, 1)
+
+	// the feed is fetched once for both users
+	requests = 0
+	users.fetchScheduledFeed(feedURL)
+	assert.Equal(t, 1, requests)
+	for _, b := range users.all() {
+		var status feedStatus
+		require.NoError(t, b.store.FeedStatusLoad("home", feedURL, &status))
+		assert.Equal(t, 200, status.StatusCode, b.Me)
+	}
+	assert.Len(t, users.followers()[feedURL], 2)
+
+	// the WebSub subscription is shared
+	hubFeeds, err := store.HubFeeds()
+	require.NoError(t, err)
+	assert.Len(t, hubFeeds, 1)
+
+	// tokens of /auth/token post to the channel of the user that approved them
+	require.NoError(t, store.AuthRequestSave("token:abc", &authRequest{Me: alice.Me, Channel: "home"}, 0))
+	b, channel, err := users.sourceBackend("abc")
+	require.NoError(t, err)
+	assert.Equal(t, alice, b)
+	assert.Equal(t, "home", channel)
+
+	// the state of a user is kept in their own storage
+	reloaded, err := loadUserBackend(store, userConfig{Me: alice.Me})
+	require.NoError(t, err)
+	assert.Len(t, reloaded.Feeds["home"], 1)
+	assert.ElementsMatch(t, []string{"Notifications", "Home"}, channelNames(t, reloaded))
+}
+
+func TestWithAuth_Users(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	// every token endpoint gives tokens for the me in the token
+	tokenEndpoint := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			me := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			json.NewEncoder(w).Encode(auth.TokenResponse{Me: me, Scope: "read"})
+		}))
+	}
+	ownerEndpoint, aliceEndpoint := tokenEndpoint(), tokenEndpoint()
+	defer ownerEndpoint.Close()
+	defer aliceEndpoint.Close()
+
+	owner := &memoryBackend{store: store, Me: "https://owner.example/", TokenEndpoint: ownerEndpoint.URL}
+	alice := &memoryBackend{store: store, Me: "https://alice.example/", TokenEndpoint: aliceEndpoint.URL}
+
+	// the token endpoint of alice can't give tokens for the owner
+	aliceOnly := WithAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		newUserBackends(&memoryBackend{store: store, Me: "https://owner.example/", TokenEndpoint: "http://127.0.0.1:1/token"}, alice))
+	r := httptest.NewRequest("GET", "/microsub?action=channels", nil)
+	r.Header.Set("Authorization", "Bearer https://owner.example/")
+	w := httptest.NewRecorder()
+	aliceOnly.ServeHTTP(w, r)
+	assert.Equal(t, 403, w.Code)
+
+	handler := WithAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := r.Context().Value(userContextKey{}).(*memoryBackend)
+		fmt.Fprint(w, b.Me)
+	}), newUserBackends(owner, alice))
+
+	tests := []struct {
+		token, hint, me string
+		status          int
+	}{
+		// without me the token is sent to the token endpoint of the owner
+		{"https://alice.example/", "", "", 403},
+		{"https://owner.example/", "https://alice.example/", "", 403},
+		{"https://owner.example/", "", "https://owner.example/", 200},
+		{"https://alice.example/", "https://alice.example/", "https://alice.example/", 200},
+		{"https://bob.example/", "https://bob.example/", "", 403},
+	}
+
+	for _, tt := range tests {
+		target := "/microsub?action=channels"
+		if tt.hint != "" {
+			target += "&me=" + url.QueryEscape(tt.hint)
+		}
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		assert.Equal(t, tt.status, w.Code, "%s with %s", tt.token, tt.hint)
+		if tt.status == 200 {
+			assert.Equal(t, tt.me, w.Body.String())
+		}
+	}
+}
+
+func TestWithAuth_TokenOnlySentToUser(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	// the token endpoint of alice accepts every token, and keeps them
+	var received []string
+	aliceEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("Authorization"))
+		json.NewEncoder(w).Encode(auth.TokenResponse{Me: "https://alice.example/", Scope: "read"})
+	}))
+	defer aliceEndpoint.Close()
+	bobEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(auth.TokenResponse{Me: "https://bob.example/", Scope: "read"})
+	}))
+	defer bobEndpoint.Close()
+
+	owner := &memoryBackend{store: store, Me: "https://owner.example/", TokenEndpoint: "http://127.0.0.1:1/token"}
+	alice := &memoryBackend{store: store, Me: "https://alice.example/", TokenEndpoint: aliceEndpoint.URL}
+	bob := &memoryBackend{store: store, Me: "https://bob.example/", TokenEndpoint: bobEndpoint.URL}
+	handler := WithAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := r.Context().Value(userContextKey{}).(*memoryBackend)
+		fmt.Fprint(w, b.Me)
+	}), newUserBackends(owner, alice, bob))
+
+	// a token of /auth/token is checked without a token endpoint
+	require.NoError(t, store.AuthRequestSave("token:issued", &authRequest{Me: bob.Me, Scope: "read"}, 0))
+
+	for _, hint := range []string{"", bob.Me} {
+		for _, token := range []string{"bob-token", "issued"} {
+			r := httptest.NewRequest("GET", "/microsub?action=channels&me="+url.QueryEscape(hint), nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if token == "issued" || hint == bob.Me {
+				assert.Equal(t, 200, w.Code, "%s with %s", token, hint)
+				assert.Equal(t, bob.Me, w.Body.String())
+			} else {
+				assert.Equal(t, 403, w.Code, "%s with %s", token, hint)
+			}
+		}
+	}
+	assert.Empty(t, received)
+}
@@ -0,0 +1,346 @@
+/*
+   ekster - microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"p83.nl/go/ekster/pkg/jf2"
+	"p83.nl/go/ekster/pkg/microsub"
+
+	"willnorris.com/go/microformats"
+)
+
+// webmentionQueueSize is the number of webmentions that wait for verification
+const webmentionQueueSize = 100
+
+// postTypeMention is the type of a mention that only links to the target
+const postTypeMention = "mention"
+
+// webmention is a received webmention that isn't verified yet
+type webmention struct {
+	Source string
+	Target string
+}
+
+// webmentionHandler receives webmentions for the posts of the users, and
+// verifies them in the background. Verified mentions are added to the
+// webmention channel of the user.
+type webmentionHandler struct {
+	Users *userBackends
+
+	queue chan webmention
+}
+
+func newWebmentionHandler(users *userBackends) *webmentionHandler {
+	return &webmentionHandler{
+		Users: users,
+		queue: make(chan webmention, webmentionQueueSize),
+	}
+}
+
+// run verifies the queued webmentions
+func (h *webmentionHandler) run() {
+	go func() {
+		for mention := range h.queue {
+			h.verify(mention)
+		}
+	}()
+}
+
+func (h *webmentionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	mention := webmention{
+		Source: r.FormValue("source"),
+		Target: r.FormValue("target"),
+	}
+	if !isHTTPURL(mention.Source) || !isHTTPURL(mention.Target) {
+		http.Error(w, "Bad Request: source and target should be http(s) urls", 400)
+		return
+	}
+	if mention.Source == mention.Target {
+		http.Error(w, "Bad Request: source and target are the same", 400)
+		return
+	}
+	if _, ok := h.targetBackend(mention.Target); !ok {
+		http.Error(w, "Bad Request: target is not a post of a user of this server", 400)
+		return
+	}
+
+	select {
+	case h.queue <- mention:
+	default:
+		http.Error(w, "Too many webmentions, try again later", 503)
+		return
+	}
+
+	w.WriteHeader(202)
+	fmt.Fprintln(w, "Accepted")
+}
+
+// isHTTPURL reports whether s is an absolute http or https url
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// targetBackend returns the user that target belongs to, the user with the
+// longest me on the same host
+func (h *webmentionHandler) targetBackend(target string) (*memoryBackend, bool) {
+	t, err := url.Parse(target)
+	if err != nil {
+		return nil, false
+	}
+
+	var found *memoryBackend
+	for _, b := range h.Users.all() {
+		me, err := url.Parse(b.Me)
+		if err != nil || !strings.EqualFold(me.Hostname(), t.Hostname()) {
+			continue
+		}
+		// the target is on the site of the user when its path is the path
+		// of me or below it, so /alice doesn't match /alicebob/post
+		prefix := strings.TrimSuffix(me.Path, "/")
+		if prefix != "" && t.Path != prefix && !strings.HasPrefix(t.Path, prefix+"/") {
+			continue
+		}
+		if found == nil || len(b.Me) > len(found.Me) {
+			found = b
+		}
+	}
+	return found, found != nil
+}
+
+// verify fetches the source of the webmention. When it links to the target,
+// the mention is added to the webmention channel, or updated when it was
+// received before. When the source is gone or doesn't link to the target
+// anymore, the mention is removed.
+func (h *webmentionHandler) verify(mention webmention) {
+	b, ok := h.targetBackend(mention.Target)
+	if !ok {
+		return
+	}
+
+	// the sender can send the webmention again right after changing the
+	// source, so a cached copy of the source is revalidated
+	resp, err := b.fetchRevalidated(mention.Source)
+	if err != nil {
+		log.Printf("Error while verifying webmention from %s: %v\n", mention.Source, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		b.removeMention(mention)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Error while verifying webmention from %s: status %d\n", mention.Source, resp.StatusCode)
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error while verifying webmention from %s: %v\n", mention.Source, err)
+		return
+	}
+
+	sourceURL, _ := url.Parse(mention.Source)
+	if !linksTo(body, sourceURL, mention.Target) {
+		log.Printf("Webmention source %s doesn't link to %s\n", mention.Source, mention.Target)
+		b.removeMention(mention)
+		return
+	}
+
+	data := microformats.Parse(bytes.NewReader(body), sourceURL)
+	item := mentionItem(jf2.SimplifyMicroformatDataItems(data), mention)
+
+	err = b.addMention(mention, item)
+	if err != nil {
+		log.Printf("Error while adding webmention from %s: %v\n", mention.Source, err)
+	}
+}
+
+// linksTo reports whether the html page at source has an element with an href
+// or src attribute that points to target
+func linksTo(body []byte, source *url.URL, target string) bool {
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			_, hasAttr := tokenizer.TagName()
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = tokenizer.TagAttr()
+				if k := string(key); k != "href" && k != "src" {
+					continue
+				}
+				if u, err := source.Parse(strings.TrimSpace(string(val))); err == nil && sameURL(u.String(), target) {
+					return true
+				}
+			}
+		}
+	}
+}
+
+// mentionItem returns the item of the source from the items on the page, or
+// an item with the url of the source when the page has no items. The name of
+// likes, reposts and bookmarks without a name or content tells what happened.
+func mentionItem(items []microsub.Item, mention webmention) microsub.Item {
+	item := microsub.Item{Type: "entry", URL: mention.Source}
+	for i, it := range items {
+		if i == 0 || it.URL == mention.Source {
+			item = it
+		}
+	}
+	if item.URL == "" {
+		item.URL = mention.Source
+	}
+	if item.Published == "" {
+		item.Published = time.Now().Format(time.RFC3339)
+	}
+	item.Source = &microsub.Source{URL: mention.Source}
+
+	if item.Name == "" && item.Content == nil {
+		switch mentionType(item, mention.Target) {
+		case microsub.PostTypeLike:
+			item.Name = "Liked " + mention.Target
+		case microsub.PostTypeRepost:
+			item.Name = "Reposted " + mention.Target
+		case microsub.PostTypeBookmark:
+			item.Name = "Bookmarked " + mention.Target
+		case microsub.PostTypeReply:
+			item.Name = "Replied to " + mention.Target
+		default:
+			item.Name = "Mentioned " + mention.Target
+		}
+	}
+	return item
+}
+
+// mentionType returns the post type of the item towards target: reply, like,
+// repost or bookmark, or postTypeMention when the item only links to target
+func mentionType(item microsub.Item, target string) string {
+	has := func(urls []string) bool {
+		for _, u := range urls {
+			if u == target {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has(item.InReplyTo):
+		return microsub.PostTypeReply
+	case has(item.LikeOf):
+		return microsub.PostTypeLike
+	case has(item.RepostOf):
+		return microsub.PostTypeRepost
+	case has(item.BookmarkOf):
+		return microsub.PostTypeBookmark
+	}
+	return postTypeMention
+}
+
+// mentionKey is the key of the mentions of target in the source items
+func mentionKey(target string) string {
+	return "webmention:" + target
+}
+
+// webmentionChannel returns the channel for webmentions, notifications when
+// WebmentionChannel isn't set or doesn't exist
+func (b *memoryBackend) webmentionChannel() string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if _, ok := b.Channels[b.WebmentionChannel]; ok {
+		return b.WebmentionChannel
+	}
+	return "notifications"
+}
+
+// addMention adds the item of the mention, or updates it when it was added
+// before
+func (b *memoryBackend) addMention(mention webmention, item microsub.Item) error {
+	key := mentionKey(mention.Target)
+
+	var src sourceItem
+	err := b.store.SourceItemLoad(key, mention.Source, &src)
+	if err == errNotFound {
+		id, err := b.store.SourceNextID(key)
+		if err != nil {
+			return err
+		}
+		src = sourceItem{
+			URL:     mention.Source,
+			ID:      fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%s:%s:%d", key, mention.Source, id)))),
+			Channel: b.webmentionChannel(),
+		}
+		err = b.store.SourceItemSave(key, &src)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	item.ID = src.ID
+	_, err = b.channelAddItem(src.Channel, item)
+	if err != nil {
+		return err
+	}
+	return b.updateChannelUnreadCount(src.Channel)
+}
+
+// removeMention removes the item of the mention, when it was added before
+func (b *memoryBackend) removeMention(mention webmention) {
+	key := mentionKey(mention.Target)
+
+	var src sourceItem
+	err := b.store.SourceItemLoad(key, mention.Source, &src)
+	if err != nil {
+		return
+	}
+
+	err = b.RemoveItems(src.Channel, []string{src.ID})
+	if err != nil {
+		log.Printf("Error while removing webmention from %s: %v\n", mention.Source, err)
+		return
+	}
+	err = b.store.SourceItemDelete(key, mention.Source)
+	if err != nil {
+		log.Printf("Error while removing webmention from %s: %v\n", mention.Source, err)
+	}
+}
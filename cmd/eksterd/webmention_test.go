@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func TestWebmentionHandler_Receive(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	owner := &memoryBackend{store: store, Me: "https://owner.example/"}
+	alice := &memoryBackend{store: store, Me: "https://example.com/alice/"}
+	h := newWebmentionHandler(newUserBackends(owner, alice))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/webmention", nil))
+	assert.Equal(t, 405, w.Code)
+
+	tests := []struct {
+		source, target string
+		status         int
+	}{
+		{"https://other.example/reply", "https://owner.example/post/1", 202},
+		{"https://other.example/reply", "https://example.com/alice/post", 202},
+		{"https://other.example/reply", "https://example.com/bob/post", 400},
+		{"https://other.example/reply", "https://example.com/alicebob/post", 400},
+		{"https://other.example/reply", "https://unknown.example/post", 400},
+		{"ftp://other.example/reply", "https://owner.example/post/1", 400},
+		{"https://owner.example/post/1", "https://owner.example/post/1", 400},
+		{"", "https://owner.example/post/1", 400},
+	}
+	for _, tt := range tests {
+		w := postForm(h, "/webmention", url.Values{"source": {tt.source}, "target": {tt.target}}, nil)
+		assert.Equal(t, tt.status, w.Code, tt.target)
+	}
+
+	// the accepted mentions are verified later
+	require.Len(t, h.queue, 2)
+	assert.Equal(t, webmention{"https://other.example/reply", "https://owner.example/post/1"}, <-h.queue)
+	b, ok := h.targetBackend("https://example.com/alice/post")
+	assert.True(t, ok)
+	assert.Equal(t, alice, b)
+	b, ok = h.targetBackend("https://example.com/alice")
+	assert.True(t, ok)
+	assert.Equal(t, alice, b)
+
+	// the path of the target must be below the path of the user
+	_, ok = h.targetBackend("https://example.com/alicebob/post")
+	assert.False(t, ok)
+	_, ok = h.targetBackend("https://example.com/alice-post")
+	assert.False(t, ok)
+}
+
+func TestWebmentionHandler_Verify(t *testing.T) {
+	store, cleanup := createBoltStorage(t)
+	defer cleanup()
+
+	status := 200
+	page := `<a href="https://owner.example/post/1">a post</a>`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		// the source is fetched again for every webmention, also when
+		// the cached copy is still fresh
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.WriteHeader(status)
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	owner := &memoryBackend{store: store, Me: "https://owner.example/"}
+	owner.setState(defaultState())
+	owner.refreshChannels()
+	h := newWebmentionHandler(newUserBackends(owner))
+
+	mentions := func(channel string) []microsub.Item {
+		timeline, err := owner.TimelineGet("", "", channel)
+		require.NoError(t, err)
+		return timeline.Items
+	}
+
+	mention := webmention{Source: server.URL + "/reply", Target: "https://owner.example/post/1"}
+	h.verify(mention)
+	items := mentions("notifications")
+	require.Len(t, items, 1)
+	assert.Equal(t, mention.Source, items[0].URL)
+	assert.Equal(t, "Mentioned https://owner.example/post/1", items[0].Name)
+
+	// a second webmention updates the item
+	h.verify(mention)
+	assert.Len(t, mentions("notifications"), 1)
+
+	// a deleted source removes the mention
+	status = http.StatusGone
+	h.verify(mention)
+	assert.Empty(t, mentions("notifications"))
+
+	// a source without a link to the target isn't added
+	status = 200
+	page = `<a href="https://owner.example/post/2">another post</a>`
+	h.verify(mention)
+	assert.Empty(t, mentions("notifications"))
+
+	// the target in text or a comment isn't a link
+	page = `<p>https://owner.example/post/1</p><!-- <a href="https://owner.example/post/1"> -->`
+	h.verify(mention)
+	assert.Empty(t, mentions("notifications"))
+
+	// embedded images count as links
+	page = `<img src=" https://owner.example/post/1 ">`
+	h.verify(mention)
+	assert.Len(t, mentions("notifications"), 1)
+
+	// the mentions go to the configured channel
+	owner.WebmentionChannel = "home"
+	page = `<a href="https://owner.example/post/1?a=1&amp;b=2">a post</a>`
+	mention.Target = "https://owner.example/post/1?a=1&b=2"
+	h.verify(mention)
+	assert.Len(t, mentions("home"), 1)
+
+	// a link that is removed removes the mention
+	page = `no links`
+	h.verify(mention)
+	assert.Empty(t, mentions("home"))
+}
+
+func TestMentionItem(t *testing.T) {
+	target := "https://owner.example/post/1"
+	mention := webmention{Source: "https://other.example/like", Target: target}
+
+	tests := []struct {
+		item     microsub.Item
+		postType string
+		name     string
+	}{
+		{microsub.Item{URL: mention.Source, LikeOf: []string{target}}, microsub.PostTypeLike, "Liked " + target},
+		{microsub.Item{URL: mention.Source, RepostOf: []string{target}}, microsub.PostTypeRepost, "Reposted " + target},
+		{microsub.Item{URL: mention.Source, BookmarkOf: []string{target}}, microsub.PostTypeBookmark, "Bookmarked " + target},
+		{microsub.Item{URL: mention.Source, InReplyTo: []string{target}, Content: &microsub.Content{Text: "Nice"}}, microsub.PostTypeReply, ""},
+		{microsub.Item{URL: mention.Source, LikeOf: []string{"https://elsewhere.example/"}}, postTypeMention, "Mentioned " + target},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.postType, mentionType(tt.item, target))
+
+		item := mentionItem([]microsub.Item{{URL: "https://other.example/"}, tt.item}, mention)
+		assert.Equal(t, mention.Source, item.URL)
+		assert.Equal(t, tt.name, item.Name)
+		assert.True(t, strings.HasPrefix(item.Source.URL, "https://other.example/"))
+	}
+}
@@ -1,5 +1,7 @@
 package auth
 
+import "strings"
+
 // Auther
 type Auther interface {
 	AuthTokenAccepted(header string, r *TokenResponse) bool
@@ -13,3 +15,13 @@ type TokenResponse struct {
 	IssuedAt int64  `json:"issued_at"`
 	Nonce    int64  `json:"nonce"`
 }
+
+// HasScope reports whether scope is one of the space separated scopes of the token
+func (r TokenResponse) HasScope(scope string) bool {
+	for _, s := range strings.Fields(r.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+const (
+	// minEventsRetry is the delay before reconnecting to the event stream,
+	// the server can change it with a retry field
+	minEventsRetry = time.Second
+
+	// maxEventsRetry is the longest delay between two failed connections
+	maxEventsRetry = time.Minute
+)
+
+// eventStream keeps the state of the event stream between connections
+type eventStream struct {
+	lastEventID string
+	retry       time.Duration
+}
+
+// AddEventListener streams the events of the server to el in the background
+func (c *Client) AddEventListener(el microsub.EventListener) error {
+	go func() {
+		err := c.StreamEvents(context.Background(), el)
+		if err != nil {
+			log.Printf("Error while streaming events: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// StreamEvents reads the events from the server and sends them to el until
+// ctx is done. When the connection is lost the client reconnects with
+// Last-Event-ID, so the server can send the events that were missed. The delay
+// before reconnecting doubles with every failed connection.
+func (c *Client) StreamEvents(ctx context.Context, el microsub.EventListener) error {
+	stream := &eventStream{retry: minEventsRetry}
+	var delay time.Duration
+
+	for {
+		connected, err := c.readEvents(ctx, stream, el)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && c.Logging {
+			log.Printf("Event stream: %v\n", err)
+		}
+
+		if connected || delay < stream.retry {
+			delay = stream.retry
+		} else {
+			delay *= 2
+			if delay > maxEventsRetry {
+				delay = maxEventsRetry
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// readEvents connects to the event stream and reads events until the
+// connection is closed, it reports whether the connection was successful
+func (c *Client) readEvents(ctx context.Context, stream *eventStream, el microsub.EventListener) (bool, error) {
+	u := *c.MicrosubEndpoint
+	q := u.Query()
+	q.Add("action", "events")
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	req.Header.Add("Accept", "text/event-stream")
+	if stream.lastEventID != "" {
+		req.Header.Add("Last-Event-ID", stream.lastEventID)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return false, fmt.Errorf("unsuccessful response: %d", res.StatusCode)
+	}
+
+	return true, stream.read(res.Body, el)
+}
+
+// read parses the text/event-stream from r and sends the events to el
+func (stream *eventStream) read(r io.Reader, el microsub.EventListener) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var eventType string
+	var data []string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			stream.dispatch(eventType, data, el)
+			eventType = ""
+			data = nil
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			// comment
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field = line[:i]
+			value = strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			stream.lastEventID = value
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil {
+				stream.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// dispatch sends the event to el, events without data, like ping, are skipped
+func (stream *eventStream) dispatch(eventType string, data []string, el microsub.EventListener) {
+	if len(data) == 0 {
+		return
+	}
+
+	var evt microsub.Event
+	err := json.Unmarshal([]byte(strings.Join(data, "\n")), &evt)
+	if err != nil {
+		log.Printf("Error while decoding %s event: %v\n", eventType, err)
+		return
+	}
+
+	if evt.Type == "" {
+		evt.Type = eventType
+	}
+	if evt.ID == 0 {
+		evt.ID, _ = strconv.ParseInt(stream.lastEventID, 10, 64)
+	}
+
+	el.WriteMessage(evt)
+}
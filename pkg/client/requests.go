@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"p83.nl/go/ekster/pkg/microsub"
 )
@@ -109,11 +111,16 @@ func (c *Client) microsubPostFormRequest(action string, args map[string]string,
 	}
 
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 
 	if res.StatusCode != 200 {
 		msg, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
 		return nil, fmt.Errorf("unsuccessful response: %d: %q", res.StatusCode, string(msg))
 	}
 
@@ -147,10 +154,33 @@ func (c *Client) ChannelsGetList() ([]microsub.Channel, error) {
 }
 
 func (c *Client) TimelineGet(before, after, channel string) (microsub.Timeline, error) {
+	return c.TimelineGetQuery(channel, microsub.TimelineQuery{Before: before, After: after})
+}
+
+// TimelineGetQuery returns the items of the channel that match the query
+func (c *Client) TimelineGetQuery(channel string, query microsub.TimelineQuery) (microsub.Timeline, error) {
 	args := make(map[string]string)
-	args["after"] = after
-	args["before"] = before
+	args["after"] = query.After
+	args["before"] = query.Before
 	args["channel"] = channel
+	if query.Limit > 0 {
+		args["limit"] = strconv.Itoa(query.Limit)
+	}
+	if query.Unread {
+		args["is_read"] = "false"
+	}
+	if query.Source != "" {
+		args["source"] = query.Source
+	}
+	if !query.Since.IsZero() {
+		args["since"] = query.Since.Format(time.RFC3339)
+	}
+	if !query.Until.IsZero() {
+		args["until"] = query.Until.Format(time.RFC3339)
+	}
+	if query.Type != "" {
+		args["type"] = query.Type
+	}
 	res, err := c.microsubGetRequest("timeline", args)
 	if err != nil {
 		return microsub.Timeline{}, err
@@ -259,6 +289,44 @@ func (c *Client) ChannelsUpdate(uid, name string) (microsub.Channel, error) {
 	return channel, nil
 }
 
+func (c *Client) ChannelsSetType(uid, timelineType string, size int) (microsub.Channel, error) {
+	args := make(map[string]string)
+	args["channel"] = uid
+	args["timeline_type"] = timelineType
+	if size > 0 {
+		args["timeline_size"] = strconv.Itoa(size)
+	}
+	res, err := c.microsubPostRequest("channels", args)
+	if err != nil {
+		return microsub.Channel{}, err
+	}
+	defer res.Body.Close()
+	var channel microsub.Channel
+	dec := json.NewDecoder(res.Body)
+	err = dec.Decode(&channel)
+	if err != nil {
+		return microsub.Channel{}, err
+	}
+	return channel, nil
+}
+
+func (c *Client) ChannelsOrder(uids []string) error {
+	args := make(map[string]string)
+	args["method"] = "order"
+
+	data := url.Values{}
+	for _, uid := range uids {
+		data.Add("channels[]", uid)
+	}
+
+	res, err := c.microsubPostFormRequest("channels", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
 func (c *Client) ChannelsDelete(uid string) error {
 	args := make(map[string]string)
 	args["channel"] = uid
@@ -321,6 +389,27 @@ func (c *Client) Search(query string) ([]microsub.Feed, error) {
 	return response.Results, nil
 }
 
+func (c *Client) ItemSearch(channel, query string) ([]microsub.Item, error) {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["query"] = query
+	res, err := c.microsubPostRequest("search", args)
+	if err != nil {
+		return []microsub.Item{}, err
+	}
+	type searchResponse struct {
+		Items []microsub.Item `json:"items"`
+	}
+	defer res.Body.Close()
+	var response searchResponse
+	dec := json.NewDecoder(res.Body)
+	err = dec.Decode(&response)
+	if err != nil {
+		return []microsub.Item{}, err
+	}
+	return response.Items, nil
+}
+
 func (c *Client) MarkRead(channel string, uids []string) error {
 	args := make(map[string]string)
 	args["channel"] = channel
@@ -339,6 +428,206 @@ func (c *Client) MarkRead(channel string, uids []string) error {
 	return nil
 }
 
-func (c *Client) AddEventListener(el microsub.EventListener) error {
-	panic("implement me")
+func (c *Client) MarkUnread(channel string, uids []string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["method"] = "mark_unread"
+
+	data := url.Values{}
+	for _, uid := range uids {
+		data.Add("entry[]", uid)
+	}
+
+	res, err := c.microsubPostFormRequest("timeline", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (c *Client) MarkReadUpTo(channel string, lastReadEntry string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["method"] = "mark_read"
+
+	data := url.Values{}
+	data.Set("last_read_entry", lastReadEntry)
+
+	res, err := c.microsubPostFormRequest("timeline", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (c *Client) MarkAllRead(channel string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["method"] = "mark_read"
+
+	data := url.Values{}
+	data.Set("all", "1")
+
+	res, err := c.microsubPostFormRequest("timeline", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (c *Client) RemoveItems(channel string, uids []string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["method"] = "remove"
+
+	data := url.Values{}
+	for _, uid := range uids {
+		data.Add("entry[]", uid)
+	}
+
+	res, err := c.microsubPostFormRequest("timeline", args, data)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (c *Client) getCardList(action, channel string) ([]microsub.Card, error) {
+	args := make(map[string]string)
+	args["channel"] = channel
+	res, err := c.microsubGetRequest(action, args)
+	if err != nil {
+		return []microsub.Card{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return []microsub.Card{}, fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
+		}
+		return []microsub.Card{}, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
+	}
+	type cardsResponse struct {
+		Items []microsub.Card `json:"items"`
+	}
+	var response cardsResponse
+	dec := json.NewDecoder(res.Body)
+	err = dec.Decode(&response)
+	if err != nil {
+		return []microsub.Card{}, err
+	}
+	return response.Items, nil
+}
+
+func (c *Client) postChannelURL(action, channel, url string) error {
+	args := make(map[string]string)
+	args["channel"] = channel
+	args["url"] = url
+	res, err := c.microsubPostRequest(action, args)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (c *Client) MuteGetList(channel string) ([]microsub.Card, error) {
+	return c.getCardList("mute", channel)
+}
+
+func (c *Client) Mute(channel string, uid string) error {
+	return c.postChannelURL("mute", channel, uid)
+}
+
+func (c *Client) Unmute(channel string, uid string) error {
+	return c.postChannelURL("unmute", channel, uid)
+}
+
+func (c *Client) BlockGetList(channel string) ([]microsub.Card, error) {
+	return c.getCardList("block", channel)
+}
+
+func (c *Client) Block(channel string, uid string) error {
+	return c.postChannelURL("block", channel, uid)
+}
+
+func (c *Client) Unblock(channel string, uid string) error {
+	return c.postChannelURL("unblock", channel, uid)
+}
+
+func (c *Client) SourcesGetList() ([]microsub.MicropubSource, error) {
+	args := make(map[string]string)
+	res, err := c.microsubGetRequest("sources", args)
+	if err != nil {
+		return []microsub.MicropubSource{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return []microsub.MicropubSource{}, fmt.Errorf("HTTP Status is not 200, but %d, error while reading body", res.StatusCode)
+		}
+		return []microsub.MicropubSource{}, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
+	}
+
+	type sourcesResponse struct {
+		Sources []microsub.MicropubSource `json:"sources"`
+	}
+
+	var response sourcesResponse
+	dec := json.NewDecoder(res.Body)
+	err = dec.Decode(&response)
+	return response.Sources, err
+}
+
+func (c *Client) SourcesCreate(source microsub.MicropubSource) (microsub.MicropubSource, error) {
+	return c.postSource(source)
+}
+
+func (c *Client) SourcesUpdate(source microsub.MicropubSource) (microsub.MicropubSource, error) {
+	return c.postSource(source)
+}
+
+func (c *Client) SourcesDelete(id string) error {
+	args := make(map[string]string)
+	args["id"] = id
+	args["method"] = "delete"
+	res, err := c.microsubPostRequest("sources", args)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
+	}
+	return nil
+}
+
+// postSource creates the source when it has no ID, or updates it
+func (c *Client) postSource(source microsub.MicropubSource) (microsub.MicropubSource, error) {
+	args := make(map[string]string)
+	if source.ID != "" {
+		args["id"] = source.ID
+	}
+	args["label"] = source.Label
+	args["channel"] = source.Channel
+	args["rate_limit"] = strconv.Itoa(source.RateLimit)
+	res, err := c.microsubPostRequest("sources", args)
+	if err != nil {
+		return microsub.MicropubSource{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return microsub.MicropubSource{}, fmt.Errorf("HTTP Status is not 200, but %d: %s", res.StatusCode, body)
+	}
+	var response microsub.MicropubSource
+	dec := json.NewDecoder(res.Body)
+	err = dec.Decode(&response)
+	return response, err
 }
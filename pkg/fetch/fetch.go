@@ -25,7 +25,9 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/url"
+	"path"
 	"strings"
 	"time"
 
@@ -176,6 +178,8 @@ func FeedItems(fetcher Fetcher, fetchURL, contentType string, body io.Reader) ([
 			item.Content = &microsub.Content{}
 			item.Content.HTML = feedItem.ContentHTML
 			item.Content.Text = feedItem.ContentText
+			item.Summary = feedItem.Summary
+			item.Category = feedItem.Tags
 			item.URL = feedItem.URL
 			item.ID = hex.EncodeToString([]byte(feedItem.ID))
 			item.Published = feedItem.DatePublished
@@ -190,7 +194,13 @@ func FeedItems(fetcher Fetcher, fetchURL, contentType string, body io.Reader) ([
 			} else {
 				item.Author = author
 			}
-			item.Photo = []string{feedItem.Image}
+			if feedItem.Image != "" {
+				item.Photo = []string{feedItem.Image}
+				item.Featured = feedItem.Image
+			}
+			for _, attachment := range feedItem.Attachments {
+				addMedia(&item, attachment.URL, attachment.MimeType, u)
+			}
 			items = append(items, item)
 		}
 	} else if strings.HasPrefix(contentType, "text/xml") || strings.HasPrefix(contentType, "application/rss+xml") || strings.HasPrefix(contentType, "application/atom+xml") || strings.HasPrefix(contentType, "application/xml") {
@@ -218,8 +228,13 @@ func FeedItems(fetcher Fetcher, fetchURL, contentType string, body io.Reader) ([
 			if len(feedItem.Summary) > 0 {
 				if len(item.Content.HTML) == 0 {
 					item.Content.HTML = feedItem.Summary
+				} else {
+					item.Summary = htmlText(feedItem.Summary)
 				}
 			}
+			for _, enclosure := range feedItem.Enclosures {
+				addMedia(&item, enclosure.URL, enclosure.Type, baseURL)
+			}
 			item.URL = feedItem.Link
 			if feedItem.ID == "" {
 				item.ID = hex.EncodeToString([]byte(feedItem.Link))
@@ -261,6 +276,47 @@ func FeedItems(fetcher Fetcher, fetchURL, contentType string, body io.Reader) ([
 	return items, nil
 }
 
+// addMedia adds the attachment to the audio, video or photos of the item,
+// depending on its mime type. Without a mime type, the type is guessed from the
+// extension of the url. Other attachments are skipped.
+func addMedia(item *microsub.Item, mediaURL, mimeType string, base *url.URL) {
+	u, err := url.Parse(mediaURL)
+	if err != nil || mediaURL == "" {
+		return
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(path.Ext(u.Path))
+	}
+
+	switch {
+	case strings.HasPrefix(mimeType, "audio/"):
+		item.Audio = append(item.Audio, u.String())
+	case strings.HasPrefix(mimeType, "video/"):
+		item.Video = append(item.Video, u.String())
+	case strings.HasPrefix(mimeType, "image/"):
+		item.Photo = append(item.Photo, u.String())
+	}
+}
+
+// htmlText returns the text of the HTML fragment, with the whitespace
+// collapsed
+func htmlText(fragment string) string {
+	var text []string
+	tokenizer := html.NewTokenizer(strings.NewReader(fragment))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(strings.Join(text, " ")), " ")
+		case html.TextToken:
+			text = append(text, string(tokenizer.Text()))
+		}
+	}
+}
+
 // expandHref expands relative URLs in a.href and img.src attributes to be absolute URLs.
 func expandHref(s string, base *url.URL) string {
 	var buf bytes.Buffer
@@ -0,0 +1,90 @@
+package fetch
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeedItems_RSSEnclosures(t *testing.T) {
+	feed := `<?xml version="1.0"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/"><channel><title>Podcast</title><link>https://podcast.example/</link>
+<item><guid>https://podcast.example/1</guid><title>Episode 1</title><link>https://podcast.example/1</link>
+<description>&lt;p&gt;The first   episode&lt;/p&gt;</description>
+<content:encoded>&lt;p&gt;Show notes&lt;/p&gt;</content:encoded>
+<enclosure url="https://podcast.example/1.mp3" type="audio/mpeg" length="1000"/>
+<pubDate>Wed, 01 Aug 2018 12:00:00 +0000</pubDate></item>
+<item><guid>https://podcast.example/2</guid><title>Episode 2</title><link>https://podcast.example/2</link>
+<enclosure url="/2.mp4" length="1000"/>
+<pubDate>Wed, 08 Aug 2018 12:00:00 +0000</pubDate></item>
+</channel></rss>`
+
+	items, err := FeedItems(nil, "https://podcast.example/feed", "application/rss+xml", strings.NewReader(feed))
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+
+	assert.Equal(t, []string{"https://podcast.example/1.mp3"}, items[0].Audio)
+	assert.Equal(t, "The first episode", items[0].Summary)
+	assert.Contains(t, items[0].Content.HTML, "<p>Show notes</p>")
+
+	// the type is guessed from the extension, relative urls are resolved
+	assert.Equal(t, []string{"https://podcast.example/2.mp4"}, items[1].Video)
+	assert.Empty(t, items[1].Audio)
+}
+
+func TestFeedItems_AtomEnclosures(t *testing.T) {
+	feed := `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><title>Videos</title><id>https://videos.example/</id><updated>2018-08-01T12:00:00Z</updated>
+<entry><id>https://videos.example/1</id><title>Video 1</title><updated>2018-08-01T12:00:00Z</updated>
+<link rel="alternate" href="https://videos.example/1"/>
+<link rel="replies" type="text/html" href="https://videos.example/1#comments"/>
+<link rel="enclosure" type="video/webm" href="https://videos.example/1.webm"/>
+<link rel="enclosure" type="image/png" href="https://videos.example/1.png"/>
+<content type="html">A video</content></entry>
+</feed>`
+
+	items, err := FeedItems(nil, "https://videos.example/feed", "application/atom+xml", strings.NewReader(feed))
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "https://videos.example/1", items[0].URL)
+	assert.Equal(t, []string{"https://videos.example/1.webm"}, items[0].Video)
+	assert.Equal(t, []string{"https://videos.example/1.png"}, items[0].Photo)
+}
+
+func TestFeedItems_JSONFeedAttachments(t *testing.T) {
+	feed := `{
+	"version": "https://jsonfeed.org/version/1",
+	"title": "Podcast",
+	"items": [
+		{
+			"id": "1",
+			"url": "https://podcast.example/1",
+			"title": "Episode 1",
+			"summary": "The first episode",
+			"content_text": "Show notes",
+			"image": "https://podcast.example/1.jpg",
+			"tags": ["go", "podcast"],
+			"attachments": [
+				{"url": "https://podcast.example/1.m4a", "mime_type": "audio/x-m4a"},
+				{"url": "https://podcast.example/1.pdf", "mime_type": "application/pdf"}
+			]
+		},
+		{"id": "2", "url": "https://podcast.example/2", "content_text": "No image"}
+	]
+}`
+
+	items, err := FeedItems(nil, "https://podcast.example/feed.json", "application/json", strings.NewReader(feed))
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+
+	assert.Equal(t, "The first episode", items[0].Summary)
+	assert.Equal(t, []string{"go", "podcast"}, items[0].Category)
+	assert.Equal(t, "https://podcast.example/1.jpg", items[0].Featured)
+	assert.Equal(t, []string{"https://podcast.example/1.m4a"}, items[0].Audio)
+	assert.Empty(t, items[0].Video)
+
+	assert.Empty(t, items[1].Photo)
+	assert.Empty(t, items[1].Featured)
+}
@@ -22,6 +22,26 @@ type Endpoints struct {
 	TokenEndpoint         string `json:"token_endpoint"`
 	MicropubEndpoint      string `json:"micropub_endpoint"`
 	MicrosubEndpoint      string `json:"microsub_endpoint"`
+
+	// Issuer, IntrospectionEndpoint and RevocationEndpoint are only known
+	// when the site links to the IndieAuth server metadata
+	Issuer                string `json:"issuer"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+	RevocationEndpoint    string `json:"revocation_endpoint"`
+}
+
+// Metadata is the IndieAuth server metadata that a site links to with
+// rel=indieauth-metadata
+type Metadata struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	IntrospectionEndpoint         string   `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint            string   `json:"revocation_endpoint,omitempty"`
+	ScopesSupported               []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported        []string `json:"response_types_supported,omitempty"`
+	GrantTypesSupported           []string `json:"grant_types_supported,omitempty"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
 }
 
 type TokenResponse struct {
@@ -33,6 +53,8 @@ type TokenResponse struct {
 	ErrorDescription string `json:"error_description"`
 }
 
+// GetEndpoints finds the endpoints of me. The endpoints of the IndieAuth server
+// metadata are used before the authorization_endpoint and token_endpoint rels.
 func GetEndpoints(me *url.URL) (Endpoints, error) {
 	var endpoints Endpoints
 
@@ -53,6 +75,7 @@ func GetEndpoints(me *url.URL) (Endpoints, error) {
 	}
 
 	var links linkheader.Links
+	var metadataURL string
 
 	if headers, e := res.Header["Link"]; e {
 		links = linkheader.ParseMultiple(headers)
@@ -65,6 +88,8 @@ func GetEndpoints(me *url.URL) (Endpoints, error) {
 				endpoints.MicropubEndpoint = link.URL
 			} else if link.Rel == "microsub" {
 				endpoints.MicrosubEndpoint = link.URL
+			} else if link.Rel == "indieauth-metadata" {
+				metadataURL = link.URL
 			} else {
 				log.Printf("Skipping unsupported rels in Link header: %s %s\n", link.Rel, link.URL)
 			}
@@ -85,10 +110,61 @@ func GetEndpoints(me *url.URL) (Endpoints, error) {
 	if microsub, e := data.Rels["microsub"]; e && endpoints.MicrosubEndpoint == "" {
 		endpoints.MicrosubEndpoint = microsub[0]
 	}
+	if metadata, e := data.Rels["indieauth-metadata"]; e && metadataURL == "" {
+		metadataURL = metadata[0]
+	}
+
+	if metadataURL != "" {
+		u, err := res.Request.URL.Parse(metadataURL)
+		if err != nil {
+			return endpoints, err
+		}
+		metadata, err := GetMetadata(u)
+		if err != nil {
+			return endpoints, err
+		}
+		endpoints.Issuer = metadata.Issuer
+		if metadata.AuthorizationEndpoint != "" {
+			endpoints.AuthorizationEndpoint = metadata.AuthorizationEndpoint
+		}
+		if metadata.TokenEndpoint != "" {
+			endpoints.TokenEndpoint = metadata.TokenEndpoint
+		}
+		endpoints.IntrospectionEndpoint = metadata.IntrospectionEndpoint
+		endpoints.RevocationEndpoint = metadata.RevocationEndpoint
+	}
 
 	return endpoints, nil
 }
 
+// GetMetadata fetches the IndieAuth server metadata
+func GetMetadata(metadataURL *url.URL) (Metadata, error) {
+	var metadata Metadata
+
+	req, err := http.NewRequest(http.MethodGet, metadataURL.String(), nil)
+	if err != nil {
+		return metadata, err
+	}
+	req.Header.Add("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return metadata, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return metadata, fmt.Errorf("error from metadata endpoint %s: %d", metadataURL, res.StatusCode)
+	}
+
+	dec := json.NewDecoder(res.Body)
+	err = dec.Decode(&metadata)
+	if err != nil {
+		return metadata, fmt.Errorf("error while parsing metadata from %s: %v", metadataURL, err)
+	}
+	return metadata, nil
+}
+
 func Authorize(me *url.URL, endpoints Endpoints, clientID, scope string) (TokenResponse, error) {
 	var tokenResponse TokenResponse
 
@@ -105,8 +181,12 @@ func Authorize(me *url.URL, endpoints Endpoints, clientID, scope string) (TokenR
 	local := ln.Addr().String()
 	redirectURI := fmt.Sprintf("http://%s/", local)
 	state := util.RandStringBytes(16)
+	codeVerifier, err := NewCodeVerifier()
+	if err != nil {
+		return tokenResponse, err
+	}
 
-	authorizationURL := CreateAuthorizationURL(*authURL, me.String(), clientID, redirectURI, state, scope)
+	authorizationURL := CreateAuthorizationURL(*authURL, me.String(), clientID, redirectURI, state, scope, CodeChallenge(codeVerifier))
 
 	log.Printf("Browse to %s\n", authorizationURL)
 
@@ -153,6 +233,7 @@ func Authorize(me *url.URL, endpoints Endpoints, clientID, scope string) (TokenR
 	reqValues.Add("redirect_uri", redirectURI)
 	reqValues.Add("client_id", clientID)
 	reqValues.Add("me", me.String())
+	reqValues.Add("code_verifier", codeVerifier)
 
 	req, err := http.NewRequest(http.MethodPost, endpoints.TokenEndpoint, strings.NewReader(reqValues.Encode()))
 	if err != nil {
@@ -205,7 +286,9 @@ func Authorize(me *url.URL, endpoints Endpoints, clientID, scope string) (TokenR
 	return tokenResponse, nil
 }
 
-func CreateAuthenticationURL(authURL url.URL, meURL, clientID, redirectURI, state string) string {
+// CreateAuthenticationURL returns the url to sign in as meURL, the code
+// challenge is left out when it's empty
+func CreateAuthenticationURL(authURL url.URL, meURL, clientID, redirectURI, state, codeChallenge string) string {
 	q := authURL.Query()
 
 	q.Add("response_type", "id")
@@ -213,13 +296,16 @@ func CreateAuthenticationURL(authURL url.URL, meURL, clientID, redirectURI, stat
 	q.Add("client_id", clientID)
 	q.Add("redirect_uri", redirectURI)
 	q.Add("state", state)
+	addCodeChallenge(q, codeChallenge)
 
 	authURL.RawQuery = q.Encode()
 
 	return authURL.String()
 }
 
-func CreateAuthorizationURL(authURL url.URL, meURL, clientID, redirectURI, state, scope string) string {
+// CreateAuthorizationURL returns the url to ask for a token with the scope,
+// the code challenge is left out when it's empty
+func CreateAuthorizationURL(authURL url.URL, meURL, clientID, redirectURI, state, scope, codeChallenge string) string {
 	q := authURL.Query()
 	q.Add("response_type", "code")
 	q.Add("me", meURL)
@@ -227,6 +313,15 @@ func CreateAuthorizationURL(authURL url.URL, meURL, clientID, redirectURI, state
 	q.Add("redirect_uri", redirectURI)
 	q.Add("state", state)
 	q.Add("scope", scope)
+	addCodeChallenge(q, codeChallenge)
 	authURL.RawQuery = q.Encode()
 	return authURL.String()
 }
+
+func addCodeChallenge(q url.Values, codeChallenge string) {
+	if codeChallenge == "" {
+		return
+	}
+	q.Add("code_challenge", codeChallenge)
+	q.Add("code_challenge_method", CodeChallengeMethod)
+}
@@ -0,0 +1,91 @@
+package indieauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetEndpoints_Metadata(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Metadata{
+			Issuer:                server.URL + "/",
+			AuthorizationEndpoint: server.URL + "/auth",
+			TokenEndpoint:         server.URL + "/token",
+			IntrospectionEndpoint: server.URL + "/introspect",
+			RevocationEndpoint:    server.URL + "/revoke",
+		})
+	})
+	mux.HandleFunc("/header", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", `</metadata>; rel="indieauth-metadata"`)
+		w.Header().Add("Link", `<https://old.example/auth>; rel="authorization_endpoint"`)
+		fmt.Fprint(w, `<html></html>`)
+	})
+	mux.HandleFunc("/rels", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", `<https://old.example/auth>; rel="authorization_endpoint"`)
+		w.Header().Add("Link", `<https://old.example/token>; rel="token_endpoint"`)
+		fmt.Fprint(w, `<html></html>`)
+	})
+
+	me, _ := url.Parse(server.URL + "/header")
+	endpoints, err := GetEndpoints(me)
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+"/", endpoints.Issuer)
+	assert.Equal(t, server.URL+"/auth", endpoints.AuthorizationEndpoint)
+	assert.Equal(t, server.URL+"/token", endpoints.TokenEndpoint)
+	assert.Equal(t, server.URL+"/introspect", endpoints.IntrospectionEndpoint)
+	assert.Equal(t, server.URL+"/revoke", endpoints.RevocationEndpoint)
+
+	// without metadata the rels are used
+	me, _ = url.Parse(server.URL + "/rels")
+	endpoints, err = GetEndpoints(me)
+	require.NoError(t, err)
+	assert.Equal(t, "https://old.example/auth", endpoints.AuthorizationEndpoint)
+	assert.Equal(t, "https://old.example/token", endpoints.TokenEndpoint)
+	assert.Empty(t, endpoints.Issuer)
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// the example of RFC 7636
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	assert.Equal(t, challenge, CodeChallenge(verifier))
+
+	assert.True(t, VerifyCodeChallenge(challenge, "S256", verifier))
+	assert.False(t, VerifyCodeChallenge(challenge, "plain", verifier))
+	assert.False(t, VerifyCodeChallenge(challenge, "S256", "wrong"))
+	assert.False(t, VerifyCodeChallenge(challenge, "S256", ""))
+
+	v1, err := NewCodeVerifier()
+	require.NoError(t, err)
+	v2, err := NewCodeVerifier()
+	require.NoError(t, err)
+	assert.Len(t, v1, 43)
+	assert.NotEqual(t, v1, v2)
+}
+
+func TestCreateAuthorizationURL(t *testing.T) {
+	authURL, _ := url.Parse("https://example.com/auth")
+
+	u, err := url.Parse(CreateAuthorizationURL(*authURL, "https://me.example/", "https://client.example/", "https://client.example/callback", "abc", "read", "challenge"))
+	require.NoError(t, err)
+	q := u.Query()
+	assert.Equal(t, "code", q.Get("response_type"))
+	assert.Equal(t, "challenge", q.Get("code_challenge"))
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+
+	u, err = url.Parse(CreateAuthenticationURL(*authURL, "https://me.example/", "https://client.example/", "https://client.example/callback", "abc", ""))
+	require.NoError(t, err)
+	_, ok := u.Query()["code_challenge"]
+	assert.False(t, ok)
+}
@@ -0,0 +1,37 @@
+package indieauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// CodeChallengeMethod is the PKCE method that is supported
+const CodeChallengeMethod = "S256"
+
+// NewCodeVerifier returns a random PKCE code verifier, it's sent with the
+// code to the token endpoint
+func NewCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 code challenge of the verifier, it's sent to
+// the authorization endpoint
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyCodeChallenge reports whether the verifier belongs to the challenge
+func VerifyCodeChallenge(challenge, method, verifier string) bool {
+	if method != CodeChallengeMethod || verifier == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(CodeChallenge(verifier)), []byte(challenge)) == 1
+}
@@ -79,6 +79,12 @@ func itemPtr(item *microsub.Item, key string) *[]string {
 		return &item.InReplyTo
 	} else if key == "photo" {
 		return &item.Photo
+	} else if key == "audio" {
+		return &item.Audio
+	} else if key == "video" {
+		return &item.Video
+	} else if key == "syndication" {
+		return &item.Syndication
 	} else if key == "category" {
 		return &item.Category
 	}
@@ -114,20 +120,24 @@ func simplifyToItem(itemType string, item map[string][]interface{}) microsub.Ite
 		case "checkin", "location":
 			author, _ := simplifyCard(v[0])
 			feedItem.Checkin = &author
-		case "name", "published", "updated", "url", "uid", "latitude", "longitude":
+		case "name", "summary", "published", "updated", "url", "uid", "latitude", "longitude":
 			if resultPtr := getScalarPtr(&feedItem, k); resultPtr != nil {
 				if len(v) >= 1 {
 					*resultPtr = v[0].(string)
 				}
 			}
-		case "photo":
+		case "photo", "audio", "video", "syndication":
 			if resultPtr := itemPtr(&feedItem, k); resultPtr != nil {
 				for _, c := range v {
-					if photo, ok := c.(string); ok {
-						*resultPtr = append(*resultPtr, photo)
+					if u, ok := urlValue(c); ok {
+						*resultPtr = append(*resultPtr, u)
 					}
 				}
 			}
+		case "featured":
+			if len(v) >= 1 {
+				feedItem.Featured, _ = urlValue(v[0])
+			}
 		case "category":
 			if resultPtr := itemPtr(&feedItem, k); resultPtr != nil {
 				for _, c := range v {
@@ -157,8 +167,26 @@ func simplifyToItem(itemType string, item map[string][]interface{}) microsub.Ite
 	return feedItem
 }
 
+// urlValue returns the url of a property value, which is a string, or an
+// object with the url as value, like an image with alt text
+func urlValue(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case map[string]string:
+		u, ok := t["value"]
+		return u, ok
+	case map[string]interface{}:
+		u, ok := t["value"].(string)
+		return u, ok
+	}
+	return "", false
+}
+
 func getScalarPtr(item *microsub.Item, k string) *string {
 	switch k {
+	case "summary":
+		return &item.Summary
 	case "published":
 		return &item.Published
 	case "updated":
@@ -95,15 +95,45 @@ import (
 // 	}
 // }
 
-func TestConvertItem0(t *testing.T) {
-	var item microsub.Item
-	var mdItem microformats.Microformat
-	f, err := os.Open("tests/test0.json")
+// loadMicroformat reads a microformat from a mf2 json file. The objects with a
+// type in the properties become microformats, like the parser returns them.
+func loadMicroformat(t *testing.T, name string) *microformats.Microformat {
+	f, err := os.Open(name)
 	if err != nil {
-		t.Fatalf("error while opening test0.json: %s", err)
+		t.Fatalf("error while opening %s: %s", name, err)
 	}
-	json.NewDecoder(f).Decode(&mdItem)
-	ConvertItem(&item, &mdItem)
+	defer f.Close()
+
+	var mdItem microformats.Microformat
+	if err := json.NewDecoder(f).Decode(&mdItem); err != nil {
+		t.Fatalf("error while decoding %s: %s", name, err)
+	}
+	nestMicroformats(&mdItem)
+	return &mdItem
+}
+
+func nestMicroformats(mdItem *microformats.Microformat) {
+	for _, values := range mdItem.Properties {
+		for i, v := range values {
+			m, ok := v.(map[string]interface{})
+			if !ok || m["type"] == nil {
+				continue
+			}
+			data, _ := json.Marshal(m)
+			var nested microformats.Microformat
+			json.Unmarshal(data, &nested)
+			nestMicroformats(&nested)
+			values[i] = &nested
+		}
+	}
+	for _, child := range mdItem.Children {
+		nestMicroformats(child)
+	}
+}
+
+func TestConvertItem0(t *testing.T) {
+	item, ok := SimplifyMicroformatItem(loadMicroformat(t, "tests/test0.json"), microsub.Card{})
+	assert.True(t, ok)
 
 	if item.Type != "entry" {
 		t.Errorf("Expected Type entry, was %q", item.Type)
@@ -114,14 +144,8 @@ func TestConvertItem0(t *testing.T) {
 }
 
 func TestConvertItem1(t *testing.T) {
-	var item microsub.Item
-	var mdItem microformats.Microformat
-	f, err := os.Open("tests/test1.json")
-	if err != nil {
-		t.Fatalf("error while opening test1.json: %s", err)
-	}
-	json.NewDecoder(f).Decode(&mdItem)
-	ConvertItem(&item, &mdItem)
+	item, ok := SimplifyMicroformatItem(loadMicroformat(t, "tests/test1.json"), microsub.Card{})
+	assert.True(t, ok)
 
 	if item.Type != "entry" {
 		t.Errorf("Expected Type entry, was %q", item.Type)
@@ -135,14 +159,8 @@ func TestConvertItem1(t *testing.T) {
 }
 
 func TestConvertItem2(t *testing.T) {
-	var item microsub.Item
-	var mdItem microformats.Microformat
-	f, err := os.Open("tests/test2.json")
-	if err != nil {
-		t.Fatalf("error while opening test2.json: %s", err)
-	}
-	json.NewDecoder(f).Decode(&mdItem)
-	ConvertItem(&item, &mdItem)
+	item, ok := SimplifyMicroformatItem(loadMicroformat(t, "tests/test2.json"), microsub.Card{})
+	assert.True(t, ok)
 
 	if item.Type != "entry" {
 		t.Errorf("Expected Type entry, was %q", item.Type)
@@ -164,8 +182,12 @@ func TestConvert992(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error while opening 992.json: %s", err)
 	}
+	defer f.Close()
 	err = json.NewDecoder(f).Decode(&mdItem)
 	if assert.NoError(t, err) {
+		for _, item := range mdItem.Items {
+			nestMicroformats(item)
+		}
 		items := SimplifyMicroformatDataItems(&mdItem)
 		assert.Len(t, items, 1)
 		item := items[0]
@@ -182,3 +204,49 @@ func TestConvert992(t *testing.T) {
 		assert.Equal(t, "card", author.Type)
 	}
 }
+
+func TestSimplifyMedia(t *testing.T) {
+	mdItem := &microformats.Microformat{
+		Type: []string{"h-entry"},
+		Properties: map[string][]interface{}{
+			"summary":  {"A short summary"},
+			"photo":    {map[string]string{"value": "https://example.com/photo.jpg", "alt": "A photo"}},
+			"audio":    {"https://example.com/episode.mp3", 42},
+			"video":    {map[string]interface{}{"value": "https://example.com/clip.mp4"}},
+			"featured": {"https://example.com/featured.jpg"},
+			"syndication": {
+				"https://social.example/1",
+				"https://other.example/1",
+			},
+		},
+	}
+
+	item, ok := SimplifyMicroformatItem(mdItem, microsub.Card{})
+	assert.True(t, ok)
+	assert.Equal(t, "A short summary", item.Summary)
+	assert.Equal(t, []string{"https://example.com/photo.jpg"}, item.Photo)
+	assert.Equal(t, []string{"https://example.com/episode.mp3"}, item.Audio)
+	assert.Equal(t, []string{"https://example.com/clip.mp4"}, item.Video)
+	assert.Equal(t, "https://example.com/featured.jpg", item.Featured)
+	assert.Equal(t, []string{"https://social.example/1", "https://other.example/1"}, item.Syndication)
+}
+
+func TestURLValue(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		url   string
+		ok    bool
+	}{
+		{"https://example.com/a.jpg", "https://example.com/a.jpg", true},
+		{map[string]string{"value": "https://example.com/b.jpg", "alt": "B"}, "https://example.com/b.jpg", true},
+		{map[string]interface{}{"value": "https://example.com/c.jpg"}, "https://example.com/c.jpg", true},
+		{map[string]string{"alt": "no url"}, "", false},
+		{map[string]interface{}{"value": 1}, "", false},
+		{1, "", false},
+	}
+	for _, tt := range tests {
+		u, ok := urlValue(tt.value)
+		assert.Equal(t, tt.ok, ok, "%v", tt.value)
+		assert.Equal(t, tt.url, u, "%v", tt.value)
+	}
+}
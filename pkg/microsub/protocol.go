@@ -35,6 +35,10 @@ type Channel struct {
 	UID    string `json:"uid"`
 	Name   string `json:"name"`
 	Unread int    `json:"unread"`
+	// TimelineType is the way items are kept: sorted-set, stream or capped
+	TimelineType string `json:"timeline_type,omitempty"`
+	// TimelineSize is the number of items kept in a capped timeline
+	TimelineSize int `json:"timeline_size,omitempty"`
 }
 
 type Card struct {
@@ -57,26 +61,38 @@ type Content struct {
 
 // Item is a post object
 type Item struct {
-	Type       string          `json:"type"`
-	Name       string          `json:"name,omitempty" mf2:"name"`
-	Published  string          `json:"published,omitempty" mf2:"published"`
-	Updated    string          `json:"updated,omitempty" mf2:"updated"`
-	URL        string          `json:"url,omitempty" mf2:"url"`
-	UID        string          `json:"uid,omitempty" mf2:"uid"`
-	Author     *Card           `json:"author,omitempty" mf2:"author"`
-	Category   []string        `json:"category,omitempty" mf2:"category"`
-	Photo      []string        `json:"photo,omitempty" mf2:"photo"`
-	LikeOf     []string        `json:"like-of,omitempty" mf2:"like-of"`
-	BookmarkOf []string        `json:"bookmark-of,omitempty" mf2:"bookmark-of"`
-	RepostOf   []string        `json:"repost-of,omitempty" mf2:"repost-of"`
-	InReplyTo  []string        `json:"in-reply-to,omitempty" mf2:"in-reply-to"`
-	Content    *Content        `json:"content,omitempty" mf2:"content"`
-	Latitude   string          `json:"latitude,omitempty" mf2:"latitude"`
-	Longitude  string          `json:"longitude,omitempty" mf2:"longitude"`
-	Checkin    *Card           `json:"checkin,omitempty" mf2:"checkin"`
-	Refs       map[string]Item `json:"refs,omitempty"`
-	ID         string          `json:"_id,omitempty"`
-	Read       bool            `json:"_is_read"`
+	Type        string          `json:"type"`
+	Name        string          `json:"name,omitempty" mf2:"name"`
+	Published   string          `json:"published,omitempty" mf2:"published"`
+	Updated     string          `json:"updated,omitempty" mf2:"updated"`
+	URL         string          `json:"url,omitempty" mf2:"url"`
+	UID         string          `json:"uid,omitempty" mf2:"uid"`
+	Author      *Card           `json:"author,omitempty" mf2:"author"`
+	Category    []string        `json:"category,omitempty" mf2:"category"`
+	Photo       []string        `json:"photo,omitempty" mf2:"photo"`
+	Audio       []string        `json:"audio,omitempty" mf2:"audio"`
+	Video       []string        `json:"video,omitempty" mf2:"video"`
+	Featured    string          `json:"featured,omitempty" mf2:"featured"`
+	Syndication []string        `json:"syndication,omitempty" mf2:"syndication"`
+	LikeOf      []string        `json:"like-of,omitempty" mf2:"like-of"`
+	BookmarkOf  []string        `json:"bookmark-of,omitempty" mf2:"bookmark-of"`
+	RepostOf    []string        `json:"repost-of,omitempty" mf2:"repost-of"`
+	InReplyTo   []string        `json:"in-reply-to,omitempty" mf2:"in-reply-to"`
+	Summary     string          `json:"summary,omitempty" mf2:"summary"`
+	Content     *Content        `json:"content,omitempty" mf2:"content"`
+	Latitude    string          `json:"latitude,omitempty" mf2:"latitude"`
+	Longitude   string          `json:"longitude,omitempty" mf2:"longitude"`
+	Checkin     *Card           `json:"checkin,omitempty" mf2:"checkin"`
+	Refs        map[string]Item `json:"refs,omitempty"`
+	ID          string          `json:"_id,omitempty"`
+	Read        bool            `json:"_is_read"`
+	Source      *Source         `json:"_source,omitempty"`
+}
+
+// Source is the feed an item was fetched from
+type Source struct {
+	URL  string `json:"url"`
+	Name string `json:"name,omitempty"`
 }
 
 // Pagination contains information about paging
@@ -98,12 +114,65 @@ type Feed struct {
 	Photo       string `json:"photo,omitempty"`
 	Description string `json:"description,omitempty"`
 	Author      Card   `json:"author,omitempty"`
+
+	// Status is only set in the follow list
+	Status *FeedStatus `json:"_status,omitempty"`
 }
 
-type Message string
+// FeedStatus is the fetch state of a followed feed, the times are in RFC3339
+type FeedStatus struct {
+	LastFetch   string `json:"last_fetch,omitempty"`
+	LastSuccess string `json:"last_success,omitempty"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	// Errors is the number of fetches that failed in a row
+	Errors    int    `json:"errors"`
+	LastError string `json:"last_error,omitempty"`
+	// LastItem is the time the last new item of the feed was added
+	LastItem string `json:"last_item,omitempty"`
+	// Items is the number of items in the feed at the last fetch
+	Items  int  `json:"items"`
+	WebSub bool `json:"websub"`
+}
 
+// MicropubSource is a micropub source of the server, the items that are
+// posted with the ID are added to the channel. LastUsed is in RFC3339.
+type MicropubSource struct {
+	ID       string `json:"id"`
+	Label    string `json:"label,omitempty"`
+	Channel  string `json:"channel"`
+	LastUsed string `json:"last_used,omitempty"`
+	// Items is the number of items that were posted
+	Items int `json:"items"`
+	// RateLimit is the number of items per hour that are accepted, 0 is
+	// unlimited
+	RateLimit int `json:"rate_limit,omitempty"`
+}
+
+// Event types
+const (
+	// EventNewItem is sent when an item is added to a channel
+	EventNewItem = "new-item"
+	// EventUnreadCountChanged is sent when the unread count of a channel changes
+	EventUnreadCountChanged = "unread-count-changed"
+	EventChannelCreated     = "channel-created"
+	EventChannelUpdated     = "channel-updated"
+	EventChannelDeleted     = "channel-deleted"
+	EventFollowAdded        = "follow-added"
+	EventFollowRemoved      = "follow-removed"
+	// EventFetchError is sent when a feed of a channel can't be fetched
+	EventFetchError = "fetch-error"
+)
+
+// Event is a change in the backend. The ID is set by the server, it increases
+// with every event and is used to replay the events a client missed.
 type Event struct {
-	Msg Message
+	ID      int64    `json:"id"`
+	Type    string   `json:"type"`
+	Channel *Channel `json:"channel,omitempty"`
+	// Item is the ID of the item for new-item
+	Item  string `json:"item,omitempty"`
+	Feed  *Feed  `json:"feed,omitempty"`
+	Error string `json:"error,omitempty"`
 }
 
 type EventListener interface {
@@ -116,10 +185,20 @@ type Microsub interface {
 	ChannelsCreate(name string) (Channel, error)
 	ChannelsUpdate(uid, name string) (Channel, error)
 	ChannelsDelete(uid string) error
+	ChannelsSetType(uid, timelineType string, size int) (Channel, error)
+	// ChannelsOrder sorts the channels in the order of uids
+	ChannelsOrder(uids []string) error
 
 	TimelineGet(before, after, channel string) (Timeline, error)
+	// TimelineGetQuery returns the items of the channel that match the query
+	TimelineGetQuery(channel string, query TimelineQuery) (Timeline, error)
 
 	MarkRead(channel string, entry []string) error
+	MarkUnread(channel string, entry []string) error
+	// MarkReadUpTo marks the entry and all entries before it as read
+	MarkReadUpTo(channel string, lastReadEntry string) error
+	MarkAllRead(channel string) error
+	RemoveItems(channel string, entry []string) error
 
 	FollowGetList(uid string) ([]Feed, error)
 	FollowURL(uid string, url string) (Feed, error)
@@ -127,7 +206,25 @@ type Microsub interface {
 	UnfollowURL(uid string, url string) error
 
 	Search(query string) ([]Feed, error)
+	// ItemSearch searches the items in the channel
+	ItemSearch(channel, query string) ([]Item, error)
 	PreviewURL(url string) (Timeline, error)
 
 	AddEventListener(el EventListener) error
+
+	MuteGetList(channel string) ([]Card, error)
+	Mute(channel string, uid string) error
+	Unmute(channel string, uid string) error
+
+	BlockGetList(channel string) ([]Card, error)
+	Block(channel string, uid string) error
+	Unblock(channel string, uid string) error
+
+	// SourcesGetList returns the micropub sources
+	SourcesGetList() ([]MicropubSource, error)
+	// SourcesCreate creates a source with a new ID
+	SourcesCreate(source MicropubSource) (MicropubSource, error)
+	// SourcesUpdate changes the label, channel and rate limit of the source
+	SourcesUpdate(source MicropubSource) (MicropubSource, error)
+	SourcesDelete(id string) error
 }
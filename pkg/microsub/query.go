@@ -0,0 +1,135 @@
+/*
+   Microsub server
+   Copyright (C) 2018  Peter Stuifzand
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+package microsub
+
+import (
+	"strings"
+	"time"
+)
+
+// Post types that are returned by PostType
+const (
+	PostTypeRepost   = "repost"
+	PostTypeLike     = "like"
+	PostTypeReply    = "reply"
+	PostTypeBookmark = "bookmark"
+	PostTypeCheckin  = "checkin"
+	PostTypePhoto    = "photo"
+	PostTypeArticle  = "article"
+	PostTypeNote     = "note"
+)
+
+// TimelineQuery selects items from a timeline. The zero value selects the
+// first page of all items.
+type TimelineQuery struct {
+	Before string
+	After  string
+
+	// Limit is the number of items on a page, 0 uses the default of the server
+	Limit int
+
+	// Unread only selects the unread items
+	Unread bool
+
+	// Source only selects the items from the feed with this URL
+	Source string
+
+	// Since and Until only select the items published in this period, Since
+	// is inclusive and Until is exclusive
+	Since time.Time
+	Until time.Time
+
+	// Type only selects the items of this post type, see PostType
+	Type string
+
+	// Hide skips the items it returns true for. It isn't sent to the server,
+	// servers use it for the items of muted and blocked authors.
+	Hide func(item Item) bool
+}
+
+// Match reports whether the item passes the filters of the query
+func (q TimelineQuery) Match(item Item) bool {
+	if q.Unread && item.Read {
+		return false
+	}
+
+	if q.Source != "" && (item.Source == nil || strings.TrimSuffix(item.Source.URL, "/") != strings.TrimSuffix(q.Source, "/")) {
+		return false
+	}
+
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		published, err := time.Parse(time.RFC3339, item.Published)
+		if err != nil {
+			return false
+		}
+		if !q.Since.IsZero() && published.Before(q.Since) {
+			return false
+		}
+		if !q.Until.IsZero() && !published.Before(q.Until) {
+			return false
+		}
+	}
+
+	if q.Type != "" && PostType(item) != q.Type {
+		return false
+	}
+
+	if q.Hide != nil && q.Hide(item) {
+		return false
+	}
+
+	return true
+}
+
+// PostType returns the type of the item, based on Post Type Discovery
+func PostType(item Item) string {
+	switch {
+	case len(item.RepostOf) > 0:
+		return PostTypeRepost
+	case len(item.LikeOf) > 0:
+		return PostTypeLike
+	case len(item.InReplyTo) > 0:
+		return PostTypeReply
+	case len(item.BookmarkOf) > 0:
+		return PostTypeBookmark
+	case item.Checkin != nil:
+		return PostTypeCheckin
+	case len(item.Photo) > 0:
+		return PostTypePhoto
+	}
+
+	name := strings.Join(strings.Fields(item.Name), " ")
+	if name == "" {
+		return PostTypeNote
+	}
+
+	var content string
+	if item.Content != nil {
+		content = item.Content.Text
+		if content == "" {
+			content = item.Content.HTML
+		}
+	}
+	content = strings.Join(strings.Fields(content), " ")
+
+	// a name that is the start of the content is not a title
+	if strings.HasPrefix(content, strings.TrimSuffix(name, "...")) {
+		return PostTypeNote
+	}
+	return PostTypeArticle
+}
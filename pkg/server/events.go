@@ -3,49 +3,244 @@ package server
 import (
 	"encoding/json"
 	"fmt"
-	"net"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"p83.nl/go/ekster/pkg/microsub"
 )
 
-type Consumer struct {
-	conn   net.Conn
-	output chan microsub.Message
-}
-
-func newConsumer(conn net.Conn) *Consumer {
-	cons := &Consumer{conn, make(chan microsub.Message)}
-
-	fmt.Fprint(conn, "HTTP/1.0 200 OK\r\n")
-	fmt.Fprint(conn, "Content-Type: text/event-stream\r\n")
-	fmt.Fprint(conn, "Access-Control-Allow-Origin: *\r\n")
-	fmt.Fprint(conn, "\r\n")
-
-	go func() {
-		ticker := time.NewTicker(10 * time.Second).C
-		for {
-			select {
-			case <-ticker:
-				fmt.Fprint(conn, `event: ping`)
-				fmt.Fprint(conn, "\r\n")
-				fmt.Fprint(conn, "\r\n")
-
-			case msg := <-cons.output:
-				fmt.Fprint(conn, `event: message`)
-				fmt.Fprint(conn, "\r\n")
-				fmt.Fprint(conn, `data:`)
-				json.NewEncoder(conn).Encode(msg)
-				fmt.Fprint(conn, "\r\n")
-				fmt.Fprint(conn, "\r\n")
+const (
+	// eventBufferSize is the number of events that are kept for replay
+	eventBufferSize = 100
+
+	// eventQueueSize is the number of events that can wait for a subscriber
+	eventQueueSize = 64
+
+	// pingInterval is the time between pings on an idle event stream
+	pingInterval = 10 * time.Second
+)
+
+// slowSubscriberPolicy decides what happens with a subscriber that doesn't
+// keep up with the events
+type slowSubscriberPolicy int
+
+const (
+	// disconnectSlowSubscribers closes the stream of a subscriber with a full
+	// queue. The client reconnects with Last-Event-ID and receives the events
+	// it missed from the buffer.
+	disconnectSlowSubscribers slowSubscriberPolicy = iota
+
+	// dropEvents skips the events that don't fit in the queue of a subscriber
+	dropEvents
+)
+
+// subscriber is a client of the event stream, the events are queued until the
+// client has written them
+type subscriber struct {
+	queue chan microsub.Event
+
+	lock sync.Mutex
+	// all is set for a subscriber of all channels, then channels only has
+	// the channels it unsubscribed from
+	all      bool
+	channels map[string]bool
+}
+
+func newSubscriber(channels []string) *subscriber {
+	sub := &subscriber{
+		queue:    make(chan microsub.Event, eventQueueSize),
+		all:      len(channels) == 0,
+		channels: make(map[string]bool),
+	}
+	sub.subscribeChannels(channels)
+	return sub
+}
+
+// wants reports whether the subscriber receives the event, events without a
+// channel are sent to all subscribers
+func (sub *subscriber) wants(evt microsub.Event) bool {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if evt.Channel == nil {
+		return true
+	}
+	subscribed, ok := sub.channels[evt.Channel.UID]
+	if sub.all {
+		return !ok || subscribed
+	}
+	return subscribed
+}
+
+// subscribeChannels adds channels to the subscription
+func (sub *subscriber) subscribeChannels(uids []string) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	for _, uid := range uids {
+		sub.channels[uid] = true
+	}
+}
+
+// unsubscribeChannels removes channels from the subscription, a subscriber
+// that unsubscribes from all its channels receives no channel events
+func (sub *subscriber) unsubscribeChannels(uids []string) {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	for _, uid := range uids {
+		sub.channels[uid] = false
+	}
+}
+
+// eventHub receives the events of the backend, gives every event an ID and
+// sends it to the subscribers without blocking the backend. The last events are
+// kept, so a subscriber that reconnects with Last-Event-ID receives the events
+// it missed.
+type eventHub struct {
+	policy slowSubscriberPolicy
+
+	lock        sync.Mutex
+	lastID      int64
+	buffer      []microsub.Event
+	subscribers map[*subscriber]struct{}
+}
+
+func newEventHub(policy slowSubscriberPolicy) *eventHub {
+	return &eventHub{
+		policy:      policy,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// WriteMessage implements microsub.EventListener
+func (hub *eventHub) WriteMessage(evt microsub.Event) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	hub.lastID++
+	evt.ID = hub.lastID
+	hub.buffer = append(hub.buffer, evt)
+	if len(hub.buffer) > eventBufferSize {
+		hub.buffer = append([]microsub.Event{}, hub.buffer[len(hub.buffer)-eventBufferSize:]...)
+	}
+
+	for sub := range hub.subscribers {
+		if !sub.wants(evt) {
+			continue
+		}
+		select {
+		case sub.queue <- evt:
+		default:
+			if hub.policy == disconnectSlowSubscribers {
+				hub.remove(sub)
 			}
 		}
-		conn.Close()
-	}()
+	}
+}
+
+// subscribe adds a subscriber for the channels, or all channels when there are
+// none, and returns the buffered events after lastID. These should be sent to
+// the subscriber before the events from the queue.
+func (hub *eventHub) subscribe(lastID int64, channels []string) (*subscriber, []microsub.Event) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	sub := newSubscriber(channels)
+	hub.subscribers[sub] = struct{}{}
+
+	if lastID > hub.lastID {
+		// the ids restarted with the server, all events are new
+		lastID = 0
+	}
+
+	var replay []microsub.Event
+	for _, evt := range hub.buffer {
+		if evt.ID > lastID && sub.wants(evt) {
+			replay = append(replay, evt)
+		}
+	}
+	return sub, replay
+}
+
+// unsubscribe removes the subscriber, it's safe to call more than once
+func (hub *eventHub) unsubscribe(sub *subscriber) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	hub.remove(sub)
+}
+
+// remove closes the queue of the subscriber, hub.lock should be held
+func (hub *eventHub) remove(sub *subscriber) {
+	if _, ok := hub.subscribers[sub]; ok {
+		delete(hub.subscribers, sub)
+		close(sub.queue)
+	}
+}
+
+// count returns the number of subscribers
+func (hub *eventHub) count() int {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	return len(hub.subscribers)
+}
+
+// serveEvents streams the events as text/event-stream until the client
+// disconnects or can't keep up
+func (hub *eventHub) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", 500)
+		return
+	}
+
+	lastEventID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	sub, replay := hub.subscribe(lastEventID, formList(r.URL.Query(), "channel"))
+	defer hub.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	for _, evt := range replay {
+		if err := writeEvent(w, evt); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
 
-	return cons
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, "event: ping\r\n\r\n"); err != nil {
+				return
+			}
+
+		case evt, ok := <-sub.queue:
+			if !ok {
+				// the subscriber was too slow and is disconnected
+				return
+			}
+			if err := writeEvent(w, evt); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
 }
 
-func (cons *Consumer) WriteMessage(evt microsub.Event) {
-	cons.output <- evt.Msg
+// writeEvent writes the event in the text/event-stream format
+func writeEvent(w io.Writer, evt microsub.Event) error {
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\r\nevent: %s\r\ndata: %s\r\n\r\n", evt.ID, evt.Type, data)
+	return err
 }
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"p83.nl/go/ekster/pkg/client"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+func eventIDs(events []microsub.Event) []int64 {
+	var ids []int64
+	for _, evt := range events {
+		ids = append(ids, evt.ID)
+	}
+	return ids
+}
+
+// readQueue returns the events that are waiting in the queue of sub
+func readQueue(sub *subscriber) []microsub.Event {
+	var events []microsub.Event
+	for {
+		select {
+		case evt, ok := <-sub.queue:
+			if !ok {
+				return events
+			}
+			events = append(events, evt)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventHub_IDs(t *testing.T) {
+	hub := newEventHub(disconnectSlowSubscribers)
+	sub, replay := hub.subscribe(0, nil)
+	assert.Empty(t, replay)
+
+	hub.WriteMessage(microsub.Event{Type: microsub.EventChannelCreated})
+	hub.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Item: "a"})
+
+	events := readQueue(sub)
+	assert.Equal(t, []int64{1, 2}, eventIDs(events))
+	assert.Equal(t, microsub.EventNewItem, events[1].Type)
+}
+
+func TestEventHub_Replay(t *testing.T) {
+	hub := newEventHub(disconnectSlowSubscribers)
+	for i := 0; i < eventBufferSize+10; i++ {
+		hub.WriteMessage(microsub.Event{Type: microsub.EventNewItem})
+	}
+
+	_, replay := hub.subscribe(105, nil)
+	assert.Equal(t, []int64{106, 107, 108, 109, 110}, eventIDs(replay))
+
+	// only the last events are kept
+	_, replay = hub.subscribe(0, nil)
+	if assert.Len(t, replay, eventBufferSize) {
+		assert.Equal(t, int64(11), replay[0].ID)
+	}
+
+	_, replay = hub.subscribe(110, nil)
+	assert.Empty(t, replay)
+
+	// an id from before a restart of the server replays all events
+	_, replay = hub.subscribe(500, nil)
+	assert.Len(t, replay, eventBufferSize)
+}
+
+func TestEventHub_SlowSubscribers(t *testing.T) {
+	hub := newEventHub(disconnectSlowSubscribers)
+	slow, _ := hub.subscribe(0, nil)
+
+	for i := 0; i < eventQueueSize+1; i++ {
+		hub.WriteMessage(microsub.Event{Type: microsub.EventNewItem})
+	}
+
+	// the queued events can be read, then the queue is closed
+	assert.Len(t, readQueue(slow), eventQueueSize)
+	_, ok := <-slow.queue
+	assert.False(t, ok)
+	assert.Equal(t, 0, hub.count())
+
+	hub = newEventHub(dropEvents)
+	slow, _ = hub.subscribe(0, nil)
+
+	for i := 0; i < eventQueueSize+10; i++ {
+		hub.WriteMessage(microsub.Event{Type: microsub.EventNewItem})
+	}
+
+	events := readQueue(slow)
+	if assert.Len(t, events, eventQueueSize) {
+		assert.Equal(t, int64(eventQueueSize), events[eventQueueSize-1].ID)
+	}
+	assert.Equal(t, 1, hub.count())
+
+	hub.WriteMessage(microsub.Event{Type: microsub.EventNewItem})
+	assert.Equal(t, []int64{eventQueueSize + 11}, eventIDs(readQueue(slow)))
+}
+
+func TestEventHub_Unsubscribe(t *testing.T) {
+	hub := newEventHub(disconnectSlowSubscribers)
+	sub, _ := hub.subscribe(0, nil)
+	assert.Equal(t, 1, hub.count())
+
+	hub.unsubscribe(sub)
+	hub.unsubscribe(sub)
+	assert.Equal(t, 0, hub.count())
+
+	hub.WriteMessage(microsub.Event{Type: microsub.EventNewItem})
+	assert.Empty(t, readQueue(sub))
+}
+
+// readEventIDs reads the ids of n events from the event stream
+func readEventIDs(t *testing.T, resp *http.Response, n int) []int64 {
+	var ids []int64
+	scanner := bufio.NewScanner(resp.Body)
+	for len(ids) < n && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "id: ") {
+			id, err := strconv.ParseInt(strings.TrimPrefix(line, "id: "), 10, 64)
+			assert.NoError(t, err)
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestServer_EventsConcurrentSubscribers(t *testing.T) {
+	handler := NewMicrosubHandler(&NullBackend{}).(*microsubHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	const subscribers = 50
+	const events = 20
+
+	responses := make([]*http.Response, subscribers)
+	for i := range responses {
+		resp, err := http.Get(server.URL + "/microsub?action=events")
+		require.NoError(t, err)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		responses[i] = resp
+	}
+
+	assert.Eventually(t, func() bool {
+		return handler.events.count() == subscribers
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var writers sync.WaitGroup
+	for i := 0; i < events; i++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem})
+		}()
+	}
+	writers.Wait()
+
+	expected := make([]int64, events)
+	for i := range expected {
+		expected[i] = int64(i + 1)
+	}
+
+	var readers sync.WaitGroup
+	for _, resp := range responses {
+		readers.Add(1)
+		go func(resp *http.Response) {
+			defer readers.Done()
+			assert.Equal(t, expected, readEventIDs(t, resp, events))
+		}(resp)
+	}
+	readers.Wait()
+
+	// a client reconnecting with Last-Event-ID receives the missed events
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/microsub?action=events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", strconv.Itoa(events-2))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{events - 1, events}, readEventIDs(t, resp, 2))
+	responses = append(responses, resp)
+
+	// disconnected clients are unsubscribed
+	for _, resp := range responses {
+		resp.Body.Close()
+	}
+	assert.Eventually(t, func() bool {
+		return handler.events.count() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+type eventChannel chan microsub.Event
+
+func (ch eventChannel) WriteMessage(evt microsub.Event) {
+	ch <- evt
+}
+
+// receive waits for the next event
+func (ch eventChannel) receive(t *testing.T) microsub.Event {
+	select {
+	case evt := <-ch:
+		return evt
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return microsub.Event{}
+	}
+}
+
+func TestClient_StreamEvents(t *testing.T) {
+	handler := NewMicrosubHandler(&NullBackend{}).(*microsubHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	c := client.Client{Token: "1234"}
+	c.MicrosubEndpoint, _ = url.Parse(server.URL + "/microsub")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(eventChannel, 10)
+	done := make(chan error)
+	go func() {
+		done <- c.StreamEvents(ctx, events)
+	}()
+
+	require.Eventually(t, func() bool {
+		return handler.events.count() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventChannelCreated, Channel: &microsub.Channel{UID: "0001", Name: "Home"}})
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0001"}, Item: "a"})
+
+	evt := events.receive(t)
+	assert.Equal(t, int64(1), evt.ID)
+	assert.Equal(t, microsub.EventChannelCreated, evt.Type)
+	assert.Equal(t, "Home", evt.Channel.Name)
+
+	evt = events.receive(t)
+	assert.Equal(t, int64(2), evt.ID)
+	assert.Equal(t, microsub.EventNewItem, evt.Type)
+	assert.Equal(t, "a", evt.Item)
+
+	// events sent while the client is disconnected are received after it
+	// reconnects
+	server.CloseClientConnections()
+	require.Eventually(t, func() bool {
+		return handler.events.count() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventChannelDeleted, Channel: &microsub.Channel{UID: "0001"}})
+
+	evt = events.receive(t)
+	assert.Equal(t, int64(3), evt.ID)
+	assert.Equal(t, microsub.EventChannelDeleted, evt.Type)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
@@ -20,22 +20,100 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
+	"time"
 
 	"p83.nl/go/ekster/pkg/microsub"
 )
 
-var (
-	entryRegex = regexp.MustCompile("^entry\\[\\d+\\]$")
-)
-
 const (
 	OutputContentType = "application/json; charset=utf-8"
 )
 
 type microsubHandler struct {
 	backend microsub.Microsub
+	events  *eventHub
+}
+
+// timelineQuery reads the paging and filter arguments of action=timeline
+func timelineQuery(values url.Values) (microsub.TimelineQuery, error) {
+	query := microsub.TimelineQuery{
+		Before: values.Get("before"),
+		After:  values.Get("after"),
+		Source: values.Get("source"),
+		Type:   values.Get("type"),
+	}
+
+	var err error
+	if limit := values.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 {
+			return query, fmt.Errorf("limit should be a positive number: %q", limit)
+		}
+	}
+
+	switch values.Get("is_read") {
+	case "":
+	case "false":
+		query.Unread = true
+	default:
+		return query, fmt.Errorf("is_read only supports false")
+	}
+
+	if since := values.Get("since"); since != "" {
+		query.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return query, fmt.Errorf("since should be a RFC3339 time: %q", since)
+		}
+	}
+	if until := values.Get("until"); until != "" {
+		query.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return query, fmt.Errorf("until should be a RFC3339 time: %q", until)
+		}
+	}
+
+	return query, nil
+}
+
+// formEntries returns the entries from entry, entry[] or entry[N] form values
+func formEntries(values url.Values) []string {
+	return formList(values, "entry")
+}
+
+// formList returns the values from name, name[] or name[N] form values, name[N]
+// values are returned in the order of N
+func formList(values url.Values, name string) []string {
+	if list, e := values[name]; e {
+		return list
+	} else if list, e := values[name+"[]"]; e {
+		return list
+	}
+
+	re := regexp.MustCompile("^" + regexp.QuoteMeta(name) + "\\[(\\d+)\\]$")
+
+	var keys []string
+	for k := range values {
+		if re.MatchString(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := strconv.Atoi(re.FindStringSubmatch(keys[i])[1])
+		b, _ := strconv.Atoi(re.FindStringSubmatch(keys[j])[1])
+		return a < b
+	})
+
+	list := []string{}
+	for _, k := range keys {
+		list = append(list, values[k]...)
+	}
+	return list
 }
 
 func respondJSON(w http.ResponseWriter, value interface{}) {
@@ -50,7 +128,12 @@ func respondJSON(w http.ResponseWriter, value interface{}) {
 }
 
 func NewMicrosubHandler(backend microsub.Microsub) http.Handler {
-	return &microsubHandler{backend}
+	events := newEventHub(disconnectSlowSubscribers)
+	err := backend.AddEventListener(events)
+	if err != nil {
+		log.Printf("Error while adding event listener: %v\n", err)
+	}
+	return &microsubHandler{backend, events}
 }
 
 func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -62,14 +145,14 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodOptions {
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 		w.Header().Add("Access-Control-Allow-Methods", "GET, POST")
-		w.Header().Add("Access-Control-Allow-Headers", "Authorization, Cache-Control")
+		w.Header().Add("Access-Control-Allow-Headers", "Authorization, Cache-Control, Last-Event-ID")
 		return
 	}
 
 	if r.Method == http.MethodGet {
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 		values := r.URL.Query()
-		action := values.Get("action")
+		action := RequestAction(r)
 		if action == "channels" {
 			channels, err := h.backend.ChannelsGetList()
 			if err != nil {
@@ -80,7 +163,12 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				"channels": channels,
 			})
 		} else if action == "timeline" {
-			timeline, err := h.backend.TimelineGet(values.Get("before"), values.Get("after"), values.Get("channel"))
+			query, err := timelineQuery(values)
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			timeline, err := h.backend.TimelineGetQuery(values.Get("channel"), query)
 			if err != nil {
 				http.Error(w, err.Error(), 500)
 				return
@@ -103,10 +191,41 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			respondJSON(w, map[string][]microsub.Feed{
 				"items": following,
 			})
+		} else if action == "mute" {
+			channel := values.Get("channel")
+			muted, err := h.backend.MuteGetList(channel)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			respondJSON(w, map[string][]microsub.Card{
+				"items": muted,
+			})
+		} else if action == "block" {
+			channel := values.Get("channel")
+			blocked, err := h.backend.BlockGetList(channel)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			respondJSON(w, map[string][]microsub.Card{
+				"items": blocked,
+			})
+		} else if action == "sources" {
+			sources, err := h.backend.SourcesGetList()
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			respondJSON(w, map[string][]microsub.MicropubSource{
+				"sources": sources,
+			})
 		} else if action == "events" {
-			conn, _, _ := w.(http.Hijacker).Hijack()
-			cons := newConsumer(conn)
-			h.backend.AddEventListener(cons)
+			if isWebSocket(r) {
+				h.events.serveWebSocket(w, r)
+			} else {
+				h.events.serveEvents(w, r)
+			}
 		} else {
 			http.Error(w, fmt.Sprintf("unknown action %s\n", action), 400)
 			return
@@ -116,7 +235,7 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Access-Control-Allow-Origin", "*")
 
 		values := r.URL.Query()
-		action := values.Get("action")
+		action := RequestAction(r)
 		if action == "channels" {
 			name := values.Get("name")
 			method := values.Get("method")
@@ -131,6 +250,41 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			if method == "order" {
+				r.ParseForm()
+				uids := formList(r.Form, "channels")
+				if len(uids) == 0 {
+					http.Error(w, "missing channels for order\n", 400)
+					return
+				}
+				err := h.backend.ChannelsOrder(uids)
+				if err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				respondJSON(w, []string{})
+				return
+			}
+
+			if timelineType := values.Get("timeline_type"); uid != "" && timelineType != "" {
+				size := 0
+				if values.Get("timeline_size") != "" {
+					var err error
+					size, err = strconv.Atoi(values.Get("timeline_size"))
+					if err != nil {
+						http.Error(w, fmt.Sprintf("timeline_size is not a number: %s", err), 400)
+						return
+					}
+				}
+				channel, err := h.backend.ChannelsSetType(uid, timelineType, size)
+				if err != nil {
+					http.Error(w, err.Error(), 500)
+					return
+				}
+				respondJSON(w, channel)
+				return
+			}
+
 			if uid == "" {
 				channel, err := h.backend.ChannelsCreate(name)
 				if err != nil {
@@ -165,6 +319,44 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			respondJSON(w, []string{})
+		} else if action == "mute" || action == "unmute" || action == "block" || action == "unblock" {
+			channel := values.Get("channel")
+			url := values.Get("url")
+			if url == "" {
+				// older clients send the url as uid
+				url = values.Get("uid")
+			}
+			if url == "" {
+				http.Error(w, fmt.Sprintf("missing url for %s\n", action), 400)
+				return
+			}
+			var err error
+			switch action {
+			case "mute":
+				err = h.backend.Mute(channel, url)
+			case "unmute":
+				err = h.backend.Unmute(channel, url)
+			case "block":
+				err = h.backend.Block(channel, url)
+			case "unblock":
+				err = h.backend.Unblock(channel, url)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			respondJSON(w, []string{})
+		} else if action == "sources" {
+			h.postSources(w, values)
+		} else if action == "search" && values.Get("channel") != "" {
+			items, err := h.backend.ItemSearch(values.Get("channel"), values.Get("query"))
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+			respondJSON(w, map[string][]microsub.Item{
+				"items": items,
+			})
 		} else if action == "search" {
 			query := values.Get("query")
 			feeds, err := h.backend.Search(query)
@@ -175,34 +367,58 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			respondJSON(w, map[string][]microsub.Feed{
 				"results": feeds,
 			})
-		} else if action == "timeline" || r.PostForm.Get("action") == "timeline" {
+		} else if action == "timeline" {
 			method := values.Get("method")
 
-			if method == "mark_read" || r.PostForm.Get("method") == "mark_read" {
+			if method == "" {
+				method = r.PostForm.Get("method")
+			}
+
+			if method == "mark_read" {
 				values = r.Form
 				channel := values.Get("channel")
-				var markAsRead []string
-				if uids, e := values["entry"]; e {
-					markAsRead = uids
-				} else if uids, e := values["entry[]"]; e {
-					markAsRead = uids
-				} else {
-					uids := []string{}
-					for k, v := range values {
-						if entryRegex.MatchString(k) {
-							uids = append(uids, v...)
-						}
-					}
-					markAsRead = uids
-				}
 
-				if len(markAsRead) > 0 {
+				if all := values.Get("all"); all == "1" || all == "true" {
+					err := h.backend.MarkAllRead(channel)
+					if err != nil {
+						http.Error(w, err.Error(), 500)
+						return
+					}
+				} else if lastReadEntry := values.Get("last_read_entry"); lastReadEntry != "" {
+					err := h.backend.MarkReadUpTo(channel, lastReadEntry)
+					if err != nil {
+						http.Error(w, err.Error(), 500)
+						return
+					}
+				} else if markAsRead := formEntries(values); len(markAsRead) > 0 {
 					err := h.backend.MarkRead(channel, markAsRead)
 					if err != nil {
 						http.Error(w, err.Error(), 500)
 						return
 					}
 				}
+			} else if method == "mark_unread" {
+				values = r.Form
+				channel := values.Get("channel")
+				markAsUnread := formEntries(values)
+				if len(markAsUnread) > 0 {
+					err := h.backend.MarkUnread(channel, markAsUnread)
+					if err != nil {
+						http.Error(w, err.Error(), 500)
+						return
+					}
+				}
+			} else if method == "remove" {
+				values = r.Form
+				channel := values.Get("channel")
+				remove := formEntries(values)
+				if len(remove) > 0 {
+					err := h.backend.RemoveItems(channel, remove)
+					if err != nil {
+						http.Error(w, err.Error(), 500)
+						return
+					}
+				}
 			} else {
 				http.Error(w, fmt.Sprintf("unknown method in timeline %s\n", method), 500)
 				return
@@ -216,3 +432,67 @@ func (h *microsubHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	return
 }
+
+// postSources creates, updates or deletes a micropub source. An update only
+// changes the fields that are sent.
+func (h *microsubHandler) postSources(w http.ResponseWriter, values url.Values) {
+	id := values.Get("id")
+
+	if values.Get("method") == "delete" {
+		err := h.backend.SourcesDelete(id)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		respondJSON(w, []string{})
+		return
+	}
+
+	source := microsub.MicropubSource{ID: id}
+	if id != "" {
+		sources, err := h.backend.SourcesGetList()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		found := false
+		for _, s := range sources {
+			if s.ID == id {
+				source = s
+				found = true
+				break
+			}
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("unknown source %s", id), 404)
+			return
+		}
+	}
+
+	if _, ok := values["label"]; ok {
+		source.Label = values.Get("label")
+	}
+	if _, ok := values["channel"]; ok {
+		source.Channel = values.Get("channel")
+	}
+	if rateLimit := values.Get("rate_limit"); rateLimit != "" {
+		var err error
+		source.RateLimit, err = strconv.Atoi(rateLimit)
+		if err != nil || source.RateLimit < 0 {
+			http.Error(w, fmt.Sprintf("rate_limit should be a number: %q", rateLimit), 400)
+			return
+		}
+	}
+
+	var err error
+	if id == "" {
+		source, err = h.backend.SourcesCreate(source)
+	} else {
+		source, err = h.backend.SourcesUpdate(source)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	respondJSON(w, source)
+}
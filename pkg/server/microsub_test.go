@@ -4,10 +4,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"p83.nl/go/ekster/pkg/client"
+	"p83.nl/go/ekster/pkg/microsub"
 )
 
 func createServerClient() (*httptest.Server, *client.Client) {
@@ -72,6 +75,35 @@ func TestServer_ChannelsUpdate(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestServer_ChannelsSetType(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	channel, err := c.ChannelsSetType("0000", "capped", 50)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "0000", channel.UID)
+		assert.Equal(t, "capped", channel.TimelineType)
+		assert.Equal(t, 50, channel.TimelineSize)
+	}
+}
+
+func TestServer_ChannelsOrder(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.ChannelsOrder([]string{"0000", "0001"})
+	assert.NoError(t, err)
+}
+
+func TestServer_ChannelsOrderMissingChannels(t *testing.T) {
+	server, _ := createServerClient()
+	defer server.Close()
+
+	res, err := http.PostForm(server.URL+"/microsub?action=channels&method=order", url.Values{})
+	if assert.NoError(t, err) {
+		defer res.Body.Close()
+		assert.Equal(t, 400, res.StatusCode)
+	}
+}
+
 func TestServer_TimelineGet(t *testing.T) {
 	server, c := createServerClient()
 	defer server.Close()
@@ -133,6 +165,15 @@ func TestServer_Search(t *testing.T) {
 	}
 }
 
+func TestServer_ItemSearch(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	items, err := c.ItemSearch("0000", "test")
+	if assert.NoError(t, err) {
+		assert.Empty(t, items)
+	}
+}
+
 func TestServer_MarkRead(t *testing.T) {
 	server, c := createServerClient()
 	defer server.Close()
@@ -140,6 +181,117 @@ func TestServer_MarkRead(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestServer_MarkUnread(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.MarkUnread("0001", []string{"test"})
+	assert.NoError(t, err)
+}
+
+func TestServer_MarkReadUpTo(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.MarkReadUpTo("0001", "test")
+	assert.NoError(t, err)
+}
+
+func TestServer_MarkAllRead(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.MarkAllRead("0001")
+	assert.NoError(t, err)
+}
+
+func TestServer_RemoveItems(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.RemoveItems("0001", []string{"test"})
+	assert.NoError(t, err)
+}
+
+func TestServer_MuteGetList(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	cards, err := c.MuteGetList("0001")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(cards))
+		assert.Equal(t, "card", cards[0].Type)
+		assert.Equal(t, "https://example.com/muted", cards[0].URL)
+	}
+}
+
+func TestServer_MuteUnmute(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.Mute("0001", "https://example.com/")
+	assert.NoError(t, err)
+	err = c.Unmute("0001", "https://example.com/")
+	assert.NoError(t, err)
+}
+
+func TestServer_BlockGetList(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	cards, err := c.BlockGetList("0001")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(cards))
+		assert.Equal(t, "card", cards[0].Type)
+		assert.Equal(t, "https://example.com/blocked", cards[0].URL)
+	}
+}
+
+func TestServer_BlockUnblock(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.Block("0001", "https://example.com/")
+	assert.NoError(t, err)
+	err = c.Unblock("0001", "https://example.com/")
+	assert.NoError(t, err)
+}
+
+func TestServer_MuteMissingURL(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+	err := c.Mute("0001", "")
+	assert.Error(t, err)
+}
+
+type muteBackend struct {
+	NullBackend
+	muted []string
+}
+
+func (b *muteBackend) Mute(channel string, url string) error {
+	b.muted = append(b.muted, url)
+	return nil
+}
+
+func TestServer_MuteURL(t *testing.T) {
+	backend := &muteBackend{}
+	server := httptest.NewServer(NewMicrosubHandler(backend))
+	defer server.Close()
+
+	c := client.Client{Token: "1234"}
+	c.Me, _ = url.Parse("https://example.com/")
+	c.MicrosubEndpoint, _ = url.Parse(server.URL + "/microsub")
+	err := c.Mute("0001", "https://example.com/client")
+	assert.NoError(t, err)
+
+	// the uid parameter of older clients still works
+	q := url.Values{
+		"action":  {"mute"},
+		"channel": {"0001"},
+		"uid":     {"https://example.com/uid"},
+	}
+	res, err := http.Post(server.URL+"/microsub?"+q.Encode(), "", nil)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	assert.Equal(t, []string{"https://example.com/client", "https://example.com/uid"}, backend.muted)
+}
+
 func TestServer_GetUnknownAction(t *testing.T) {
 	server, c := createServerClient()
 	defer server.Close()
@@ -168,3 +320,92 @@ func TestServer_PostUnknownAction(t *testing.T) {
 		assert.Equal(t, 400, resp.StatusCode)
 	}
 }
+
+func TestTimelineQuery(t *testing.T) {
+	query, err := timelineQuery(url.Values{
+		"after":   {"10"},
+		"limit":   {"50"},
+		"is_read": {"false"},
+		"source":  {"https://example.com/feed"},
+		"since":   {"2018-08-01T00:00:00Z"},
+		"until":   {"2018-09-01T00:00:00Z"},
+		"type":    {"reply"},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "10", query.After)
+		assert.Equal(t, 50, query.Limit)
+		assert.True(t, query.Unread)
+		assert.Equal(t, "https://example.com/feed", query.Source)
+		assert.Equal(t, time.Date(2018, 8, 1, 0, 0, 0, 0, time.UTC), query.Since)
+		assert.Equal(t, time.Date(2018, 9, 1, 0, 0, 0, 0, time.UTC), query.Until)
+		assert.Equal(t, "reply", query.Type)
+	}
+
+	for _, values := range []url.Values{
+		{"limit": {"-1"}},
+		{"is_read": {"true"}},
+		{"since": {"yesterday"}},
+	} {
+		_, err := timelineQuery(values)
+		assert.Error(t, err, values.Encode())
+	}
+}
+
+func TestServer_TimelineGetQuery(t *testing.T) {
+	server, c := createServerClient()
+	defer server.Close()
+
+	timeline, err := c.TimelineGetQuery("0001", microsub.TimelineQuery{Limit: 10, Unread: true, Type: "reply"})
+	if assert.NoError(t, err) {
+		assert.Empty(t, timeline.Items)
+	}
+}
+
+func TestRequiredScope(t *testing.T) {
+	tests := []struct {
+		method, target, body string
+		scope                string
+		ok                   bool
+	}{
+		{"GET", "/microsub?action=channels", "", ScopeRead, true},
+		{"GET", "/microsub?action=timeline&channel=home", "", ScopeRead, true},
+		{"GET", "/microsub?action=follow&channel=home", "", ScopeRead, true},
+		{"GET", "/microsub?action=events", "", ScopeRead, true},
+		{"GET", "/microsub?action=preview&url=https://example.com/", "", ScopeFollow, true},
+		{"POST", "/microsub?action=channels&name=Test", "", ScopeChannels, true},
+		{"POST", "/microsub?action=channels&method=delete&channel=home", "", ScopeChannels, true},
+		{"GET", "/microsub?action=sources", "", ScopeChannels, true},
+		{"POST", "/microsub?action=sources&channel=home", "", ScopeChannels, true},
+		{"POST", "/microsub?action=follow&channel=home&url=https://example.com/", "", ScopeFollow, true},
+		{"POST", "/microsub?action=unfollow&channel=home&url=https://example.com/", "", ScopeFollow, true},
+		{"POST", "/microsub?action=search&query=example", "", ScopeFollow, true},
+		{"POST", "/microsub?action=search&channel=home&query=example", "", ScopeRead, true},
+		{"POST", "/microsub?action=mute&url=https://example.com/", "", ScopeMute, true},
+		{"POST", "/microsub?action=unblock&url=https://example.com/", "", ScopeBlock, true},
+		{"POST", "/microsub", "action=timeline&method=mark_read&channel=home&entry=1", ScopeRead, true},
+		{"POST", "/microsub?action=unknown", "", "", false},
+		{"POST", "/microsub", "", "", false},
+		{"GET", "/microsub", "", "", false},
+		{"POST", "/microsub?action=unknown", "action=timeline&method=remove&channel=home&entry=1", "", false},
+		{"OPTIONS", "/microsub?action=channels", "", "", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.body != "" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		scope, ok := RequiredScope(r)
+		assert.Equal(t, tt.ok, ok, "%s %s %s", tt.method, tt.target, tt.body)
+		assert.Equal(t, tt.scope, scope, "%s %s %s", tt.method, tt.target, tt.body)
+	}
+}
+
+func TestRespondInsufficientScope(t *testing.T) {
+	w := httptest.NewRecorder()
+	RespondInsufficientScope(w, ScopeChannels)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, `Bearer error="insufficient_scope", scope="channels"`, w.Header().Get("WWW-Authenticate"))
+	assert.JSONEq(t, `{"error":"insufficient_scope","error_description":"The token doesn't have the \"channels\" scope","scope":"channels"}`, w.Body.String())
+}
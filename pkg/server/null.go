@@ -25,8 +25,9 @@ import (
 type NullBackend struct {
 }
 
+// AddEventListener adds no listener, there are no events
 func (b *NullBackend) AddEventListener(el microsub.EventListener) error {
-	panic("implement me")
+	return nil
 }
 
 // ChannelsGetList gets no channels
@@ -58,6 +59,21 @@ func (b *NullBackend) ChannelsDelete(uid string) error {
 	return nil
 }
 
+// ChannelsSetType sets the timeline type of no channels
+func (b *NullBackend) ChannelsSetType(uid, timelineType string, size int) (microsub.Channel, error) {
+	return microsub.Channel{
+		UID:          uid,
+		Name:         "default",
+		TimelineType: timelineType,
+		TimelineSize: size,
+	}, nil
+}
+
+// ChannelsOrder sorts no channels
+func (b *NullBackend) ChannelsOrder(uids []string) error {
+	return nil
+}
+
 // TimelineGet gets no timeline
 func (b *NullBackend) TimelineGet(before, after, channel string) (microsub.Timeline, error) {
 	return microsub.Timeline{
@@ -66,6 +82,11 @@ func (b *NullBackend) TimelineGet(before, after, channel string) (microsub.Timel
 	}, nil
 }
 
+// TimelineGetQuery returns no items
+func (b *NullBackend) TimelineGetQuery(channel string, query microsub.TimelineQuery) (microsub.Timeline, error) {
+	return b.TimelineGet(query.Before, query.After, channel)
+}
+
 func (b *NullBackend) FollowGetList(uid string) ([]microsub.Feed, error) {
 	return []microsub.Feed{
 		{Name: "test", Type: "feed", URL: "https://example.com/"},
@@ -82,7 +103,7 @@ func (b *NullBackend) UnfollowURL(uid string, url string) error {
 
 func (b *NullBackend) Search(query string) ([]microsub.Feed, error) {
 	return []microsub.Feed{
-		{"feed", "https://example.com/", "Example", "test.jpg", "test", microsub.Card{}},
+		{Type: "feed", URL: "https://example.com/", Name: "Example", Photo: "test.jpg", Description: "test"},
 	}, nil
 }
 
@@ -93,6 +114,74 @@ func (b *NullBackend) PreviewURL(url string) (microsub.Timeline, error) {
 	}, nil
 }
 
+func (b *NullBackend) ItemSearch(channel, query string) ([]microsub.Item, error) {
+	return []microsub.Item{}, nil
+}
+
 func (b *NullBackend) MarkRead(channel string, uids []string) error {
 	return nil
 }
+
+func (b *NullBackend) MarkUnread(channel string, uids []string) error {
+	return nil
+}
+
+func (b *NullBackend) MarkReadUpTo(channel string, lastReadEntry string) error {
+	return nil
+}
+
+func (b *NullBackend) MarkAllRead(channel string) error {
+	return nil
+}
+
+func (b *NullBackend) RemoveItems(channel string, uids []string) error {
+	return nil
+}
+
+func (b *NullBackend) MuteGetList(channel string) ([]microsub.Card, error) {
+	return []microsub.Card{
+		{Type: "card", URL: "https://example.com/muted"},
+	}, nil
+}
+
+func (b *NullBackend) Mute(channel string, uid string) error {
+	return nil
+}
+
+func (b *NullBackend) Unmute(channel string, uid string) error {
+	return nil
+}
+
+func (b *NullBackend) BlockGetList(channel string) ([]microsub.Card, error) {
+	return []microsub.Card{
+		{Type: "card", URL: "https://example.com/blocked"},
+	}, nil
+}
+
+func (b *NullBackend) Block(channel string, uid string) error {
+	return nil
+}
+
+func (b *NullBackend) Unblock(channel string, uid string) error {
+	return nil
+}
+
+// SourcesGetList returns no sources
+func (b *NullBackend) SourcesGetList() ([]microsub.MicropubSource, error) {
+	return []microsub.MicropubSource{}, nil
+}
+
+// SourcesCreate creates no source
+func (b *NullBackend) SourcesCreate(source microsub.MicropubSource) (microsub.MicropubSource, error) {
+	return source, nil
+}
+
+// SourcesUpdate updates no source
+func (b *NullBackend) SourcesUpdate(source microsub.MicropubSource) (microsub.MicropubSource, error) {
+	return source, nil
+}
+
+// SourcesDelete deletes no source
+func (b *NullBackend) SourcesDelete(id string) error {
+	return nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Microsub scopes
+const (
+	// ScopeRead allows reading channels and timelines, and marking items as read
+	ScopeRead = "read"
+	// ScopeFollow allows searching, previewing, following and unfollowing feeds
+	ScopeFollow = "follow"
+	// ScopeMute allows muting and unmuting users
+	ScopeMute = "mute"
+	// ScopeBlock allows blocking and unblocking users
+	ScopeBlock = "block"
+	// ScopeChannels allows creating, updating, ordering and deleting channels,
+	// and managing the micropub sources of the channels
+	ScopeChannels = "channels"
+)
+
+// RequestAction returns the Microsub action of the request. The action is read
+// from the query, POST requests without an action in the query can also send
+// it in the body.
+func RequestAction(r *http.Request) string {
+	action := r.URL.Query().Get("action")
+	if action == "" && r.Method == http.MethodPost {
+		action = r.PostFormValue("action")
+	}
+	return action
+}
+
+// RequiredScope returns the scope a token needs for the request. CORS
+// preflight requests don't need a scope. For requests with an empty or
+// unknown action it returns false, these requests should be denied.
+func RequiredScope(r *http.Request) (string, bool) {
+	action := RequestAction(r)
+
+	switch r.Method {
+	case http.MethodOptions:
+		return "", true
+
+	case http.MethodGet:
+		switch action {
+		case "channels", "timeline", "follow", "mute", "block", "events":
+			return ScopeRead, true
+		case "preview":
+			return ScopeFollow, true
+		case "sources":
+			return ScopeChannels, true
+		}
+
+	case http.MethodPost:
+		switch action {
+		case "channels", "sources":
+			return ScopeChannels, true
+		case "follow", "unfollow":
+			return ScopeFollow, true
+		case "mute", "unmute":
+			return ScopeMute, true
+		case "block", "unblock":
+			return ScopeBlock, true
+		case "search":
+			if r.URL.Query().Get("channel") != "" {
+				return ScopeRead, true
+			}
+			return ScopeFollow, true
+		case "timeline":
+			return ScopeRead, true
+		}
+	}
+
+	return "", false
+}
+
+// RespondInsufficientScope tells the client that the token doesn't have the
+// scope, in the format of the Microsub and OAuth 2.0 Bearer Token specs
+func RespondInsufficientScope(w http.ResponseWriter, scope string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+	w.Header().Set("Content-Type", OutputContentType)
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             "insufficient_scope",
+		"error_description": fmt.Sprintf("The token doesn't have the %q scope", scope),
+		"scope":             scope,
+	})
+}
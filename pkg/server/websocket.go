@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+// socketMessage is sent by the client over the websocket to change the
+// channels it receives events for
+type socketMessage struct {
+	// Action is subscribe or unsubscribe
+	Action   string   `json:"action"`
+	Channels []string `json:"channels"`
+}
+
+// isWebSocket reports whether the client asks for a websocket
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// serveWebSocket sends the events as JSON messages over a websocket. It
+// receives the same events as the text/event-stream, the client can send
+// subscribe and unsubscribe messages to receive the events of some channels.
+func (hub *eventHub) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	lastEventID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	channels := formList(r.URL.Query(), "channel")
+
+	server := websocket.Server{
+		// the request is authorized with a token, so every origin is allowed
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			hub.streamSocket(ws, lastEventID, channels)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+func (hub *eventHub) streamSocket(ws *websocket.Conn, lastEventID int64, channels []string) {
+	sub, replay := hub.subscribe(lastEventID, channels)
+	defer hub.unsubscribe(sub)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var data string
+			if err := websocket.Message.Receive(ws, &data); err != nil {
+				return
+			}
+			var msg socketMessage
+			if err := json.Unmarshal([]byte(data), &msg); err != nil {
+				log.Printf("Error while decoding websocket message: %v\n", err)
+				continue
+			}
+			switch msg.Action {
+			case "subscribe":
+				sub.subscribeChannels(msg.Channels)
+			case "unsubscribe":
+				sub.unsubscribeChannels(msg.Channels)
+			default:
+				log.Printf("Unknown websocket action %q\n", msg.Action)
+			}
+		}
+	}()
+
+	for _, evt := range replay {
+		if err := websocket.JSON.Send(ws, evt); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+
+		case <-ticker.C:
+			if err := websocket.JSON.Send(ws, microsub.Event{Type: "ping"}); err != nil {
+				return
+			}
+
+		case evt, ok := <-sub.queue:
+			if !ok {
+				// the subscriber was too slow and is disconnected
+				return
+			}
+			if err := websocket.JSON.Send(ws, evt); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+	"p83.nl/go/ekster/pkg/microsub"
+)
+
+// receiveSocketEvent waits for the next event on the websocket
+func receiveSocketEvent(t *testing.T, ws *websocket.Conn) microsub.Event {
+	require.NoError(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var evt microsub.Event
+	require.NoError(t, websocket.JSON.Receive(ws, &evt))
+	return evt
+}
+
+// subscribedTo reports whether all subscribers of the hub receive the events
+// of channel
+func subscribedTo(hub *eventHub, channel string) bool {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	for sub := range hub.subscribers {
+		if !sub.wants(microsub.Event{Channel: &microsub.Channel{UID: channel}}) {
+			return false
+		}
+	}
+	return len(hub.subscribers) > 0
+}
+
+func TestServer_EventsWebSocket(t *testing.T) {
+	handler := NewMicrosubHandler(&NullBackend{}).(*microsubHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0001"}, Item: "a"})
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0002"}, Item: "b"})
+
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/microsub?action=events&channel=0001", server.URL)
+	require.NoError(t, err)
+	config.Header.Set("Authorization", "Bearer 1234")
+	config.Header.Set("Last-Event-ID", "0")
+	ws, err := websocket.DialConfig(config)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	// the replay only contains events of the subscribed channel
+	evt := receiveSocketEvent(t, ws)
+	assert.Equal(t, int64(1), evt.ID)
+	assert.Equal(t, "a", evt.Item)
+
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0002"}, Item: "c"})
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0001"}, Item: "d"})
+
+	evt = receiveSocketEvent(t, ws)
+	assert.Equal(t, int64(4), evt.ID)
+	assert.Equal(t, microsub.EventNewItem, evt.Type)
+	assert.Equal(t, "d", evt.Item)
+
+	require.NoError(t, websocket.JSON.Send(ws, socketMessage{Action: "subscribe", Channels: []string{"0002"}}))
+	require.Eventually(t, func() bool {
+		return subscribedTo(handler.events, "0002")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0002"}, Item: "e"})
+	evt = receiveSocketEvent(t, ws)
+	assert.Equal(t, "e", evt.Item)
+
+	require.NoError(t, websocket.JSON.Send(ws, socketMessage{Action: "unsubscribe", Channels: []string{"0001"}}))
+	require.Eventually(t, func() bool {
+		return !subscribedTo(handler.events, "0001")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0001"}, Item: "f"})
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0002"}, Item: "g"})
+	evt = receiveSocketEvent(t, ws)
+	assert.Equal(t, "g", evt.Item)
+
+	// without channels the socket doesn't receive the events of any channel
+	require.NoError(t, websocket.JSON.Send(ws, socketMessage{Action: "unsubscribe", Channels: []string{"0002"}}))
+	require.Eventually(t, func() bool {
+		return !subscribedTo(handler.events, "0002")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, subscribedTo(handler.events, "0003"))
+
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0002"}, Item: "h"})
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0003"}, Item: "i"})
+	require.NoError(t, websocket.JSON.Send(ws, socketMessage{Action: "subscribe", Channels: []string{"0001"}}))
+	require.Eventually(t, func() bool {
+		return subscribedTo(handler.events, "0001")
+	}, 5*time.Second, 10*time.Millisecond)
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0001"}, Item: "j"})
+	evt = receiveSocketEvent(t, ws)
+	assert.Equal(t, "j", evt.Item)
+
+	// closed sockets are unsubscribed
+	ws.Close()
+	assert.Eventually(t, func() bool {
+		return handler.events.count() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_EventsWebSocketAllChannels(t *testing.T) {
+	handler := NewMicrosubHandler(&NullBackend{}).(*microsubHandler)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/microsub?action=events", server.URL)
+	require.NoError(t, err)
+	config.Header.Set("Authorization", "Bearer 1234")
+	ws, err := websocket.DialConfig(config)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	require.Eventually(t, func() bool {
+		return subscribedTo(handler.events, "0001")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a subscriber of all channels can unsubscribe from one of them
+	require.NoError(t, websocket.JSON.Send(ws, socketMessage{Action: "unsubscribe", Channels: []string{"0001"}}))
+	require.Eventually(t, func() bool {
+		return !subscribedTo(handler.events, "0001")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, subscribedTo(handler.events, "0002"))
+
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0001"}, Item: "a"})
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0002"}, Item: "b"})
+	evt := receiveSocketEvent(t, ws)
+	assert.Equal(t, "b", evt.Item)
+
+	// and subscribe to it again
+	require.NoError(t, websocket.JSON.Send(ws, socketMessage{Action: "subscribe", Channels: []string{"0001"}}))
+	require.Eventually(t, func() bool {
+		return subscribedTo(handler.events, "0001")
+	}, 5*time.Second, 10*time.Millisecond)
+	handler.events.WriteMessage(microsub.Event{Type: microsub.EventNewItem, Channel: &microsub.Channel{UID: "0001"}, Item: "c"})
+	evt = receiveSocketEvent(t, ws)
+	assert.Equal(t, "c", evt.Item)
+}